@@ -0,0 +1,612 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+const (
+	actionsCollection = "actions"
+	// defaultActionTimeout bounds the request that executes an action.
+	defaultActionTimeout = 30 * time.Second
+	maxActionTimeout     = 5 * time.Minute
+	// defaultApprovalTimeout is how long a proposed action waits for approval before it expires.
+	defaultApprovalTimeout = time.Hour
+	maxApprovalTimeout     = 24 * time.Hour
+	// actionResponseLimit is how much of the response body of an action is recorded.
+	actionResponseLimit = 4 << 10
+	// dryRunHeader is sent to targets that support dry-run, which must then only validate the request.
+	dryRunHeader  = "X-Dry-Run"
+	redactedValue = "[redacted]"
+)
+
+// Action kinds. They differ in how the request body is built, not in how they are sent.
+const (
+	actionWebhook = "webhook"
+	actionScale   = "scale"
+	actionRestart = "restart"
+)
+
+// Action statuses. Actions move from proposed to approved, then to succeeded or failed, or
+// end as rejected or expired without running.
+const (
+	actionProposed  = "proposed"
+	actionApproved  = "approved"
+	actionSucceeded = "succeeded"
+	actionFailed    = "failed"
+	actionRejected  = "rejected"
+	actionExpired   = "expired"
+)
+
+// actionSettings configures the execution of remediation actions.
+type actionSettings struct {
+	// WebhookAllowlist lists the hosts action requests may reach, in the format of the
+	// runbook HTTP check allowlist. Dry-runs and executions fail while it is empty.
+	WebhookAllowlist []string `json:"webhookAllowlist"`
+}
+
+// actionApproval is the approval of an action by a Grafana user.
+type actionApproval struct {
+	User    string    `json:"user"`
+	Comment string    `json:"comment,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// actionAuditEntry records a state transition of an action.
+type actionAuditEntry struct {
+	At      time.Time `json:"at"`
+	User    string    `json:"user,omitempty"`
+	Event   string    `json:"event"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// actionRequest is the HTTP request an action sends, as shown by a dry-run.
+type actionRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// actionOutcome is the response to an action request, or the error that prevented one.
+type actionOutcome struct {
+	StatusCode int       `json:"statusCode,omitempty"`
+	Body       string    `json:"body,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   string    `json:"duration"`
+	At         time.Time `json:"at"`
+}
+
+// action is a remediation proposed by a user, a runbook or the assistant. It is only
+// executed after a dry-run and the required number of approvals.
+type action struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Kind   string `json:"kind"`
+	Reason string `json:"reason,omitempty"`
+	// Source is who proposed the action: "user", "runbook" or "assistant", with SourceID
+	// identifying the runbook. Actions created through the API always come from "user";
+	// runbook executions and the agent propose the others.
+	Source   string `json:"source"`
+	SourceID string `json:"sourceId,omitempty"`
+
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Headers are sent with the request, e.g. for authentication. Their values are never
+	// returned by the API.
+	Headers map[string]string `json:"headers,omitempty"`
+	Payload map[string]any    `json:"payload,omitempty"`
+	// Replicas is the desired replica count of scale actions.
+	Replicas *int `json:"replicas,omitempty"`
+	// SupportsDryRun means the target validates requests sent with the X-Dry-Run header
+	// without applying them. Otherwise a dry-run only renders the request.
+	SupportsDryRun bool `json:"supportsDryRun,omitempty"`
+
+	RequiredApprovals int    `json:"requiredApprovals"`
+	Timeout           string `json:"timeout,omitempty"`
+	ApprovalTimeout   string `json:"approvalTimeout,omitempty"`
+
+	Status     string             `json:"status"`
+	DryRun     *actionOutcome     `json:"dryRun,omitempty"`
+	Approvals  []actionApproval   `json:"approvals"`
+	Outcome    *actionOutcome     `json:"outcome,omitempty"`
+	Audit      []actionAuditEntry `json:"audit"`
+	ProposedBy string             `json:"proposedBy,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt"`
+	ExpiresAt  time.Time          `json:"expiresAt"`
+	UpdatedAt  time.Time          `json:"updatedAt"`
+}
+
+// validate checks a proposed action and fills in defaults.
+func (ac *action) validate() error {
+	if strings.TrimSpace(ac.Title) == "" {
+		return errors.New("title is required")
+	}
+	switch ac.Kind {
+	case actionWebhook, actionRestart:
+	case actionScale:
+		if ac.Replicas == nil || *ac.Replicas < 0 {
+			return errors.New("scale actions need a non-negative replicas count")
+		}
+	default:
+		return fmt.Errorf("kind must be %q, %q or %q", actionWebhook, actionScale, actionRestart)
+	}
+	switch ac.Source {
+	case "":
+		ac.Source = "user"
+	case "user", "runbook", "assistant":
+	default:
+		return fmt.Errorf("invalid source %q", ac.Source)
+	}
+	switch ac.Method = strings.ToUpper(ac.Method); ac.Method {
+	case "":
+		ac.Method = http.MethodPost
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return errors.New("method must be POST, PUT or PATCH")
+	}
+	if u, err := url.Parse(ac.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", ac.URL)
+	}
+	switch ac.RequiredApprovals {
+	case 0:
+		ac.RequiredApprovals = 1
+	case 1, 2:
+	default:
+		return errors.New("requiredApprovals must be 1 or 2")
+	}
+	if err := validateTimeout("timeout", ac.Timeout, maxActionTimeout); err != nil {
+		return err
+	}
+	return validateTimeout("approvalTimeout", ac.ApprovalTimeout, maxApprovalTimeout)
+}
+
+// validateTimeout checks an optional duration field against its upper limit.
+func validateTimeout(name, v string, limit time.Duration) error {
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if d <= 0 || d > limit {
+		return fmt.Errorf("%s must be between 0 and %s", name, limit)
+	}
+	return nil
+}
+
+func (ac *action) timeout() time.Duration {
+	if d, err := time.ParseDuration(ac.Timeout); err == nil {
+		return d
+	}
+	return defaultActionTimeout
+}
+
+func (ac *action) approvalTimeout() time.Duration {
+	if d, err := time.ParseDuration(ac.ApprovalTimeout); err == nil {
+		return d
+	}
+	return defaultApprovalTimeout
+}
+
+// request builds the HTTP request of the action. Scale actions send the replica count
+// along with the payload.
+func (ac *action) request() (actionRequest, error) {
+	payload := map[string]any{}
+	for k, v := range ac.Payload {
+		payload[k] = v
+	}
+	if ac.Kind == actionScale {
+		payload["replicas"] = *ac.Replicas
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return actionRequest{}, fmt.Errorf("marshal payload: %w", err)
+	}
+	return actionRequest{Method: ac.Method, URL: ac.URL, Headers: ac.Headers, Body: body}, nil
+}
+
+// transition moves the action to a new status and audits it.
+func (ac *action) transition(user, to, message string) {
+	ac.audit(user, "transition", ac.Status, to, message)
+	ac.Status = to
+}
+
+func (ac *action) audit(user, event, from, to, message string) {
+	ac.Audit = append(ac.Audit, actionAuditEntry{At: time.Now().UTC(), User: user, Event: event, From: from, To: to, Message: message})
+}
+
+// logActionAudit logs the audit entries of ac from index from on, once they are saved.
+func (a *App) logActionAudit(ctx context.Context, ac action, from int) {
+	for _, e := range ac.Audit[from:] {
+		a.logger(ctx).Info("Remediation action audit", "id", ac.ID, "event", e.Event, "user", e.User, "from", e.From, "to", e.To, "message", e.Message)
+	}
+}
+
+// expire marks a proposed action that waited too long for approval as expired. It
+// reports whether the action changed.
+func (ac *action) expire(now time.Time) bool {
+	if ac.Status != actionProposed || now.Before(ac.ExpiresAt) {
+		return false
+	}
+	ac.transition("", actionExpired, "not approved within "+ac.approvalTimeout().String())
+	return true
+}
+
+// redacted returns a copy of the action that is safe to return from the API.
+func (ac action) redacted() action {
+	if len(ac.Headers) > 0 {
+		headers := make(map[string]string, len(ac.Headers))
+		for k := range ac.Headers {
+			headers[k] = redactedValue
+		}
+		ac.Headers = headers
+	}
+	return ac
+}
+
+// send executes the action request with client, or validates it when dryRun is set.
+func (ac *action) send(ctx context.Context, client *http.Client, dryRun bool) (outcome actionOutcome) {
+	start := time.Now()
+	outcome.At = start.UTC()
+	defer func() { outcome.Duration = time.Since(start).Round(time.Millisecond).String() }()
+
+	r, err := ac.request()
+	if err != nil {
+		outcome.Error = err.Error()
+		return outcome
+	}
+	ctx, cancel := context.WithTimeout(ctx, ac.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.URL, bytes.NewReader(r.Body))
+	if err != nil {
+		outcome.Error = err.Error()
+		return outcome
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("X-Action-Id", ac.ID)
+	if dryRun {
+		req.Header.Set(dryRunHeader, "true")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		outcome.Error = err.Error()
+		return outcome
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, actionResponseLimit))
+	outcome.StatusCode, outcome.Body = resp.StatusCode, string(body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		outcome.Error = fmt.Sprintf("target responded with status %d", resp.StatusCode)
+	}
+	return outcome
+}
+
+// errActionForbidden is returned when the user may not change an action.
+var errActionForbidden = errors.New("changing actions proposed by other users requires the Editor or Admin role")
+
+// errProposeForbidden is returned when the user may not propose actions.
+var errProposeForbidden = errors.New("proposing actions requires the Editor or Admin role")
+
+// actionConflictError is returned when an operation is not allowed in the current state of an action.
+type actionConflictError struct{ msg string }
+
+func (e *actionConflictError) Error() string { return e.msg }
+
+func actionConflict(format string, args ...any) error {
+	return &actionConflictError{msg: fmt.Sprintf(format, args...)}
+}
+
+// updateAction loads an action, expires it if needed, applies fn and saves the result,
+// all while holding actionsMu. A nil fn only persists the expiry. The expiry is saved
+// even if fn fails.
+func (a *App) updateAction(ctx context.Context, id string, fn func(*action) error) (action, error) {
+	a.actionsMu.Lock()
+	defer a.actionsMu.Unlock()
+	ac, err := loadJSON[action](ctx, a.store, actionsCollection, id)
+	if err != nil {
+		return ac, err
+	}
+	audited := len(ac.Audit)
+	expired := ac.expire(time.Now())
+	var fnErr error
+	if fn != nil {
+		fnErr = fn(&ac)
+	}
+	if (fn == nil || fnErr != nil) && !expired {
+		return ac, fnErr
+	}
+	ac.UpdatedAt = time.Now().UTC()
+	if err := saveJSON(ctx, a.store, actionsCollection, id, ac); err != nil {
+		return ac, err
+	}
+	a.logActionAudit(ctx, ac, audited)
+	return ac, fnErr
+}
+
+// proposeAction saves a validated action as proposed by the current user. Actions proposed
+// by a runbook execution or the agent are proposed on behalf of the user who ran it, who
+// therefore cannot approve them either. Only editors may propose actions, since a dry-run
+// may already call the target.
+func (a *App) proposeAction(ctx context.Context, ac action) (action, error) {
+	if !isEditor(backend.UserFromContext(ctx)) {
+		return ac, errProposeForbidden
+	}
+	now := time.Now().UTC()
+	ac.ID = uuid.NewString()
+	ac.ProposedBy = userLogin(ctx)
+	ac.Status, ac.DryRun, ac.Outcome = "", nil, nil
+	ac.Approvals, ac.Audit = []actionApproval{}, nil
+	ac.CreatedAt, ac.UpdatedAt = now, now
+	ac.ExpiresAt = now.Add(ac.approvalTimeout())
+	ac.transition(ac.ProposedBy, actionProposed, ac.Reason)
+	if err := saveJSON(ctx, a.store, actionsCollection, ac.ID, ac); err != nil {
+		return ac, err
+	}
+	a.logActionAudit(ctx, ac, 0)
+	return ac, nil
+}
+
+func writeActionError(w http.ResponseWriter, err error) {
+	var conflict *actionConflictError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		http.Error(w, "action not found", http.StatusNotFound)
+	case errors.Is(err, errActionForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.As(err, &conflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleActions lists actions on GET, newest first, and proposes one on POST.
+func (a *App) handleActions(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		actions, err := listJSON[action](ctx, a.store, actionsCollection)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sort.SliceStable(actions, func(i, j int) bool { return actions[i].CreatedAt.After(actions[j].CreatedAt) })
+		now := time.Now()
+		for i := range actions {
+			// Expiry is persisted by the next update; listing only reports it.
+			actions[i].expire(now)
+			actions[i] = actions[i].redacted()
+		}
+		writeJSON(w, http.StatusOK, actions)
+	case http.MethodPost:
+		if !requireEditor(w, req, "proposing actions") {
+			return
+		}
+		var ac action
+		if err := json.NewDecoder(req.Body).Decode(&ac); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ac.Source, ac.SourceID = "user", ""
+		if err := ac.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ac, err := a.proposeAction(ctx, ac)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, ac.redacted())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAction returns the action identified by {id}.
+func (a *App) handleAction(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ac, err := a.updateAction(req.Context(), req.PathValue("id"), nil)
+	if err != nil {
+		writeActionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ac.redacted())
+}
+
+// handleActionDryRun renders the request of a proposed action and, if the target supports
+// it, sends it with the X-Dry-Run header. Approval requires a successful dry-run.
+func (a *App) handleActionDryRun(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireEditor(w, req, "dry-running actions") {
+		return
+	}
+	ctx := req.Context()
+	id := req.PathValue("id")
+	ac, err := a.updateAction(ctx, id, func(ac *action) error {
+		if ac.Status != actionProposed {
+			return actionConflict("action is %s", ac.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		writeActionError(w, err)
+		return
+	}
+	r, err := ac.request()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	outcome := actionOutcome{At: time.Now().UTC(), Duration: "0s"}
+	if ac.SupportsDryRun {
+		// The target is called outside actionsMu, so a slow dry-run does not block other actions.
+		outcome = ac.send(ctx, a.outbound.client(dependencyWebhooks), true)
+	}
+	ac, err = a.updateAction(ctx, id, func(ac *action) error {
+		if ac.Status != actionProposed {
+			return actionConflict("action is %s", ac.Status)
+		}
+		ac.DryRun = &outcome
+		message := "request rendered"
+		if ac.SupportsDryRun {
+			message = fmt.Sprintf("target responded with status %d", outcome.StatusCode)
+			if outcome.Error != "" {
+				message = outcome.Error
+			}
+		}
+		ac.audit(userLogin(ctx), "dry-run", "", "", message)
+		return nil
+	})
+	if err != nil {
+		writeActionError(w, err)
+		return
+	}
+	r.Headers = ac.redacted().Headers
+	writeJSON(w, http.StatusOK, map[string]any{"action": ac.redacted(), "request": r})
+}
+
+// canApprove reports whether the user may approve remediation actions.
+func canApprove(u *backend.User) bool {
+	return isEditor(u)
+}
+
+// handleActionApprove records the approval of the current user. The action is executed
+// once it has the required number of approvals from distinct users other than the proposer.
+func (a *App) handleActionApprove(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Comment string `json:"comment"`
+	}
+	if req.Body != nil {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx := req.Context()
+	u := backend.UserFromContext(ctx)
+	if !canApprove(u) {
+		http.Error(w, "approving actions requires the Editor or Admin role", http.StatusForbidden)
+		return
+	}
+	id := req.PathValue("id")
+	ac, err := a.updateAction(ctx, id, func(ac *action) error {
+		if ac.Status != actionProposed {
+			return actionConflict("action is %s", ac.Status)
+		}
+		if ac.DryRun == nil || ac.DryRun.Error != "" {
+			return actionConflict("action needs a successful dry-run before it can be approved")
+		}
+		if u.Login == ac.ProposedBy {
+			return actionConflict("actions cannot be approved by the user who proposed them")
+		}
+		for _, ap := range ac.Approvals {
+			if ap.User == u.Login {
+				return actionConflict("%s already approved this action", u.Login)
+			}
+		}
+		ac.Approvals = append(ac.Approvals, actionApproval{User: u.Login, Comment: body.Comment, At: time.Now().UTC()})
+		ac.audit(u.Login, "approval", "", "", fmt.Sprintf("approval %d of %d", len(ac.Approvals), ac.RequiredApprovals))
+		if len(ac.Approvals) >= ac.RequiredApprovals {
+			ac.transition(u.Login, actionApproved, "")
+		}
+		return nil
+	})
+	if err != nil {
+		writeActionError(w, err)
+		return
+	}
+	if ac.Status == actionApproved {
+		ac, err = a.executeAction(ctx, id, ac)
+		if err != nil {
+			writeActionError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, ac.redacted())
+}
+
+// executeAction sends the request of an approved action and records the outcome. The
+// request is not cancelled when the approving client goes away, only by the action timeout.
+func (a *App) executeAction(ctx context.Context, id string, ac action) (action, error) {
+	outcome := ac.send(context.WithoutCancel(ctx), a.outbound.client(dependencyWebhooks), false)
+	return a.updateAction(context.WithoutCancel(ctx), id, func(ac *action) error {
+		ac.Outcome = &outcome
+		if outcome.Error != "" {
+			ac.transition("", actionFailed, outcome.Error)
+		} else {
+			ac.transition("", actionSucceeded, fmt.Sprintf("target responded with status %d", outcome.StatusCode))
+		}
+		return nil
+	})
+}
+
+// handleActionReject rejects a proposed action.
+func (a *App) handleActionReject(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Comment string `json:"comment"`
+	}
+	if req.Body != nil {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx := req.Context()
+	u := backend.UserFromContext(ctx)
+	if u == nil || u.Login == "" {
+		http.Error(w, "rejecting actions requires a signed in user", http.StatusForbidden)
+		return
+	}
+	ac, err := a.updateAction(ctx, req.PathValue("id"), func(ac *action) error {
+		if ac.Status != actionProposed {
+			return actionConflict("action is %s", ac.Status)
+		}
+		// The proposer may withdraw their own action; anyone else needs to be able to approve.
+		if !canApprove(u) && u.Login != ac.ProposedBy {
+			return errActionForbidden
+		}
+		ac.transition(u.Login, actionRejected, body.Comment)
+		return nil
+	})
+	if err != nil {
+		writeActionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ac.redacted())
+}
@@ -0,0 +1,375 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// actionTarget is a local stand-in for the endpoints remediation actions call.
+type actionTarget struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	status   int
+	delay    time.Duration
+}
+
+func newActionTarget(t *testing.T) (*actionTarget, *httptest.Server) {
+	target := &actionTarget{status: http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		target.mu.Lock()
+		target.requests = append(target.requests, req)
+		target.bodies = append(target.bodies, string(b))
+		status, delay := target.status, target.delay
+		target.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"result":"done"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return target, srv
+}
+
+// newActionTestApp returns an app whose actions may reach the loopback targets of
+// newActionTarget, which webhooks never reach otherwise.
+func newActionTestApp(t *testing.T) *App {
+	t.Helper()
+	app := newTestApp(t, "http://localhost:0", map[string]any{"actions": map[string]any{"webhookAllowlist": []string{"127.0.0.1/32"}}})
+	app.outbound.webhooks.blocked = nil
+	return app
+}
+
+var (
+	alice  = &backend.User{Login: "alice", Role: "Editor"}
+	bob    = &backend.User{Login: "bob", Role: "Admin"}
+	viewer = &backend.User{Login: "victor", Role: "Viewer"}
+)
+
+func decodeAction(t *testing.T, resp *backend.CallResourceResponse, expStatus int) action {
+	t.Helper()
+	if resp.Status != expStatus {
+		t.Fatalf("expected status %d, got %d: %s", expStatus, resp.Status, resp.Body)
+	}
+	var ac action
+	if err := json.Unmarshal(resp.Body, &ac); err != nil {
+		t.Fatal(err)
+	}
+	return ac
+}
+
+func TestActionValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		action action
+		expErr string
+	}{
+		{name: "valid", action: action{Title: "t", Kind: actionWebhook, URL: "http://hooks/x"}},
+		{name: "unknown kind", action: action{Title: "t", Kind: "delete", URL: "http://hooks/x"}, expErr: "kind must be"},
+		{name: "scale without replicas", action: action{Title: "t", Kind: actionScale, URL: "http://hooks/x"}, expErr: "replicas"},
+		{name: "get method", action: action{Title: "t", Kind: actionRestart, URL: "http://hooks/x", Method: "get"}, expErr: "method must be"},
+		{name: "bad url", action: action{Title: "t", Kind: actionWebhook, URL: "file:///etc/passwd"}, expErr: "invalid url"},
+		{name: "three approvals", action: action{Title: "t", Kind: actionWebhook, URL: "http://hooks/x", RequiredApprovals: 3}, expErr: "requiredApprovals"},
+		{name: "long timeout", action: action{Title: "t", Kind: actionWebhook, URL: "http://hooks/x", Timeout: "1h"}, expErr: "timeout must be between"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.action.validate()
+			if tc.expErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tc.expErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expErr)) {
+				t.Fatalf("expected error containing %q, got %v", tc.expErr, err)
+			}
+			if tc.expErr == "" && (tc.action.Method != http.MethodPost || tc.action.RequiredApprovals != 1 || tc.action.Source != "user") {
+				t.Errorf("defaults not applied: %+v", tc.action)
+			}
+		})
+	}
+}
+
+func TestActionApprovalWorkflow(t *testing.T) {
+	target, srv := newActionTarget(t)
+	app := newActionTestApp(t)
+
+	ac := decodeAction(t, callResource(t, app, http.MethodPost, "actions", map[string]any{
+		"title":          "Restart checkout",
+		"kind":           "restart",
+		"url":            srv.URL + "/restart",
+		"headers":        map[string]string{"Authorization": "Bearer secret"},
+		"payload":        map[string]any{"deployment": "checkout"},
+		"supportsDryRun": true,
+		"source":         "runbook",
+		"sourceId":       "rb-1",
+	}), http.StatusOK)
+	// Only runbook executions and the agent propose actions on behalf of a runbook.
+	if ac.Status != actionProposed || ac.ProposedBy != "tester" || ac.Source != "user" || ac.SourceID != "" || ac.Headers["Authorization"] != redactedValue {
+		t.Fatalf("unexpected action %+v", ac)
+	}
+
+	resp := callResourceAs(t, app, alice, http.MethodPost, "actions/"+ac.ID+"/approve", nil)
+	if resp.Status != http.StatusConflict || !strings.Contains(string(resp.Body), "dry-run") {
+		t.Errorf("expected approval without dry-run to conflict, got %d %s", resp.Status, resp.Body)
+	}
+
+	resp = callResource(t, app, http.MethodPost, "actions/"+ac.ID+"/dry-run", nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("dry-run: %d %s", resp.Status, resp.Body)
+	}
+	if strings.Contains(string(resp.Body), "secret") {
+		t.Errorf("dry-run leaked a header value: %s", resp.Body)
+	}
+	target.mu.Lock()
+	if len(target.requests) != 1 || target.requests[0].Header.Get(dryRunHeader) != "true" {
+		t.Errorf("expected one dry-run request, got %d", len(target.requests))
+	}
+	target.mu.Unlock()
+
+	resp = callResourceAs(t, app, viewer, http.MethodPost, "actions/"+ac.ID+"/approve", nil)
+	if resp.Status != http.StatusForbidden {
+		t.Errorf("expected viewers to be unable to approve, got %d", resp.Status)
+	}
+	resp = callResourceAs(t, app, &backend.User{Login: "tester", Role: "Admin"}, http.MethodPost, "actions/"+ac.ID+"/approve", nil)
+	if resp.Status != http.StatusConflict {
+		t.Errorf("expected the proposer to be unable to approve, got %d", resp.Status)
+	}
+
+	ac = decodeAction(t, callResourceAs(t, app, alice, http.MethodPost, "actions/"+ac.ID+"/approve", map[string]string{"comment": "go"}), http.StatusOK)
+	if ac.Status != actionSucceeded || ac.Outcome == nil || ac.Outcome.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected action %+v", ac)
+	}
+	target.mu.Lock()
+	if len(target.requests) != 2 {
+		t.Fatalf("expected the action to be sent once, got %d requests", len(target.requests))
+	}
+	req := target.requests[1]
+	if req.Header.Get(dryRunHeader) != "" || req.Header.Get("Authorization") != "Bearer secret" || req.Header.Get("X-Action-Id") != ac.ID {
+		t.Errorf("unexpected request headers %v", req.Header)
+	}
+	if target.bodies[1] != `{"deployment":"checkout"}` {
+		t.Errorf("unexpected request body %s", target.bodies[1])
+	}
+	target.mu.Unlock()
+
+	var events []string
+	for _, e := range ac.Audit {
+		events = append(events, e.Event+":"+e.To)
+	}
+	if got := strings.Join(events, " "); got != "transition:proposed dry-run: approval: transition:approved transition:succeeded" {
+		t.Errorf("unexpected audit %s", got)
+	}
+
+	resp = callResourceAs(t, app, bob, http.MethodPost, "actions/"+ac.ID+"/approve", nil)
+	if resp.Status != http.StatusConflict {
+		t.Errorf("expected approving an executed action to conflict, got %d", resp.Status)
+	}
+}
+
+func TestActionTargetGuard(t *testing.T) {
+	target, srv := newActionTarget(t)
+	propose := func(app *App, url string) action {
+		t.Helper()
+		return decodeAction(t, callResourceAs(t, app, alice, http.MethodPost, "actions", map[string]any{
+			"title": "Hook", "kind": "webhook", "url": url, "supportsDryRun": true,
+		}), http.StatusOK)
+	}
+	dryRun := func(app *App, ac action) string {
+		t.Helper()
+		resp := callResourceAs(t, app, alice, http.MethodPost, "actions/"+ac.ID+"/dry-run", nil)
+		var res struct{ Action action }
+		if err := json.Unmarshal(resp.Body, &res); err != nil || resp.Status != http.StatusOK || res.Action.DryRun == nil {
+			t.Fatalf("dry-run: %d %s", resp.Status, resp.Body)
+		}
+		return res.Action.DryRun.Error
+	}
+
+	// Viewers can neither propose actions nor have them sent by a dry-run.
+	app := newTestApp(t, "http://localhost:0", nil)
+	resp := callResourceAs(t, app, viewer, http.MethodPost, "actions", map[string]any{"title": "Hook", "kind": "webhook", "url": srv.URL})
+	if resp.Status != http.StatusForbidden {
+		t.Errorf("expected viewers to be unable to propose actions, got %d", resp.Status)
+	}
+	ac := propose(app, srv.URL)
+	if resp := callResourceAs(t, app, viewer, http.MethodPost, "actions/"+ac.ID+"/dry-run", nil); resp.Status != http.StatusForbidden {
+		t.Errorf("expected viewers to be unable to dry-run actions, got %d", resp.Status)
+	}
+
+	// Targets must be allowlisted, and blocked addresses are never reached.
+	if err := dryRun(app, propose(app, "http://192.0.2.1/hook")); !strings.Contains(err, "not in the webhook allowlist") {
+		t.Errorf("expected the target to be outside the allowlist, got %q", err)
+	}
+	app = newTestApp(t, "http://localhost:0", map[string]any{"actions": map[string]any{"webhookAllowlist": []string{"127.0.0.1/32", "169.254.0.0/16"}}})
+	if err := dryRun(app, propose(app, srv.URL)); !strings.Contains(err, "is blocked for webhooks") {
+		t.Errorf("expected loopback to be blocked, got %q", err)
+	}
+	if err := dryRun(app, propose(app, "http://169.254.169.254/latest/api/token")); !strings.Contains(err, "is blocked for webhooks") {
+		t.Errorf("expected the metadata endpoint to be blocked, got %q", err)
+	}
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if len(target.requests) != 0 {
+		t.Errorf("expected no request to reach the target, got %d", len(target.requests))
+	}
+}
+
+func TestActionTwoPersonApproval(t *testing.T) {
+	target, srv := newActionTarget(t)
+	target.status = http.StatusInternalServerError
+	app := newActionTestApp(t)
+
+	ac := decodeAction(t, callResource(t, app, http.MethodPost, "actions", map[string]any{
+		"title":             "Scale checkout",
+		"kind":              "scale",
+		"url":               srv.URL + "/scale",
+		"replicas":          5,
+		"requiredApprovals": 2,
+	}), http.StatusOK)
+	resp := callResource(t, app, http.MethodPost, "actions/"+ac.ID+"/dry-run", nil)
+	if resp.Status != http.StatusOK || !strings.Contains(string(resp.Body), `"body":{"replicas":5}`) {
+		t.Fatalf("dry-run: %d %s", resp.Status, resp.Body)
+	}
+	target.mu.Lock()
+	if len(target.requests) != 0 {
+		t.Errorf("targets without dry-run support must not be called by a dry-run")
+	}
+	target.mu.Unlock()
+
+	ac = decodeAction(t, callResourceAs(t, app, alice, http.MethodPost, "actions/"+ac.ID+"/approve", nil), http.StatusOK)
+	if ac.Status != actionProposed || len(ac.Approvals) != 1 {
+		t.Fatalf("expected the action to wait for a second approval: %+v", ac)
+	}
+	resp = callResourceAs(t, app, alice, http.MethodPost, "actions/"+ac.ID+"/approve", nil)
+	if resp.Status != http.StatusConflict {
+		t.Errorf("expected a second approval by the same user to conflict, got %d", resp.Status)
+	}
+	ac = decodeAction(t, callResourceAs(t, app, bob, http.MethodPost, "actions/"+ac.ID+"/approve", nil), http.StatusOK)
+	if ac.Status != actionFailed || ac.Outcome.StatusCode != http.StatusInternalServerError || !strings.Contains(ac.Outcome.Error, "status 500") {
+		t.Errorf("unexpected action %+v", ac)
+	}
+}
+
+func TestActionTimeoutAndExpiry(t *testing.T) {
+	target, srv := newActionTarget(t)
+	target.delay = time.Second
+	app := newActionTestApp(t)
+
+	ac := decodeAction(t, callResource(t, app, http.MethodPost, "actions", map[string]any{
+		"title": "Slow hook", "kind": "webhook", "url": srv.URL, "timeout": "50ms",
+	}), http.StatusOK)
+	callResource(t, app, http.MethodPost, "actions/"+ac.ID+"/dry-run", nil)
+	ac = decodeAction(t, callResourceAs(t, app, alice, http.MethodPost, "actions/"+ac.ID+"/approve", nil), http.StatusOK)
+	if ac.Status != actionFailed || !strings.Contains(ac.Outcome.Error, "deadline exceeded") {
+		t.Errorf("expected the action to time out: %+v", ac.Outcome)
+	}
+
+	ac = decodeAction(t, callResource(t, app, http.MethodPost, "actions", map[string]any{
+		"title": "Expiring hook", "kind": "webhook", "url": srv.URL, "approvalTimeout": "10ms",
+	}), http.StatusOK)
+	time.Sleep(20 * time.Millisecond)
+	resp := callResourceAs(t, app, alice, http.MethodPost, "actions/"+ac.ID+"/approve", nil)
+	if resp.Status != http.StatusConflict || !strings.Contains(string(resp.Body), "expired") {
+		t.Errorf("expected approving an expired action to conflict, got %d %s", resp.Status, resp.Body)
+	}
+	ac = decodeAction(t, callResource(t, app, http.MethodGet, "actions/"+ac.ID, nil), http.StatusOK)
+	if ac.Status != actionExpired || ac.Audit[len(ac.Audit)-1].To != actionExpired {
+		t.Errorf("expected the expiry to be persisted and audited: %+v", ac)
+	}
+}
+
+func TestActionReject(t *testing.T) {
+	_, srv := newActionTarget(t)
+	app := newActionTestApp(t)
+
+	ac := decodeAction(t, callResourceAs(t, app, alice, http.MethodPost, "actions", map[string]any{
+		"title": "Hook", "kind": "webhook", "url": srv.URL,
+	}), http.StatusOK)
+	resp := callResourceAs(t, app, viewer, http.MethodPost, "actions/"+ac.ID+"/reject", nil)
+	if resp.Status != http.StatusForbidden {
+		t.Errorf("expected viewers to be unable to reject other users' actions, got %d", resp.Status)
+	}
+	ac = decodeAction(t, callResourceAs(t, app, bob, http.MethodPost, "actions/"+ac.ID+"/reject", map[string]string{"comment": "not now"}), http.StatusOK)
+	if ac.Status != actionRejected || ac.Audit[len(ac.Audit)-1].Message != "not now" {
+		t.Errorf("unexpected action %+v", ac)
+	}
+
+	resp = callResource(t, app, http.MethodGet, "actions", nil)
+	if resp.Status != http.StatusOK || !strings.Contains(string(resp.Body), ac.ID) {
+		t.Errorf("list: %d %s", resp.Status, resp.Body)
+	}
+	resp = callResource(t, app, http.MethodGet, "actions/missing", nil)
+	if resp.Status != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.Status)
+	}
+}
+
+func TestActionProposals(t *testing.T) {
+	target, srv := newActionTarget(t)
+	app := newActionTestApp(t)
+	resp := callResource(t, app, http.MethodPost, "runbooks", runbook{
+		Title: "Checkout errors",
+		Content: "```action kind=restart title=\"Restart checkout\" approvals=2 dryrun=true\n" +
+			"POST " + srv.URL + "/restart\n" +
+			"{\"deployment\": \"{{ $labels.service }}\"}\n```\n",
+	})
+	var rb runbook
+	if err := json.Unmarshal(resp.Body, &rb); err != nil || resp.Status != http.StatusOK {
+		t.Fatalf("create runbook: %d %s", resp.Status, resp.Body)
+	}
+
+	resp = callResource(t, app, http.MethodPost, "runbooks/"+rb.ID+"/execute", alertContext{Labels: map[string]string{"service": "checkout"}})
+	var executed struct {
+		Steps []runbookStepResult `json:"steps"`
+	}
+	if err := json.Unmarshal(resp.Body, &executed); err != nil || len(executed.Steps) != 1 || executed.Steps[0].ActionID == "" {
+		t.Fatalf("execute runbook: %d %s", resp.Status, resp.Body)
+	}
+	ac := decodeAction(t, callResource(t, app, http.MethodGet, "actions/"+executed.Steps[0].ActionID, nil), http.StatusOK)
+	if ac.Status != actionProposed || ac.Source != "runbook" || ac.SourceID != rb.ID || ac.ProposedBy != "tester" ||
+		ac.RequiredApprovals != 2 || !ac.SupportsDryRun || ac.Payload["deployment"] != "checkout" {
+		t.Errorf("unexpected runbook action %+v", ac)
+	}
+
+	app.llm = &scriptedLLM{script: []chatMessage{
+		callTool("c1", "propose_action", `{"runbookId": "`+rb.ID+`", "step": 1, "labels": {"service": "cart"}, "reason": "Pods are stuck"}`),
+		{Role: "assistant", Content: "I proposed a restart of cart."},
+	}}
+	resp = callResource(t, app, http.MethodPost, "agent", map[string]any{"question": "Fix cart"})
+	var res agentResult
+	if err := json.Unmarshal(resp.Body, &res); err != nil || len(res.Steps) != 1 || res.Steps[0].Error != "" {
+		t.Fatalf("agent: %d %s", resp.Status, resp.Body)
+	}
+	resp = callResource(t, app, http.MethodGet, "actions", nil)
+	var actions []action
+	if err := json.Unmarshal(resp.Body, &actions); err != nil {
+		t.Fatal(err)
+	}
+	var proposed *action
+	for i := range actions {
+		if actions[i].Source == "assistant" {
+			proposed = &actions[i]
+		}
+	}
+	if proposed == nil || proposed.SourceID != rb.ID || proposed.Reason != "Pods are stuck" || proposed.Payload["deployment"] != "cart" {
+		t.Fatalf("unexpected actions %s", resp.Body)
+	}
+	if !strings.Contains(res.Steps[0].Output, proposed.ID) {
+		t.Errorf("unexpected tool output %q", res.Steps[0].Output)
+	}
+	// Proposing never runs the action.
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if len(target.requests) != 0 {
+		t.Errorf("proposals must not call the target, got %d requests", len(target.requests))
+	}
+}
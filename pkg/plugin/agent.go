@@ -0,0 +1,489 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// maxAgentSteps bounds the number of LLM round trips of one agent request.
+	maxAgentSteps = 8
+	// agentToolOutputLimit bounds the tool output returned to the LLM.
+	agentToolOutputLimit = 8 << 10
+	// agentConfirmationTTL is how long a mutating call waits for confirmation.
+	agentConfirmationTTL = 15 * time.Minute
+)
+
+// agentTool is a function the agent loop lets the LLM call.
+type agentTool struct {
+	name        string
+	description string
+	parameters  map[string]any
+	// mutating tools change something outside the plugin. They need the Editor role and
+	// only run once the user who asked confirms the call.
+	mutating bool
+	run      func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+func (t agentTool) definition() chatTool {
+	var def chatTool
+	def.Type = "function"
+	def.Function.Name = t.name
+	def.Function.Description = t.description
+	def.Function.Parameters = t.parameters
+	return def
+}
+
+// mcpAgentTool exposes an MCP tool of the Grafana server to the agent loop.
+func (a *App) mcpAgentTool(name, description string, parameters map[string]any) agentTool {
+	return agentTool{
+		name:        name,
+		description: description,
+		parameters:  parameters,
+		run: func(ctx context.Context, raw json.RawMessage) (string, error) {
+			var args map[string]any
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return "", fmt.Errorf("invalid arguments: %w", err)
+			}
+			return toolOutput(a.mcp.CallTool(ctx, name, args))
+		},
+	}
+}
+
+// agentTools returns the tools available to the agent loop.
+func (a *App) agentTools() []agentTool {
+	return []agentTool{
+		{
+			name: "knowledge_search",
+			description: "Search the team's own runbooks, postmortems and resolved investigations. " +
+				"Use it to find how similar problems were diagnosed and fixed before, and cite the results by title and URL.",
+			parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{"type": "string", "description": "What to search for, in natural language."},
+					"kind":  map[string]any{"type": "string", "enum": []string{knowledgeRunbook, knowledgePostmortem, knowledgeInvestigation}},
+					"k":     map[string]any{"type": "integer", "minimum": 1, "maximum": maxKnowledgeResults},
+				},
+				"required": []string{"query"},
+			},
+			run: func(ctx context.Context, raw json.RawMessage) (string, error) {
+				var args struct {
+					Query string `json:"query"`
+					Kind  string `json:"kind"`
+					K     int    `json:"k"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return "", fmt.Errorf("invalid arguments: %w", err)
+				}
+				var kinds []string
+				if args.Kind != "" {
+					kinds = []string{args.Kind}
+				}
+				k := args.K
+				if k < 1 || k > maxKnowledgeResults {
+					k = defaultKnowledgeResults
+				}
+				results, err := a.searchKnowledge(ctx, args.Query, k, kinds)
+				if err != nil {
+					return "", err
+				}
+				return formatKnowledgeResults(results), nil
+			},
+		},
+		{
+			name:        "suspect_changes",
+			description: "Rank recent deploys, feature flag and config changes by how likely they caused a problem with the given labels or services.",
+			parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"labels":   map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}},
+					"services": map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+					"lookback": map[string]any{"type": "string", "description": "How far back to look, e.g. 2h."},
+				},
+			},
+			run: func(ctx context.Context, raw json.RawMessage) (string, error) {
+				var r suspectsRequest
+				if err := json.Unmarshal(raw, &r); err != nil {
+					return "", fmt.Errorf("invalid arguments: %w", err)
+				}
+				r.Time = time.Now().UTC()
+				suspects, err := a.findSuspects(ctx, r, r.Time)
+				if err != nil {
+					return "", err
+				}
+				return formatSuspects(suspects), nil
+			},
+		},
+		a.mcpAgentTool("search_dashboards", "Search Grafana dashboards by title.", map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"query": map[string]any{"type": "string"}},
+			"required":   []string{"query"},
+		}),
+		a.mcpAgentTool("query_loki_logs", "Query log lines from a Loki datasource with LogQL.", map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"datasourceUid": map[string]any{"type": "string"},
+				"logql":         map[string]any{"type": "string"},
+				"startRfc3339":  map[string]any{"type": "string"},
+				"endRfc3339":    map[string]any{"type": "string"},
+				"limit":         map[string]any{"type": "integer", "maximum": investigationQueryLogLimit},
+			},
+			"required": []string{"datasourceUid", "logql"},
+		}),
+		{
+			name: "propose_action",
+			description: "Propose the remediation action of an action step of a runbook, rendered with the given alert labels. " +
+				"The action does not run: it waits for a dry-run and for approval by other people.",
+			parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"runbookId": map[string]any{"type": "string"},
+					"step":      map[string]any{"type": "integer", "minimum": 1, "description": "The 1-based index of the action step."},
+					"labels":    map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}},
+					"reason":    map[string]any{"type": "string", "description": "Why the action should run."},
+				},
+				"required": []string{"runbookId", "step", "reason"},
+			},
+			run: func(ctx context.Context, raw json.RawMessage) (string, error) {
+				var args struct {
+					RunbookID string            `json:"runbookId"`
+					Step      int               `json:"step"`
+					Labels    map[string]string `json:"labels"`
+					Reason    string            `json:"reason"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return "", fmt.Errorf("invalid arguments: %w", err)
+				}
+				rb, err := loadJSON[runbook](ctx, a.store, runbooksCollection, args.RunbookID)
+				if err != nil {
+					return "", fmt.Errorf("runbook %s: %w", args.RunbookID, err)
+				}
+				if args.Step < 1 || args.Step > len(rb.Steps) || rb.Steps[args.Step-1].Kind != runbookStepAction {
+					return "", fmt.Errorf("step %d of runbook %s is not an action step", args.Step, rb.ID)
+				}
+				step := rb.Steps[args.Step-1]
+				rendered, err := step.render(args.Labels)
+				if err != nil {
+					return "", err
+				}
+				ac, err := a.proposeRunbookAction(ctx, rb, step, rendered, "assistant", args.Reason)
+				if err != nil {
+					return "", err
+				}
+				return describeProposal(ac), nil
+			},
+		},
+		{
+			name:        "create_silence",
+			description: "Silence the alerts matching the given label matchers in the Grafana Alertmanager.",
+			parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"matchers": map[string]any{"type": "array", "items": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"name":    map[string]any{"type": "string"},
+							"value":   map[string]any{"type": "string"},
+							"isRegex": map[string]any{"type": "boolean"},
+							"isEqual": map[string]any{"type": "boolean"},
+						},
+						"required": []string{"name", "value"},
+					}},
+					"duration": map[string]any{"type": "string", "description": "How long to silence for, e.g. 2h."},
+					"comment":  map[string]any{"type": "string"},
+				},
+				"required": []string{"matchers"},
+			},
+			mutating: true,
+			run: func(ctx context.Context, raw json.RawMessage) (string, error) {
+				var r silenceRequest
+				if err := json.Unmarshal(raw, &r); err != nil {
+					return "", fmt.Errorf("invalid arguments: %w", err)
+				}
+				s, err := r.toPostable(ctx, time.Now())
+				if err != nil {
+					return "", err
+				}
+				id, err := a.createSilence(ctx, s)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("Created silence %s for %s until %s.", id, formatMatchers(s.Matchers), s.EndsAt.Format(time.RFC3339)), nil
+			},
+		},
+	}
+}
+
+// formatKnowledgeResults describes knowledge base results for the LLM.
+func formatKnowledgeResults(results []knowledgeResult) string {
+	if len(results) == 0 {
+		return "No matching runbooks, postmortems or investigations."
+	}
+	var b strings.Builder
+	for i, r := range results {
+		fmt.Fprintf(&b, "%d. [%s] %s (%s, score %.2f)\n%s\n\n", i+1, r.Kind, r.Title, r.URL, r.Score, r.Text)
+	}
+	return b.String()
+}
+
+const agentSystemPrompt = `You are an SRE assistant answering questions about production systems.
+Use the tools to look up the team's own runbooks, postmortems, investigations and recent changes before answering.
+Cite what you used by title and URL. If the tools do not give you enough information, say so instead of guessing.`
+
+// agentRequest is the body of POST /agent.
+type agentRequest struct {
+	Question string `json:"question"`
+	// Labels give context, e.g. the labels of the alert the question is about.
+	Labels map[string]string `json:"labels"`
+	// Confirmations are the tokens of pending confirmations returned by a previous run of
+	// the same user, who approved them. Each token runs its recorded call once, before the
+	// model is asked anything.
+	Confirmations []string `json:"confirmations"`
+}
+
+// agentStep is a tool call made by the agent.
+type agentStep struct {
+	Tool      string `json:"tool"`
+	Arguments string `json:"arguments"`
+	Output    string `json:"output,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// InjectionFlags name the instruction-like patterns found in the output.
+	InjectionFlags []string `json:"injectionFlags,omitempty"`
+	// Blocked is set when a mutating call waits for human confirmation, and Confirmed
+	// when it ran because the user confirmed it.
+	Blocked   bool `json:"blocked,omitempty"`
+	Confirmed bool `json:"confirmed,omitempty"`
+}
+
+// agentConfirmation is a mutating tool call blocked until the user confirms it, by sending
+// the token again with the question.
+type agentConfirmation struct {
+	Token     string `json:"token"`
+	Tool      string `json:"tool"`
+	Arguments string `json:"arguments"`
+	Reason    string `json:"reason"`
+}
+
+// agentResult is the answer of the agent and the tool calls it made to get there.
+type agentResult struct {
+	degradation
+	Answer string      `json:"answer"`
+	Steps  []agentStep `json:"steps"`
+	Usage  llmUsage    `json:"usage"`
+	// PendingConfirmations are the mutating calls blocked in this run.
+	PendingConfirmations []agentConfirmation `json:"pendingConfirmations,omitempty"`
+	// Error is set when the agent ran out of steps before answering.
+	Error string `json:"error,omitempty"`
+}
+
+var errAgentStepLimit = fmt.Errorf("agent did not answer within %d steps", maxAgentSteps)
+
+// runAgent lets the LLM call tools until it answers the question.
+func (a *App) runAgent(ctx context.Context, r agentRequest) (agentResult, error) {
+	ctx = withLLMFeature(ctx, featureAgent, "")
+	res := agentResult{Steps: []agentStep{}}
+	tools := map[string]agentTool{}
+	var defs []chatTool
+	for _, t := range a.agentTools() {
+		tools[t.name] = t
+		defs = append(defs, t.definition())
+	}
+	question := r.Question
+	if len(r.Labels) > 0 {
+		question += "\n\nLabels: " + formatLabelSet(r.Labels)
+	}
+	tag := untrustedTag()
+	messages := []chatMessage{
+		{Role: "system", Content: agentSystemPrompt + "\n" + untrustedPrompt(tag)},
+		{Role: "user", Content: question},
+	}
+	var mutating []string
+	for name, t := range tools {
+		if t.mutating {
+			mutating = append(mutating, name)
+		}
+	}
+	user := backend.UserFromContext(ctx)
+	// flagged lists the tools whose output looked like an injection so far.
+	var flagged []string
+
+	// Confirmed calls run as they were recorded, and the model is told about them.
+	if confirmed := a.takeConfirmations(r.Confirmations, userLogin(ctx), time.Now()); len(confirmed) > 0 {
+		calls := chatMessage{Role: "assistant"}
+		var results []chatMessage
+		for i, p := range confirmed {
+			call := toolCall{ID: fmt.Sprintf("confirmed-%d", i+1), Type: "function"}
+			call.Function.Name, call.Function.Arguments = p.tool, p.arguments
+			calls.ToolCalls = append(calls.ToolCalls, call)
+			step := agentStep{Tool: p.tool, Arguments: p.arguments, Confirmed: true}
+			content := "Confirmed by the user and run. "
+			out, err := "", errors.New(p.tool+" requires the Editor or Admin role")
+			if isEditor(user) {
+				out, err = a.callAgentTool(ctx, tools, call)
+			}
+			if err != nil {
+				step.Error = err.Error()
+				content += "Error: " + err.Error()
+			} else {
+				step.Output = truncate(out, agentToolOutputLimit)
+				content += step.Output
+			}
+			res.Steps = append(res.Steps, step)
+			results = append(results, chatMessage{Role: "tool", ToolCallID: call.ID, Content: wrapUntrusted(tag, p.tool, content, nil)})
+		}
+		messages = append(append(messages, calls), results...)
+	}
+
+	for range maxAgentSteps {
+		resp, err := a.completion(ctx, chatCompletionRequest{Model: llmModelLarge, Messages: messages, Tools: defs})
+		if err != nil {
+			return res, fmt.Errorf("llm: %w", err)
+		}
+		res.Usage.PromptTokens += resp.Usage.PromptTokens
+		res.Usage.CompletionTokens += resp.Usage.CompletionTokens
+		res.Usage.TotalTokens += resp.Usage.TotalTokens
+		if len(resp.Choices) == 0 {
+			return res, errors.New("llm: response has no choices")
+		}
+		msg := resp.Choices[0].Message
+		if len(msg.ToolCalls) == 0 {
+			res.Answer = msg.Content
+			return res, nil
+		}
+		messages = append(messages, msg)
+		for _, call := range msg.ToolCalls {
+			step := agentStep{Tool: call.Function.Name, Arguments: call.Function.Arguments}
+			if tool, ok := tools[call.Function.Name]; ok && tool.mutating {
+				if !isEditor(user) {
+					step.Error = call.Function.Name + " requires the Editor or Admin role"
+					res.Steps = append(res.Steps, step)
+					messages = append(messages, chatMessage{Role: "tool", ToolCallID: call.ID, Content: "Error: " + step.Error})
+					continue
+				}
+				reason := call.Function.Name + " changes something outside the assistant"
+				if len(flagged) > 0 {
+					reason += ", and earlier output of " + strings.Join(flagged, ", ") + " contained instruction-like text"
+				}
+				step.Blocked, step.Error = true, "waiting for human confirmation: "+reason
+				res.Steps = append(res.Steps, step)
+				res.PendingConfirmations = append(res.PendingConfirmations, agentConfirmation{
+					Token:     a.pendConfirmation(user.Login, call.Function.Name, call.Function.Arguments, time.Now()),
+					Tool:      call.Function.Name,
+					Arguments: call.Function.Arguments,
+					Reason:    reason,
+				})
+				messages = append(messages, chatMessage{Role: "tool", ToolCallID: call.ID, Content: fmt.Sprintf(
+					"Blocked: %s needs human confirmation because %s. Tell the user what you wanted to do and why.", call.Function.Name, reason)})
+				continue
+			}
+			out, err := a.callAgentTool(ctx, tools, call)
+			content := truncate(out, agentToolOutputLimit)
+			if err != nil {
+				step.Error = err.Error()
+				content = "Error: " + err.Error()
+			} else {
+				step.Output = content
+			}
+			if step.InjectionFlags = detectInjection(content, mutating); len(step.InjectionFlags) > 0 {
+				recordInjection(step.Tool, step.InjectionFlags)
+				a.logger(ctx).Warn("Possible prompt injection in tool output", "tool", step.Tool, "flags", step.InjectionFlags)
+				if !slices.Contains(flagged, step.Tool) {
+					flagged = append(flagged, step.Tool)
+				}
+			}
+			res.Steps = append(res.Steps, step)
+			messages = append(messages, chatMessage{Role: "tool", ToolCallID: call.ID, Content: wrapUntrusted(tag, step.Tool, content, step.InjectionFlags)})
+		}
+	}
+	return res, errAgentStepLimit
+}
+
+func (a *App) callAgentTool(ctx context.Context, tools map[string]agentTool, call toolCall) (string, error) {
+	tool, ok := tools[call.Function.Name]
+	if !ok {
+		return "", fmt.Errorf("unknown tool %q", call.Function.Name)
+	}
+	args := json.RawMessage(call.Function.Arguments)
+	if strings.TrimSpace(call.Function.Arguments) == "" {
+		args = json.RawMessage("{}")
+	}
+	return tool.run(ctx, args)
+}
+
+// agentFallback answers without the LLM. It searches the knowledge base for the question
+// and, given labels, ranks the changes suspected of causing the problem, and lists what it
+// found. The steps made before the LLM failed are kept.
+func (a *App) agentFallback(ctx context.Context, r agentRequest, res agentResult, d degradation) agentResult {
+	res.degradation = d
+	tools := map[string]agentTool{}
+	for _, t := range a.agentTools() {
+		tools[t.name] = t
+	}
+	var b strings.Builder
+	b.WriteString("The LLM is unavailable, so this answer lists what the knowledge base and recent changes have on the question without interpreting it.\n")
+	run := func(heading, name string, args any) {
+		raw, err := json.Marshal(args)
+		if err != nil {
+			return
+		}
+		step := agentStep{Tool: name, Arguments: string(raw)}
+		out, err := tools[name].run(ctx, raw)
+		if err != nil {
+			step.Error = err.Error()
+			out = "Error: " + err.Error()
+		} else {
+			step.Output = truncate(out, agentToolOutputLimit)
+		}
+		res.Steps = append(res.Steps, step)
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", heading, strings.TrimSpace(out))
+	}
+	run("Runbooks, postmortems and investigations", "knowledge_search", map[string]any{"query": r.Question})
+	if len(r.Labels) > 0 {
+		run("Suspect changes", "suspect_changes", map[string]any{"labels": r.Labels})
+	}
+	res.Answer = b.String()
+	return res
+}
+
+// handleAgent answers a question with the agent loop.
+func (a *App) handleAgent(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var r agentRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(r.Question) == "" {
+		http.Error(w, "question is required", http.StatusBadRequest)
+		return
+	}
+	res, err := a.runAgent(req.Context(), r)
+	if llmUnavailable(err) {
+		writeJSON(w, http.StatusOK, a.agentFallback(req.Context(), r, res, a.degrade(req.Context(), featureAgent, err)))
+		return
+	}
+	if errors.Is(err, errAgentStepLimit) {
+		res.Error = err.Error()
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+	if writeLimitError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scriptedLLM replies with the next message of a script, recording the requests.
+type scriptedLLM struct {
+	mu       sync.Mutex
+	script   []chatMessage
+	requests []chatCompletionRequest
+}
+
+func (s *scriptedLLM) ChatCompletions(_ context.Context, req chatCompletionRequest) (chatCompletionResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	var resp chatCompletionResponse
+	if len(s.script) == 0 {
+		return resp, errors.New("scripted llm: no more replies")
+	}
+	resp.Choices = append(resp.Choices, struct {
+		Message      chatMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
+	}{Message: s.script[0]})
+	resp.Usage = llmUsage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110}
+	s.script = s.script[1:]
+	return resp, nil
+}
+
+// callTool returns an assistant message calling a tool with JSON arguments.
+func callTool(id, name, args string) chatMessage {
+	c := toolCall{ID: id, Type: "function"}
+	c.Function.Name, c.Function.Arguments = name, args
+	return chatMessage{Role: "assistant", ToolCalls: []toolCall{c}}
+}
+
+func TestAgentKnowledgeSearch(t *testing.T) {
+	app, _ := newKnowledgeApp(t)
+	err := saveJSON(context.Background(), app.store, runbooksCollection, "rb-db", runbook{
+		ID: "rb-db", Title: "Database connection pool exhausted", Content: "Kill slow queries holding connections.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.reindexKnowledge(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	llm := &scriptedLLM{script: []chatMessage{
+		callTool("c1", "knowledge_search", `{"query": "connection pool exhausted", "kind": "runbook"}`),
+		callTool("c2", "delete_database", `{}`),
+		{Role: "assistant", Content: "Follow the Database connection pool exhausted runbook."},
+	}}
+	app.llm = llm
+
+	resp := callResource(t, app, http.MethodPost, "agent", map[string]any{"question": "Why are connections timing out?", "labels": map[string]string{"service": "orders"}})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("agent: %d %s", resp.Status, resp.Body)
+	}
+	var res agentResult
+	if err := json.Unmarshal(resp.Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Answer != "Follow the Database connection pool exhausted runbook." || res.Usage.TotalTokens != 330 || len(res.Steps) != 2 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if !strings.Contains(res.Steps[0].Output, "[runbook] Database connection pool exhausted ("+pluginResourcesPath+"/runbooks/rb-db") {
+		t.Errorf("unexpected search output %q", res.Steps[0].Output)
+	}
+	if !strings.Contains(res.Steps[1].Error, `unknown tool "delete_database"`) {
+		t.Errorf("unexpected step %+v", res.Steps[1])
+	}
+
+	llm.mu.Lock()
+	defer llm.mu.Unlock()
+	first := llm.requests[0]
+	if len(first.Tools) != len(app.agentTools()) || first.Tools[0].Function.Name != "knowledge_search" || !strings.Contains(first.Messages[1].Content, `service="orders"`) {
+		t.Errorf("unexpected first request %+v", first)
+	}
+	// The tool results are sent back with the IDs of the calls they answer.
+	last := llm.requests[2].Messages
+	if m := last[len(last)-1]; m.Role != "tool" || m.ToolCallID != "c2" || !strings.Contains(m.Content, "\nError: ") {
+		t.Errorf("unexpected tool message %+v", m)
+	}
+	if m := last[3]; m.Role != "tool" || m.ToolCallID != "c1" {
+		t.Errorf("unexpected tool message %+v", m)
+	}
+}
+
+func TestAgentStepLimit(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	llm := &scriptedLLM{}
+	for range maxAgentSteps {
+		llm.script = append(llm.script, callTool("c", "suspect_changes", `{"services": ["checkout"]}`))
+	}
+	app.llm = llm
+	resp := callResource(t, app, http.MethodPost, "agent", map[string]any{"question": "What changed?"})
+	var res agentResult
+	if err := json.Unmarshal(resp.Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != http.StatusOK || res.Error == "" || len(res.Steps) != maxAgentSteps || !strings.Contains(res.Steps[0].Output, "No changes") {
+		t.Errorf("unexpected result %d %+v", resp.Status, res)
+	}
+	if resp := callResource(t, app, http.MethodPost, "agent", map[string]any{"question": " "}); resp.Status != http.StatusBadRequest {
+		t.Errorf("expected 400 without a question, got %d", resp.Status)
+	}
+}
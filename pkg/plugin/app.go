@@ -2,11 +2,21 @@ package plugin
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+
+	"github.com/sre/assistant/pkg/plugin/store"
 )
 
 // Make sure App implements required interfaces. This is important to do
@@ -17,37 +27,235 @@ var (
 	_ backend.CallResourceHandler   = (*App)(nil)
 	_ instancemgmt.InstanceDisposer = (*App)(nil)
 	_ backend.CheckHealthHandler    = (*App)(nil)
+	_ backend.StreamHandler         = (*App)(nil)
+	_ backend.CollectMetricsHandler = (*App)(nil)
 )
 
 // App is an example app plugin with a backend which can respond to data queries.
 type App struct {
 	backend.CallResourceHandler
+
+	settings *Settings
+	orgID    int64
+	grafana  *grafanaClient
+	// outbound holds the HTTP clients and circuit breakers of the dependencies.
+	outbound *outboundClients
+	store    store.Store
+	llm      llmProvider
+	mcp      mcpToolCaller
+	// redactor removes sensitive values from every request sent to llm and embeddings.
+	// redactionAuditPending holds the audit entries not saved yet.
+	redactor              *redactor
+	redactionAuditMu      sync.Mutex
+	redactionAuditPending []redactionAuditEntry
+	// llmGate caps the calls to llm in flight, and limiter rate limits the routes using it.
+	llmGate *llmGate
+	limiter *rateLimiter
+	// toolCache caches the results of read-only tools called through mcp. It is nil when
+	// the cache is disabled.
+	toolCache *toolCache
+	// embeddings is nil when no embeddings endpoint is configured.
+	embeddings embeddingsProvider
+	// httpChecker sends the requests of runbook HTTP checks.
+	httpChecker *httpChecker
+
+	// maintenanceMu serializes changes to maintenance windows between the
+	// resource handlers and the scheduler.
+	maintenanceMu sync.Mutex
+
+	// investigationsMu serializes updates to investigations and guards
+	// investigationRuns, the investigations whose steps are being executed.
+	investigationsMu    sync.Mutex
+	investigationRuns   map[string]*investigationRun
+	investigationEvents investigationBroker
+
+	// actionsMu serializes state transitions of remediation actions.
+	actionsMu sync.Mutex
+
+	// confirmations are the mutating agent tool calls waiting for confirmation, by token.
+	confirmationsMu sync.Mutex
+	confirmations   map[string]pendingConfirmation
+
+	// knowledgeMu serializes knowledge base reindexing. knowledgeCache holds the decoded
+	// documents between reindexes and is nil until loaded.
+	knowledgeMu      sync.Mutex
+	knowledgeCacheMu sync.RWMutex
+	knowledgeCache   []knowledgeDoc
+
+	// usageMu serializes updates of the token usage records and guards usagePeriod, the
+	// usage of the current budget period, and budgetWarnings, the soft budgets already
+	// reported in their current period.
+	usageMu        sync.Mutex
+	usagePeriod    *periodUsage
+	budgetWarnings map[string]bool
+
+	// baseLogger is where the loggers returned by logger write. logRedactor removes
+	// secrets from their lines, and debugLogging is the org's runtime debug override.
+	baseLogger   log.Logger
+	logRedactor  *logRedactor
+	debugLogging atomic.Bool
+
+	// jobsCtx is the context of background jobs. cancel stops them, and jobs
+	// is used to wait for them to exit.
+	jobsCtx context.Context
+	cancel  context.CancelFunc
+	jobs    sync.WaitGroup
 }
 
 // NewApp creates a new example *App instance.
-func NewApp(_ context.Context, _ backend.AppInstanceSettings) (instancemgmt.Instance, error) {
+func NewApp(ctx context.Context, appSettings backend.AppInstanceSettings) (instancemgmt.Instance, error) {
 	var app App
+	var err error
+
+	app.settings, err = loadSettings(appSettings)
+	if err != nil {
+		log.DefaultLogger.Error("Error loading settings", "err", err)
+		return nil, err
+	}
+	// App instances are created per organization.
+	app.orgID = backend.PluginConfigFromContext(ctx).OrgID
+	app.baseLogger = log.DefaultLogger
+	app.logRedactor, err = newLogRedactor(app.settings.Logging.RedactPatterns)
+	if err != nil {
+		log.DefaultLogger.Error("Error loading settings", "err", err)
+		return nil, err
+	}
+	app.debugLogging.Store(app.settings.Logging.Debug)
+	app.redactor, err = newRedactor(app.settings.Redaction)
+	if err != nil {
+		log.DefaultLogger.Error("Error loading settings", "err", err)
+		return nil, err
+	}
+	limits := app.settings.RateLimits
+	queueTimeout, err := time.ParseDuration(limits.LLMQueueTimeout)
+	if err != nil {
+		log.DefaultLogger.Error("Error loading settings", "err", err)
+		return nil, fmt.Errorf("invalid llmQueueTimeout: %w", err)
+	}
+	app.llmGate = newLLMGate(limits.LLMConcurrency, limits.LLMQueueSize, queueTimeout)
+	app.limiter = newRateLimiter()
+
+	// Getting the service account token that has been shared with the plugin,
+	// and the Grafana URL needed to call the Grafana API with it.
+	cfg := backend.GrafanaConfigFromContext(ctx)
+	saToken, err := cfg.PluginAppClientSecret()
+	if err != nil {
+		log.DefaultLogger.Warn("Unable to get service account token", "err", err)
+	}
+	grafanaURL, err := cfg.AppURL()
+	if err != nil {
+		log.DefaultLogger.Warn("Unable to get Grafana URL", "err", err)
+		// For debugging purposes only
+		grafanaURL = "http://localhost:3000"
+	}
+	webhooks, err := newAddressGuard("webhook", app.settings.Actions.WebhookAllowlist)
+	if err != nil {
+		log.DefaultLogger.Error("Error loading settings", "err", err)
+		return nil, err
+	}
+	app.outbound, err = newOutboundClients(app.settings.HTTP, app.orgID, app.logger, webhooks)
+	if err != nil {
+		log.DefaultLogger.Error("Error loading settings", "err", err)
+		return nil, err
+	}
+	app.grafana = newGrafanaClient(grafanaURL, saToken, app.outbound)
+	app.llm = instrumentedLLM{&grafanaLLMProvider{grafana: app.grafana}}
+	app.mcp = instrumentedMCP{newMCPClient(app.grafana)}
+	app.embeddings = newEmbeddingsProvider(app.settings.Embeddings, app.outbound.client(dependencyEmbeddings))
+	app.httpChecker, err = newHTTPChecker(app.settings.Runbooks.HTTPAllowlist)
+	if err != nil {
+		log.DefaultLogger.Error("Error loading settings", "err", err)
+		return nil, err
+	}
+
+	// Each organization gets its own store.
+	app.store, err = store.NewFileStore(filepath.Join(app.settings.DataPath, fmt.Sprintf("org_%d", app.orgID)))
+	if err != nil {
+		log.DefaultLogger.Error("Error creating store", "err", err)
+		return nil, err
+	}
+	app.toolCache, err = newToolCache(app.settings.Cache, app.store, app.orgID)
+	if err != nil {
+		log.DefaultLogger.Error("Error loading settings", "err", err)
+		return nil, err
+	}
+	if app.toolCache != nil {
+		app.mcp = cachedMCP{mcpToolCaller: app.mcp, cache: app.toolCache, logger: app.logger}
+	}
 
 	// Use a httpadapter (provided by the SDK) for resource calls. This allows us
 	// to use a *http.ServeMux for resource calls, so we can map multiple routes
 	// to CallResource without having to implement extra logic.
 	mux := http.NewServeMux()
 	app.registerRoutes(mux)
-	app.CallResourceHandler = httpadapter.New(mux)
+	app.CallResourceHandler = newSLOResourceHandler(httpadapter.New(withRequestLogging(mux, instrumentRoutes(mux))))
+
+	// Background jobs outlive any single request, so they get their own context
+	// which is cancelled in Dispose.
+	app.jobsCtx, app.cancel = context.WithCancel(context.Background())
+	app.startJob(jobMaintenanceScheduler, func() { app.runMaintenanceScheduler(app.jobsCtx, maintenanceSchedulerInterval) })
+	app.startJob(jobKnowledgeIndexer, func() { app.runKnowledgeIndexer(app.jobsCtx, knowledgeIndexInterval) })
+	app.startJob(jobRedactionAudit, func() {
+		app.runRedactionAudit(app.jobsCtx, redactionAuditFlushInterval, redactionAuditPruneInterval)
+	})
+
+	// Pick up investigations that were interrupted by a restart.
+	app.investigationRuns = map[string]*investigationRun{}
+	app.budgetWarnings = map[string]bool{}
+	app.confirmations = map[string]pendingConfirmation{}
+	app.resumeInvestigations(ctx)
 
 	return &app, nil
 }
 
+// Names of background jobs, used in metrics.
+const (
+	jobMaintenanceScheduler = "maintenance_scheduler"
+	jobKnowledgeIndexer     = "knowledge_indexer"
+	jobRedactionAudit       = "redaction_audit"
+	jobInvestigation        = "investigation"
+)
+
+// startJob runs fn in a background goroutine tracked by Dispose.
+func (a *App) startJob(name string, fn func()) {
+	a.jobs.Add(1)
+	jobsRunning.WithLabelValues(name).Inc()
+	go func() {
+		defer a.jobs.Done()
+		defer jobsRunning.WithLabelValues(name).Dec()
+		fn()
+	}()
+}
+
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
 // created.
 func (a *App) Dispose() {
-	// cleanup
+	if a.cancel != nil {
+		a.cancel()
+	}
+	a.jobs.Wait()
 }
 
-// CheckHealth handles health checks sent from Grafana to the plugin.
+// CheckHealth handles health checks sent from Grafana to the plugin. It fails while the
+// circuit breaker of a dependency is open, and details the state of every breaker. Open
+// breakers of single webhook targets only show in the message: the app itself still works.
 func (a *App) CheckHealth(_ context.Context, _ *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	return &backend.CheckHealthResult{
-		Status:  backend.HealthStatusOk,
-		Message: "ok",
-	}, nil
+	breakers := map[string]string{}
+	for dep, state := range a.outbound.breakerStates() {
+		breakers[dep] = state.String()
+	}
+	details, err := json.Marshal(map[string]any{"circuitBreakers": breakers})
+	if err != nil {
+		return nil, err
+	}
+	result := &backend.CheckHealthResult{Status: backend.HealthStatusOk, Message: "ok", JSONDetails: details}
+	dependencies, hosts := a.outbound.openBreakers()
+	if len(dependencies) > 0 {
+		result.Status = backend.HealthStatusError
+		result.Message = "circuit breaker open for " + strings.Join(dependencies, ", ")
+	}
+	if len(hosts) > 0 {
+		result.Message += "; warning: circuit breaker open for " + strings.Join(hosts, ", ")
+	}
+	return result, nil
 }
@@ -0,0 +1,355 @@
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+const (
+	toolCacheCollection = "tool_cache"
+	// defaultToolCacheEntries bounds the results kept in memory.
+	defaultToolCacheEntries = 1000
+	// sharedToolCallTimeout bounds a tool call shared by concurrent misses, which does
+	// not stop when the caller that started it goes away.
+	sharedToolCallTimeout = 2 * grafanaRequestTimeout
+)
+
+// defaultToolCacheTTLs are the read-only MCP tools whose results are cached, and for how
+// long. Query time ranges are aligned to the TTL in the cache key, so that requests made
+// within one TTL of each other share a result. Other tools are never cached.
+var defaultToolCacheTTLs = map[string]time.Duration{
+	"query_prometheus":             30 * time.Second,
+	"query_loki_logs":              30 * time.Second,
+	"query_loki_stats":             30 * time.Second,
+	"list_prometheus_metric_names": 5 * time.Minute,
+	"list_prometheus_label_names":  5 * time.Minute,
+	"list_prometheus_label_values": 5 * time.Minute,
+	"list_prometheus_metrics":      5 * time.Minute,
+	"list_loki_label_names":        5 * time.Minute,
+	"list_loki_label_values":       5 * time.Minute,
+	"search_dashboards":            time.Minute,
+}
+
+// cacheQueryArgs and cacheTimeArgs are the arguments normalized in cache keys.
+var (
+	cacheQueryArgs = []string{"expr", "logql", "query"}
+	cacheTimeArgs  = []string{"startTime", "endTime", "startRfc3339", "endRfc3339"}
+)
+
+// cacheSettings configures the cache of MCP tool results.
+type cacheSettings struct {
+	// Disabled turns the cache off.
+	Disabled bool `json:"disabled"`
+	// MaxEntries bounds the results kept in memory. Defaults to 1000.
+	MaxEntries int `json:"maxEntries"`
+	// Persist also keeps results in the plugin store, so that they survive restarts and
+	// entries evicted from memory can still be served.
+	Persist bool `json:"persist"`
+	// TTLs override the TTL of tools, e.g. {"query_prometheus": "1m"}. A zero TTL stops
+	// caching a tool.
+	TTLs map[string]string `json:"ttls"`
+}
+
+// toolCacheEntry is a cached tool result.
+type toolCacheEntry struct {
+	Key     string         `json:"key"`
+	Tool    string         `json:"tool"`
+	Result  *mcpToolResult `json:"result"`
+	Expires time.Time      `json:"expires"`
+}
+
+// toolCache is an LRU cache of MCP tool results with an optional store tier. Concurrent
+// misses of the same key share one upstream call.
+type toolCache struct {
+	orgID      int64
+	ttls       map[string]time.Duration
+	maxEntries int
+	store      store.Store // nil unless persisted
+	calls      singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+
+	// stored holds the expiry of the results in the store by key, so that its size is
+	// known without listing it. It is nil until loaded.
+	storedMu sync.Mutex
+	stored   map[string]time.Time
+}
+
+func newToolCache(settings cacheSettings, s store.Store, orgID int64) (*toolCache, error) {
+	if settings.Disabled {
+		return nil, nil
+	}
+	c := &toolCache{orgID: orgID, ttls: map[string]time.Duration{}, maxEntries: settings.MaxEntries, entries: map[string]*list.Element{}, lru: list.New()}
+	for tool, ttl := range defaultToolCacheTTLs {
+		c.ttls[tool] = ttl
+	}
+	for tool, v := range settings.TTLs {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid cache TTL %q for %s", v, tool)
+		}
+		if _, ok := defaultToolCacheTTLs[tool]; !ok {
+			return nil, fmt.Errorf("tool %s is not a cacheable read-only tool", tool)
+		}
+		c.ttls[tool] = ttl
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultToolCacheEntries
+	}
+	if settings.Persist {
+		c.store = s
+	}
+	return c, nil
+}
+
+// normalizeQuery collapses whitespace outside of quoted strings.
+func normalizeQuery(q string) string {
+	var b strings.Builder
+	var quote rune
+	space := false
+	for _, r := range strings.TrimSpace(q) {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'' || r == '`':
+			quote = r
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// cacheKey returns the cache key of a tool call, with its time range aligned to ttl. The
+// tool is still called with the original arguments.
+func (c *toolCache) cacheKey(tool string, args map[string]any, ttl time.Duration) string {
+	keyArgs := make(map[string]any, len(args))
+	for k, v := range args {
+		keyArgs[k] = v
+	}
+	for _, k := range cacheTimeArgs {
+		if s, ok := keyArgs[k].(string); ok {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				keyArgs[k] = t.UTC().Truncate(ttl).Format(time.RFC3339)
+			}
+		}
+	}
+	for _, k := range cacheQueryArgs {
+		if s, ok := keyArgs[k].(string); ok {
+			keyArgs[k] = normalizeQuery(s)
+		}
+	}
+	// The datasource and the query are part of the arguments; json.Marshal sorts map keys.
+	b, _ := json.Marshal(keyArgs)
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d\x00%s\x00%s", c.orgID, tool, b))
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the unexpired result of key, from memory or else from the store.
+func (c *toolCache) get(ctx context.Context, key string, now time.Time) (*mcpToolResult, bool) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*toolCacheEntry)
+		if now.Before(e.Expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return e.Result, true
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	if c.store == nil {
+		return nil, false
+	}
+	e, err := loadJSON[toolCacheEntry](ctx, c.store, toolCacheCollection, key)
+	if err != nil || !now.Before(e.Expires) {
+		return nil, false
+	}
+	c.add(&e)
+	return e.Result, true
+}
+
+// add puts an entry in memory, evicting the least recently used ones over maxEntries.
+func (c *toolCache) add(e *toolCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.Key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.Key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*toolCacheEntry).Key)
+	}
+}
+
+// put caches a result in memory and, if persisted, in the store. Expired entries are
+// removed from the store once it holds more than maxEntries.
+func (c *toolCache) put(ctx context.Context, e *toolCacheEntry, now time.Time) error {
+	c.add(e)
+	if c.store == nil {
+		return nil
+	}
+	if err := saveJSON(ctx, c.store, toolCacheCollection, e.Key, e); err != nil {
+		return err
+	}
+	c.storedMu.Lock()
+	defer c.storedMu.Unlock()
+	if c.stored == nil {
+		// The store may hold results of an earlier run.
+		stored, err := listJSON[toolCacheEntry](ctx, c.store, toolCacheCollection)
+		if err != nil {
+			return err
+		}
+		c.stored = make(map[string]time.Time, len(stored))
+		for _, s := range stored {
+			c.stored[s.Key] = s.Expires
+		}
+	}
+	c.stored[e.Key] = e.Expires
+	if len(c.stored) <= c.maxEntries {
+		return nil
+	}
+	for key, expires := range c.stored {
+		if !now.Before(expires) {
+			if err := c.store.Delete(ctx, toolCacheCollection, key); err != nil {
+				return err
+			}
+			delete(c.stored, key)
+		}
+	}
+	return nil
+}
+
+// purge removes the results of tool, or all results if tool is empty, from memory and
+// the store, and returns how many results were removed.
+func (c *toolCache) purge(ctx context.Context, tool string) (int, error) {
+	purged := map[string]bool{}
+	c.mu.Lock()
+	for key, el := range c.entries {
+		if tool == "" || el.Value.(*toolCacheEntry).Tool == tool {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			purged[key] = true
+		}
+	}
+	c.mu.Unlock()
+	if c.store == nil {
+		return len(purged), nil
+	}
+	stored, err := listJSON[toolCacheEntry](ctx, c.store, toolCacheCollection)
+	if err != nil {
+		return len(purged), err
+	}
+	c.storedMu.Lock()
+	defer c.storedMu.Unlock()
+	for _, s := range stored {
+		if tool == "" || s.Tool == tool {
+			if err := c.store.Delete(ctx, toolCacheCollection, s.Key); err != nil {
+				return len(purged), err
+			}
+			if c.stored != nil {
+				delete(c.stored, s.Key)
+			}
+			purged[s.Key] = true
+		}
+	}
+	return len(purged), nil
+}
+
+// cachedMCP serves the results of read-only tools from a toolCache.
+type cachedMCP struct {
+	mcpToolCaller
+	cache  *toolCache
+	logger func(context.Context) log.Logger
+}
+
+func (m cachedMCP) CallTool(ctx context.Context, name string, args map[string]any) (*mcpToolResult, error) {
+	ttl := m.cache.ttls[name]
+	if ttl <= 0 {
+		return m.mcpToolCaller.CallTool(ctx, name, args)
+	}
+	key := m.cache.cacheKey(name, args, ttl)
+	if res, ok := m.cache.get(ctx, key, time.Now()); ok {
+		recordCacheLookup("mcp_tools", true)
+		return res, nil
+	}
+	recordCacheLookup("mcp_tools", false)
+	// The call is shared with the concurrent misses of other requests, so it must not be
+	// cancelled with the request that happened to start it. Each caller still stops
+	// waiting when its own request is cancelled.
+	ch := m.cache.calls.DoChan(key, func() (any, error) {
+		callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedToolCallTimeout)
+		defer cancel()
+		res, err := m.mcpToolCaller.CallTool(callCtx, name, args)
+		if err != nil || res.IsError {
+			return res, err
+		}
+		now := time.Now()
+		if err := m.cache.put(callCtx, &toolCacheEntry{Key: key, Tool: name, Result: res, Expires: now.Add(ttl)}, now); err != nil {
+			m.logger(ctx).Warn("Error caching tool result", "tool", name, "err", err)
+		}
+		return res, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return r.Val.(*mcpToolResult), nil
+	}
+}
+
+// handleCachePurge drops cached tool results, those of ?tool= only if given. It requires
+// the Admin role.
+func (a *App) handleCachePurge(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if u := backend.UserFromContext(req.Context()); u == nil || u.Role != "Admin" {
+		http.Error(w, "purging the cache requires the Admin role", http.StatusForbidden)
+		return
+	}
+	if a.toolCache == nil {
+		http.Error(w, "the cache is disabled", http.StatusNotFound)
+		return
+	}
+	n, err := a.toolCache.purge(req.Context(), req.URL.Query().Get("tool"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.logger(req.Context()).Info("Cache purged", "tool", req.URL.Query().Get("tool"), "entries", n)
+	writeJSON(w, http.StatusOK, map[string]any{"purged": n})
+}
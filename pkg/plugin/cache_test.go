@@ -0,0 +1,255 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+	for in, want := range map[string]string{
+		"  sum(rate(x[5m]))\n\t  by (job) ": "sum(rate(x[5m])) by (job)",
+		`{app="a  b"}   |=  "x  y"`:         `{app="a  b"} |= "x  y"`,
+		"`a  b`  c":                         "`a  b` c",
+	} {
+		if got := normalizeQuery(in); got != want {
+			t.Errorf("normalizeQuery(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestToolCache(t *testing.T) {
+	app := newTestApp(t, "", map[string]any{"cache": map[string]any{"persist": true, "maxEntries": 2, "ttls": map[string]any{"search_dashboards": "0s"}}})
+	var mu sync.Mutex
+	var starts []string
+	fake := &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"query_prometheus": func(args map[string]any) (any, error) {
+			mu.Lock()
+			starts = append(starts, args["startTime"].(string))
+			mu.Unlock()
+			return []any{args["datasourceUid"]}, nil
+		},
+		"search_dashboards":     func(map[string]any) (any, error) { return []any{}, nil },
+		"list_loki_label_names": func(map[string]any) (any, error) { return nil, errors.New("unavailable") },
+		"create_annotation":     func(map[string]any) (any, error) { return "ok", nil },
+	}}
+	app.mcp = cachedMCP{mcpToolCaller: fake, cache: app.toolCache, logger: app.logger}
+	ctx := context.Background()
+	upstream := func() int {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.calls)
+	}
+	query := func(ds, expr, start string) string {
+		t.Helper()
+		res, err := app.mcp.CallTool(ctx, "query_prometheus", map[string]any{"datasourceUid": ds, "expr": expr, "startTime": start})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.text()
+	}
+	hits := testutil.ToFloat64(cacheRequests.WithLabelValues("mcp_tools", "hit"))
+
+	// Queries that only differ in whitespace and fall in the same aligned range share a result.
+	query("prom", "sum(rate(x[5m]))\n  by (job)", "2026-01-01T00:00:05Z")
+	query("prom", "sum(rate(x[5m])) by (job)", "2026-01-01T00:00:20Z")
+	// The range is only aligned in the cache key: the tool gets the start it was asked for.
+	if upstream() != 1 || starts[0] != "2026-01-01T00:00:05Z" {
+		t.Fatalf("expected one upstream call with the original start, got %d %v", upstream(), starts)
+	}
+	if got := testutil.ToFloat64(cacheRequests.WithLabelValues("mcp_tools", "hit")) - hits; got != 1 {
+		t.Errorf("expected one hit, got %g", got)
+	}
+	if query("other", "sum(rate(x[5m])) by (job)", "2026-01-01T00:00:20Z") != `["other"]` || upstream() != 2 {
+		t.Errorf("another datasource should miss")
+	}
+	query("prom", "sum(rate(x[5m])) by (job)", "2026-01-01T00:00:40Z")
+	if upstream() != 3 {
+		t.Errorf("the next aligned range should miss")
+	}
+
+	// Writes, errors and tools with a zero TTL are not cached.
+	for range 2 {
+		app.mcp.CallTool(ctx, "search_dashboards", map[string]any{"query": "x"})
+		app.mcp.CallTool(ctx, "list_loki_label_names", map[string]any{"datasourceUid": "loki"})
+		app.mcp.CallTool(ctx, "create_annotation", map[string]any{"text": "x"})
+	}
+	if upstream() != 9 {
+		t.Errorf("expected every uncacheable call upstream, got %d calls", upstream())
+	}
+
+	// The first query was evicted from memory by the later ones, but the store has it,
+	// also for a new instance after a restart.
+	if len(app.toolCache.entries) != 2 {
+		t.Errorf("expected 2 entries in memory, got %d", len(app.toolCache.entries))
+	}
+	query("prom", "sum(rate(x[5m])) by (job)", "2026-01-01T00:00:10Z")
+	restarted, err := newToolCache(cacheSettings{Persist: true}, app.store, app.orgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.mcp = cachedMCP{mcpToolCaller: fake, cache: restarted, logger: app.logger}
+	query("other", "sum(rate(x[5m])) by (job)", "2026-01-01T00:00:10Z")
+	if upstream() != 9 {
+		t.Errorf("expected store hits, got %d upstream calls", upstream())
+	}
+
+	// Purging requires the Admin role and drops memory and store entries.
+	app.mcp = cachedMCP{mcpToolCaller: fake, cache: app.toolCache, logger: app.logger}
+	if resp := callResource(t, app, http.MethodPost, "cache/purge", nil); resp.Status != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.Status)
+	}
+	resp := callResourceAs(t, app, &backend.User{Login: "admin", Role: "Admin"}, http.MethodPost, "cache/purge?tool=query_prometheus", nil)
+	var purged struct{ Purged int }
+	if err := json.Unmarshal(resp.Body, &purged); err != nil || purged.Purged != 3 {
+		t.Errorf("unexpected purge response %d %s", resp.Status, resp.Body)
+	}
+	query("prom", "sum(rate(x[5m])) by (job)", "2026-01-01T00:00:10Z")
+	if upstream() != 10 {
+		t.Errorf("expected a miss after the purge, got %d upstream calls", upstream())
+	}
+}
+
+func TestToolCacheSingleflight(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	release := make(chan struct{})
+	fake := &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"list_prometheus_metric_names": func(map[string]any) (any, error) {
+			<-release
+			return []string{"up"}, nil
+		},
+	}}
+	app.mcp = cachedMCP{mcpToolCaller: fake, cache: app.toolCache, logger: app.logger}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := app.mcp.CallTool(context.Background(), "list_prometheus_metric_names", map[string]any{"datasourceUid": "prom"})
+			if err != nil || res.text() != `["up"]` {
+				t.Errorf("unexpected result %v %v", res, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if len(fake.calls) != 1 {
+		t.Errorf("expected concurrent calls to share one upstream call, got %d", len(fake.calls))
+	}
+	if _, err := newToolCache(cacheSettings{TTLs: map[string]string{"create_silence": "1m"}}, nil, 0); err == nil {
+		t.Error("expected an error for a TTL of a tool that is not cacheable")
+	}
+}
+
+// mcpFunc adapts a function to mcpToolCaller.
+type mcpFunc func(ctx context.Context, name string, args map[string]any) (*mcpToolResult, error)
+
+func (f mcpFunc) CallTool(ctx context.Context, name string, args map[string]any) (*mcpToolResult, error) {
+	return f(ctx, name, args)
+}
+
+func TestToolCacheSharedCallOutlivesCaller(t *testing.T) {
+	cache, err := newToolCache(cacheSettings{}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls atomic.Int32
+	upstream := mcpFunc(func(ctx context.Context, _ string, _ map[string]any) (*mcpToolResult, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		res := &mcpToolResult{}
+		res.Content = append(res.Content, struct {
+			Type string `json:"type"`
+			Text string `json:"text,omitempty"`
+		}{Type: "text", Text: "up"})
+		return res, nil
+	})
+	m := cachedMCP{mcpToolCaller: upstream, cache: cache, logger: func(context.Context) log.Logger { return log.DefaultLogger }}
+	args := map[string]any{"datasourceUid": "prom"}
+
+	// The request that started the call goes away while another one waits for it.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := m.CallTool(ctx, "list_prometheus_metric_names", args)
+		first <- err
+	}()
+	<-started
+	second := make(chan *mcpToolResult, 1)
+	go func() {
+		res, err := m.CallTool(context.Background(), "list_prometheus_metric_names", args)
+		if err != nil {
+			t.Errorf("the shared call should not be cancelled with the first caller: %s", err)
+		}
+		second <- res
+	}()
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("the cancelled caller should stop waiting, got %v", err)
+	}
+	close(release)
+	if res := <-second; res == nil || res.text() != "up" || calls.Load() != 1 {
+		t.Errorf("expected one shared upstream call, got %d calls and %v", calls.Load(), res)
+	}
+}
+
+// countingStore counts the listings of a store.
+type countingStore struct {
+	store.Store
+	lists atomic.Int32
+}
+
+func (s *countingStore) List(ctx context.Context, collection string) ([]store.Item, error) {
+	s.lists.Add(1)
+	return s.Store.List(ctx, collection)
+}
+
+func TestToolCacheStoreSize(t *testing.T) {
+	ctx := context.Background()
+	s := &countingStore{Store: store.NewMemoryStore()}
+	now := time.Now()
+	expired := &toolCacheEntry{Key: "old", Tool: "query_prometheus", Expires: now.Add(-time.Minute)}
+	if err := saveJSON(ctx, s, toolCacheCollection, expired.Key, expired); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := newToolCache(cacheSettings{Persist: true, MaxEntries: 3}, s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		e := &toolCacheEntry{Key: strconv.Itoa(i), Tool: "query_prometheus", Result: &mcpToolResult{}, Expires: now.Add(time.Minute)}
+		if err := cache.put(ctx, e, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.lists.Load(); n != 1 {
+		t.Errorf("expected the store to be listed once, got %d", n)
+	}
+	if _, err := s.Get(ctx, toolCacheCollection, "old"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected the expired entry to be removed, got %v", err)
+	}
+	if len(cache.stored) != 5 {
+		t.Errorf("expected 5 stored entries, got %d", len(cache.stored))
+	}
+}
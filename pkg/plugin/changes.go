@@ -0,0 +1,344 @@
+package plugin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	changesCollection = "changes"
+	// changesTokenHeader carries the ingestion token. Grafana itself authenticates the
+	// request through the Authorization header, so the token cannot be sent there.
+	changesTokenHeader = "X-Changes-Token"
+	// defaultSuspectLookback is how long before an anomaly changes are considered suspects.
+	defaultSuspectLookback = 2 * time.Hour
+	maxSuspectLookback     = 7 * 24 * time.Hour
+	// suspectGrace accepts changes recorded shortly after the anomaly started, since
+	// alerts fire some time after the change that caused them.
+	suspectGrace        = 5 * time.Minute
+	defaultSuspectLimit = 10
+)
+
+// Change kinds.
+const (
+	changeDeploy = "deploy"
+	changeFlag   = "flag"
+	changeConfig = "config"
+)
+
+// serviceLabelNames are the labels that name a service in alerts and metrics.
+var serviceLabelNames = []string{"service", "service_name", "app", "application", "job"}
+
+// change is a deploy, feature flag or configuration change reported by CI or by a
+// deployment tool.
+type change struct {
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	Service string `json:"service"`
+	// Version is the deployed version, or the new value of a flag or configuration.
+	Version     string `json:"version,omitempty"`
+	Author      string `json:"author,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Environment string `json:"environment,omitempty"`
+	// Labels relate the change to alerts and metrics beyond its service, e.g. {"cluster": "eu-1"}.
+	Labels map[string]string `json:"labels,omitempty"`
+	URL    string            `json:"url,omitempty"`
+	// Time is when the change was made. Defaults to when it was received.
+	Time       time.Time `json:"time,omitzero"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// validate checks the change and fills in defaults.
+func (c *change) validate(now time.Time) error {
+	if !slices.Contains([]string{changeDeploy, changeFlag, changeConfig}, c.Kind) {
+		return fmt.Errorf("kind must be %q, %q or %q", changeDeploy, changeFlag, changeConfig)
+	}
+	if strings.TrimSpace(c.Service) == "" {
+		return errors.New("service is required")
+	}
+	if c.Kind == changeDeploy && c.Version == "" {
+		return errors.New("deploys need a version")
+	}
+	if c.Time.IsZero() {
+		c.Time = now
+	}
+	if c.Time.After(now.Add(suspectGrace)) {
+		return errors.New("time must not be in the future")
+	}
+	c.Time = c.Time.UTC()
+	if c.Title == "" {
+		c.Title = strings.TrimSpace(fmt.Sprintf("%s %s %s", c.Kind, c.Service, c.Version))
+	}
+	return nil
+}
+
+// labelSet returns the labels of the change including its service and environment.
+func (c change) labelSet() map[string]string {
+	labels := map[string]string{"service": c.Service}
+	if c.Environment != "" {
+		labels["env"] = c.Environment
+	}
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// timelineKind returns the kind of timeline event of the change.
+func (c change) timelineKind() string {
+	if c.Kind == changeDeploy {
+		return "deploy"
+	}
+	return "change"
+}
+
+// listChanges returns the changes made between from and to, oldest first.
+func (a *App) listChanges(ctx context.Context, from, to time.Time) ([]change, error) {
+	all, err := listJSON[change](ctx, a.store, changesCollection)
+	if err != nil {
+		return nil, err
+	}
+	changes := []change{}
+	for _, c := range all {
+		if !c.Time.Before(from) && !c.Time.After(to) {
+			changes = append(changes, c)
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Time.Before(changes[j].Time) })
+	return changes, nil
+}
+
+// suspectsRequest describes an anomaly or alert group to find suspect changes for.
+type suspectsRequest struct {
+	// Time is when the anomaly started or the alert group fired. Defaults to now.
+	Time time.Time `json:"time"`
+	// Labels are the labels of the anomalous series or the common labels of the alert group.
+	Labels map[string]string `json:"labels"`
+	// Services are affected services in addition to the ones named by Labels.
+	Services []string `json:"services"`
+	// Lookback is how long before Time changes are considered. Defaults to 2h.
+	Lookback string `json:"lookback"`
+	Limit    int    `json:"limit"`
+}
+
+// suspect is a change ranked by how likely it caused an anomaly.
+type suspect struct {
+	Change change `json:"change"`
+	// Score is between 0 and 1, combining ServiceScore and TimeScore.
+	Score        float64  `json:"score"`
+	ServiceScore float64  `json:"serviceScore"`
+	TimeScore    float64  `json:"timeScore"`
+	Reasons      []string `json:"reasons"`
+}
+
+// services returns the services named by the request.
+func (r suspectsRequest) services() []string {
+	services := slices.Clone(r.Services)
+	for _, name := range serviceLabelNames {
+		if v := r.Labels[name]; v != "" && !slices.Contains(services, v) {
+			services = append(services, v)
+		}
+	}
+	return services
+}
+
+// rankSuspects scores changes by service overlap and time proximity to the anomaly at t.
+// A change to an affected service scores 1 on overlap, a change sharing other labels with
+// the anomaly 0.5 and an unrelated change 0.1, since shared configuration and flags can
+// still break other services. Proximity decays linearly over the lookback window.
+func rankSuspects(changes []change, r suspectsRequest, t time.Time, lookback time.Duration) []suspect {
+	services := r.services()
+	suspects := []suspect{}
+	for _, c := range changes {
+		if c.Time.Before(t.Add(-lookback)) || c.Time.After(t.Add(suspectGrace)) {
+			continue
+		}
+		s := suspect{Change: c}
+		switch {
+		case slices.Contains(services, c.Service):
+			s.ServiceScore = 1
+			s.Reasons = append(s.Reasons, "changed affected service "+c.Service)
+		case len(r.Labels) > 0 && sharesLabel(c.labelSet(), r.Labels):
+			s.ServiceScore = 0.5
+			s.Reasons = append(s.Reasons, "shares labels with the anomaly")
+		default:
+			s.ServiceScore = 0.1
+		}
+		delta := t.Sub(c.Time)
+		s.TimeScore = max(0, 1-math.Abs(float64(delta))/float64(lookback))
+		if delta >= 0 {
+			s.Reasons = append(s.Reasons, fmt.Sprintf("made %s before the anomaly", formatDuration(delta.Round(time.Minute))))
+		} else {
+			s.Reasons = append(s.Reasons, "made just after the anomaly started")
+		}
+		s.Score = math.Round((0.6*s.ServiceScore+0.4*s.TimeScore)*1000) / 1000
+		suspects = append(suspects, s)
+	}
+	sort.SliceStable(suspects, func(i, j int) bool {
+		if suspects[i].Score != suspects[j].Score {
+			return suspects[i].Score > suspects[j].Score
+		}
+		return suspects[i].Change.Time.After(suspects[j].Change.Time)
+	})
+	return suspects
+}
+
+// sharesLabel reports whether a and b have a label with the same value, ignoring env,
+// which nearly every change and alert shares.
+func sharesLabel(a, b map[string]string) bool {
+	for k, v := range a {
+		if k != "env" && b[k] == v {
+			return true
+		}
+	}
+	return false
+}
+
+// findSuspects returns the ranked suspects of an anomaly, at most r.Limit.
+func (a *App) findSuspects(ctx context.Context, r suspectsRequest, now time.Time) ([]suspect, error) {
+	t := r.Time
+	if t.IsZero() {
+		t = now
+	}
+	lookback := defaultSuspectLookback
+	if r.Lookback != "" {
+		d, err := time.ParseDuration(r.Lookback)
+		if err != nil || d <= 0 || d > maxSuspectLookback {
+			return nil, fmt.Errorf("%w: lookback must be a duration up to %s", errInvalidSuspectsRequest, formatDuration(maxSuspectLookback))
+		}
+		lookback = d
+	}
+	changes, err := a.listChanges(ctx, t.Add(-lookback), t.Add(suspectGrace))
+	if err != nil {
+		return nil, err
+	}
+	suspects := rankSuspects(changes, r, t, lookback)
+	limit := r.Limit
+	if limit <= 0 {
+		limit = defaultSuspectLimit
+	}
+	return suspects[:min(limit, len(suspects))], nil
+}
+
+var errInvalidSuspectsRequest = errors.New("invalid suspects request")
+
+// formatSuspects describes suspects for an LLM prompt or an investigation step.
+func formatSuspects(suspects []suspect) string {
+	if len(suspects) == 0 {
+		return "No changes were recorded in the lookback window."
+	}
+	var b strings.Builder
+	for i, s := range suspects {
+		c := s.Change
+		fmt.Fprintf(&b, "%d. %s at %s", i+1, c.Title, c.Time.Format(time.RFC3339))
+		if c.Author != "" {
+			fmt.Fprintf(&b, " by %s", c.Author)
+		}
+		fmt.Fprintf(&b, " (score %.2f: %s)\n", s.Score, strings.Join(s.Reasons, ", "))
+		if c.Description != "" {
+			fmt.Fprintf(&b, "   %s\n", truncate(c.Description, 300))
+		}
+	}
+	return b.String()
+}
+
+// authorizeChanges checks the ingestion token. Ingestion is disabled until a token is configured.
+func (a *App) authorizeChanges(w http.ResponseWriter, req *http.Request) bool {
+	if a.settings.ChangesToken == "" {
+		http.Error(w, "change ingestion is disabled: no changes token is configured", http.StatusForbidden)
+		return false
+	}
+	token := req.Header.Get(changesTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.settings.ChangesToken)) != 1 {
+		http.Error(w, "invalid or missing "+changesTokenHeader+" header", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleChanges records a change (POST, authenticated with the changes token) or lists
+// the changes of a time window (GET, with from, to and service query parameters).
+func (a *App) handleChanges(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		q := req.URL.Query()
+		to, err := parseTimeParam(q.Get("to"), time.Now().UTC())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, err := parseTimeParam(q.Get("from"), to.Add(-24*time.Hour))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		changes, err := a.listChanges(ctx, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if service := q.Get("service"); service != "" {
+			changes = slices.DeleteFunc(changes, func(c change) bool { return c.Service != service })
+		}
+		writeJSON(w, http.StatusOK, changes)
+	case http.MethodPost:
+		if !a.authorizeChanges(w, req) {
+			return
+		}
+		var c change
+		if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now().UTC()
+		if err := c.validate(now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.ID, c.ReceivedAt = uuid.NewString(), now
+		if err := saveJSON(ctx, a.store, changesCollection, c.ID, c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.logger(ctx).Info("Recorded change", "id", c.ID, "kind", c.Kind, "service", c.Service, "version", c.Version, "author", c.Author)
+		writeJSON(w, http.StatusCreated, c)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleChangeSuspects ranks recent changes against an anomaly or alert group.
+func (a *App) handleChangeSuspects(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var r suspectsRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	suspects, err := a.findSuspects(req.Context(), r, time.Now().UTC())
+	if errors.Is(err, errInvalidSuspectsRequest) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, suspects)
+}
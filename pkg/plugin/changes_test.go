@@ -0,0 +1,162 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// postChange reports a change to app with the given ingestion token.
+func postChange(t *testing.T, app *App, token string, c map[string]any) *backend.CallResourceResponse {
+	t.Helper()
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string][]string{}
+	if token != "" {
+		headers[changesTokenHeader] = []string{token}
+	}
+	var r mockCallResourceResponseSender
+	err = app.CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{User: &backend.User{Login: "ci"}},
+		Method:        http.MethodPost,
+		Path:          "changes",
+		Headers:       headers,
+		Body:          b,
+	}, &r)
+	if err != nil || r.response == nil {
+		t.Fatalf("CallResource: %v", err)
+	}
+	return r.response
+}
+
+func TestChangeIngestion(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	deploy := map[string]any{"kind": "deploy", "service": "checkout", "version": "v2.3.0", "author": "dana"}
+
+	if resp := postChange(t, app, "ci-token", deploy); resp.Status != http.StatusForbidden {
+		t.Errorf("expected 403 without a configured token, got %d", resp.Status)
+	}
+	app.settings.ChangesToken = "ci-token"
+	if resp := postChange(t, app, "", deploy); resp.Status != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", resp.Status)
+	}
+	if resp := postChange(t, app, "wrong", deploy); resp.Status != http.StatusUnauthorized {
+		t.Errorf("expected 401 with a wrong token, got %d", resp.Status)
+	}
+	for _, c := range []map[string]any{
+		{"kind": "rollback", "service": "checkout"},
+		{"kind": "deploy", "service": "checkout"},
+		{"kind": "flag", "service": ""},
+		{"kind": "config", "service": "checkout", "time": time.Now().Add(time.Hour)},
+	} {
+		if resp := postChange(t, app, "ci-token", c); resp.Status != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", c, resp.Status)
+		}
+	}
+
+	resp := postChange(t, app, "ci-token", deploy)
+	if resp.Status != http.StatusCreated {
+		t.Fatalf("post: %d %s", resp.Status, resp.Body)
+	}
+	var c change
+	if err := json.Unmarshal(resp.Body, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.ID == "" || c.Title != "deploy checkout v2.3.0" || c.Time.IsZero() {
+		t.Errorf("unexpected change %+v", c)
+	}
+	if resp := postChange(t, app, "ci-token", map[string]any{"kind": "flag", "service": "cart", "version": "new-pricing=on"}); resp.Status != http.StatusCreated {
+		t.Fatalf("post: %d %s", resp.Status, resp.Body)
+	}
+
+	resp = callResource(t, app, http.MethodGet, "changes?service=checkout", nil)
+	var changes []change
+	if err := json.Unmarshal(resp.Body, &changes); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].ID != c.ID {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+
+	// Changes feed the timeline.
+	resp = callResource(t, app, http.MethodGet, "timeline?label=service=checkout", nil)
+	var timeline struct {
+		Events []timelineEvent `json:"events"`
+	}
+	if err := json.Unmarshal(resp.Body, &timeline); err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline.Events) != 1 || timeline.Events[0].Kind != "deploy" || timeline.Events[0].Source != sourceChanges {
+		t.Errorf("unexpected timeline %+v", timeline.Events)
+	}
+}
+
+func TestRankSuspects(t *testing.T) {
+	t0 := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	changes := []change{
+		{ID: "old-checkout", Service: "checkout", Title: "old", Time: t0.Add(-3 * time.Hour)},
+		{ID: "checkout", Service: "checkout", Title: "checkout", Time: t0.Add(-90 * time.Minute)},
+		{ID: "cluster", Service: "ingress", Title: "cluster", Labels: map[string]string{"cluster": "eu-1"}, Time: t0.Add(-30 * time.Minute)},
+		{ID: "cart", Service: "cart", Title: "cart", Time: t0.Add(-10 * time.Minute)},
+		{ID: "payments", Service: "payments", Title: "payments", Time: t0.Add(-20 * time.Minute)},
+		{ID: "after", Service: "checkout", Title: "after", Time: t0.Add(time.Hour)},
+	}
+	r := suspectsRequest{Labels: map[string]string{"app": "checkout", "cluster": "eu-1"}, Services: []string{"payments"}}
+	suspects := rankSuspects(changes, r, t0, 2*time.Hour)
+	var got []string
+	for _, s := range suspects {
+		got = append(got, s.Change.ID)
+	}
+	// Affected services rank first, then changes sharing labels, then unrelated ones,
+	// each ordered by how close they are to the anomaly.
+	if strings.Join(got, " ") != "payments checkout cluster cart" {
+		t.Errorf("unexpected ranking %v", got)
+	}
+	if s := suspects[0]; s.Score != 0.933 || !strings.Contains(strings.Join(s.Reasons, ", "), "20m before the anomaly") {
+		t.Errorf("unexpected top suspect %+v", s)
+	}
+}
+
+func TestChangeSuspectsAndInvestigationStep(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	now := time.Now().UTC()
+	for _, c := range []change{
+		{ID: "c1", Kind: changeDeploy, Service: "checkout", Version: "v2.3.0", Title: "deploy checkout v2.3.0", Author: "dana", Time: now.Add(-15 * time.Minute)},
+		{ID: "c2", Kind: changeConfig, Service: "search", Title: "config search", Time: now.Add(-5 * time.Minute)},
+	} {
+		if err := saveJSON(context.Background(), app.store, changesCollection, c.ID, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp := callResource(t, app, http.MethodPost, "changes/suspects", map[string]any{"labels": map[string]string{"service": "checkout"}, "limit": 1})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("suspects: %d %s", resp.Status, resp.Body)
+	}
+	var suspects []suspect
+	if err := json.Unmarshal(resp.Body, &suspects); err != nil {
+		t.Fatal(err)
+	}
+	if len(suspects) != 1 || suspects[0].Change.ID != "c1" {
+		t.Errorf("unexpected suspects %+v", suspects)
+	}
+	if resp := callResource(t, app, http.MethodPost, "changes/suspects", map[string]any{"lookback": "forever"}); resp.Status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid lookback, got %d", resp.Status)
+	}
+
+	inv := createInvestigation(t, app, map[string]any{
+		"title": "checkout errors", "goal": "Find the cause", "labels": map[string]string{"service": "checkout"},
+		"steps": []map[string]any{{"kind": "changes", "title": "suspect changes"}},
+	})
+	inv = waitForInvestigation(t, app, inv.ID, investigationCompleted)
+	if out := inv.Steps[0].Output; !strings.HasPrefix(out, "1. deploy checkout v2.3.0") || !strings.Contains(out, "by dana") {
+		t.Errorf("unexpected step output:\n%s", out)
+	}
+}
@@ -0,0 +1,49 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+)
+
+// degradation marks a response, or an investigation step, that was built without the LLM
+// because it was unavailable, and why. Every route calling the LLM has a fallback: the
+// agent, postmortem drafts, PromQL and LogQL generation and investigation steps. There is
+// no health report, anomaly explanation or rule advice route, nor a rule linter or
+// backtester, for a fallback to build on.
+type degradation struct {
+	Degraded       bool   `json:"degraded,omitempty"`
+	DegradedReason string `json:"degradedReason,omitempty"`
+}
+
+// annotate adds the degradation, if any, to a response built as a map.
+func (d degradation) annotate(resp map[string]any) map[string]any {
+	if d.Degraded {
+		resp["degraded"] = true
+		resp["degradedReason"] = d.DegradedReason
+	}
+	return resp
+}
+
+// llmUnavailableError wraps the errors of the LLM provider, as opposed to the limits
+// checked before calling it.
+type llmUnavailableError struct {
+	err error
+}
+
+func (e *llmUnavailableError) Error() string { return e.err.Error() }
+func (e *llmUnavailableError) Unwrap() error { return e.err }
+
+// llmUnavailable reports whether err is a failure of the LLM that AI endpoints answer
+// with their non-LLM fallback. Rate limits and budgets are still reported as such, and
+// cancelled requests have no one to answer.
+func llmUnavailable(err error) bool {
+	var unavailable *llmUnavailableError
+	return errors.As(err, &unavailable) && !errors.Is(err, context.Canceled)
+}
+
+// degrade records that feature answers without the LLM because of err.
+func (a *App) degrade(ctx context.Context, feature string, err error) degradation {
+	a.logger(ctx).Warn("LLM unavailable, using the fallback", "feature", feature, "err", err)
+	llmFallbacks.WithLabelValues(feature).Inc()
+	return degradation{Degraded: true, DegradedReason: "the LLM is unavailable: " + err.Error()}
+}
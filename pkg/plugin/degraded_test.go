@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// unavailableLLM fails every call like an LLM app whose provider is down.
+func unavailableLLM() *fakeLLM {
+	return &fakeLLM{err: &grafanaAPIError{StatusCode: http.StatusBadGateway, Message: "provider unreachable"}}
+}
+
+// degradedResponse holds the degradation fields of a JSON response.
+type degradedResponse struct {
+	Degraded       bool
+	DegradedReason string
+}
+
+func checkDegraded(t *testing.T, body []byte) {
+	t.Helper()
+	var d degradedResponse
+	if err := json.Unmarshal(body, &d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Degraded || !strings.Contains(d.DegradedReason, "provider unreachable") {
+		t.Errorf("expected a degraded response with the reason, got %s", body)
+	}
+}
+
+func TestAgentFallback(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	app.llm = unavailableLLM()
+	fallbacks := testutil.ToFloat64(llmFallbacks.WithLabelValues(featureAgent))
+
+	resp := callResource(t, app, http.MethodPost, "agent", map[string]any{"question": "Why is checkout slow?", "labels": map[string]string{"service": "checkout"}})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("expected the fallback answer, got %d %s", resp.Status, resp.Body)
+	}
+	checkDegraded(t, resp.Body)
+	var res agentResult
+	if err := json.Unmarshal(resp.Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Steps) != 2 || res.Steps[0].Tool != "knowledge_search" || res.Steps[1].Tool != "suspect_changes" || res.Steps[1].Arguments != `{"labels":{"service":"checkout"}}` {
+		t.Errorf("unexpected steps %+v", res.Steps)
+	}
+	if !strings.Contains(res.Answer, "The LLM is unavailable") || !strings.Contains(res.Answer, "## Suspect changes") {
+		t.Errorf("unexpected answer %q", res.Answer)
+	}
+	if got := testutil.ToFloat64(llmFallbacks.WithLabelValues(featureAgent)) - fallbacks; got != 1 {
+		t.Errorf("expected one fallback counted, got %g", got)
+	}
+}
+
+func TestPostmortemFallback(t *testing.T) {
+	srv, _ := newFakeIncidentGrafana(t)
+	app := newTestApp(t, srv.URL, nil)
+	app.llm = unavailableLLM()
+
+	resp := callResource(t, app, http.MethodPost, "postmortems/generate", map[string]any{"incidentId": "42"})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("expected a template draft, got %d %s", resp.Status, resp.Body)
+	}
+	checkDegraded(t, resp.Body)
+	var pm postmortem
+	if err := json.Unmarshal(resp.Body, &pm); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(pm.Summary.Text, "Checkout errors lasted 1h, from ") || strings.Join(pm.Summary.Evidence, ",") != "E1,E4" {
+		t.Errorf("unexpected summary %+v", pm.Summary)
+	}
+	if pm.Impact.Text != "Alerts fired: HighErrorRate." || pm.Impact.Unsupported {
+		t.Errorf("unexpected impact %+v", pm.Impact)
+	}
+	if !pm.RootCause.Unsupported || !strings.HasPrefix(pm.RootCause.Text, "Not determined.") {
+		t.Errorf("unexpected root cause %+v", pm.RootCause)
+	}
+	if len(pm.ActionItems) != 2 || pm.ActionItems[1].Text != "Review the alert HighErrorRate and its runbook." {
+		t.Errorf("unexpected action items %+v", pm.ActionItems)
+	}
+	// The draft is saved like any other, and stays marked as degraded.
+	resp = callResource(t, app, http.MethodGet, "postmortems/"+pm.ID, nil)
+	checkDegraded(t, resp.Body)
+	if !strings.Contains(string(resp.Body), "Review the alert HighErrorRate") {
+		t.Errorf("unexpected saved postmortem %s", resp.Body)
+	}
+}
+
+func TestQueryGenerateFallback(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	app.llm = unavailableLLM()
+	generate := func(path string, body map[string]any) (int, map[string]any) {
+		t.Helper()
+		resp := callResource(t, app, http.MethodPost, path, body)
+		checkDegraded(t, resp.Body)
+		var out map[string]any
+		if err := json.Unmarshal(resp.Body, &out); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status, out
+	}
+
+	app.mcp = newFakePrometheusMCP(map[string][]string{
+		"http_requests_total":                  {"service"},
+		"http_request_duration_seconds_bucket": {"service", "le"},
+		"process_cpu_seconds_total":            {"service"},
+	})
+	for question, want := range map[string]string{
+		"p95 latency of http request duration": "histogram_quantile(0.95, sum by (le) (rate(http_request_duration_seconds_bucket[5m])))",
+		"rate of http requests":                "sum(rate(http_requests_total[5m]))",
+	} {
+		status, out := generate("query/promql/generate", map[string]any{"question": question, "datasourceUid": "prom"})
+		if status != http.StatusOK || out["query"] != want {
+			t.Errorf("%q: expected %s, got %d %v", question, want, status, out)
+		}
+	}
+	if status, out := generate("query/promql/generate", map[string]any{"question": "disk usage", "datasourceUid": "prom"}); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 without a matching metric, got %d %v", status, out)
+	}
+
+	app.mcp = newFakeLokiMCP(map[string][]string{"app": {"checkout", "cart"}, "namespace": {"prod"}})
+	status, out := generate("query/logql/generate", map[string]any{"question": "How many errors did checkout log?", "datasourceUid": "loki"})
+	if status != http.StatusOK || out["query"] != `sum(count_over_time({app="checkout"} |~ "(?i)error"[5m]))` {
+		t.Errorf("unexpected LogQL fallback %d %v", status, out)
+	}
+	if status, out := generate("query/logql/generate", map[string]any{"question": "payments logs", "datasourceUid": "loki"}); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 without a matching stream, got %d %v", status, out)
+	}
+}
+
+func TestInvestigationLLMFallback(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	app.llm = unavailableLLM()
+
+	inv := createInvestigation(t, app, map[string]any{
+		"goal": "Find the cause of checkout errors",
+		"steps": []map[string]any{
+			{"kind": "note", "title": "first look", "note": "errors started at 10:00"},
+			{"kind": "llm", "prompt": "What next?"},
+			{"kind": "note", "note": "after"},
+		},
+	})
+	inv = waitForInvestigation(t, app, inv.ID, investigationCompleted)
+	step := inv.Steps[1]
+	if !step.Degraded || !strings.Contains(step.DegradedReason, "provider unreachable") || step.Error != "" ||
+		!strings.Contains(step.Output, "Step 1 (note): first look\nerrors started at 10:00") {
+		t.Errorf("unexpected LLM step %+v", step)
+	}
+	if inv.Steps[2].Status != investigationCompleted || inv.Steps[0].Degraded {
+		t.Errorf("expected the other steps to run normally, got %+v", inv.Steps)
+	}
+}
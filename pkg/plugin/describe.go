@@ -0,0 +1,375 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/sre/assistant/pkg/plugin/logql"
+)
+
+// promqlFunctionPhrases describe PromQL functions; %s is replaced by the first argument.
+var promqlFunctionPhrases = map[string]string{
+	"rate":               "the per-second rate of increase of %s",
+	"irate":              "the instant per-second rate of increase of %s",
+	"increase":           "the increase of %s",
+	"delta":              "the change of %s",
+	"idelta":             "the change between the last two samples of %s",
+	"deriv":              "the per-second derivative of %s",
+	"changes":            "the number of times %s changed",
+	"resets":             "the number of counter resets of %s",
+	"avg_over_time":      "the average of %s",
+	"sum_over_time":      "the sum of %s",
+	"min_over_time":      "the minimum of %s",
+	"max_over_time":      "the maximum of %s",
+	"count_over_time":    "the number of samples of %s",
+	"last_over_time":     "the last sample of %s",
+	"present_over_time":  "whether there are samples of %s",
+	"stddev_over_time":   "the standard deviation of %s",
+	"absent":             "whether %s is absent",
+	"absent_over_time":   "whether %s is absent",
+	"abs":                "the absolute value of %s",
+	"ceil":               "%s rounded up",
+	"floor":              "%s rounded down",
+	"round":              "%s rounded",
+	"sqrt":               "the square root of %s",
+	"ln":                 "the natural logarithm of %s",
+	"log2":               "the binary logarithm of %s",
+	"log10":              "the decimal logarithm of %s",
+	"exp":                "the exponential of %s",
+	"sort":               "%s sorted ascending",
+	"sort_desc":          "%s sorted descending",
+	"timestamp":          "the timestamp of %s",
+	"scalar":             "%s as a scalar",
+	"vector":             "the constant %s",
+	"clamp_min":          "%s clamped to a minimum",
+	"clamp_max":          "%s clamped to a maximum",
+	"predict_linear":     "the linear prediction of %s",
+	"label_replace":      "%s with a label rewritten",
+	"label_join":         "%s with labels joined",
+	"histogram_count":    "the observation count of the native histogram %s",
+	"histogram_sum":      "the sum of observations of the native histogram %s",
+	"histogram_fraction": "the fraction of observations of %s",
+}
+
+// aggregationPhrases describe aggregation operators; %s is replaced by the parameter.
+var aggregationPhrases = map[string]string{
+	"sum":          "the sum of",
+	"avg":          "the average of",
+	"min":          "the minimum of",
+	"max":          "the maximum of",
+	"count":        "the number of series of",
+	"group":        "one series per group of",
+	"stddev":       "the standard deviation of",
+	"stdvar":       "the variance of",
+	"topk":         "the %s largest series of",
+	"bottomk":      "the %s smallest series of",
+	"quantile":     "the %s quantile of",
+	"count_values": "the number of series per value of",
+	"limitk":       "%s sampled series of",
+	"sort":         "sorted ascending,",
+	"sort_desc":    "sorted descending,",
+}
+
+var binaryPhrases = map[string]string{
+	"+": "plus", "-": "minus", "*": "multiplied by", "/": "divided by", "%": "modulo", "^": "to the power of",
+	"==": "equal to", "!=": "not equal to", ">": "greater than", ">=": "greater than or equal to",
+	"<": "less than", "<=": "less than or equal to",
+	"atan2": "atan2 with",
+}
+
+// sentence capitalizes a description and ends it with a full stop.
+func sentence(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:] + "."
+}
+
+// describeAggregation describes an aggregation of an already described expression.
+func describeAggregation(op, param, inner string, without bool, grouping []string) string {
+	phrase, ok := aggregationPhrases[op]
+	if !ok {
+		phrase = op + " of"
+	}
+	if strings.Contains(phrase, "%s") {
+		phrase = fmt.Sprintf(phrase, param)
+	}
+	out := phrase + " " + inner
+	if len(grouping) > 0 {
+		return out + describeGrouping(without, grouping)
+	}
+	switch op {
+	case "topk", "bottomk", "sort", "sort_desc", "limitk":
+		return out
+	}
+	return out + ", across all series"
+}
+
+func describeGrouping(without bool, grouping []string) string {
+	if without {
+		return ", keeping all labels except " + strings.Join(grouping, ", ")
+	}
+	return ", per " + strings.Join(grouping, ", ")
+}
+
+// describeBinary describes a binary operation between two described expressions.
+func describeBinary(op, lhs, rhs string, returnBool bool) string {
+	switch op {
+	case "and":
+		return lhs + ", only where " + rhs + " also has a value"
+	case "or":
+		return lhs + ", or else " + rhs
+	case "unless":
+		return lhs + ", except where " + rhs + " has a value"
+	}
+	phrase, ok := binaryPhrases[op]
+	if !ok {
+		phrase = op
+	}
+	switch op {
+	case "==", "!=", ">", ">=", "<", "<=":
+		if returnBool {
+			return fmt.Sprintf("1 if %s is %s %s, otherwise 0", lhs, phrase, rhs)
+		}
+		return fmt.Sprintf("%s, keeping only values %s %s", lhs, phrase, rhs)
+	}
+	return fmt.Sprintf("(%s) %s (%s)", lhs, phrase, rhs)
+}
+
+// describePromQL describes a PromQL expression in plain language.
+func describePromQL(e parser.Expr) string {
+	switch n := e.(type) {
+	case *parser.ParenExpr:
+		return describePromQL(n.Expr)
+	case *parser.StepInvariantExpr:
+		return describePromQL(n.Expr)
+	case *parser.NumberLiteral:
+		return strconv.FormatFloat(n.Val, 'g', -1, 64)
+	case *parser.StringLiteral:
+		return strconv.Quote(n.Val)
+	case *parser.VectorSelector:
+		return describeVectorSelector(n)
+	case *parser.MatrixSelector:
+		return describePromQL(n.VectorSelector) + " over the last " + formatDuration(n.Range)
+	case *parser.SubqueryExpr:
+		step := "the default resolution"
+		if n.Step > 0 {
+			step = formatDuration(n.Step)
+		}
+		return fmt.Sprintf("%s, evaluated every %s over the last %s", describePromQL(n.Expr), step, formatDuration(n.Range))
+	case *parser.UnaryExpr:
+		return "the negation of " + describePromQL(n.Expr)
+	case *parser.AggregateExpr:
+		param := ""
+		if n.Param != nil {
+			param = describePromQL(n.Param)
+		}
+		return describeAggregation(n.Op.String(), param, describePromQL(n.Expr), n.Without, n.Grouping)
+	case *parser.BinaryExpr:
+		return describeBinary(n.Op.String(), describePromQL(n.LHS), describePromQL(n.RHS), n.ReturnBool)
+	case *parser.Call:
+		return describePromQLCall(n)
+	default:
+		return e.String()
+	}
+}
+
+func describeVectorSelector(vs *parser.VectorSelector) string {
+	name := selectorMetricName(vs)
+	out := "the series"
+	if name != "" {
+		out = "the series of " + name
+	}
+	var conds []string
+	for _, m := range vs.LabelMatchers {
+		if m.Name == labels.MetricName && m.Value == name && m.Type == labels.MatchEqual {
+			continue
+		}
+		conds = append(conds, describeMatcher(m.Name, m.Type.String(), m.Value))
+	}
+	if len(conds) > 0 {
+		out += " where " + strings.Join(conds, " and ")
+	}
+	if vs.OriginalOffset != 0 {
+		out += ", shifted back by " + formatDuration(vs.OriginalOffset)
+	}
+	return out
+}
+
+func describeMatcher(name, op, value string) string {
+	switch op {
+	case "=":
+		return fmt.Sprintf("%s is %q", name, value)
+	case "!=":
+		return fmt.Sprintf("%s is not %q", name, value)
+	case "=~":
+		return fmt.Sprintf("%s matches %q", name, value)
+	case "!~":
+		return fmt.Sprintf("%s does not match %q", name, value)
+	default:
+		return name + op + strconv.Quote(value)
+	}
+}
+
+func describePromQLCall(c *parser.Call) string {
+	name := c.Func.Name
+	switch name {
+	case "histogram_quantile":
+		if len(c.Args) == 2 {
+			return fmt.Sprintf("the %s quantile of the histogram %s", describePromQL(c.Args[0]), describePromQL(c.Args[1]))
+		}
+	case "time":
+		return "the current time"
+	}
+	if phrase, ok := promqlFunctionPhrases[name]; ok && len(c.Args) > 0 {
+		return fmt.Sprintf(phrase, describePromQL(c.Args[0]))
+	}
+	args := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = describePromQL(a)
+	}
+	return name + " of " + strings.Join(args, ", ")
+}
+
+// logqlRangePhrases describe LogQL range aggregations; %s is replaced by the log range.
+var logqlRangePhrases = map[string]string{
+	"rate":             "the per-second rate of %s",
+	"count_over_time":  "the number of %s",
+	"bytes_rate":       "the bytes per second of %s",
+	"bytes_over_time":  "the bytes of %s",
+	"absent_over_time": "whether there are no %s",
+	"rate_counter":     "the per-second rate of increase of %s",
+	"sum_over_time":    "the sum of %s",
+	"avg_over_time":    "the average of %s",
+	"max_over_time":    "the maximum of %s",
+	"min_over_time":    "the minimum of %s",
+	"stdvar_over_time": "the variance of %s",
+	"stddev_over_time": "the standard deviation of %s",
+	"first_over_time":  "the first value of %s",
+	"last_over_time":   "the last value of %s",
+}
+
+// describeLogQL describes a LogQL expression in plain language.
+func describeLogQL(e logql.Expr) string {
+	switch n := e.(type) {
+	case *logql.LogExpr:
+		return describeLogExpr(n)
+	case *logql.LiteralExpr:
+		return strconv.FormatFloat(n.Value, 'g', -1, 64)
+	case *logql.VectorExpr:
+		return "the constant " + strconv.FormatFloat(n.Value, 'g', -1, 64)
+	case *logql.RangeAggregationExpr:
+		inner := describeLogExpr(n.Range.Log)
+		if u := n.Range.Unwrap(); u != nil {
+			inner = "the " + u.Label + " values of " + inner
+		}
+		phrase := logqlRangePhrases[n.Op]
+		if n.Op == "quantile_over_time" && n.Param != nil {
+			phrase = "the " + strconv.FormatFloat(*n.Param, 'g', -1, 64) + " quantile of %s"
+		}
+		out := fmt.Sprintf(phrase, inner) + " over the last " + formatDuration(n.Range.Range)
+		if n.Range.Offset != 0 {
+			out += ", shifted back by " + formatDuration(n.Range.Offset)
+		}
+		if n.Grouping != nil {
+			out += describeGrouping(n.Grouping.Without, n.Grouping.Labels)
+		}
+		return out
+	case *logql.VectorAggregationExpr:
+		param := ""
+		if n.Param != nil {
+			param = strconv.FormatFloat(*n.Param, 'g', -1, 64)
+		}
+		var without bool
+		var grouping []string
+		if n.Grouping != nil {
+			without, grouping = n.Grouping.Without, n.Grouping.Labels
+		}
+		return describeAggregation(n.Op, param, describeLogQL(n.Expr), without, grouping)
+	case *logql.BinaryExpr:
+		return describeBinary(n.Op, describeLogQL(n.LHS), describeLogQL(n.RHS), n.ReturnBool)
+	case *logql.LabelReplaceExpr:
+		return describeLogQL(n.Expr) + " with the label " + n.Dst + " rewritten"
+	default:
+		return e.String()
+	}
+}
+
+func describeLogExpr(e *logql.LogExpr) string {
+	conds := make([]string, len(e.Matchers))
+	for i, m := range e.Matchers {
+		conds[i] = describeMatcher(m.Name, m.Op, m.Value)
+	}
+	out := "log lines of the streams where " + strings.Join(conds, " and ")
+	var stages []string
+	for _, s := range e.Pipeline {
+		if d := describeStage(s); d != "" {
+			stages = append(stages, d)
+		}
+	}
+	if len(stages) > 0 {
+		out += ", " + strings.Join(stages, ", ")
+	}
+	return out
+}
+
+func describeStage(s logql.Stage) string {
+	switch n := s.(type) {
+	case *logql.LineFilter:
+		values := make([]string, len(n.Values))
+		for i, v := range n.Values {
+			values[i] = strconv.Quote(v)
+		}
+		alternatives := strings.Join(values, " or ")
+		if n.IP {
+			alternatives = "an IP in " + alternatives
+		}
+		switch n.Op {
+		case "|=":
+			return "containing " + alternatives
+		case "!=":
+			return "not containing " + alternatives
+		case "|~":
+			return "matching " + alternatives
+		case "!~":
+			return "not matching " + alternatives
+		case "|>":
+			return "matching the pattern " + alternatives
+		default:
+			return "not matching the pattern " + alternatives
+		}
+	case *logql.ParserStage:
+		switch n.Parser {
+		case "json":
+			return "parsed as JSON"
+		case "logfmt":
+			return "parsed as logfmt"
+		case "unpack":
+			return "unpacked"
+		default:
+			return "parsed with the " + n.Parser + " " + strconv.Quote(n.Expression)
+		}
+	case *logql.LabelFilterStage:
+		return "where " + n.Filter.String()
+	case *logql.FormatStage:
+		switch n.Op {
+		case "line_format":
+			return "reformatted"
+		case "label_format":
+			return "with labels renamed or rewritten"
+		case "drop":
+			return "dropping labels"
+		case "keep":
+			return "keeping only some labels"
+		default:
+			return "with colors removed"
+		}
+	default:
+		// Unwrap stages are described by their range aggregation.
+		return ""
+	}
+}
@@ -0,0 +1,189 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEmbeddingsModel = "text-embedding-3-small"
+	// embeddingsBatchSize is the number of inputs sent in one embeddings request.
+	embeddingsBatchSize = 64
+	embeddingsTimeout   = time.Minute
+)
+
+// embeddingsSettings configures the OpenAI-compatible embeddings endpoint of the LLM
+// provider. The Grafana LLM app does not proxy embeddings, so the endpoint is configured
+// here; the API key is set through secureJsonData as embeddingsApiKey.
+type embeddingsSettings struct {
+	// URL is the base URL of the provider API, e.g. https://api.openai.com. Embeddings
+	// are disabled without it.
+	URL    string `json:"url"`
+	Model  string `json:"model"`
+	APIKey string `json:"-"`
+}
+
+// embeddingsProvider turns texts into vectors.
+type embeddingsProvider interface {
+	Embed(ctx context.Context, inputs []string) ([][]float32, error)
+}
+
+// openAIEmbeddings is an embeddingsProvider for the OpenAI /v1/embeddings API, which most
+// providers and local model servers implement.
+type openAIEmbeddings struct {
+	url        string
+	model      string
+	apiKey     string
+	httpClient *http.Client
+}
+
+// newEmbeddingsProvider returns the provider configured by s, sending requests with client,
+// or nil if none is configured.
+func newEmbeddingsProvider(s embeddingsSettings, client *http.Client) embeddingsProvider {
+	if s.URL == "" {
+		return nil
+	}
+	model := s.Model
+	if model == "" {
+		model = defaultEmbeddingsModel
+	}
+	return &openAIEmbeddings{
+		url:        strings.TrimSuffix(strings.TrimSuffix(s.URL, "/"), "/v1") + "/v1/embeddings",
+		model:      model,
+		apiKey:     s.APIKey,
+		httpClient: client,
+	}
+}
+
+func (p *openAIEmbeddings) Embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(inputs))
+	for start := 0; start < len(inputs); start += embeddingsBatchSize {
+		batch := inputs[start:min(start+embeddingsBatchSize, len(inputs))]
+		vs, err := p.embedBatch(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, vs...)
+	}
+	return vectors, nil
+}
+
+func (p *openAIEmbeddings) embedBatch(ctx context.Context, inputs []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]any{"model": p.model, "input": inputs})
+	if err != nil {
+		return nil, fmt.Errorf("embeddings: encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("embeddings: create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("embeddings: %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, fmt.Errorf("embeddings: read response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("embeddings: status %d: %s", resp.StatusCode, truncate(strings.TrimSpace(string(b)), 500))
+	}
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("embeddings: decode response: %w", err)
+	}
+	if len(out.Data) != len(inputs) {
+		return nil, fmt.Errorf("embeddings: got %d embeddings for %d inputs", len(out.Data), len(inputs))
+	}
+	vectors := make([][]float32, len(inputs))
+	for _, d := range out.Data {
+		if d.Index < 0 || d.Index >= len(inputs) {
+			return nil, fmt.Errorf("embeddings: invalid index %d", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return vectors, nil
+}
+
+var errEmbeddingsDisabled = errors.New("no embeddings endpoint is configured")
+
+// vector is a unit-length embedding. It is stored as base64 of its little-endian float32
+// values, which is about a quarter of the size of a JSON number array.
+type vector []float32
+
+// normalize returns v scaled to unit length, so cosine similarity is a dot product.
+func normalize(v []float32) vector {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	out := make(vector, len(v))
+	if sum == 0 {
+		return out
+	}
+	norm := float32(math.Sqrt(sum))
+	for i, x := range v {
+		out[i] = x / norm
+	}
+	return out
+}
+
+// dot returns the cosine similarity of two unit vectors, or 0 if their dimensions differ,
+// as they do after the embeddings model changes.
+func (v vector) dot(w vector) float64 {
+	if len(v) != len(w) {
+		return 0
+	}
+	var sum float32
+	for i := range v {
+		sum += v[i] * w[i]
+	}
+	return float64(sum)
+}
+
+func (v vector) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(x))
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(b))
+}
+
+func (v *vector) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b)%4 != 0 {
+		return errors.New("invalid vector length")
+	}
+	*v = make(vector, len(b)/4)
+	for i := range *v {
+		(*v)[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return nil
+}
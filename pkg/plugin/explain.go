@@ -0,0 +1,469 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/sre/assistant/pkg/plugin/logql"
+)
+
+const (
+	// explainMaxRange is the range window above which a query is flagged as expensive.
+	explainMaxRange = 24 * time.Hour
+	// explainHighCardinality is the number of label values above which a grouping label is flagged.
+	explainHighCardinality = 100
+	// explainScrapeInterval is the scrape interval assumed when estimating the samples a range selector reads.
+	explainScrapeInterval = 15 * time.Second
+	// explainStatsWindow is the time range Loki stats are requested for.
+	explainStatsWindow = time.Hour
+)
+
+// Cost levels, from the series or bytes a query reads per evaluation.
+const (
+	costLow    = "low"
+	costMedium = "medium"
+	costHigh   = "high"
+)
+
+// highCardinalityLabelHints are label names that usually have many values. They are used to
+// flag grouping labels whose values cannot be counted, such as labels extracted by LogQL parsers.
+var highCardinalityLabelHints = map[string]bool{
+	"pod": true, "container_id": true, "instance": true, "ip": true, "trace_id": true,
+	"traceID": true, "span_id": true, "request_id": true, "user_id": true, "session_id": true,
+	"url": true, "path": true, "uid": true, "id": true,
+}
+
+// queryBreakdown is the response of POST /query/explain.
+type queryBreakdown struct {
+	Language     string            `json:"language"`
+	Query        string            `json:"query"`
+	Selectors    []selectorInfo    `json:"selectors"`
+	Aggregations []aggregationInfo `json:"aggregations"`
+	Functions    []string          `json:"functions"`
+	Ranges       []string          `json:"ranges"`
+	Explanation  string            `json:"explanation"`
+	Cost         *costEstimate     `json:"cost,omitempty"`
+	Warnings     []queryWarning    `json:"warnings"`
+}
+
+// selectorInfo describes a series or stream selector of a query.
+type selectorInfo struct {
+	Selector string   `json:"selector"`
+	Metric   string   `json:"metric,omitempty"`
+	Matchers []string `json:"matchers"`
+	// Pipeline lists the LogQL pipeline stages applied to the stream selector.
+	Pipeline []string `json:"pipeline,omitempty"`
+	Range    string   `json:"range,omitempty"`
+	Offset   string   `json:"offset,omitempty"`
+	// Series is the number of series a PromQL selector currently matches.
+	Series *int `json:"series,omitempty"`
+	// Stats is the amount of data a LogQL stream selector matched over the last explainStatsWindow.
+	Stats *lokiStats `json:"stats,omitempty"`
+
+	rangeDuration time.Duration
+}
+
+// aggregationInfo describes an aggregation operator.
+type aggregationInfo struct {
+	Op      string   `json:"op"`
+	Param   string   `json:"param,omitempty"`
+	By      []string `json:"by,omitempty"`
+	Without []string `json:"without,omitempty"`
+}
+
+// costEstimate summarizes how much data a query reads per evaluation.
+type costEstimate struct {
+	// Series is the number of series (PromQL) or streams (LogQL) the selectors match.
+	Series int `json:"series"`
+	// Samples is the number of samples PromQL selectors read per evaluation.
+	Samples int64 `json:"samples,omitempty"`
+	// Bytes is the number of log bytes LogQL selectors matched over the last explainStatsWindow.
+	Bytes int64  `json:"bytes,omitempty"`
+	Level string `json:"level"`
+}
+
+// queryWarning is a potential performance problem of a query.
+type queryWarning struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// lokiStats is the result of the query_loki_stats tool.
+type lokiStats struct {
+	Streams int64 `json:"streams"`
+	Chunks  int64 `json:"chunks"`
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// seriesCount returns the number of series a selector currently matches.
+func (c *promCatalog) seriesCount(ctx context.Context, selector string) (int, error) {
+	samples, err := c.queryInstant(ctx, "count("+selector+")")
+	if err != nil || len(samples) == 0 {
+		return 0, err
+	}
+	return int(samples[0].Value), nil
+}
+
+// stats returns how much data a stream selector matched over the given window.
+func (c *lokiCatalog) stats(ctx context.Context, selector string, window time.Duration, now time.Time) (lokiStats, error) {
+	var s lokiStats
+	err := callToolJSON(ctx, c.mcp, "query_loki_stats", map[string]any{
+		"datasourceUid": c.datasourceUID,
+		"logql":         selector,
+		"startRfc3339":  now.Add(-window).Format(time.RFC3339),
+		"endRfc3339":    now.Format(time.RFC3339),
+	}, &s)
+	return s, err
+}
+
+// unboundedRegex reports whether a regex matches any value or starts with a wildcard,
+// which forces a scan of every label value or log line.
+func unboundedRegex(re string) bool {
+	return strings.HasPrefix(re, ".*") || strings.HasPrefix(re, ".+")
+}
+
+func formatDuration(d time.Duration) string { return model.Duration(d).String() }
+
+// sortedRanges formats a set of durations in ascending order.
+func sortedRanges(set map[time.Duration]bool) []string {
+	ds := make([]time.Duration, 0, len(set))
+	for d := range set {
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	out := make([]string, len(ds))
+	for i, d := range ds {
+		out[i] = formatDuration(d)
+	}
+	return out
+}
+
+// rangeWarnings flags range windows longer than explainMaxRange.
+func rangeWarnings(ranges map[time.Duration]bool) []queryWarning {
+	var warnings []queryWarning
+	for _, r := range sortedRanges(ranges) {
+		if d, _ := model.ParseDuration(r); time.Duration(d) > explainMaxRange {
+			warnings = append(warnings, queryWarning{Kind: "large_range", Message: fmt.Sprintf(
+				"range [%s] is longer than %s; consider a recording rule or a shorter window", r, formatDuration(explainMaxRange))})
+		}
+	}
+	return warnings
+}
+
+// explainPromQL builds the breakdown of a PromQL query. With a catalog, selectors are
+// annotated with series counts and grouping labels with their number of values.
+func explainPromQL(ctx context.Context, catalog *promCatalog, query string) (*queryBreakdown, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, invalidQuery("parse error: %s", err)
+	}
+	b := &queryBreakdown{Language: "promql", Query: expr.String(), Explanation: sentence(describePromQL(expr))}
+	functions, ranges := map[string]bool{}, map[time.Duration]bool{}
+	grouping := map[string]bool{}
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			sel := selectorInfo{Selector: n.String(), Metric: selectorMetricName(n)}
+			for _, m := range n.LabelMatchers {
+				if m.Name == labels.MetricName && sel.Metric != "" && m.Type == labels.MatchEqual {
+					continue
+				}
+				sel.Matchers = append(sel.Matchers, m.String())
+				if (m.Type == labels.MatchRegexp || m.Type == labels.MatchNotRegexp) && unboundedRegex(m.Value) {
+					b.Warnings = append(b.Warnings, queryWarning{Kind: "unbounded_regex", Message: fmt.Sprintf(
+						"matcher %s starts with a wildcard and has to be checked against every value of %s", m, m.Name)})
+				}
+			}
+			if n.OriginalOffset != 0 {
+				sel.Offset = formatDuration(n.OriginalOffset)
+			}
+			if len(path) > 0 {
+				if ms, ok := path[len(path)-1].(*parser.MatrixSelector); ok {
+					sel.Range, sel.rangeDuration = formatDuration(ms.Range), ms.Range
+					sel.Selector = ms.String()
+				}
+			}
+			b.Selectors = append(b.Selectors, sel)
+		case *parser.MatrixSelector:
+			ranges[n.Range] = true
+		case *parser.SubqueryExpr:
+			ranges[n.Range] = true
+		case *parser.Call:
+			functions[n.Func.Name] = true
+		case *parser.AggregateExpr:
+			agg := aggregationInfo{Op: n.Op.String()}
+			if n.Param != nil {
+				agg.Param = n.Param.String()
+			}
+			if n.Without {
+				agg.Without = n.Grouping
+			} else {
+				agg.By = n.Grouping
+				for _, l := range n.Grouping {
+					grouping[l] = true
+				}
+			}
+			b.Aggregations = append(b.Aggregations, agg)
+		}
+		return nil
+	})
+	b.Functions = sortedKeys(functions)
+	b.Ranges = sortedRanges(ranges)
+	b.Warnings = append(b.Warnings, rangeWarnings(ranges)...)
+
+	if catalog == nil {
+		b.Warnings = append(b.Warnings, groupingHintWarnings(sortedKeys(grouping))...)
+		return b, nil
+	}
+	cost := &costEstimate{}
+	for i := range b.Selectors {
+		sel := &b.Selectors[i]
+		matchers := sel.Matchers
+		if sel.Metric != "" {
+			matchers = append([]string{labels.MetricName + "=" + strconv.Quote(sel.Metric)}, matchers...)
+		}
+		n, err := catalog.seriesCount(ctx, "{"+strings.Join(matchers, ", ")+"}")
+		if err != nil {
+			return nil, err
+		}
+		sel.Series = &n
+		cost.Series += n
+		samples := int64(1)
+		if sel.rangeDuration > 0 {
+			samples = int64(max(sel.rangeDuration/explainScrapeInterval, 1))
+		}
+		cost.Samples += int64(n) * samples
+	}
+	cost.Level = costLevel(cost.Series > 10_000 || cost.Samples > 50_000_000, cost.Series > 1_000 || cost.Samples > 5_000_000)
+	b.Cost = cost
+	for _, l := range sortedKeys(grouping) {
+		values, err := catalog.labelValues(ctx, l, explainHighCardinality+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > explainHighCardinality {
+			b.Warnings = append(b.Warnings, highCardinalityWarning(l, fmt.Sprintf("more than %d values", explainHighCardinality)))
+		}
+	}
+	return b, nil
+}
+
+// explainLogQL builds the breakdown of a LogQL query. With a catalog, stream selectors
+// are annotated with Loki stats and grouping stream labels with their number of values.
+func explainLogQL(ctx context.Context, catalog *lokiCatalog, query string, now time.Time) (*queryBreakdown, error) {
+	expr, err := logql.ParseExpr(query)
+	if err != nil {
+		return nil, invalidQuery("%s", err)
+	}
+	b := &queryBreakdown{Language: "logql", Query: expr.String(), Explanation: sentence(describeLogQL(expr))}
+	functions, ranges := map[string]bool{}, map[time.Duration]bool{}
+	grouping := map[string]bool{}
+	addSelector := func(e *logql.LogExpr, r *logql.LogRange) {
+		sel := selectorInfo{Selector: (&logql.LogExpr{Matchers: e.Matchers}).String()}
+		for _, m := range e.Matchers {
+			sel.Matchers = append(sel.Matchers, m.String())
+			if (m.Op == "=~" || m.Op == "!~") && unboundedRegex(m.Value) {
+				b.Warnings = append(b.Warnings, queryWarning{Kind: "unbounded_regex", Message: fmt.Sprintf(
+					"matcher %s starts with a wildcard and has to be checked against every value of %s", m, m.Name)})
+			}
+		}
+		for _, s := range e.Pipeline {
+			sel.Pipeline = append(sel.Pipeline, s.String())
+			if f, ok := s.(*logql.LineFilter); ok && (f.Op == "|~" || f.Op == "!~") {
+				for _, v := range f.Values {
+					if unboundedRegex(v) {
+						b.Warnings = append(b.Warnings, queryWarning{Kind: "unbounded_regex", Message: fmt.Sprintf(
+							"line filter %q starts with a wildcard; line filters are unanchored, so drop the leading %s", v, v[:2])})
+					}
+				}
+			}
+		}
+		if r != nil {
+			sel.Range, sel.rangeDuration = formatDuration(r.Range), r.Range
+			if r.Offset != 0 {
+				sel.Offset = formatDuration(r.Offset)
+			}
+		}
+		b.Selectors = append(b.Selectors, sel)
+	}
+	addGrouping := func(op string, param *float64, g *logql.Grouping) {
+		agg := aggregationInfo{Op: op}
+		if param != nil {
+			agg.Param = strconv.FormatFloat(*param, 'g', -1, 64)
+		}
+		if g != nil && g.Without {
+			agg.Without = g.Labels
+		} else if g != nil {
+			agg.By = g.Labels
+			for _, l := range g.Labels {
+				grouping[l] = true
+			}
+		}
+		b.Aggregations = append(b.Aggregations, agg)
+	}
+	logql.Inspect(expr, func(node logql.Node) bool {
+		switch n := node.(type) {
+		case *logql.LogExpr:
+			addSelector(n, nil)
+			return false
+		case *logql.LogRange:
+			ranges[n.Range] = true
+			addSelector(n.Log, n)
+			return false
+		case *logql.RangeAggregationExpr:
+			functions[n.Op] = true
+			if n.Grouping != nil {
+				addGrouping(n.Op, n.Param, n.Grouping)
+			}
+		case *logql.VectorAggregationExpr:
+			addGrouping(n.Op, n.Param, n.Grouping)
+		case *logql.LabelReplaceExpr:
+			functions["label_replace"] = true
+		case *logql.VectorExpr:
+			functions["vector"] = true
+		}
+		return true
+	})
+	b.Functions = sortedKeys(functions)
+	b.Ranges = sortedRanges(ranges)
+	b.Warnings = append(b.Warnings, rangeWarnings(ranges)...)
+
+	if catalog == nil {
+		b.Warnings = append(b.Warnings, groupingHintWarnings(sortedKeys(grouping))...)
+		return b, nil
+	}
+	cost := &costEstimate{}
+	for i := range b.Selectors {
+		sel := &b.Selectors[i]
+		s, err := catalog.stats(ctx, sel.Selector, explainStatsWindow, now)
+		if err != nil {
+			return nil, err
+		}
+		sel.Stats = &s
+		cost.Series += int(s.Streams)
+		cost.Bytes += s.Bytes
+	}
+	cost.Level = costLevel(cost.Bytes > 10<<30, cost.Bytes > 1<<30)
+	b.Cost = cost
+	var extracted []string
+	for _, l := range sortedKeys(grouping) {
+		ok, err := catalog.labelExists(ctx, l)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			extracted = append(extracted, l)
+			continue
+		}
+		values, err := catalog.labelValues(ctx, l)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) > explainHighCardinality {
+			b.Warnings = append(b.Warnings, highCardinalityWarning(l, fmt.Sprintf("%d values", len(values))))
+		}
+	}
+	// Labels extracted by parsers are not indexed, so their values cannot be counted.
+	b.Warnings = append(b.Warnings, groupingHintWarnings(extracted)...)
+	return b, nil
+}
+
+func costLevel(high, medium bool) string {
+	switch {
+	case high:
+		return costHigh
+	case medium:
+		return costMedium
+	default:
+		return costLow
+	}
+}
+
+func highCardinalityWarning(label, detail string) queryWarning {
+	return queryWarning{Kind: "high_cardinality_grouping", Message: fmt.Sprintf(
+		"grouping by %s (%s) produces many output series", label, detail)}
+}
+
+// groupingHintWarnings flags grouping labels that are usually high-cardinality.
+func groupingHintWarnings(grouping []string) []queryWarning {
+	var warnings []queryWarning
+	for _, l := range grouping {
+		if highCardinalityLabelHints[l] {
+			warnings = append(warnings, highCardinalityWarning(l, "usually has many values"))
+		}
+	}
+	return warnings
+}
+
+// explainRequest is the body of POST /query/explain.
+type explainRequest struct {
+	Query string `json:"query"`
+	// Language is "promql" or "logql".
+	Language string `json:"language"`
+	// DatasourceUID optionally enables series counts and cost estimates.
+	DatasourceUID string `json:"datasourceUid"`
+}
+
+// handleQueryExplain returns a structured breakdown, a plain-language explanation and
+// a cost estimate of a PromQL or LogQL query.
+func (a *App) handleQueryExplain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body explainRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(body.Query) == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	var b *queryBreakdown
+	var err error
+	switch body.Language {
+	case "promql":
+		var catalog *promCatalog
+		if body.DatasourceUID != "" {
+			catalog = newPromCatalog(a.mcp, body.DatasourceUID)
+		}
+		b, err = explainPromQL(ctx, catalog, body.Query)
+	case "logql":
+		var catalog *lokiCatalog
+		if body.DatasourceUID != "" {
+			catalog = newLokiCatalog(a.mcp, body.DatasourceUID)
+		}
+		b, err = explainLogQL(ctx, catalog, body.Query, time.Now())
+	default:
+		http.Error(w, `language must be "promql" or "logql"`, http.StatusBadRequest)
+		return
+	}
+	var invalid *invalidQueryError
+	if errors.As(err, &invalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	if b.Warnings == nil {
+		b.Warnings = []queryWarning{}
+	}
+	writeJSON(w, http.StatusOK, b)
+}
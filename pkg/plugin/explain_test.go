@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDescribePromQL(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		exp   string
+	}{
+		{
+			query: `sum by (code) (rate(http_requests_total{service="checkout"}[5m]))`,
+			exp:   `The sum of the per-second rate of increase of the series of http_requests_total where service is "checkout" over the last 5m, per code.`,
+		},
+		{
+			query: `histogram_quantile(0.99, sum by (le) (rate(http_request_duration_seconds_bucket[5m])))`,
+			exp:   `The 0.99 quantile of the histogram the sum of the per-second rate of increase of the series of http_request_duration_seconds_bucket over the last 5m, per le.`,
+		},
+		{
+			query: `up == bool 0`,
+			exp:   `1 if the series of up is equal to 0, otherwise 0.`,
+		},
+		{
+			query: `topk(3, max_over_time(rate(x[1m])[1h:5m]))`,
+			exp:   `The 3 largest series of the maximum of the per-second rate of increase of the series of x over the last 1m, evaluated every 5m over the last 1h.`,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			b, err := explainPromQL(t.Context(), nil, tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.Explanation != tc.exp {
+				t.Fatalf("expected %q, got %q", tc.exp, b.Explanation)
+			}
+		})
+	}
+}
+
+func TestDescribeLogQL(t *testing.T) {
+	b, err := explainLogQL(t.Context(), nil, `sum by (level) (count_over_time({app="checkout"} |= "error" | json [5m]))`, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := `The sum of the number of log lines of the streams where app is "checkout", containing "error", parsed as JSON over the last 5m, per level.`
+	if b.Explanation != exp {
+		t.Fatalf("expected %q, got %q", exp, b.Explanation)
+	}
+}
+
+func TestQueryExplainPromQL(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	mcp := newFakePrometheusMCP(map[string][]string{"http_requests_total": {"service", "pod"}})
+	mcp.tools["query_prometheus"] = func(args map[string]any) (any, error) {
+		count := "20"
+		if strings.Contains(args["expr"].(string), `pod=~".*-canary"`) {
+			count = "2"
+		}
+		return []map[string]any{{"metric": map[string]string{}, "value": []any{1700000000, count}}}, nil
+	}
+	mcp.tools["list_prometheus_label_values"] = func(args map[string]any) (any, error) {
+		values := []string{"a", "b"}
+		if args["labelName"] == "pod" {
+			values = make([]string, explainHighCardinality+1)
+		}
+		return values, nil
+	}
+	app.mcp = mcp
+
+	resp := callResource(t, app, http.MethodPost, "query/explain", map[string]any{
+		"language":      "promql",
+		"datasourceUid": "prom",
+		"query":         `sum by (pod) (rate(http_requests_total{pod=~".*-canary"}[2d])) / sum by (pod) (rate(http_requests_total[5m]))`,
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", resp.Status, resp.Body)
+	}
+	var out queryBreakdown
+	if err := json.Unmarshal(resp.Body, &out); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if len(out.Selectors) != 2 || out.Selectors[0].Metric != "http_requests_total" || out.Selectors[0].Range != "2d" || *out.Selectors[0].Series != 2 {
+		t.Errorf("unexpected selectors %+v", out.Selectors)
+	}
+	if len(out.Aggregations) != 2 || out.Aggregations[0].Op != "sum" || out.Aggregations[0].By[0] != "pod" {
+		t.Errorf("unexpected aggregations %+v", out.Aggregations)
+	}
+	if strings.Join(out.Functions, ",") != "rate" || strings.Join(out.Ranges, ",") != "5m,2d" {
+		t.Errorf("unexpected functions %v or ranges %v", out.Functions, out.Ranges)
+	}
+	// 2 series over 2d at a 15s scrape interval, plus 20 series over 5m.
+	if out.Cost == nil || out.Cost.Series != 22 || out.Cost.Samples != 2*11520+20*20 || out.Cost.Level != costLow {
+		t.Errorf("unexpected cost %+v", out.Cost)
+	}
+	var kinds []string
+	for _, w := range out.Warnings {
+		kinds = append(kinds, w.Kind)
+	}
+	if strings.Join(kinds, ",") != "unbounded_regex,large_range,high_cardinality_grouping" {
+		t.Errorf("unexpected warnings %+v", out.Warnings)
+	}
+}
+
+func TestQueryExplainLogQL(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	mcp := newFakeLokiMCP(map[string][]string{"app": {"checkout"}})
+	mcp.tools["query_loki_stats"] = func(args map[string]any) (any, error) {
+		if args["logql"] != `{app="checkout"}` {
+			t.Errorf("stats should be requested for the stream selector, got %v", args["logql"])
+		}
+		return lokiStats{Streams: 4, Chunks: 10, Entries: 1000, Bytes: 2 << 30}, nil
+	}
+	app.mcp = mcp
+
+	resp := callResource(t, app, http.MethodPost, "query/explain", map[string]any{
+		"language":      "logql",
+		"datasourceUid": "loki",
+		"query":         `sum by (user_id) (count_over_time({app="checkout"} |~ ".*error" | logfmt [5m]))`,
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", resp.Status, resp.Body)
+	}
+	var out queryBreakdown
+	if err := json.Unmarshal(resp.Body, &out); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if len(out.Selectors) != 1 || out.Selectors[0].Stats.Streams != 4 || strings.Join(out.Selectors[0].Pipeline, ";") != `|~ ".*error";| logfmt` {
+		t.Errorf("unexpected selectors %+v", out.Selectors)
+	}
+	if out.Cost == nil || out.Cost.Bytes != 2<<30 || out.Cost.Level != costMedium {
+		t.Errorf("unexpected cost %+v", out.Cost)
+	}
+	if len(out.Warnings) != 2 || out.Warnings[0].Kind != "unbounded_regex" || !strings.Contains(out.Warnings[1].Message, "user_id") {
+		t.Errorf("unexpected warnings %+v", out.Warnings)
+	}
+}
+
+func TestQueryExplainRejectsInvalidQueries(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	for _, body := range []map[string]any{
+		{"language": "promql", "query": "sum("},
+		{"language": "logql", "query": `{app=""}`},
+		{"language": "sql", "query": "select 1"},
+		{"language": "promql"},
+	} {
+		if resp := callResource(t, app, http.MethodPost, "query/explain", body); resp.Status != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d %s", body, resp.Status, resp.Body)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// grafanaRequestTimeout bounds every call the plugin makes to the Grafana HTTP API.
+const grafanaRequestTimeout = 30 * time.Second
+
+// grafanaAPIError is returned when the Grafana HTTP API responds with a non-2xx status.
+type grafanaAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *grafanaAPIError) Error() string {
+	return fmt.Sprintf("grafana api: status %d: %s", e.StatusCode, e.Message)
+}
+
+// grafanaClient talks to the Grafana HTTP API using the service account token
+// shared with the plugin.
+type grafanaClient struct {
+	baseURL  string
+	token    string
+	outbound *outboundClients
+}
+
+// newGrafanaClient creates a new *grafanaClient for the Grafana instance at baseURL.
+func newGrafanaClient(baseURL, token string, outbound *outboundClients) *grafanaClient {
+	return &grafanaClient{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		token:    token,
+		outbound: outbound,
+	}
+}
+
+// httpClient returns the client for a Grafana API path. The LLM and MCP endpoints of the
+// LLM app are dependencies of their own, with their own circuit breakers.
+func (c *grafanaClient) httpClient(path string) *http.Client {
+	switch {
+	case strings.HasPrefix(path, llmAppLLMPath):
+		return c.outbound.client(dependencyLLM)
+	case strings.HasPrefix(path, mcpServerPath):
+		return c.outbound.client(dependencyMCP)
+	}
+	return c.outbound.client(dependencyGrafana)
+}
+
+// newRequest creates an authenticated request for a Grafana API path. A non-nil
+// body is sent as JSON.
+func (c *grafanaClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends a request to the Grafana API. If body is not nil it is encoded as JSON,
+// and if out is not nil the response body is decoded into it.
+func (c *grafanaClient) do(ctx context.Context, method, path string, body, out any) error {
+	return c.doWithHeader(ctx, method, path, nil, body, out)
+}
+
+// doWithHeader is like do but also sets the given request headers.
+func (c *grafanaClient) doWithHeader(ctx context.Context, method, path string, header http.Header, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal request body: %w", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := c.newRequest(ctx, method, path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	resp, err := c.httpClient(path).Do(req)
+	if err != nil {
+		return fmt.Errorf("make request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read response body: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &grafanaAPIError{StatusCode: resp.StatusCode, Message: apiErrorMessage(respBody)}
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("unmarshal response: %w", err)
+	}
+	return nil
+}
+
+// apiErrorMessage extracts the "message" field Grafana uses for API errors,
+// falling back to the raw body.
+func apiErrorMessage(body []byte) string {
+	var msg struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &msg); err == nil && msg.Message != "" {
+		return msg.Message
+	}
+	return strings.TrimSpace(string(body))
+}
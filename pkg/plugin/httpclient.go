@@ -0,0 +1,630 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	sdkslo "github.com/grafana/grafana-plugin-sdk-go/experimental/slo"
+)
+
+// Outbound dependencies. Each one gets its own HTTP client and circuit breaker, so that an
+// outage of one does not fail or slow down calls to the others. Webhooks target unrelated
+// services and get a circuit breaker per host.
+const (
+	dependencyGrafana    = "grafana"
+	dependencyLLM        = "llm"
+	dependencyMCP        = "mcp"
+	dependencyEmbeddings = "embeddings"
+	dependencyWebhooks   = "webhooks"
+)
+
+const (
+	// maxRetryDelay caps the delay before a retry, including delays asked for with
+	// Retry-After. Responses asking for longer are returned as they are.
+	maxRetryDelay = 10 * time.Second
+	// retryDrainLimit bounds what is read from a response discarded for a retry, so that
+	// its connection can be reused.
+	retryDrainLimit = 64 << 10
+	// maxHostBreakers bounds the per-host circuit breakers of a dependency. Closed breakers
+	// are dropped once it is reached.
+	maxHostBreakers = 100
+)
+
+// dependencyClientSettings configures the HTTP client of a dependency.
+type dependencyClientSettings struct {
+	// Timeout bounds a request including its retries. An empty Timeout leaves it to the
+	// context of the request.
+	Timeout string `json:"timeout"`
+	// Retries is how often idempotent requests are retried after a network error or a 429,
+	// 502, 503 or 504 response. Each delay is drawn at random up to RetryBackoff, doubled
+	// on every retry.
+	Retries      int    `json:"retries"`
+	RetryBackoff string `json:"retryBackoff"`
+	// BreakerFailures consecutive failures open the circuit breaker of the dependency,
+	// which then fails requests right away for BreakerCooldown before letting one through
+	// to probe it. A zero BreakerFailures disables the breaker.
+	BreakerFailures int    `json:"breakerFailures"`
+	BreakerCooldown string `json:"breakerCooldown"`
+}
+
+// httpSettings configures the HTTP clients of the outbound dependencies. The LLM and MCP
+// are reached through the LLM app in Grafana, but are separate dependencies.
+type httpSettings struct {
+	Grafana    dependencyClientSettings `json:"grafana"`
+	LLM        dependencyClientSettings `json:"llm"`
+	MCP        dependencyClientSettings `json:"mcp"`
+	Embeddings dependencyClientSettings `json:"embeddings"`
+	// Webhooks are the targets of remediation actions, whose timeouts are set per action.
+	Webhooks dependencyClientSettings `json:"webhooks"`
+}
+
+// defaultHTTPSettings keep the request timeouts the clients had before they were
+// configurable.
+var defaultHTTPSettings = httpSettings{
+	Grafana:    dependencyClientSettings{Timeout: grafanaRequestTimeout.String(), Retries: 2, RetryBackoff: "200ms", BreakerFailures: 5, BreakerCooldown: "30s"},
+	LLM:        dependencyClientSettings{Timeout: grafanaRequestTimeout.String(), Retries: 2, RetryBackoff: "500ms", BreakerFailures: 5, BreakerCooldown: "30s"},
+	MCP:        dependencyClientSettings{Timeout: grafanaRequestTimeout.String(), Retries: 2, RetryBackoff: "200ms", BreakerFailures: 5, BreakerCooldown: "30s"},
+	Embeddings: dependencyClientSettings{Timeout: embeddingsTimeout.String(), Retries: 2, RetryBackoff: "500ms", BreakerFailures: 5, BreakerCooldown: "30s"},
+	Webhooks:   dependencyClientSettings{Retries: 2, RetryBackoff: "500ms", BreakerFailures: 5, BreakerCooldown: "1m"},
+}
+
+func (s httpSettings) byDependency() map[string]dependencyClientSettings {
+	return map[string]dependencyClientSettings{
+		dependencyGrafana:    s.Grafana,
+		dependencyLLM:        s.LLM,
+		dependencyMCP:        s.MCP,
+		dependencyEmbeddings: s.Embeddings,
+		dependencyWebhooks:   s.Webhooks,
+	}
+}
+
+// parseSettingDuration parses an optional duration setting, which is zero when empty.
+func parseSettingDuration(name, v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+// outboundClients holds the HTTP client and the circuit breakers of every dependency.
+type outboundClients struct {
+	clients  map[string]*http.Client
+	breakers map[string]*circuitBreakers
+	// webhooks guards the connections of the webhooks client.
+	webhooks *addressGuard
+}
+
+// newOutboundClients builds the clients of org with the SDK httpclient. Requests are traced,
+// retried if idempotent, guarded by the breaker of their dependency and, innermost, timed by
+// the SDK SLO middleware, so that every attempt counts as time spent downstream. Breakers
+// report their transitions to logger. Webhooks only connect to the addresses webhooks allows.
+func newOutboundClients(s httpSettings, orgID int64, logger func(context.Context) log.Logger, webhooks *addressGuard) (*outboundClients, error) {
+	o := &outboundClients{clients: map[string]*http.Client{}, breakers: map[string]*circuitBreakers{}, webhooks: webhooks}
+	for dep, ds := range s.byDependency() {
+		timeout, err := parseSettingDuration(dep+" timeout", ds.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		backoff, err := parseSettingDuration(dep+" retryBackoff", ds.RetryBackoff)
+		if err != nil {
+			return nil, err
+		}
+		cooldown, err := parseSettingDuration(dep+" breakerCooldown", ds.BreakerCooldown)
+		if err != nil {
+			return nil, err
+		}
+		timeouts := httpclient.DefaultTimeoutOptions
+		timeouts.Timeout = timeout
+		var configureTransport httpclient.ConfigureTransportFunc
+		if dep == dependencyWebhooks {
+			configureTransport = func(_ httpclient.Options, t *http.Transport) {
+				// No proxy: the checked address must be the one connected to.
+				t.Proxy = nil
+				t.DialContext = webhooks.dialContext(&net.Dialer{Timeout: timeouts.DialTimeout, KeepAlive: timeouts.KeepAlive})
+			}
+		}
+		b := &circuitBreakers{
+			dependency: dep,
+			perHost:    dep == dependencyWebhooks,
+			orgID:      strconv.FormatInt(orgID, 10),
+			threshold:  ds.BreakerFailures,
+			cooldown:   cooldown,
+			logger:     logger,
+			byHost:     map[string]*circuitBreaker{},
+		}
+		if !b.perHost {
+			b.get("")
+		}
+		client, err := httpclient.New(httpclient.Options{
+			Timeouts:           &timeouts,
+			ConfigureTransport: configureTransport,
+			Middlewares: []httpclient.Middleware{
+				httpclient.TracingMiddleware(nil),
+				retryMiddleware(dep, ds.Retries, backoff),
+				b.middleware(),
+				sdkslo.Middleware(),
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create %s http client: %w", dep, err)
+		}
+		o.clients[dep], o.breakers[dep] = client, b
+	}
+	return o, nil
+}
+
+// client returns the HTTP client of dependency.
+func (o *outboundClients) client(dependency string) *http.Client {
+	return o.clients[dependency]
+}
+
+// breakerStates returns the state of every circuit breaker by name: the dependency, followed
+// by the host for per-host breakers.
+func (o *outboundClients) breakerStates() map[string]breakerState {
+	if o == nil {
+		return nil
+	}
+	states := map[string]breakerState{}
+	for _, bs := range o.breakers {
+		bs.mu.Lock()
+		for _, b := range bs.byHost {
+			states[b.name()] = b.currentState()
+		}
+		bs.mu.Unlock()
+	}
+	return states
+}
+
+// openBreakers returns the names of the open circuit breakers, sorted: those of whole
+// dependencies, and those of single hosts of dependencies with a breaker per host.
+func (o *outboundClients) openBreakers() (dependencies, hosts []string) {
+	if o == nil {
+		return nil, nil
+	}
+	for _, bs := range o.breakers {
+		bs.mu.Lock()
+		for _, b := range bs.byHost {
+			switch {
+			case b.currentState() != breakerOpen:
+			case bs.perHost:
+				hosts = append(hosts, b.name())
+			default:
+				dependencies = append(dependencies, b.name())
+			}
+		}
+		bs.mu.Unlock()
+	}
+	sort.Strings(dependencies)
+	sort.Strings(hosts)
+	return dependencies, hosts
+}
+
+// blockedAddressPrefixes are never reached by HTTP checks and webhooks, whatever their
+// allowlist says: loopback, link-local, which includes the cloud metadata endpoint
+// 169.254.169.254, unspecified and multicast addresses, and the other well-known metadata
+// endpoints.
+var blockedAddressPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("100.100.100.200/32"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+	netip.MustParsePrefix("fd00:ec2::254/128"),
+}
+
+// addressGuard restricts the connections of a client whose targets users control to
+// allowlisted hosts, never reaching the blocked addresses. Addresses are checked when
+// connecting, after DNS resolution, so names resolving to blocked addresses and redirects
+// are caught too.
+type addressGuard struct {
+	// what names the requests guarded in errors, e.g. "HTTP check".
+	what     string
+	hosts    []string
+	prefixes []netip.Prefix
+	blocked  []netip.Prefix
+}
+
+// newAddressGuard parses allowlist: host names, "*.example.com" for the subdomains of a
+// domain, or CIDRs such as "10.0.0.0/8". Nothing is allowed while it is empty.
+func newAddressGuard(what string, allowlist []string) (*addressGuard, error) {
+	g := &addressGuard{what: what, blocked: blockedAddressPrefixes}
+	for _, entry := range allowlist {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s allowlist entry %q: %w", what, entry, err)
+			}
+			g.prefixes = append(g.prefixes, prefix.Masked())
+			continue
+		}
+		if entry == "" || entry == "*." || strings.ContainsAny(entry, ":@ ") {
+			return nil, fmt.Errorf("invalid %s allowlist entry %q", what, entry)
+		}
+		g.hosts = append(g.hosts, entry)
+	}
+	return g, nil
+}
+
+// enabled reports whether anything is allowlisted.
+func (g *addressGuard) enabled() bool {
+	return len(g.hosts) > 0 || len(g.prefixes) > 0
+}
+
+// hostAllowed reports whether host is allowlisted by name.
+func (g *addressGuard) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range g.hosts {
+		if h == host || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddr returns an error unless a request to host may connect to addr.
+func (g *addressGuard) checkAddr(host string, addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, p := range g.blocked {
+		if p.Contains(addr) {
+			return fmt.Errorf("address %s of %s is blocked for %ss", addr, host, g.what)
+		}
+	}
+	if g.hostAllowed(host) {
+		return nil
+	}
+	for _, p := range g.prefixes {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in the %s allowlist", host, g.what)
+}
+
+// dialContext returns a DialContext function for transports that dials with dialer, checking
+// every address connected to.
+func (g *addressGuard) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		d := *dialer
+		d.Control = func(_, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return g.checkAddr(host, ap.Addr())
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// idempotentMethods are the methods whose requests may be sent more than once.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+type idempotentKey struct{}
+
+// withIdempotent marks the requests made with ctx as safe to retry whatever their method,
+// e.g. JSON-RPC calls of read-only MCP tools.
+func withIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// retryable reports whether req may be retried: it must be idempotent, by its method, an
+// Idempotency-Key header or its context, and its body must be replayable.
+func retryable(req *http.Request) bool {
+	marked, _ := req.Context().Value(idempotentKey{}).(bool)
+	if !idempotentMethods[req.Method] && !marked && req.Header.Get("Idempotency-Key") == "" && req.Header.Get("X-Idempotency-Key") == "" {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// shouldRetry reports whether an attempt failed in a way another attempt may not.
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		var open *circuitOpenError
+		return ctx.Err() == nil && !errors.As(err, &open)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns the delay before retry number attempt+1: at random up to backoff
+// doubled attempt times, or what the response asked for with Retry-After if longer.
+func retryDelay(backoff time.Duration, attempt int, resp *http.Response) time.Duration {
+	ceiling := min(backoff<<attempt, maxRetryDelay)
+	var delay time.Duration
+	if ceiling > 0 {
+		delay = rand.N(ceiling) + 1
+	}
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			delay = max(delay, time.Duration(s)*time.Second)
+		}
+	}
+	return delay
+}
+
+// retryMiddleware retries failed idempotent requests up to retries times.
+func retryMiddleware(dependency string, retries int, backoff time.Duration) httpclient.Middleware {
+	return httpclient.NamedMiddlewareFunc("retry", func(_ httpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if retries <= 0 || !retryable(req) {
+				return next.RoundTrip(req)
+			}
+			ctx := req.Context()
+			attemptReq := req
+			for attempt := 0; ; attempt++ {
+				resp, err := next.RoundTrip(attemptReq)
+				if attempt == retries || !shouldRetry(ctx, resp, err) {
+					return resp, err
+				}
+				delay := retryDelay(backoff, attempt, resp)
+				if delay > maxRetryDelay {
+					return resp, err
+				}
+				if resp != nil {
+					_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, retryDrainLimit))
+					resp.Body.Close()
+				}
+				outboundRetries.WithLabelValues(dependency).Inc()
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				case <-timer.C:
+				}
+				attemptReq = req.Clone(ctx)
+				if req.GetBody != nil {
+					if attemptReq.Body, err = req.GetBody(); err != nil {
+						return nil, err
+					}
+				}
+			}
+		})
+	})
+}
+
+// breakerState is the state of a circuitBreaker. The values are those of the state metric.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// circuitBreakers are the circuit breakers of a dependency: a single one, or one per host if
+// perHost is set, created on first use. There are none if threshold is not positive. At
+// most maxHostBreakers are kept, dropping closed ones first and then the least recently used.
+type circuitBreakers struct {
+	dependency string
+	perHost    bool
+	orgID      string
+	threshold  int
+	cooldown   time.Duration
+	logger     func(context.Context) log.Logger
+
+	mu     sync.Mutex
+	byHost map[string]*circuitBreaker
+}
+
+// get returns the breaker guarding requests to host, or nil if breakers are disabled.
+func (bs *circuitBreakers) get(host string) *circuitBreaker {
+	if bs.threshold <= 0 {
+		return nil
+	}
+	if !bs.perHost {
+		host = ""
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	now := time.Now()
+	if b, ok := bs.byHost[host]; ok {
+		b.usedAt = now
+		return b
+	}
+	if len(bs.byHost) >= maxHostBreakers {
+		bs.pruneLocked()
+	}
+	b := &circuitBreaker{dependency: bs.dependency, host: host, orgID: bs.orgID, threshold: bs.threshold, cooldown: bs.cooldown, logger: bs.logger, usedAt: now}
+	circuitBreakerState.WithLabelValues(b.orgID, b.dependency, b.host).Set(float64(breakerClosed))
+	bs.byHost[host] = b
+	return b
+}
+
+// pruneLocked drops the closed breakers that are not probing or, if every breaker is
+// open or probing, the least recently used one. Requests holding a dropped breaker keep
+// using it, which only delays the next breaker opening or forgets an outage early.
+func (bs *circuitBreakers) pruneLocked() {
+	var oldest *circuitBreaker
+	for host, b := range bs.byHost {
+		b.mu.Lock()
+		idle := b.state == breakerClosed && !b.probing
+		b.mu.Unlock()
+		if idle {
+			bs.dropLocked(host, b)
+		} else if oldest == nil || b.usedAt.Before(oldest.usedAt) {
+			oldest = b
+		}
+	}
+	if len(bs.byHost) >= maxHostBreakers && oldest != nil {
+		bs.dropLocked(oldest.host, oldest)
+	}
+}
+
+// dropLocked removes the breaker of host and its state metric.
+func (bs *circuitBreakers) dropLocked(host string, b *circuitBreaker) {
+	delete(bs.byHost, host)
+	circuitBreakerState.DeleteLabelValues(b.orgID, b.dependency, b.host)
+}
+
+// middleware fails requests while the breaker of their host is open and records the
+// outcome of the others. Network errors and 5xx responses are failures.
+func (bs *circuitBreakers) middleware() httpclient.Middleware {
+	return httpclient.NamedMiddlewareFunc("circuit-breaker", func(_ httpclient.Options, next http.RoundTripper) http.RoundTripper {
+		if bs.threshold <= 0 {
+			return next
+		}
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			ctx := req.Context()
+			b := bs.get(req.URL.Host)
+			if err := b.allow(ctx, time.Now()); err != nil {
+				circuitBreakerRejections.WithLabelValues(b.orgID, b.dependency, b.host).Inc()
+				return nil, err
+			}
+			resp, err := next.RoundTrip(req)
+			failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+			b.done(ctx, time.Now(), failed, err != nil && ctx.Err() != nil)
+			return resp, err
+		})
+	})
+}
+
+// circuitOpenError fails requests to a dependency while its circuit breaker is open.
+type circuitOpenError struct {
+	dependency string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%s is unavailable: circuit breaker open, retry in %s", e.dependency, e.retryAfter.Round(time.Second))
+}
+
+// circuitBreaker opens after threshold consecutive failures of a dependency. Once open, it
+// fails requests for cooldown and then lets a single request through: its success closes
+// the breaker and its failure opens it again.
+type circuitBreaker struct {
+	dependency string
+	// host is empty unless the dependency has a breaker per host. usedAt, guarded by the
+	// mutex of the circuitBreakers holding the breaker, is when it was last used.
+	host      string
+	usedAt    time.Time
+	orgID     string
+	threshold int
+	cooldown  time.Duration
+	logger    func(context.Context) log.Logger
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// name identifies the breaker in health checks and errors.
+func (b *circuitBreaker) name() string {
+	if b.host == "" {
+		return b.dependency
+	}
+	return b.dependency + "/" + b.host
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow returns an error if a request must fail without being sent.
+func (b *circuitBreaker) allow(ctx context.Context, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.cooldown - now.Sub(b.openedAt); wait > 0 {
+			return &circuitOpenError{dependency: b.name(), retryAfter: wait}
+		}
+		b.setState(ctx, breakerHalfOpen)
+	case breakerHalfOpen:
+		if b.probing {
+			return &circuitOpenError{dependency: b.name(), retryAfter: b.cooldown}
+		}
+	default:
+		return nil
+	}
+	b.probing = true
+	return nil
+}
+
+// done records the outcome of a request let through. Requests cancelled by their caller
+// say nothing about the dependency and are not counted.
+func (b *circuitBreaker) done(ctx context.Context, now time.Time, failed, cancelled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	switch {
+	case cancelled:
+	case !failed:
+		b.failures = 0
+		b.setState(ctx, breakerClosed)
+	default:
+		b.failures++
+		if b.state == breakerHalfOpen || b.state == breakerClosed && b.failures >= b.threshold {
+			b.openedAt = now
+			b.setState(ctx, breakerOpen)
+		}
+	}
+}
+
+// setState changes the state, which b.mu must guard, and reports the transition.
+func (b *circuitBreaker) setState(ctx context.Context, s breakerState) {
+	if b.state == s {
+		return
+	}
+	b.state = s
+	circuitBreakerTransitions.WithLabelValues(b.orgID, b.dependency, b.host, s.String()).Inc()
+	circuitBreakerState.WithLabelValues(b.orgID, b.dependency, b.host).Set(float64(s))
+	switch s {
+	case breakerOpen:
+		b.logger(ctx).Warn("Circuit breaker open", "dependency", b.dependency, "host", b.host, "failures", b.failures, "cooldown", b.cooldown)
+	case breakerClosed:
+		b.logger(ctx).Info("Circuit breaker closed", "dependency", b.dependency, "host", b.host)
+	}
+}
@@ -0,0 +1,375 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testBreakerLogger is the logger of the circuit breakers of test clients.
+func testBreakerLogger(context.Context) log.Logger { return log.DefaultLogger }
+
+// loopbackWebhooks lets test webhooks reach httptest servers, which listen on loopback.
+func loopbackWebhooks() *addressGuard {
+	return &addressGuard{what: "webhook", prefixes: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+}
+
+// newTestOutbound returns the outbound clients of org 1 with the default settings.
+func newTestOutbound(t *testing.T) *outboundClients {
+	t.Helper()
+	o, err := newOutboundClients(defaultHTTPSettings, 1, testBreakerLogger, loopbackWebhooks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// flakyServer fails the first failures requests, with status or by dropping the connection
+// if status is 0, and then answers with the request body.
+type flakyServer struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	requests int
+	bodies   []string
+}
+
+func (f *flakyServer) start(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.requests++
+		f.bodies = append(f.bodies, string(body))
+		fail := f.requests <= f.failures
+		f.mu.Unlock()
+		switch {
+		case fail && f.status == 0:
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case fail:
+			w.WriteHeader(f.status)
+		default:
+			w.Write(body)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *flakyServer) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func newTestDependencyClient(t *testing.T, s dependencyClientSettings) (*http.Client, *outboundClients) {
+	t.Helper()
+	o, err := newOutboundClients(httpSettings{Webhooks: s}, 1, testBreakerLogger, loopbackWebhooks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.client(dependencyWebhooks), o
+}
+
+func TestOutboundRetries(t *testing.T) {
+	client, _ := newTestDependencyClient(t, dependencyClientSettings{Retries: 2, RetryBackoff: "1ms"})
+	send := func(srv *httptest.Server, method string, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequest(method, srv.URL, strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	retries := testutil.ToFloat64(outboundRetries.WithLabelValues(dependencyWebhooks))
+
+	// Idempotent requests are retried with their body, after errors and after dropped connections.
+	for _, status := range []int{http.StatusServiceUnavailable, 0} {
+		f := &flakyServer{failures: 2, status: status}
+		resp, err := send(f.start(t), http.MethodPut, nil)
+		if err != nil || resp.StatusCode != http.StatusOK || f.count() != 3 || f.bodies[2] != "payload" {
+			t.Errorf("status %d: expected success on the third attempt, got %v %v after %d requests %q", status, resp, err, f.count(), f.bodies)
+		}
+	}
+	if got := testutil.ToFloat64(outboundRetries.WithLabelValues(dependencyWebhooks)) - retries; got != 4 {
+		t.Errorf("expected 4 retries counted, got %g", got)
+	}
+
+	// Retries are bounded, and other failures are not retried.
+	f := &flakyServer{failures: 5, status: http.StatusBadGateway}
+	if resp, err := send(f.start(t), http.MethodGet, nil); err != nil || resp.StatusCode != http.StatusBadGateway || f.count() != 3 {
+		t.Errorf("expected the last response after 3 attempts, got %v %v after %d", resp, err, f.count())
+	}
+	f = &flakyServer{failures: 1, status: http.StatusInternalServerError}
+	if resp, _ := send(f.start(t), http.MethodGet, nil); resp.StatusCode != http.StatusInternalServerError || f.count() != 1 {
+		t.Errorf("expected a 500 not to be retried, got %d requests", f.count())
+	}
+
+	// A POST is only retried with an idempotency key.
+	f = &flakyServer{failures: 1, status: http.StatusServiceUnavailable}
+	srv := f.start(t)
+	if resp, _ := send(srv, http.MethodPost, nil); resp.StatusCode != http.StatusServiceUnavailable || f.count() != 1 {
+		t.Errorf("expected a POST not to be retried, got %d requests", f.count())
+	}
+	f.failures = 2
+	if resp, _ := send(srv, http.MethodPost, http.Header{"Idempotency-Key": {"k1"}}); resp.StatusCode != http.StatusOK || f.count() != 3 {
+		t.Errorf("expected a POST with an idempotency key to be retried, got %d requests", f.count())
+	}
+}
+
+func TestOutboundTimeoutAndRetryAfter(t *testing.T) {
+	client, _ := newTestDependencyClient(t, dependencyClientSettings{Timeout: "50ms", Retries: 3, RetryBackoff: "1ms"})
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	start := time.Now()
+	if _, err := client.Get(slow.URL); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("expected the timeout to bound the request and its retries, got %v after %s", err, time.Since(start))
+	}
+
+	// A Retry-After beyond what the client waits returns the response right away.
+	var requests int
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	client, _ = newTestDependencyClient(t, dependencyClientSettings{Retries: 3, RetryBackoff: "1ms"})
+	if resp, err := client.Get(limited.URL); err != nil || resp.StatusCode != http.StatusTooManyRequests || requests != 1 {
+		t.Errorf("expected the 429 without retries, got %v %v after %d requests", resp, err, requests)
+	}
+	for attempt := range 8 {
+		if d := retryDelay(time.Second, attempt, nil); d <= 0 || d > min(time.Second<<attempt, maxRetryDelay) {
+			t.Errorf("retry delay %s of attempt %d out of bounds", d, attempt)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breakers := &circuitBreakers{dependency: "test", orgID: "1", threshold: 2, cooldown: time.Minute, logger: testBreakerLogger, byHost: map[string]*circuitBreaker{}}
+	b := breakers.get("example.com")
+	ctx := context.Background()
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	fail := func(at time.Duration) {
+		if err := b.allow(ctx, t0.Add(at)); err != nil {
+			t.Fatalf("request at %s rejected: %v", at, err)
+		}
+		b.done(ctx, t0.Add(at), true, false)
+	}
+	fail(0)
+	// A cancelled request or a success in between does not count towards the threshold.
+	b.allow(ctx, t0)
+	b.done(ctx, t0, true, true)
+	if b.currentState() != breakerClosed {
+		t.Fatal("expected one failure to keep the breaker closed")
+	}
+	fail(time.Second)
+	var open *circuitOpenError
+	if err := b.allow(ctx, t0.Add(30*time.Second)); !errors.As(err, &open) || open.retryAfter != 31*time.Second {
+		t.Fatalf("expected the open breaker to reject, got %v", err)
+	}
+
+	// After the cooldown a single probe is let through; its failure opens the breaker again.
+	if err := b.allow(ctx, t0.Add(2*time.Minute)); err != nil || b.currentState() != breakerHalfOpen {
+		t.Fatalf("expected a probe, got %v in state %s", err, b.currentState())
+	}
+	if err := b.allow(ctx, t0.Add(2*time.Minute)); err == nil {
+		t.Error("expected a second request to wait for the probe")
+	}
+	b.done(ctx, t0.Add(2*time.Minute), true, false)
+	if b.currentState() != breakerOpen || b.allow(ctx, t0.Add(2*time.Minute+30*time.Second)) == nil {
+		t.Fatal("expected a failed probe to open the breaker for another cooldown")
+	}
+	if err := b.allow(ctx, t0.Add(4*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	b.done(ctx, t0.Add(4*time.Minute), false, false)
+	if b.currentState() != breakerClosed || testutil.ToFloat64(circuitBreakerState.WithLabelValues("1", "test", "")) != 0 {
+		t.Error("expected a successful probe to close the breaker")
+	}
+	if breakers.get("other.example.com") != b {
+		t.Error("expected a single breaker for a dependency without per-host breakers")
+	}
+	if (&circuitBreakers{dependency: "disabled", cooldown: time.Minute}).get("") != nil {
+		t.Error("expected a zero threshold to disable the breaker")
+	}
+}
+
+func TestCircuitBreakerHealth(t *testing.T) {
+	f := &flakyServer{failures: 3, status: http.StatusBadGateway}
+	srv := f.start(t)
+	app := newTestApp(t, srv.URL, map[string]any{"http": map[string]any{"llm": map[string]any{"breakerFailures": 3, "breakerCooldown": "50ms"}}})
+	logs := newRecordingLogger()
+	app.baseLogger = logs
+	ctx := context.Background()
+	call := func() error {
+		return app.grafana.do(ctx, http.MethodPost, llmAppChatCompletionsPath, map[string]any{"model": "base"}, nil)
+	}
+	rejections := testutil.ToFloat64(circuitBreakerRejections.WithLabelValues("0", dependencyLLM, ""))
+
+	// Completions are POSTs, so each failure counts, and the third opens the LLM breaker.
+	for range 3 {
+		var apiErr *grafanaAPIError
+		if err := call(); !errors.As(err, &apiErr) {
+			t.Fatalf("expected the upstream error, got %v", err)
+		}
+	}
+	var open *circuitOpenError
+	if err := call(); !errors.As(err, &open) || f.count() != 3 {
+		t.Fatalf("expected the open breaker to fail the call without a request, got %v after %d requests", err, f.count())
+	}
+	if got := testutil.ToFloat64(circuitBreakerRejections.WithLabelValues("0", dependencyLLM, "")) - rejections; got != 1 {
+		t.Errorf("expected one rejection counted, got %g", got)
+	}
+	if testutil.ToFloat64(circuitBreakerState.WithLabelValues("0", dependencyLLM, "")) != float64(breakerOpen) {
+		t.Error("expected the state metric to show the open breaker")
+	}
+	// Transitions are logged through the logger of the app.
+	var logged bool
+	for _, line := range logs.recorded() {
+		if line.msg == "Circuit breaker open" {
+			logged = line.level == "warn" && line.attrs[logKeyOrgID] == int64(0) && line.attrs["dependency"] == dependencyLLM
+		}
+	}
+	if !logged {
+		t.Errorf("expected the opening to be logged with the org, got %+v", logs.recorded())
+	}
+	// Other dependencies are not affected.
+	if err := app.grafana.do(ctx, http.MethodGet, "/api/health", nil, nil); err != nil {
+		t.Errorf("expected the Grafana API to be reachable, got %v", err)
+	}
+
+	res, err := app.CheckHealth(ctx, &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details struct{ CircuitBreakers map[string]string }
+	if err := json.Unmarshal(res.JSONDetails, &details); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != backend.HealthStatusError || res.Message != "circuit breaker open for llm" ||
+		details.CircuitBreakers[dependencyLLM] != "open" || details.CircuitBreakers[dependencyGrafana] != "closed" {
+		t.Errorf("unexpected health %v %q %+v", res.Status, res.Message, details)
+	}
+
+	// Once the cooldown passed, a successful probe closes the breaker.
+	time.Sleep(60 * time.Millisecond)
+	if err := call(); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if res, _ := app.CheckHealth(ctx, &backend.CheckHealthRequest{}); res.Status != backend.HealthStatusOk {
+		t.Errorf("expected a healthy app, got %q", res.Message)
+	}
+}
+
+func TestWebhookBreakersPerHost(t *testing.T) {
+	client, o := newTestDependencyClient(t, dependencyClientSettings{BreakerFailures: 2, BreakerCooldown: "1m"})
+	down := (&flakyServer{failures: 10, status: http.StatusBadGateway}).start(t)
+	up := (&flakyServer{}).start(t)
+	post := func(url string) error {
+		resp, err := client.Post(url, "application/json", strings.NewReader("{}"))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	for range 2 {
+		if err := post(down.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var open *circuitOpenError
+	if err := post(down.URL); !errors.As(err, &open) {
+		t.Fatalf("expected the breaker of the failing host to open, got %v", err)
+	}
+	// A failing webhook target does not block the others.
+	if err := post(up.URL); err != nil {
+		t.Fatalf("expected another host to be reachable, got %v", err)
+	}
+	downName := dependencyWebhooks + "/" + strings.TrimPrefix(down.URL, "http://")
+	upName := dependencyWebhooks + "/" + strings.TrimPrefix(up.URL, "http://")
+	if states := o.breakerStates(); states[downName] != breakerOpen || states[upName] != breakerClosed {
+		t.Errorf("unexpected breaker states %v", states)
+	}
+	if deps, hosts := o.openBreakers(); len(deps) != 0 || len(hosts) != 1 || hosts[0] != downName {
+		t.Errorf("expected only the host %s open, got %v %v", downName, deps, hosts)
+	}
+	if testutil.ToFloat64(circuitBreakerState.WithLabelValues("1", dependencyWebhooks, strings.TrimPrefix(down.URL, "http://"))) != float64(breakerOpen) {
+		t.Error("expected the state metric of the failing host to show the open breaker")
+	}
+
+	// Closed breakers are dropped once there are too many hosts; open ones are kept.
+	bs := o.breakers[dependencyWebhooks]
+	for i := range maxHostBreakers {
+		bs.get(fmt.Sprintf("host-%d.example.com", i))
+	}
+	bs.mu.Lock()
+	n, kept := len(bs.byHost), bs.byHost[strings.TrimPrefix(down.URL, "http://")] != nil
+	bs.mu.Unlock()
+	if n > maxHostBreakers || !kept {
+		t.Errorf("expected at most %d breakers including the open one, got %d (open kept: %t)", maxHostBreakers, n, kept)
+	}
+
+	// Once every breaker is open, the least recently used one makes room.
+	for i := range maxHostBreakers - n {
+		bs.get(fmt.Sprintf("open-%d.example.com", i))
+	}
+	bs.mu.Lock()
+	for _, b := range bs.byHost {
+		b.state = breakerOpen
+	}
+	bs.byHost["host-99.example.com"].usedAt = time.Now().Add(-time.Hour)
+	bs.mu.Unlock()
+	bs.get(strings.TrimPrefix(down.URL, "http://"))
+	bs.get("new.example.com")
+	bs.mu.Lock()
+	n, kept = len(bs.byHost), bs.byHost[strings.TrimPrefix(down.URL, "http://")] != nil
+	_, oldest := bs.byHost["host-99.example.com"]
+	bs.mu.Unlock()
+	if n != maxHostBreakers || !kept || oldest {
+		t.Errorf("expected %d breakers without the least recently used one, got %d (recently used kept: %t, oldest kept: %t)", maxHostBreakers, n, kept, oldest)
+	}
+}
+
+func TestWebhookBreakerHealth(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	b := app.outbound.breakers[dependencyWebhooks].get("hooks.example.com")
+	b.mu.Lock()
+	b.state = breakerOpen
+	b.mu.Unlock()
+
+	// A webhook target being down does not make the app unhealthy.
+	res, err := app.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != backend.HealthStatusOk || res.Message != "ok; warning: circuit breaker open for webhooks/hooks.example.com" {
+		t.Errorf("unexpected health %v %q", res.Status, res.Message)
+	}
+}
@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// annotationsLimit is the maximum number of annotations read for one time window.
+const annotationsLimit = 500
+
+// grafanaAnnotation is an annotation as returned by the Grafana annotations API. Alert
+// state changes are annotations with an AlertID when state history is kept in annotations.
+type grafanaAnnotation struct {
+	ID           int64    `json:"id"`
+	AlertID      int64    `json:"alertId"`
+	AlertName    string   `json:"alertName"`
+	DashboardUID string   `json:"dashboardUID"`
+	PanelID      int64    `json:"panelId"`
+	NewState     string   `json:"newState"`
+	PrevState    string   `json:"prevState"`
+	Time         int64    `json:"time"`
+	TimeEnd      int64    `json:"timeEnd"`
+	Text         string   `json:"text"`
+	Tags         []string `json:"tags"`
+	Login        string   `json:"login"`
+}
+
+func (an grafanaAnnotation) time() time.Time { return time.UnixMilli(an.Time).UTC() }
+
+// url links to the panel the annotation belongs to, if any.
+func (an grafanaAnnotation) url() string {
+	if an.DashboardUID == "" {
+		return ""
+	}
+	u := "/d/" + an.DashboardUID + "?from=" + strconv.FormatInt(an.Time-int64(30*time.Minute/time.Millisecond), 10) +
+		"&to=" + strconv.FormatInt(max(an.TimeEnd, an.Time)+int64(30*time.Minute/time.Millisecond), 10)
+	if an.PanelID != 0 {
+		u += "&viewPanel=" + strconv.FormatInt(an.PanelID, 10)
+	}
+	return u
+}
+
+// listAnnotations returns the annotations between from and to. kind is "alert",
+// "annotation" or empty for both.
+func (a *App) listAnnotations(ctx context.Context, from, to time.Time, kind string) ([]grafanaAnnotation, error) {
+	q := url.Values{}
+	q.Set("from", strconv.FormatInt(from.UnixMilli(), 10))
+	q.Set("to", strconv.FormatInt(to.UnixMilli(), 10))
+	q.Set("limit", strconv.Itoa(annotationsLimit))
+	if kind != "" {
+		q.Set("type", kind)
+	}
+	var annotations []grafanaAnnotation
+	if err := a.grafana.do(ctx, http.MethodGet, "/api/annotations?"+q.Encode(), nil, &annotations); err != nil {
+		return nil, fmt.Errorf("list annotations: %w", err)
+	}
+	return annotations, nil
+}
+
+// irmUser is a user as referenced by the IRM app.
+type irmUser struct {
+	UserID string `json:"userID"`
+	Name   string `json:"name"`
+}
+
+// irmIncident is an incident of the Grafana IRM app.
+type irmIncident struct {
+	IncidentID  string `json:"incidentID"`
+	Title       string `json:"title"`
+	Severity    string `json:"severity"`
+	Status      string `json:"status"`
+	Summary     string `json:"summary"`
+	OverviewURL string `json:"overviewURL"`
+	// Times are RFC 3339 strings, which are empty when not set.
+	CreatedTime   string `json:"createdTime"`
+	ClosedTime    string `json:"closedTime"`
+	IncidentStart string `json:"incidentStart"`
+	IncidentEnd   string `json:"incidentEnd"`
+	Labels        []struct {
+		Key   string `json:"key"`
+		Label string `json:"label"`
+	} `json:"labels"`
+	IncidentMembership struct {
+		Assignments []struct {
+			Role struct {
+				Name string `json:"name"`
+			} `json:"role"`
+			User irmUser `json:"user"`
+		} `json:"assignments"`
+	} `json:"incidentMembership"`
+}
+
+// window returns the time range of the incident. Open incidents end now.
+func (inc irmIncident) window(now time.Time) (time.Time, time.Time) {
+	start, end := parseIRMTime(inc.IncidentStart), parseIRMTime(inc.IncidentEnd)
+	if start.IsZero() {
+		start = parseIRMTime(inc.CreatedTime)
+	}
+	if end.IsZero() {
+		end = parseIRMTime(inc.ClosedTime)
+	}
+	if end.IsZero() {
+		end = now
+	}
+	return start, end
+}
+
+// labelSet returns the incident labels as a label set. Labels without a key are keyed by
+// their value, so they can still be matched against alert labels.
+func (inc irmIncident) labelSet() map[string]string {
+	labels := map[string]string{}
+	for _, l := range inc.Labels {
+		key := l.Key
+		if key == "" {
+			key = l.Label
+		}
+		labels[key] = l.Label
+	}
+	return labels
+}
+
+// irmActivity is an entry of the activity timeline of an incident.
+type irmActivity struct {
+	ActivityItemID string  `json:"activityItemID"`
+	ActivityKind   string  `json:"activityKind"`
+	Body           string  `json:"body"`
+	EventTime      string  `json:"eventTime"`
+	CreatedTime    string  `json:"createdTime"`
+	User           irmUser `json:"user"`
+}
+
+func (ac irmActivity) time() time.Time {
+	if t := parseIRMTime(ac.EventTime); !t.IsZero() {
+		return t
+	}
+	return parseIRMTime(ac.CreatedTime)
+}
+
+// parseIRMTime parses a time of the IRM API, returning the zero time if it is not set.
+func parseIRMTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// irmPath returns the path of an IRM API method, e.g. IncidentsService.GetIncident.
+func (a *App) irmPath(method string) string {
+	return "/api/plugins/" + a.settings.IRMPluginID + "/resources/api/v1/" + method
+}
+
+// getIncident returns an IRM incident by ID.
+func (a *App) getIncident(ctx context.Context, id string) (irmIncident, error) {
+	var resp struct {
+		Incident irmIncident `json:"incident"`
+	}
+	err := a.grafana.do(ctx, http.MethodPost, a.irmPath("IncidentsService.GetIncident"), map[string]string{"incidentID": id}, &resp)
+	if err != nil {
+		return irmIncident{}, fmt.Errorf("get incident: %w", err)
+	}
+	return resp.Incident, nil
+}
+
+// incidentActivity returns the activity timeline of an IRM incident, oldest first.
+func (a *App) incidentActivity(ctx context.Context, id string) ([]irmActivity, error) {
+	var resp struct {
+		ActivityItems []irmActivity `json:"activityItems"`
+	}
+	err := a.grafana.do(ctx, http.MethodPost, a.irmPath("ActivityService.QueryActivity"), map[string]any{
+		"query": map[string]any{"incidentID": id, "limit": 200, "orderDirection": "ASC"},
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("query incident activity: %w", err)
+	}
+	return resp.ActivityItems, nil
+}
@@ -0,0 +1,865 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+const (
+	investigationsCollection = "investigations"
+	// investigationOutputLimit bounds the output stored for a single step.
+	investigationOutputLimit = 16 << 10
+	// investigationContextLimit bounds each earlier step output included in an LLM step prompt.
+	investigationContextLimit = 2000
+	// investigationFallbackOutput bounds each earlier step output listed by an LLM step
+	// while the LLM is unavailable.
+	investigationFallbackOutput = 500
+	// investigationQueryLogLimit is the number of log lines a LogQL query step returns.
+	investigationQueryLogLimit = 100
+)
+
+// Investigation and step statuses.
+const (
+	investigationPending   = "pending"
+	investigationRunning   = "running"
+	investigationCompleted = "completed"
+	investigationFailed    = "failed"
+	investigationCancelled = "cancelled"
+	// investigationSkipped is only used for steps left over when an investigation is cancelled.
+	investigationSkipped = "skipped"
+)
+
+// Step kinds.
+const (
+	stepQuery = "query"
+	stepTool  = "tool"
+	stepLLM   = "llm"
+	stepNote  = "note"
+	// stepChanges ranks recent changes as root cause suspects.
+	stepChanges = "changes"
+)
+
+// investigationStep is one step of an investigation. Which fields are used depends on Kind.
+type investigationStep struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Title string `json:"title,omitempty"`
+
+	// Query steps run Query, in Language "promql" or "logql", against DatasourceUID
+	// over the last Range (default 1h).
+	Language      string `json:"language,omitempty"`
+	DatasourceUID string `json:"datasourceUid,omitempty"`
+	Query         string `json:"query,omitempty"`
+	Range         string `json:"range,omitempty"`
+	// Tool steps call an MCP tool.
+	Tool      string         `json:"tool,omitempty"`
+	Arguments map[string]any `json:"arguments,omitempty"`
+	// LLM steps ask the LLM to reason about the goal and the output of earlier steps.
+	Prompt string `json:"prompt,omitempty"`
+	// Changes steps rank the changes made in the Range (default 2h) before the
+	// investigation started against its labels and Services, as root cause suspects.
+	Services []string `json:"services,omitempty"`
+	// Note steps record a human observation.
+	Note   string `json:"note,omitempty"`
+	Author string `json:"author,omitempty"`
+
+	Status      string    `json:"status"`
+	Output      string    `json:"output,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"startedAt,omitzero"`
+	CompletedAt time.Time `json:"completedAt,omitzero"`
+	// degradation is set on LLM steps that listed the earlier steps instead because the
+	// LLM was unavailable.
+	degradation
+}
+
+// validate checks the step definition and resets its execution state.
+func (s *investigationStep) validate() error {
+	switch s.Kind {
+	case stepQuery:
+		if s.Language != "promql" && s.Language != "logql" {
+			return errors.New(`query steps need a language of "promql" or "logql"`)
+		}
+		if s.DatasourceUID == "" || strings.TrimSpace(s.Query) == "" {
+			return errors.New("query steps need a datasourceUid and a query")
+		}
+		if s.Range != "" {
+			if d, err := time.ParseDuration(s.Range); err != nil || d <= 0 {
+				return errors.New("invalid range: must be a positive duration")
+			}
+		}
+	case stepTool:
+		if s.Tool == "" {
+			return errors.New("tool steps need a tool")
+		}
+		if err := checkReadOnlyTool(s.Tool); err != nil {
+			return err
+		}
+	case stepLLM:
+		if strings.TrimSpace(s.Prompt) == "" {
+			return errors.New("llm steps need a prompt")
+		}
+	case stepNote:
+		if strings.TrimSpace(s.Note) == "" {
+			return errors.New("note steps need a note")
+		}
+	case stepChanges:
+		if s.Range != "" {
+			if d, err := time.ParseDuration(s.Range); err != nil || d <= 0 || d > maxSuspectLookback {
+				return fmt.Errorf("invalid range: must be a duration up to %s", formatDuration(maxSuspectLookback))
+			}
+		}
+	default:
+		return fmt.Errorf("unknown step kind %q", s.Kind)
+	}
+	s.ID = uuid.NewString()
+	s.Status = investigationPending
+	s.Output, s.Error = "", ""
+	s.StartedAt, s.CompletedAt = time.Time{}, time.Time{}
+	s.degradation = degradation{}
+	return nil
+}
+
+// evidence is material attached to an investigation, such as a link to a dashboard,
+// a log excerpt or the output of a step.
+type evidence struct {
+	ID      string    `json:"id"`
+	Title   string    `json:"title"`
+	Kind    string    `json:"kind,omitempty"`
+	URL     string    `json:"url,omitempty"`
+	Content string    `json:"content,omitempty"`
+	StepID  string    `json:"stepId,omitempty"`
+	AddedBy string    `json:"addedBy,omitempty"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// investigation is a goal worked towards through an ordered list of steps. Steps run
+// asynchronously and in order; progress is persisted after every step.
+type investigation struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Goal  string `json:"goal"`
+	// Labels describe what is investigated, e.g. the labels of the alert that started it.
+	Labels      map[string]string   `json:"labels,omitempty"`
+	Status      string              `json:"status"`
+	Steps       []investigationStep `json:"steps"`
+	Evidence    []evidence          `json:"evidence"`
+	Error       string              `json:"error,omitempty"`
+	CreatedBy   string              `json:"createdBy,omitempty"`
+	CreatedAt   time.Time           `json:"createdAt"`
+	UpdatedAt   time.Time           `json:"updatedAt"`
+	CompletedAt time.Time           `json:"completedAt,omitzero"`
+}
+
+// nextStep returns the index of the first step that has not finished, or -1.
+func (inv *investigation) nextStep() int {
+	for i, s := range inv.Steps {
+		if s.Status == investigationPending || s.Status == investigationRunning {
+			return i
+		}
+	}
+	return -1
+}
+
+// investigationEvent is sent to stream subscribers when an investigation or one of its steps changes.
+type investigationEvent struct {
+	Type   string             `json:"type"` // "status" or "step"
+	Status string             `json:"status"`
+	Step   *investigationStep `json:"step,omitempty"`
+	Time   time.Time          `json:"time"`
+}
+
+// investigationBroker fans out investigation events to stream subscribers.
+type investigationBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan investigationEvent]struct{}
+}
+
+// subscribe returns a channel receiving the events of an investigation and a function
+// that ends the subscription.
+func (b *investigationBroker) subscribe(id string) (<-chan investigationEvent, func()) {
+	ch := make(chan investigationEvent, 32)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = map[string]map[chan investigationEvent]struct{}{}
+	}
+	if b.subs[id] == nil {
+		b.subs[id] = map[chan investigationEvent]struct{}{}
+	}
+	b.subs[id][ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[id], ch)
+		if len(b.subs[id]) == 0 {
+			delete(b.subs, id)
+		}
+	}
+}
+
+// publish sends an event to the subscribers of an investigation. Subscribers that
+// fall behind miss events rather than blocking the investigation.
+func (b *investigationBroker) publish(id string, ev investigationEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[id] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// investigationRun is a running investigation.
+type investigationRun struct {
+	cancel context.CancelFunc
+}
+
+// updateInvestigation loads an investigation, applies fn and saves the result, all while
+// holding investigationsMu. It returns the saved investigation.
+func (a *App) updateInvestigation(ctx context.Context, id string, fn func(*investigation) error) (investigation, error) {
+	a.investigationsMu.Lock()
+	defer a.investigationsMu.Unlock()
+	inv, err := loadJSON[investigation](ctx, a.store, investigationsCollection, id)
+	if err != nil {
+		return inv, err
+	}
+	if err := fn(&inv); err != nil {
+		return inv, err
+	}
+	inv.UpdatedAt = time.Now().UTC()
+	return inv, saveJSON(ctx, a.store, investigationsCollection, id, inv)
+}
+
+// startInvestigation runs the pending steps of an investigation in the background,
+// unless it is already running.
+func (a *App) startInvestigation(id string) {
+	a.investigationsMu.Lock()
+	defer a.investigationsMu.Unlock()
+	if _, ok := a.investigationRuns[id]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(withLogAttrs(a.jobsCtx, logKeyInvestigationID, id))
+	run := &investigationRun{cancel: cancel}
+	a.investigationRuns[id] = run
+	a.startJob(jobInvestigation, func() {
+		defer cancel()
+		a.runInvestigation(ctx, id, run)
+	})
+}
+
+// finishRun forgets a run if it is still the registered one. investigationsMu must be held.
+func (a *App) finishRun(id string, run *investigationRun) {
+	if a.investigationRuns[id] == run {
+		delete(a.investigationRuns, id)
+	}
+}
+
+// runInvestigation executes steps one at a time until none are left, a step fails or
+// ctx is cancelled. When ctx is cancelled because the plugin shuts down, the running
+// step stays "running" and is run again when the investigation is resumed.
+func (a *App) runInvestigation(ctx context.Context, id string, run *investigationRun) {
+	defer func() {
+		a.investigationsMu.Lock()
+		a.finishRun(id, run)
+		a.investigationsMu.Unlock()
+	}()
+	for {
+		var step investigationStep
+		var done bool
+		inv, err := a.updateInvestigation(ctx, id, func(inv *investigation) error {
+			if inv.Status == investigationCancelled {
+				done = true
+				return nil
+			}
+			i := inv.nextStep()
+			if i < 0 {
+				// Finishing and unregistering happen under the same lock, so steps added
+				// concurrently either run in this loop or start a new run.
+				inv.Status = investigationCompleted
+				inv.CompletedAt = time.Now().UTC()
+				a.finishRun(id, run)
+				done = true
+				return nil
+			}
+			inv.Status = investigationRunning
+			inv.Steps[i].Status = investigationRunning
+			inv.Steps[i].StartedAt = time.Now().UTC()
+			step = inv.Steps[i]
+			return nil
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				a.logger(ctx).Error("Error updating investigation", "err", err)
+			}
+			return
+		}
+		if done {
+			a.publishInvestigationStatus(inv)
+			return
+		}
+		a.investigationEvents.publish(id, investigationEvent{Type: "step", Status: step.Status, Step: &step, Time: time.Now()})
+
+		output, stepErr := a.executeInvestigationStep(ctx, inv, step)
+		if ctx.Err() != nil {
+			return
+		}
+		var degraded degradation
+		if step.Kind == stepLLM && llmUnavailable(stepErr) {
+			degraded = a.degrade(ctx, featureInvestigation, stepErr)
+			output, stepErr = investigationFallback(inv, step), nil
+		}
+		var failed bool
+		inv, err = a.updateInvestigation(context.WithoutCancel(ctx), id, func(inv *investigation) error {
+			for i := range inv.Steps {
+				if inv.Steps[i].ID != step.ID {
+					continue
+				}
+				s := &inv.Steps[i]
+				s.CompletedAt = time.Now().UTC()
+				s.Output = truncate(output, investigationOutputLimit)
+				s.Status = investigationCompleted
+				s.degradation = degraded
+				if stepErr != nil {
+					s.Status, s.Error = investigationFailed, stepErr.Error()
+					inv.Status = investigationFailed
+					inv.Error = fmt.Sprintf("step %d failed: %s", i+1, stepErr)
+					a.finishRun(id, run)
+					failed = true
+				}
+				step = *s
+			}
+			return nil
+		})
+		if err != nil {
+			a.logger(ctx).Error("Error updating investigation", "err", err)
+			return
+		}
+		a.investigationEvents.publish(id, investigationEvent{Type: "step", Status: step.Status, Step: &step, Time: time.Now()})
+		if failed {
+			a.publishInvestigationStatus(inv)
+			return
+		}
+	}
+}
+
+func (a *App) publishInvestigationStatus(inv investigation) {
+	a.investigationEvents.publish(inv.ID, investigationEvent{Type: "status", Status: inv.Status, Time: time.Now()})
+}
+
+// executeInvestigationStep runs a single step and returns its output.
+func (a *App) executeInvestigationStep(ctx context.Context, inv investigation, step investigationStep) (string, error) {
+	switch step.Kind {
+	case stepQuery:
+		window := time.Hour
+		if step.Range != "" {
+			// Checked again for investigations persisted before ranges had to be positive.
+			d, err := time.ParseDuration(step.Range)
+			if err != nil || d <= 0 {
+				return "", fmt.Errorf("invalid range %q", step.Range)
+			}
+			window = d
+		}
+		end := time.Now().UTC()
+		var res *mcpToolResult
+		var err error
+		if step.Language == "promql" {
+			res, err = a.mcp.CallTool(ctx, "query_prometheus", map[string]any{
+				"datasourceUid": step.DatasourceUID,
+				"expr":          step.Query,
+				"startTime":     end.Add(-window).Format(time.RFC3339),
+				"endTime":       end.Format(time.RFC3339),
+				"stepSeconds":   max(int(window/time.Second)/60, 15),
+				"queryType":     "range",
+			})
+		} else {
+			res, err = a.mcp.CallTool(ctx, "query_loki_logs", map[string]any{
+				"datasourceUid": step.DatasourceUID,
+				"logql":         step.Query,
+				"startRfc3339":  end.Add(-window).Format(time.RFC3339),
+				"endRfc3339":    end.Format(time.RFC3339),
+				"limit":         investigationQueryLogLimit,
+			})
+		}
+		return toolOutput(res, err)
+	case stepTool:
+		// Checked again for investigations persisted before the check existed.
+		if err := checkReadOnlyTool(step.Tool); err != nil {
+			return "", err
+		}
+		return toolOutput(a.mcp.CallTool(ctx, step.Tool, step.Arguments))
+	case stepLLM:
+		return a.chat(withLLMFeature(ctx, featureInvestigation, inv.CreatedBy), llmModelLarge, investigationPrompt(inv, step))
+	case stepNote:
+		return step.Note, nil
+	case stepChanges:
+		suspects, err := a.findSuspects(ctx, suspectsRequest{Time: inv.CreatedAt, Labels: inv.Labels, Services: step.Services, Lookback: step.Range}, time.Now().UTC())
+		if err != nil {
+			return "", err
+		}
+		return formatSuspects(suspects), nil
+	default:
+		return "", fmt.Errorf("unknown step kind %q", step.Kind)
+	}
+}
+
+func toolOutput(res *mcpToolResult, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if res.IsError {
+		return "", errors.New(res.text())
+	}
+	return res.text(), nil
+}
+
+const investigationSystemPrompt = `You are an SRE assistant helping an engineer with an investigation.
+Reason about the goal using the output of the steps taken so far. Point out what the evidence shows,
+what it rules out, and what to check next. Be concise and do not invent data that is not in the steps.`
+
+// investigationPrompt builds the messages of an LLM step from the goal and the earlier steps.
+// Step outputs hold logs, query results and tool output, so they are wrapped as untrusted
+// like in the agent loop.
+func investigationPrompt(inv investigation, step investigationStep) []chatMessage {
+	tag := untrustedTag()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Goal: %s\n", inv.Goal)
+	if len(inv.Labels) > 0 {
+		fmt.Fprintf(&b, "Labels: %s\n", formatLabelSet(inv.Labels))
+	}
+	for i, s := range inv.Steps {
+		if s.ID == step.ID {
+			break
+		}
+		if s.Status != investigationCompleted {
+			continue
+		}
+		title := s.Title
+		if title == "" {
+			title = s.Kind
+		}
+		output := truncate(s.Output, investigationContextLimit)
+		fmt.Fprintf(&b, "\nStep %d (%s): %s\n%s\n", i+1, s.Kind, title, wrapUntrusted(tag, s.Kind, output, detectInjection(output, nil)))
+	}
+	fmt.Fprintf(&b, "\n%s", step.Prompt)
+	return []chatMessage{
+		{Role: "system", Content: investigationSystemPrompt + "\n" + untrustedPrompt(tag)},
+		{Role: "user", Content: b.String()},
+	}
+}
+
+// investigationFallback is the output of an LLM step when the LLM is unavailable: the
+// outputs of the earlier steps, for the engineer to reason about.
+func investigationFallback(inv investigation, step investigationStep) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "The LLM is unavailable, so this step lists the earlier steps instead of reasoning about them.\n\nGoal: %s\n", inv.Goal)
+	n := 0
+	for i, s := range inv.Steps {
+		if s.ID == step.ID {
+			break
+		}
+		if s.Status != investigationCompleted {
+			continue
+		}
+		title := s.Title
+		if title == "" {
+			title = s.Kind
+		}
+		fmt.Fprintf(&b, "\nStep %d (%s): %s\n%s\n", i+1, s.Kind, title, truncate(strings.TrimSpace(s.Output), investigationFallbackOutput))
+		n++
+	}
+	if n == 0 {
+		b.WriteString("\nNo earlier step has completed.\n")
+	}
+	return b.String()
+}
+
+// truncate shortens s to at most n bytes, marking that it was cut. It cuts on a rune
+// boundary so that the result stays valid UTF-8.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "\n…(truncated)"
+}
+
+// resumeInvestigations restarts investigations that were running when the plugin stopped.
+func (a *App) resumeInvestigations(ctx context.Context) {
+	invs, err := listJSON[investigation](ctx, a.store, investigationsCollection)
+	if err != nil {
+		a.logger(ctx).Error("Error listing investigations", "err", err)
+		return
+	}
+	for _, inv := range invs {
+		if inv.Status == investigationPending || inv.Status == investigationRunning {
+			a.logger(ctx).Info("Resuming investigation", logKeyInvestigationID, inv.ID)
+			a.startInvestigation(inv.ID)
+		}
+	}
+}
+
+// investigationRequest is the body of POST /investigations.
+type investigationRequest struct {
+	Title  string              `json:"title"`
+	Goal   string              `json:"goal"`
+	Labels map[string]string   `json:"labels"`
+	Steps  []investigationStep `json:"steps"`
+}
+
+func validateSteps(steps []investigationStep, author string) error {
+	for i := range steps {
+		if err := steps[i].validate(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		if steps[i].Kind == stepNote && steps[i].Author == "" {
+			steps[i].Author = author
+		}
+	}
+	return nil
+}
+
+func userLogin(ctx context.Context) string {
+	if u := backend.UserFromContext(ctx); u != nil {
+		return u.Login
+	}
+	return ""
+}
+
+// handleInvestigations lists investigations on GET, newest first, and creates and starts one on POST.
+func (a *App) handleInvestigations(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		invs, err := listJSON[investigation](ctx, a.store, investigationsCollection)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sort.SliceStable(invs, func(i, j int) bool { return invs[i].CreatedAt.After(invs[j].CreatedAt) })
+		writeJSON(w, http.StatusOK, invs)
+	case http.MethodPost:
+		if !a.allowRequest(w, req) {
+			return
+		}
+		var body investigationRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(body.Goal) == "" {
+			http.Error(w, "goal is required", http.StatusBadRequest)
+			return
+		}
+		login := userLogin(ctx)
+		if err := validateSteps(body.Steps, login); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now().UTC()
+		inv := investigation{
+			ID:        uuid.NewString(),
+			Title:     body.Title,
+			Goal:      body.Goal,
+			Labels:    body.Labels,
+			Status:    investigationPending,
+			Steps:     body.Steps,
+			Evidence:  []evidence{},
+			CreatedBy: login,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if inv.Title == "" {
+			inv.Title = truncate(inv.Goal, 80)
+		}
+		if inv.Steps == nil {
+			inv.Steps = []investigationStep{}
+		}
+		if err := saveJSON(ctx, a.store, investigationsCollection, inv.ID, inv); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.startInvestigation(inv.ID)
+		writeJSON(w, http.StatusAccepted, inv)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// errInvestigationForbidden is returned when the user may not delete or cancel an
+// investigation.
+var errInvestigationForbidden = errors.New("changing investigations created by other users requires the Editor or Admin role")
+
+// canChangeInvestigation reports whether the current user may delete or cancel inv: its
+// creator and editors may.
+func canChangeInvestigation(ctx context.Context, inv investigation) bool {
+	u := backend.UserFromContext(ctx)
+	return isEditor(u) || (u != nil && u.Login != "" && u.Login == inv.CreatedBy)
+}
+
+// handleInvestigation gets or deletes the investigation identified by {id}. Deleting a
+// running investigation cancels it.
+func (a *App) handleInvestigation(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := req.PathValue("id")
+	switch req.Method {
+	case http.MethodGet:
+		inv, err := loadJSON[investigation](ctx, a.store, investigationsCollection, id)
+		if err != nil {
+			writeInvestigationError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, inv)
+	case http.MethodDelete:
+		a.investigationsMu.Lock()
+		inv, err := loadJSON[investigation](ctx, a.store, investigationsCollection, id)
+		switch {
+		case err != nil:
+		case !canChangeInvestigation(ctx, inv):
+			err = errInvestigationForbidden
+		default:
+			if run, ok := a.investigationRuns[id]; ok {
+				run.cancel()
+				delete(a.investigationRuns, id)
+			}
+			err = a.store.Delete(ctx, investigationsCollection, id)
+		}
+		a.investigationsMu.Unlock()
+		if err != nil {
+			writeInvestigationError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "investigation deleted"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeInvestigationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "investigation not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInvestigationForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// handleInvestigationSteps appends steps to an investigation and runs them, restarting
+// the investigation if it had completed.
+func (a *App) handleInvestigationSteps(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Steps []investigationStep `json:"steps"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	if len(body.Steps) == 0 {
+		http.Error(w, "steps are required", http.StatusBadRequest)
+		return
+	}
+	if err := validateSteps(body.Steps, userLogin(ctx)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inv, err := a.updateInvestigation(ctx, req.PathValue("id"), func(inv *investigation) error {
+		if inv.Status == investigationCancelled || inv.Status == investigationFailed {
+			return fmt.Errorf("investigation is %s", inv.Status)
+		}
+		inv.Steps = append(inv.Steps, body.Steps...)
+		if inv.Status == investigationCompleted {
+			inv.Status, inv.CompletedAt = investigationPending, time.Time{}
+		}
+		return nil
+	})
+	if err != nil {
+		writeInvestigationUpdateError(w, err)
+		return
+	}
+	a.startInvestigation(inv.ID)
+	writeJSON(w, http.StatusAccepted, inv)
+}
+
+func writeInvestigationUpdateError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "investigation not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errInvestigationForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusConflict)
+}
+
+// handleInvestigationEvidence attaches evidence to an investigation.
+func (a *App) handleInvestigationEvidence(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ev evidence
+	if err := json.NewDecoder(req.Body).Decode(&ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(ev.Title) == "" || (ev.URL == "" && ev.Content == "" && ev.StepID == "") {
+		http.Error(w, "evidence needs a title and a url, content or stepId", http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	ev.ID = uuid.NewString()
+	ev.AddedBy = userLogin(ctx)
+	ev.AddedAt = time.Now().UTC()
+	inv, err := a.updateInvestigation(ctx, req.PathValue("id"), func(inv *investigation) error {
+		if ev.StepID != "" && !slices.ContainsFunc(inv.Steps, func(s investigationStep) bool { return s.ID == ev.StepID }) {
+			return fmt.Errorf("step %s does not exist", ev.StepID)
+		}
+		inv.Evidence = append(inv.Evidence, ev)
+		return nil
+	})
+	if err != nil {
+		writeInvestigationUpdateError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, inv)
+}
+
+// handleInvestigationCancel stops a running investigation and skips its remaining steps.
+// Only its creator and editors may cancel it.
+func (a *App) handleInvestigationCancel(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := req.Context()
+	id := req.PathValue("id")
+	inv, err := a.updateInvestigation(ctx, id, func(inv *investigation) error {
+		if !canChangeInvestigation(ctx, *inv) {
+			return errInvestigationForbidden
+		}
+		if inv.Status != investigationPending && inv.Status != investigationRunning {
+			return fmt.Errorf("investigation is %s", inv.Status)
+		}
+		inv.Status = investigationCancelled
+		inv.CompletedAt = time.Now().UTC()
+		for i := range inv.Steps {
+			if s := &inv.Steps[i]; s.Status == investigationPending || s.Status == investigationRunning {
+				s.Status = investigationSkipped
+			}
+		}
+		if run, ok := a.investigationRuns[id]; ok {
+			run.cancel()
+			delete(a.investigationRuns, id)
+		}
+		return nil
+	})
+	if err != nil {
+		writeInvestigationUpdateError(w, err)
+		return
+	}
+	a.publishInvestigationStatus(inv)
+	writeJSON(w, http.StatusOK, inv)
+}
+
+// handleInvestigationResume retries the failed step of an investigation and continues with the rest.
+func (a *App) handleInvestigationResume(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	inv, err := a.updateInvestigation(req.Context(), req.PathValue("id"), func(inv *investigation) error {
+		if inv.Status != investigationFailed {
+			return fmt.Errorf("only failed investigations can be resumed, this one is %s", inv.Status)
+		}
+		for i := range inv.Steps {
+			if s := &inv.Steps[i]; s.Status == investigationFailed {
+				s.Status, s.Error, s.Output = investigationPending, "", ""
+			}
+		}
+		inv.Status, inv.Error = investigationPending, ""
+		return nil
+	})
+	if err != nil {
+		writeInvestigationUpdateError(w, err)
+		return
+	}
+	a.startInvestigation(inv.ID)
+	writeJSON(w, http.StatusAccepted, inv)
+}
+
+// investigationStreamPrefix is the Grafana Live channel path prefix of investigation
+// updates: plugin/sre-assistant-app/investigations/{id}.
+const investigationStreamPrefix = "investigations/"
+
+// SubscribeStream allows subscribing to the updates of an existing investigation. The
+// current state of the investigation is sent as the initial data.
+func (a *App) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	id, ok := strings.CutPrefix(req.Path, investigationStreamPrefix)
+	if !ok {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	b, err := a.store.Get(ctx, investigationsCollection, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	initial, err := backend.NewInitialData(b)
+	if err != nil {
+		return nil, err
+	}
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK, InitialData: initial}, nil
+}
+
+// RunStream sends investigation events to Grafana Live until the last subscriber leaves.
+func (a *App) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	id := strings.TrimPrefix(req.Path, investigationStreamPrefix)
+	events, unsubscribe := a.investigationEvents.subscribe(id)
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev := <-events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			if err := sender.SendJSON(b); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// PublishStream rejects publishing; investigation streams are only written by the backend.
+func (a *App) PublishStream(context.Context, *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
@@ -0,0 +1,391 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+// waitForInvestigation polls an investigation until it reaches status.
+func waitForInvestigation(t *testing.T, app *App, id, status string) investigation {
+	t.Helper()
+	var inv investigation
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp := callResource(t, app, http.MethodGet, "investigations/"+id, nil)
+		if resp.Status != http.StatusOK {
+			t.Fatalf("get: %d %s", resp.Status, resp.Body)
+		}
+		if err := json.Unmarshal(resp.Body, &inv); err != nil {
+			t.Fatal(err)
+		}
+		if inv.Status == status {
+			return inv
+		}
+	}
+	t.Fatalf("investigation did not become %s: %+v", status, inv)
+	return inv
+}
+
+func createInvestigation(t *testing.T, app *App, body map[string]any) investigation {
+	t.Helper()
+	resp := callResource(t, app, http.MethodPost, "investigations", body)
+	if resp.Status != http.StatusAccepted {
+		t.Fatalf("create: %d %s", resp.Status, resp.Body)
+	}
+	var inv investigation
+	if err := json.Unmarshal(resp.Body, &inv); err != nil {
+		t.Fatal(err)
+	}
+	return inv
+}
+
+func TestInvestigationRun(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	app.mcp = &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"query_prometheus": func(args map[string]any) (any, error) {
+			if args["queryType"] != "range" {
+				t.Errorf("unexpected query type %v", args["queryType"])
+			}
+			return []map[string]any{{"metric": map[string]string{"pod": "checkout-1"}, "values": [][]any{{1700000000, "0.12"}}}}, nil
+		},
+		"list_loki_label_names": func(map[string]any) (any, error) { return []string{"app"}, nil },
+	}}
+	llm := &fakeLLM{replies: []string{"Errors started on checkout-1 after the deploy."}}
+	app.llm = llm
+
+	inv := createInvestigation(t, app, map[string]any{
+		"goal":   "Why is checkout returning errors?",
+		"labels": map[string]string{"service": "checkout"},
+		"steps": []map[string]any{
+			{"kind": "query", "title": "error rate", "language": "promql", "datasourceUid": "prom", "query": `rate(http_requests_total{code="500"}[5m])`},
+			{"kind": "tool", "tool": "list_loki_label_names", "arguments": map[string]any{"datasourceUid": "loki"}},
+			{"kind": "note", "note": "A deploy went out at 10:02."},
+			{"kind": "llm", "prompt": "What is the most likely cause?"},
+		},
+	})
+	if inv.Title != "Why is checkout returning errors?" || inv.CreatedBy != "tester" || len(inv.Steps) != 4 {
+		t.Fatalf("unexpected investigation %+v", inv)
+	}
+
+	inv = waitForInvestigation(t, app, inv.ID, investigationCompleted)
+	for _, s := range inv.Steps {
+		if s.Status != investigationCompleted || s.Output == "" {
+			t.Errorf("step %s: status %s output %q error %q", s.Kind, s.Status, s.Output, s.Error)
+		}
+	}
+	if inv.Steps[2].Author != "tester" || inv.Steps[3].Output != "Errors started on checkout-1 after the deploy." {
+		t.Errorf("unexpected steps %+v", inv.Steps)
+	}
+	llm.mu.Lock()
+	system, prompt := llm.requests[0].Messages[0].Content, llm.requests[0].Messages[1].Content
+	llm.mu.Unlock()
+	for _, want := range []string{"Goal: Why is checkout returning errors?", "checkout-1", "A deploy went out at 10:02.", "What is the most likely cause?"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt is missing %q:\n%s", want, prompt)
+		}
+	}
+	// Step outputs are delimited as untrusted, with the tag named in the system prompt.
+	if tag := regexp.MustCompile(`<(untrusted-tool-output-[0-9a-f]+) tool="`).FindStringSubmatch(prompt); tag == nil || !strings.Contains(system, "<"+tag[1]+">") {
+		t.Errorf("step outputs should be wrapped as untrusted:\n%s\n%s", system, prompt)
+	}
+
+	// Appending steps to a completed investigation runs them.
+	resp := callResource(t, app, http.MethodPost, "investigations/"+inv.ID+"/steps", map[string]any{
+		"steps": []map[string]any{{"kind": "note", "note": "Rolled back."}},
+	})
+	if resp.Status != http.StatusAccepted {
+		t.Fatalf("add steps: %d %s", resp.Status, resp.Body)
+	}
+	inv = waitForInvestigation(t, app, inv.ID, investigationCompleted)
+	if len(inv.Steps) != 5 || inv.Steps[4].Status != investigationCompleted {
+		t.Errorf("appended step did not run: %+v", inv.Steps)
+	}
+
+	resp = callResource(t, app, http.MethodPost, "investigations/"+inv.ID+"/evidence", map[string]any{
+		"title": "error rate", "stepId": inv.Steps[0].ID,
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("evidence: %d %s", resp.Status, resp.Body)
+	}
+	resp = callResource(t, app, http.MethodPost, "investigations/"+inv.ID+"/evidence", map[string]any{
+		"title": "dangling", "stepId": "nope",
+	})
+	if resp.Status != http.StatusConflict {
+		t.Errorf("expected evidence for an unknown step to be rejected, got %d", resp.Status)
+	}
+	inv = waitForInvestigation(t, app, inv.ID, investigationCompleted)
+	if len(inv.Evidence) != 1 || inv.Evidence[0].AddedBy != "tester" {
+		t.Errorf("unexpected evidence %+v", inv.Evidence)
+	}
+
+	resp = callResource(t, app, http.MethodGet, "investigations", nil)
+	if resp.Status != http.StatusOK || !strings.Contains(string(resp.Body), inv.ID) {
+		t.Errorf("list: %d %s", resp.Status, resp.Body)
+	}
+}
+
+func TestInvestigationValidation(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	for _, tc := range []struct {
+		name   string
+		body   map[string]any
+		expErr string
+	}{
+		{name: "no goal", body: map[string]any{}, expErr: "goal is required"},
+		{name: "unknown kind", body: map[string]any{"goal": "g", "steps": []map[string]any{{"kind": "dance"}}}, expErr: `step 1: unknown step kind "dance"`},
+		{name: "query without language", body: map[string]any{"goal": "g", "steps": []map[string]any{{"kind": "query", "query": "up"}}}, expErr: "language"},
+		{name: "zero range", body: map[string]any{"goal": "g", "steps": []map[string]any{{"kind": "query", "language": "promql", "datasourceUid": "prom", "query": "up", "range": "0s"}}}, expErr: "invalid range"},
+		{name: "negative range", body: map[string]any{"goal": "g", "steps": []map[string]any{{"kind": "query", "language": "logql", "datasourceUid": "loki", "query": "{app=\"x\"}", "range": "-1h"}}}, expErr: "invalid range"},
+		{name: "empty note", body: map[string]any{"goal": "g", "steps": []map[string]any{{"kind": "note"}}}, expErr: "note steps need a note"},
+		{name: "mutating tool", body: map[string]any{"goal": "g", "steps": []map[string]any{{"kind": "tool", "tool": "create_incident"}}}, expErr: `step 1: tool "create_incident" is not a read-only tool`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := callResource(t, app, http.MethodPost, "investigations", tc.body)
+			if resp.Status != http.StatusBadRequest || !strings.Contains(string(resp.Body), tc.expErr) {
+				t.Errorf("expected 400 with %q, got %d %s", tc.expErr, resp.Status, resp.Body)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{in: "short", n: 10, want: "short"},
+		{in: "abcdef", n: 3, want: "abc\n…(truncated)"},
+		// "é" is two bytes: cutting after its first byte backs off to before it.
+		{in: "abé", n: 3, want: "ab\n…(truncated)"},
+		{in: "日本語", n: 4, want: "日\n…(truncated)"},
+	} {
+		got := truncate(tc.in, tc.n)
+		if got != tc.want || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tc.in, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestInvestigationFailAndResume(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	app.mcp = &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"search_dashboards": func(map[string]any) (any, error) { return nil, errors.New("datasource unavailable") },
+	}}
+
+	inv := createInvestigation(t, app, map[string]any{
+		"goal": "g",
+		"steps": []map[string]any{
+			{"kind": "tool", "tool": "search_dashboards"},
+			{"kind": "note", "note": "after"},
+		},
+	})
+	inv = waitForInvestigation(t, app, inv.ID, investigationFailed)
+	if inv.Steps[0].Status != investigationFailed || inv.Steps[1].Status != investigationPending || !strings.Contains(inv.Error, "step 1 failed") {
+		t.Fatalf("unexpected investigation %+v", inv)
+	}
+
+	app.mcp = &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"search_dashboards": func(map[string]any) (any, error) { return "recovered", nil },
+	}}
+	resp := callResource(t, app, http.MethodPost, "investigations/"+inv.ID+"/resume", nil)
+	if resp.Status != http.StatusAccepted {
+		t.Fatalf("resume: %d %s", resp.Status, resp.Body)
+	}
+	inv = waitForInvestigation(t, app, inv.ID, investigationCompleted)
+	if inv.Steps[0].Output != `"recovered"` || inv.Error != "" {
+		t.Errorf("unexpected investigation %+v", inv)
+	}
+}
+
+// blockingMCP blocks every tool call until its context is cancelled.
+type blockingMCP struct {
+	started chan struct{}
+}
+
+func (b *blockingMCP) CallTool(ctx context.Context, _ string, _ map[string]any) (*mcpToolResult, error) {
+	b.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestInvestigationCancel(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	mcp := &blockingMCP{started: make(chan struct{}, 1)}
+	app.mcp = mcp
+
+	inv := createInvestigation(t, app, map[string]any{
+		"goal":  "g",
+		"steps": []map[string]any{{"kind": "tool", "tool": "search_dashboards"}, {"kind": "note", "note": "n"}},
+	})
+	<-mcp.started
+	// Only the creator and editors may cancel or delete an investigation.
+	resp := callResourceAs(t, app, viewer, http.MethodPost, "investigations/"+inv.ID+"/cancel", nil)
+	if resp.Status != http.StatusForbidden {
+		t.Errorf("expected viewers to be unable to cancel other users' investigations, got %d", resp.Status)
+	}
+	if resp := callResourceAs(t, app, viewer, http.MethodDelete, "investigations/"+inv.ID, nil); resp.Status != http.StatusForbidden {
+		t.Errorf("expected viewers to be unable to delete other users' investigations, got %d", resp.Status)
+	}
+	resp = callResource(t, app, http.MethodPost, "investigations/"+inv.ID+"/cancel", nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("cancel: %d %s", resp.Status, resp.Body)
+	}
+	inv = waitForInvestigation(t, app, inv.ID, investigationCancelled)
+	for _, s := range inv.Steps {
+		if s.Status != investigationSkipped {
+			t.Errorf("expected step to be skipped, got %s", s.Status)
+		}
+	}
+	resp = callResource(t, app, http.MethodPost, "investigations/"+inv.ID+"/cancel", nil)
+	if resp.Status != http.StatusConflict {
+		t.Errorf("expected cancelling twice to conflict, got %d", resp.Status)
+	}
+
+	resp = callResource(t, app, http.MethodDelete, "investigations/"+inv.ID, nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("delete: %d %s", resp.Status, resp.Body)
+	}
+	resp = callResource(t, app, http.MethodGet, "investigations/"+inv.ID, nil)
+	if resp.Status != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", resp.Status)
+	}
+
+	resp = callResourceAs(t, app, viewer, http.MethodPost, "investigations", map[string]any{"goal": "g", "steps": []map[string]any{{"kind": "note", "note": "n"}}})
+	if err := json.Unmarshal(resp.Body, &inv); err != nil || inv.CreatedBy != viewer.Login {
+		t.Fatalf("create as viewer: %d %s", resp.Status, resp.Body)
+	}
+	if resp := callResourceAs(t, app, viewer, http.MethodDelete, "investigations/"+inv.ID, nil); resp.Status != http.StatusOK {
+		t.Errorf("expected the creator to be able to delete the investigation, got %d %s", resp.Status, resp.Body)
+	}
+}
+
+func TestInvestigationResumeAfterRestart(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := store.NewFileStore(filepath.Join(dataPath, "org_0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	// The plugin stopped while the second step was running.
+	err = saveJSON(context.Background(), s, investigationsCollection, "inv-1", investigation{
+		ID:     "inv-1",
+		Goal:   "g",
+		Status: investigationRunning,
+		Steps: []investigationStep{
+			{ID: "s1", Kind: stepNote, Note: "first", Status: investigationCompleted, Output: "first"},
+			{ID: "s2", Kind: stepNote, Note: "second", Status: investigationRunning, StartedAt: now},
+			{ID: "s3", Kind: stepNote, Note: "third", Status: investigationPending},
+		},
+		CreatedAt: now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApp(t, "http://localhost:0", map[string]any{"dataPath": dataPath})
+	inv := waitForInvestigation(t, app, "inv-1", investigationCompleted)
+	if inv.Steps[1].Output != "second" || inv.Steps[2].Output != "third" {
+		t.Errorf("unexpected steps after resume %+v", inv.Steps)
+	}
+}
+
+// fakeStreamPacketSender records the packets sent to a stream.
+type fakeStreamPacketSender struct {
+	mu      sync.Mutex
+	packets []json.RawMessage
+}
+
+func (f *fakeStreamPacketSender) Send(p *backend.StreamPacket) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.packets = append(f.packets, p.Data)
+	return nil
+}
+
+func (f *fakeStreamPacketSender) events() []investigationEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var events []investigationEvent
+	for _, p := range f.packets {
+		var ev investigationEvent
+		if err := json.Unmarshal(p, &ev); err == nil {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+func TestInvestigationStream(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	mcp := &blockingMCP{started: make(chan struct{}, 1)}
+	app.mcp = mcp
+	ctx := context.Background()
+
+	sub, err := app.SubscribeStream(ctx, &backend.SubscribeStreamRequest{Path: "investigations/missing"})
+	if err != nil || sub.Status != backend.SubscribeStreamStatusNotFound {
+		t.Fatalf("expected not found, got %+v %v", sub, err)
+	}
+
+	inv := createInvestigation(t, app, map[string]any{
+		"goal":  "g",
+		"steps": []map[string]any{{"kind": "tool", "tool": "search_dashboards"}},
+	})
+	path := investigationStreamPrefix + inv.ID
+	sub, err = app.SubscribeStream(ctx, &backend.SubscribeStreamRequest{Path: path})
+	if err != nil || sub.Status != backend.SubscribeStreamStatusOK || !strings.Contains(string(sub.InitialData.Data()), inv.ID) {
+		t.Fatalf("unexpected subscribe response %+v %v", sub, err)
+	}
+
+	var sender fakeStreamPacketSender
+	streamCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.RunStream(streamCtx, &backend.RunStreamRequest{Path: path}, backend.NewStreamSender(&sender))
+	}()
+	// Wait for RunStream to subscribe before the investigation changes.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		app.investigationEvents.mu.Lock()
+		n := len(app.investigationEvents.subs[inv.ID])
+		app.investigationEvents.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("RunStream did not subscribe")
+		}
+	}
+	<-mcp.started
+	callResource(t, app, http.MethodPost, "investigations/"+inv.ID+"/cancel", nil)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		events := sender.events()
+		if len(events) > 0 && events[len(events)-1].Type == "status" && events[len(events)-1].Status == investigationCancelled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cancellation was not streamed: %+v", events)
+		}
+	}
+	stop()
+	if err := <-done; err != nil {
+		t.Errorf("RunStream: %s", err)
+	}
+
+	pub, err := app.PublishStream(ctx, &backend.PublishStreamRequest{Path: path})
+	if err != nil || pub.Status != backend.PublishStreamStatusPermissionDenied {
+		t.Errorf("expected publishing to be denied, got %+v %v", pub, err)
+	}
+}
@@ -0,0 +1,458 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	knowledgeCollection = "knowledge"
+	// knowledgeChunkSize is the maximum size of a chunk in bytes, well below the input
+	// limit of embeddings models.
+	knowledgeChunkSize = 1500
+	// knowledgeIndexInterval is how often the knowledge base picks up new and changed sources.
+	knowledgeIndexInterval  = 10 * time.Minute
+	defaultKnowledgeResults = 5
+	maxKnowledgeResults     = 20
+)
+
+// Knowledge source kinds.
+const (
+	knowledgeRunbook       = "runbook"
+	knowledgePostmortem    = "postmortem"
+	knowledgeInvestigation = "investigation"
+)
+
+// knowledgeSource is a document of the plugin's own history the knowledge base indexes.
+type knowledgeSource struct {
+	Kind     string
+	SourceID string
+	Title    string
+	URL      string
+	Content  string
+}
+
+func (s knowledgeSource) id() string { return s.Kind + ":" + s.SourceID }
+
+// hash identifies the indexed content, so unchanged sources are not embedded again.
+func (s knowledgeSource) hash() string {
+	h := sha256.Sum256([]byte(s.Title + "\x00" + s.URL + "\x00" + s.Content))
+	return hex.EncodeToString(h[:])
+}
+
+// knowledgeChunk is an embedded part of a document.
+type knowledgeChunk struct {
+	Text   string `json:"text"`
+	Vector vector `json:"vector"`
+}
+
+// knowledgeDoc is an indexed source.
+type knowledgeDoc struct {
+	ID        string           `json:"id"`
+	Kind      string           `json:"kind"`
+	SourceID  string           `json:"sourceId"`
+	Title     string           `json:"title"`
+	URL       string           `json:"url,omitempty"`
+	Hash      string           `json:"hash"`
+	Chunks    []knowledgeChunk `json:"chunks"`
+	IndexedAt time.Time        `json:"indexedAt"`
+}
+
+// knowledgeResult is a search hit: the best matching chunk of a document.
+type knowledgeResult struct {
+	Kind     string  `json:"kind"`
+	SourceID string  `json:"sourceId"`
+	Title    string  `json:"title"`
+	URL      string  `json:"url,omitempty"`
+	Text     string  `json:"text"`
+	Score    float64 `json:"score"`
+}
+
+// knowledgeIndexStats summarizes a reindex.
+type knowledgeIndexStats struct {
+	Indexed   int      `json:"indexed"`
+	Unchanged int      `json:"unchanged"`
+	Removed   int      `json:"removed"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// chunkText splits Markdown into chunks of at most size bytes along paragraphs, then words,
+// then characters. Each chunk starts with the title and the heading it is under, clipped to
+// a quarter of size, so it can be understood on its own.
+func chunkText(title, content string, size int) []string {
+	var chunks []string
+	var heading string
+	var b strings.Builder
+	prefix := func() string {
+		if heading != "" && heading != title {
+			return clipRunes(title+" › "+heading, size/4) + "\n\n"
+		}
+		return clipRunes(title, size/4) + "\n\n"
+	}
+	flush := func() {
+		if strings.TrimSpace(b.String()) != "" {
+			chunks = append(chunks, prefix()+strings.TrimSpace(b.String()))
+		}
+		b.Reset()
+	}
+	for _, para := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		if strings.HasPrefix(para, "#") {
+			flush()
+			line, rest, _ := strings.Cut(para, "\n")
+			heading = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			if para = strings.TrimSpace(rest); para == "" {
+				continue
+			}
+		}
+		limit := max(size-len(prefix()), 1)
+		if b.Len() > 0 && b.Len()+len(para)+2 > limit {
+			flush()
+		}
+		for len(para) > limit {
+			// Split long paragraphs at the last space before the limit, or at the last
+			// character boundary for text without spaces such as CJK.
+			cut := strings.LastIndexAny(para[:limit], " \n")
+			if cut <= 0 {
+				cut = len(clipRunes(para, limit))
+			}
+			if cut == 0 {
+				_, cut = utf8.DecodeRuneInString(para)
+			}
+			b.WriteString(para[:cut])
+			flush()
+			para = strings.TrimSpace(para[cut:])
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(para)
+	}
+	flush()
+	return chunks
+}
+
+// clipRunes returns the longest prefix of s of at most n bytes that does not split a rune.
+func clipRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// knowledgeSources returns the runbooks, postmortems and completed investigations to index.
+func (a *App) knowledgeSources(ctx context.Context) ([]knowledgeSource, error) {
+	var sources []knowledgeSource
+	runbooks, err := listJSON[runbook](ctx, a.store, runbooksCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, rb := range runbooks {
+		url := rb.URL
+		if url == "" {
+			url = pluginResourcesPath + "/runbooks/" + rb.ID
+		}
+		sources = append(sources, knowledgeSource{Kind: knowledgeRunbook, SourceID: rb.ID, Title: rb.Title, URL: url, Content: rb.Content})
+	}
+	pms, err := listJSON[postmortem](ctx, a.store, postmortemsCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, pm := range pms {
+		sources = append(sources, knowledgeSource{
+			Kind: knowledgePostmortem, SourceID: pm.ID, Title: pm.Title, URL: pluginResourcesPath + "/postmortems/" + pm.ID, Content: pm.Markdown,
+		})
+	}
+	invs, err := listJSON[investigation](ctx, a.store, investigationsCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, inv := range invs {
+		if inv.Status == investigationCompleted {
+			sources = append(sources, knowledgeSource{
+				Kind: knowledgeInvestigation, SourceID: inv.ID, Title: inv.Title, URL: pluginResourcesPath + "/investigations/" + inv.ID, Content: investigationText(inv),
+			})
+		}
+	}
+	return sources, nil
+}
+
+// investigationText renders an investigation as Markdown for indexing.
+func investigationText(inv investigation) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Goal: %s\n", inv.Goal)
+	if len(inv.Labels) > 0 {
+		fmt.Fprintf(&b, "Labels: %s\n", formatLabelSet(inv.Labels))
+	}
+	for i, s := range inv.Steps {
+		if s.Status != investigationCompleted {
+			continue
+		}
+		title := s.Title
+		if title == "" {
+			title = s.Kind
+		}
+		fmt.Fprintf(&b, "\n## Step %d: %s\n\n", i+1, title)
+		if s.Query != "" {
+			fmt.Fprintf(&b, "%s\n\n", s.Query)
+		}
+		fmt.Fprintf(&b, "%s\n", truncate(s.Output, investigationContextLimit))
+	}
+	for _, ev := range inv.Evidence {
+		fmt.Fprintf(&b, "\n## Evidence: %s\n\n%s\n", ev.Title, truncate(ev.Content, investigationContextLimit))
+	}
+	return b.String()
+}
+
+// reindexKnowledge embeds new and changed sources and removes the documents of deleted ones.
+// A source that fails to embed is reported and retried on the next run.
+func (a *App) reindexKnowledge(ctx context.Context) (knowledgeIndexStats, error) {
+	var stats knowledgeIndexStats
+	if a.embeddings == nil {
+		return stats, errEmbeddingsDisabled
+	}
+	a.knowledgeMu.Lock()
+	defer a.knowledgeMu.Unlock()
+
+	sources, err := a.knowledgeSources(ctx)
+	if err != nil {
+		return stats, err
+	}
+	docs, err := listJSON[knowledgeDoc](ctx, a.store, knowledgeCollection)
+	if err != nil {
+		return stats, err
+	}
+	existing := map[string]knowledgeDoc{}
+	for _, d := range docs {
+		existing[d.ID] = d
+	}
+	defer a.invalidateKnowledgeCache()
+
+	for _, src := range sources {
+		id, hash := src.id(), src.hash()
+		if d, ok := existing[id]; ok && d.Hash == hash {
+			stats.Unchanged++
+			delete(existing, id)
+			continue
+		}
+		texts := chunkText(src.Title, src.Content, knowledgeChunkSize)
+		if len(texts) == 0 {
+			// Sources without content are removed below.
+			continue
+		}
+		delete(existing, id)
+		vectors, err := a.embed(ctx, texts)
+		if err != nil {
+			stats.Errors = append(stats.Errors, fmt.Sprintf("%s: %s", id, err))
+			continue
+		}
+		doc := knowledgeDoc{
+			ID: id, Kind: src.Kind, SourceID: src.SourceID, Title: src.Title, URL: src.URL, Hash: hash,
+			Chunks: make([]knowledgeChunk, len(texts)), IndexedAt: time.Now().UTC(),
+		}
+		for i, text := range texts {
+			doc.Chunks[i] = knowledgeChunk{Text: text, Vector: normalize(vectors[i])}
+		}
+		if err := saveJSON(ctx, a.store, knowledgeCollection, id, doc); err != nil {
+			return stats, err
+		}
+		stats.Indexed++
+	}
+	for id := range existing {
+		if err := a.store.Delete(ctx, knowledgeCollection, id); err != nil {
+			return stats, err
+		}
+		stats.Removed++
+	}
+	return stats, nil
+}
+
+// knowledgeDocs returns the indexed documents, decoding them from the store once per reindex.
+func (a *App) knowledgeDocs(ctx context.Context) ([]knowledgeDoc, error) {
+	a.knowledgeCacheMu.RLock()
+	docs := a.knowledgeCache
+	a.knowledgeCacheMu.RUnlock()
+	recordCacheLookup("knowledge", docs != nil)
+	if docs != nil {
+		return docs, nil
+	}
+	// Load under the write lock, so a reindex finishing meanwhile cannot be overwritten
+	// with documents read before it.
+	a.knowledgeCacheMu.Lock()
+	defer a.knowledgeCacheMu.Unlock()
+	if a.knowledgeCache != nil {
+		return a.knowledgeCache, nil
+	}
+	docs, err := listJSON[knowledgeDoc](ctx, a.store, knowledgeCollection)
+	if err != nil {
+		return nil, err
+	}
+	a.knowledgeCache = docs
+	return docs, nil
+}
+
+func (a *App) invalidateKnowledgeCache() {
+	a.knowledgeCacheMu.Lock()
+	a.knowledgeCache = nil
+	a.knowledgeCacheMu.Unlock()
+}
+
+// searchKnowledge returns the k documents most similar to query, optionally restricted to
+// some kinds, each with its best matching chunk. The index is small enough for an exact
+// search over every chunk.
+func (a *App) searchKnowledge(ctx context.Context, query string, k int, kinds []string) ([]knowledgeResult, error) {
+	if a.embeddings == nil {
+		return nil, errEmbeddingsDisabled
+	}
+	vs, err := a.embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if len(vs) != 1 {
+		return nil, errors.New("embeddings: no embedding returned for the query")
+	}
+	q := normalize(vs[0])
+	docs, err := a.knowledgeDocs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := []knowledgeResult{}
+	for _, d := range docs {
+		if len(kinds) > 0 && !slices.Contains(kinds, d.Kind) {
+			continue
+		}
+		best := knowledgeResult{Score: -1}
+		for _, c := range d.Chunks {
+			if score := c.Vector.dot(q); score > best.Score {
+				best = knowledgeResult{Kind: d.Kind, SourceID: d.SourceID, Title: d.Title, URL: d.URL, Text: c.Text, Score: score}
+			}
+		}
+		if best.Score > 0 {
+			results = append(results, best)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	return results[:min(k, len(results))], nil
+}
+
+// runKnowledgeIndexer keeps the knowledge base up to date until ctx is cancelled.
+func (a *App) runKnowledgeIndexer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if a.embeddings == nil {
+				continue
+			}
+			stats, err := a.reindexKnowledge(ctx)
+			recordJobRun(jobKnowledgeIndexer, err)
+			if err != nil {
+				a.logger(ctx).Error("Knowledge base reindex failed", "err", err)
+				continue
+			}
+			if stats.Indexed > 0 || stats.Removed > 0 || len(stats.Errors) > 0 {
+				a.logger(ctx).Info("Knowledge base reindexed", "indexed", stats.Indexed, "removed", stats.Removed, "errors", stats.Errors)
+			}
+		}
+	}
+}
+
+// writeKnowledgeError maps knowledge base errors to HTTP statuses.
+func writeKnowledgeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errEmbeddingsDisabled) {
+		http.Error(w, "knowledge base is disabled: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// handleKnowledge lists the indexed documents without their vectors.
+func (a *App) handleKnowledge(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	docs, err := a.knowledgeDocs(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type docInfo struct {
+		ID        string    `json:"id"`
+		Kind      string    `json:"kind"`
+		SourceID  string    `json:"sourceId"`
+		Title     string    `json:"title"`
+		URL       string    `json:"url,omitempty"`
+		Chunks    int       `json:"chunks"`
+		IndexedAt time.Time `json:"indexedAt"`
+	}
+	out := make([]docInfo, len(docs))
+	for i, d := range docs {
+		out[i] = docInfo{ID: d.ID, Kind: d.Kind, SourceID: d.SourceID, Title: d.Title, URL: d.URL, Chunks: len(d.Chunks), IndexedAt: d.IndexedAt}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleKnowledgeReindex indexes new and changed sources right away instead of waiting for
+// the background indexer.
+func (a *App) handleKnowledgeReindex(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := a.reindexKnowledge(req.Context())
+	if err != nil {
+		writeKnowledgeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleKnowledgeSearch searches the knowledge base. The query parameters are q, k, the
+// number of results, and kind, which may be repeated.
+func (a *App) handleKnowledgeSearch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	k := defaultKnowledgeResults
+	if v := q.Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxKnowledgeResults {
+			http.Error(w, fmt.Sprintf("k must be between 1 and %d", maxKnowledgeResults), http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+	results, err := a.searchKnowledge(req.Context(), query, k, q["kind"])
+	if err != nil {
+		writeKnowledgeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,251 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// bagOfWords is a deterministic stand-in for an embeddings model: texts sharing words
+// get similar vectors.
+func bagOfWords(text string) []float32 {
+	v := make([]float32, 256)
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if len(w) < 4 {
+			continue
+		}
+		h := fnv.New32a()
+		h.Write([]byte(w))
+		v[h.Sum32()%256]++
+	}
+	return v
+}
+
+// newFakeEmbeddings serves the OpenAI embeddings API with bagOfWords, counting the
+// embedded inputs.
+func newFakeEmbeddings(t *testing.T, inputs *atomic.Int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer sk-test" {
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != "embed-test" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		inputs.Add(int64(len(req.Input)))
+		data := make([]map[string]any, len(req.Input))
+		// Reply out of order, as the API allows.
+		for i, in := range req.Input {
+			data[len(req.Input)-1-i] = map[string]any{"index": i, "embedding": bagOfWords(in)}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"data": data})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newKnowledgeApp returns an app whose embeddings are served by newFakeEmbeddings.
+func newKnowledgeApp(t *testing.T) (*App, *atomic.Int64) {
+	var inputs atomic.Int64
+	srv := newFakeEmbeddings(t, &inputs)
+	app := newTestApp(t, "", nil)
+	// The API key is secure data, which newTestApp cannot set.
+	app.embeddings = newEmbeddingsProvider(embeddingsSettings{URL: srv.URL, Model: "embed-test", APIKey: "sk-test"}, http.DefaultClient)
+	return app, &inputs
+}
+
+func TestOpenAIEmbeddings(t *testing.T) {
+	var inputs atomic.Int64
+	srv := newFakeEmbeddings(t, &inputs)
+	texts := make([]string, embeddingsBatchSize+3)
+	for i := range texts {
+		texts[i] = strings.Repeat("word ", i+1)
+	}
+	p := newEmbeddingsProvider(embeddingsSettings{URL: srv.URL + "/", Model: "embed-test", APIKey: "sk-test"}, http.DefaultClient)
+	vectors, err := p.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) != len(texts) || vectors[9][bagIndex("word")] != 10 {
+		t.Errorf("unexpected vectors for %d texts", len(vectors))
+	}
+	p = newEmbeddingsProvider(embeddingsSettings{URL: srv.URL, Model: "embed-test"}, http.DefaultClient)
+	if _, err := p.Embed(context.Background(), texts[:1]); err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Errorf("expected an authorization error, got %v", err)
+	}
+	if newEmbeddingsProvider(embeddingsSettings{}, http.DefaultClient) != nil {
+		t.Error("embeddings should be disabled without a URL")
+	}
+}
+
+func bagIndex(word string) int {
+	h := fnv.New32a()
+	h.Write([]byte(word))
+	return int(h.Sum32() % 256)
+}
+
+func TestVectorJSON(t *testing.T) {
+	v := normalize([]float32{3, 4})
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got vector
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != 0.6 || got[1] != 0.8 || got.dot(v) < 0.999 {
+		t.Errorf("unexpected vector %v from %s", got, b)
+	}
+	if (vector{1}).dot(v) != 0 {
+		t.Error("vectors of different dimensions should not match")
+	}
+}
+
+func TestChunkText(t *testing.T) {
+	content := "Intro paragraph.\n\n# Diagnose\n\nCheck the pool.\n\n" + strings.Repeat("long words ", 40) + "\n\n## Mitigate\n\nRestart it."
+	chunks := chunkText("DB runbook", content, 200)
+	if len(chunks) < 4 {
+		t.Fatalf("expected the long paragraph to be split, got %q", chunks)
+	}
+	if chunks[0] != "DB runbook\n\nIntro paragraph." || !strings.HasPrefix(chunks[1], "DB runbook › Diagnose\n\nCheck the pool.") {
+		t.Errorf("unexpected chunks %q", chunks[:2])
+	}
+	if last := chunks[len(chunks)-1]; last != "DB runbook › Mitigate\n\nRestart it." {
+		t.Errorf("unexpected last chunk %q", last)
+	}
+	for _, c := range chunks {
+		if len(c) > 200 {
+			t.Errorf("chunk longer than the limit: %d", len(c))
+		}
+	}
+}
+
+func TestChunkTextLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		title   string
+		content string
+		size    int
+	}{
+		{name: "long title", title: strings.Repeat("Checkout latency ", 40), content: "Check the pool.\n\n" + strings.Repeat("long words ", 40), size: 200},
+		{name: "cjk", title: "資料庫連線池耗盡", content: "# 診斷\n\n" + strings.Repeat("檢查連線池與慢查詢", 60), size: 200},
+		{name: "tiny size", title: "資料庫", content: strings.Repeat("連線", 10), size: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := chunkText(tc.title, tc.content, tc.size)
+			if len(chunks) == 0 {
+				t.Fatal("expected chunks")
+			}
+			var text strings.Builder
+			for _, c := range chunks {
+				if !utf8.ValidString(c) {
+					t.Errorf("chunk splits a character: %q", c)
+				}
+				if tc.size > 4*utf8.UTFMax && len(c) > tc.size {
+					t.Errorf("chunk longer than the limit: %d", len(c))
+				}
+				_, body, _ := strings.Cut(c, "\n\n")
+				text.WriteString(body)
+			}
+			if want := strings.NewReplacer(" ", "", "\n", "", "#", "", "診斷", "").Replace(tc.content); strings.ReplaceAll(text.String(), " ", "") != want {
+				t.Errorf("chunks lost content: %q", chunks)
+			}
+		})
+	}
+}
+
+func TestKnowledgeBase(t *testing.T) {
+	app, inputs := newKnowledgeApp(t)
+	ctx := context.Background()
+	for id, v := range map[string]any{
+		"rb-db":  runbook{ID: "rb-db", Title: "Database connection pool exhausted", Content: "# Diagnose\n\nCheck active connections and slow queries holding connections.\n\n# Mitigate\n\nIncrease the connection pool or kill slow queries."},
+		"rb-dns": runbook{ID: "rb-dns", Title: "DNS resolution failures", Content: "Check coredns pods and upstream resolvers."},
+	} {
+		if err := saveJSON(ctx, app.store, runbooksCollection, id, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, inv := range []investigation{
+		{ID: "inv-1", Title: "checkout latency", Goal: "Find why checkout is slow", Status: investigationCompleted,
+			Steps: []investigationStep{{Kind: stepNote, Status: investigationCompleted, Output: "Slow queries exhausted the connection pool of the orders database."}}},
+		{ID: "inv-2", Title: "running", Goal: "Still open", Status: investigationRunning},
+	} {
+		if err := saveJSON(ctx, app.store, investigationsCollection, inv.ID, inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if resp := callResource(t, app, http.MethodGet, "knowledge/search?q=pool", nil); resp.Status != http.StatusOK || string(resp.Body) != "[]\n" {
+		t.Errorf("expected no results before indexing, got %d %s", resp.Status, resp.Body)
+	}
+	resp := callResource(t, app, http.MethodPost, "knowledge/reindex", nil)
+	var stats knowledgeIndexStats
+	if err := json.Unmarshal(resp.Body, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Indexed != 3 || stats.Unchanged != 0 || len(stats.Errors) != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	resp = callResource(t, app, http.MethodGet, "knowledge/search?q=connection+pool+exhausted+by+slow+queries&k=2", nil)
+	var results []knowledgeResult
+	if err := json.Unmarshal(resp.Body, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].SourceID != "rb-db" || results[1].SourceID != "inv-1" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if !strings.Contains(results[0].Text, "pool") || results[0].URL != pluginResourcesPath+"/runbooks/rb-db" {
+		t.Errorf("unexpected best chunk %+v", results[0])
+	}
+	resp = callResource(t, app, http.MethodGet, "knowledge/search?q=connection+pool&kind=investigation", nil)
+	if err := json.Unmarshal(resp.Body, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Kind != knowledgeInvestigation {
+		t.Errorf("unexpected filtered results %+v", results)
+	}
+
+	// Unchanged sources are not embedded again and deleted ones are removed.
+	before := inputs.Load()
+	if err := app.store.Delete(ctx, runbooksCollection, "rb-dns"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := app.reindexKnowledge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Unchanged != 2 || stats.Removed != 1 || inputs.Load() != before {
+		t.Errorf("unexpected reindex %+v, %d inputs embedded", stats, inputs.Load()-before)
+	}
+	resp = callResource(t, app, http.MethodGet, "knowledge", nil)
+	if !strings.Contains(string(resp.Body), `"chunks":2`) || strings.Contains(string(resp.Body), "vector") {
+		t.Errorf("unexpected document list %s", resp.Body)
+	}
+}
+
+func TestKnowledgeDisabled(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	for _, r := range []struct{ method, path string }{{http.MethodGet, "knowledge/search?q=x"}, {http.MethodPost, "knowledge/reindex"}} {
+		if resp := callResource(t, app, r.method, r.path, nil); resp.Status != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected 503, got %d", r.path, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// llmAppChatCompletionsPath is the OpenAI-compatible chat completions endpoint of the
+// Grafana LLM app, which forwards requests to whichever provider it is configured with.
+// llmAppLLMPath is the prefix of the LLM app's endpoints calling the provider.
+const (
+	llmAppLLMPath             = "/api/plugins/grafana-llm-app/resources/llm/"
+	llmAppChatCompletionsPath = llmAppLLMPath + "v1/chat/completions"
+)
+
+// Abstract models understood by the Grafana LLM app.
+const (
+	// llmModelBase is for efficient, high-throughput tasks.
+	llmModelBase = "base"
+	// llmModelLarge is for more advanced tasks with longer context windows.
+	llmModelLarge = "large"
+)
+
+// chatMessage is a single message in a chat completion request or response.
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// ToolCalls are the tools an assistant message asks to call.
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the call a "tool" message returns the result of.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// toolCall is a function call requested by the LLM. Arguments is a JSON object.
+type toolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// chatTool declares a function the LLM may call. Parameters is a JSON schema.
+type chatTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description"`
+		Parameters  map[string]any `json:"parameters"`
+	} `json:"function"`
+}
+
+// chatCompletionRequest is an OpenAI-style chat completion request.
+type chatCompletionRequest struct {
+	Model       string        `json:"model"`
+	Messages    []chatMessage `json:"messages"`
+	Tools       []chatTool    `json:"tools,omitempty"`
+	Temperature *float64      `json:"temperature,omitempty"`
+}
+
+// llmUsage is the token usage reported for a chat completion.
+type llmUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// chatCompletionResponse is an OpenAI-style chat completion response.
+type chatCompletionResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      chatMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
+	} `json:"choices"`
+	Usage llmUsage `json:"usage"`
+}
+
+// llmProvider sends chat completion requests to an LLM.
+type llmProvider interface {
+	ChatCompletions(ctx context.Context, req chatCompletionRequest) (chatCompletionResponse, error)
+}
+
+// grafanaLLMProvider is an llmProvider that goes through the Grafana LLM app, so that
+// provider credentials never have to be configured in this plugin.
+type grafanaLLMProvider struct {
+	grafana *grafanaClient
+}
+
+func (p *grafanaLLMProvider) ChatCompletions(ctx context.Context, req chatCompletionRequest) (chatCompletionResponse, error) {
+	var resp chatCompletionResponse
+	err := p.grafana.do(ctx, http.MethodPost, llmAppChatCompletionsPath, req, &resp)
+	return resp, err
+}
+
+// chat sends messages to the LLM and returns the content of the first choice.
+func (a *App) chat(ctx context.Context, model string, messages []chatMessage) (string, error) {
+	resp, err := a.completion(ctx, chatCompletionRequest{Model: model, Messages: messages})
+	if err != nil {
+		return "", fmt.Errorf("llm: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return "", errors.New("llm: response has no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// decodeLLMJSON decodes a JSON object from an LLM reply. Models often wrap JSON in
+// Markdown code fences or add a sentence around it, so only the outermost object is used.
+func decodeLLMJSON(content string, v any) error {
+	start := strings.Index(content, "{")
+	end := strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return errors.New("reply does not contain a JSON object")
+	}
+	if err := json.Unmarshal([]byte(content[start:end+1]), v); err != nil {
+		return fmt.Errorf("reply is not valid JSON: %w", err)
+	}
+	return nil
+}
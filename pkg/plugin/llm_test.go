@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+// fakeLLM is an llmProvider that returns scripted replies in order and records the requests it received.
+type fakeLLM struct {
+	mu       sync.Mutex
+	replies  []string
+	err      error
+	requests []chatCompletionRequest
+}
+
+func (f *fakeLLM) ChatCompletions(_ context.Context, req chatCompletionRequest) (chatCompletionResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	var resp chatCompletionResponse
+	if f.err != nil {
+		return resp, f.err
+	}
+	if len(f.replies) == 0 {
+		return resp, errors.New("fake llm: no more replies")
+	}
+	resp.Choices = append(resp.Choices, struct {
+		Message      chatMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
+	}{Message: chatMessage{Role: "assistant", Content: f.replies[0]}, FinishReason: "stop"})
+	resp.Usage = llmUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}
+	f.replies = f.replies[1:]
+	return resp, nil
+}
+
+func TestGrafanaLLMProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != llmAppChatCompletionsPath || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var req chatCompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != llmModelBase {
+			http.Error(w, "unexpected body", http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"hi"}}],"usage":{"total_tokens":3}}`))
+	}))
+	defer srv.Close()
+
+	app := &App{llm: &grafanaLLMProvider{grafana: newGrafanaClient(srv.URL, "token", newTestOutbound(t))}, settings: &Settings{}, store: store.NewMemoryStore()}
+	got, err := app.chat(context.Background(), llmModelBase, []chatMessage{{Role: "user", Content: "hello"}})
+	if err != nil {
+		t.Fatalf("chat: %s", err)
+	}
+	if got != "hi" {
+		t.Errorf("unexpected reply %q", got)
+	}
+}
+
+func TestDecodeLLMJSON(t *testing.T) {
+	var v generatedQuery
+	if err := decodeLLMJSON("Sure!\n```json\n{\"query\": \"up\", \"explanation\": \"x\"}\n```", &v); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if v.Query != "up" {
+		t.Errorf("unexpected query %q", v.Query)
+	}
+	if err := decodeLLMJSON("no json here", &v); err == nil {
+		t.Error("expected an error for a reply without JSON")
+	}
+}
@@ -0,0 +1,222 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// Keys of the correlation attributes attached to request-scoped log lines.
+const (
+	logKeyRequestID       = "requestId"
+	logKeyOrgID           = "orgId"
+	logKeyUser            = "user"
+	logKeyRoute           = "route"
+	logKeyInvestigationID = "investigationId"
+)
+
+// requestIDHeader carries the ID correlating the log lines of a request. A valid ID sent
+// by the caller is reused, otherwise one is generated; it is echoed in the response.
+const requestIDHeader = "X-Request-Id"
+
+// loggingSettings configures the plugin's logs.
+type loggingSettings struct {
+	// Debug enables debug logs when the instance starts. It can be changed at runtime
+	// through /logging.
+	Debug bool `json:"debug"`
+	// RedactPatterns are regular expressions of PII to redact from logs, in addition to
+	// the built-in API key and token patterns.
+	RedactPatterns []string `json:"redactPatterns"`
+}
+
+// logRedaction replaces the matches of a pattern with repl, which may refer to groups.
+type logRedaction struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// builtinLogRedactions match credentials that must never be logged.
+var builtinLogRedactions = []logRedaction{
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/-]{8,}=*`), "$1 " + redactedValue},
+	{regexp.MustCompile(`\b(glsa|glc|sk|xox[abp])[_-][A-Za-z0-9_-]{8,}`), redactedValue},
+	{regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`), redactedValue},
+	{regexp.MustCompile(`(?i)\b((?:api[_-]?key|access[_-]?token|token|secret|password|passwd)["']?\s*[:=]\s*["']?)[^\s"'&,;]+`), "${1}" + redactedValue},
+}
+
+// sensitiveLogKey matches the names of log attributes whose values are redacted entirely.
+var sensitiveLogKey = regexp.MustCompile(`(?i)(api[_-]?key|token|secret|password|authorization|cookie)`)
+
+// logRedactor removes credentials and configured PII from log lines.
+type logRedactor struct {
+	redactions []logRedaction
+}
+
+func newLogRedactor(patterns []string) (*logRedactor, error) {
+	r := &logRedactor{redactions: append([]logRedaction{}, builtinLogRedactions...)}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log redaction pattern %q: %w", p, err)
+		}
+		r.redactions = append(r.redactions, logRedaction{re: re, repl: redactedValue})
+	}
+	return r, nil
+}
+
+func (r *logRedactor) redact(s string) string {
+	for _, rd := range r.redactions {
+		s = rd.re.ReplaceAllString(s, rd.repl)
+	}
+	return s
+}
+
+// args redacts the values of key/value log arguments.
+func (r *logRedactor) args(args []any) []any {
+	out := make([]any, len(args))
+	for i, v := range args {
+		if i%2 == 1 {
+			if k, ok := args[i-1].(string); ok && sensitiveLogKey.MatchString(k) {
+				out[i] = redactedValue
+				continue
+			}
+		}
+		switch v := v.(type) {
+		case string:
+			out[i] = r.redact(v)
+		case error:
+			out[i] = r.redact(v.Error())
+		case fmt.Stringer:
+			out[i] = r.redact(v.String())
+		case []string:
+			s := make([]string, len(v))
+			for j := range v {
+				s[j] = r.redact(v[j])
+			}
+			out[i] = s
+		default:
+			out[i] = v
+		}
+	}
+	return out
+}
+
+// contextLogger is a log.Logger that redacts every line and drops debug lines unless
+// debug logging is enabled for the org.
+type contextLogger struct {
+	base     log.Logger
+	redactor *logRedactor
+	debug    bool
+}
+
+func (l contextLogger) Debug(msg string, args ...any) {
+	if l.debug {
+		l.base.Debug(l.redactor.redact(msg), l.redactor.args(args)...)
+	}
+}
+
+func (l contextLogger) Info(msg string, args ...any) {
+	l.base.Info(l.redactor.redact(msg), l.redactor.args(args)...)
+}
+
+func (l contextLogger) Warn(msg string, args ...any) {
+	l.base.Warn(l.redactor.redact(msg), l.redactor.args(args)...)
+}
+
+func (l contextLogger) Error(msg string, args ...any) {
+	l.base.Error(l.redactor.redact(msg), l.redactor.args(args)...)
+}
+
+func (l contextLogger) With(args ...any) log.Logger {
+	l.base = l.base.With(l.redactor.args(args)...)
+	return l
+}
+
+func (l contextLogger) Level() log.Level {
+	if l.debug {
+		return log.Debug
+	}
+	return log.Info
+}
+
+func (l contextLogger) FromContext(ctx context.Context) log.Logger {
+	return l.With(log.ContextualAttributesFromContext(ctx)...)
+}
+
+// logger returns the logger for ctx, with the org and the correlation attributes of ctx.
+func (a *App) logger(ctx context.Context) log.Logger {
+	l := contextLogger{base: a.baseLogger, redactor: a.logRedactor, debug: a.debugLogging.Load()}
+	return l.With(logKeyOrgID, a.orgID).FromContext(ctx)
+}
+
+// withLogAttrs returns a context whose logger adds the key/value pairs to every line.
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	return log.WithContextualAttributes(ctx, args)
+}
+
+// validRequestID matches request IDs accepted from callers.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// withRequestLogging attaches the request ID, user, route and, for investigation routes,
+// the investigation ID to the logger of each request served by next.
+func withRequestLogging(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+		_, route := mux.Handler(req)
+		args := []any{logKeyRequestID, id, logKeyRoute, route}
+		if u := backend.UserFromContext(req.Context()); u != nil && u.Login != "" {
+			args = append(args, logKeyUser, u.Login)
+		}
+		if strings.HasPrefix(route, "/investigations/{id}") {
+			args = append(args, logKeyInvestigationID, patternValue(route, req.URL.Path, "id"))
+		}
+		next.ServeHTTP(w, req.WithContext(withLogAttrs(req.Context(), args...)))
+	})
+}
+
+// patternValue returns the path segment matching the {name} wildcard of a route pattern.
+func patternValue(pattern, path, name string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range strings.Split(strings.Trim(pattern, "/"), "/") {
+		if s == "{"+name+"}" && i < len(segments) {
+			return segments[i]
+		}
+	}
+	return ""
+}
+
+// handleLogging shows the org's debug logging override on GET and changes it on PUT,
+// which requires the Admin role.
+func (a *App) handleLogging(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if u := backend.UserFromContext(req.Context()); u == nil || u.Role != "Admin" {
+			http.Error(w, "changing the log level requires the Admin role", http.StatusForbidden)
+			return
+		}
+		var body struct {
+			Debug *bool `json:"debug"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Debug == nil {
+			http.Error(w, "invalid request body: debug is required", http.StatusBadRequest)
+			return
+		}
+		a.debugLogging.Store(*body.Debug)
+		a.logger(req.Context()).Info("Debug logging changed", "debug", *body.Debug)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"debug": a.debugLogging.Load()})
+}
@@ -0,0 +1,256 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sre/assistant/pkg/plugin/logql"
+)
+
+const (
+	// logqlContextLabelValues is the number of values included per label in a generation prompt.
+	logqlContextLabelValues = 50
+	// logqlContextLabels is the number of labels whose values are offered when the caller names none.
+	logqlContextLabels = 5
+)
+
+// lokiCatalog looks up the label names and values of a Loki datasource through the
+// Loki MCP tools, caching results for the lifetime of a single request.
+type lokiCatalog struct {
+	mcp           mcpToolCaller
+	datasourceUID string
+
+	names map[string]bool
+}
+
+func newLokiCatalog(mcp mcpToolCaller, datasourceUID string) *lokiCatalog {
+	return &lokiCatalog{mcp: mcp, datasourceUID: datasourceUID}
+}
+
+// labelNames lists the label names of the datasource.
+func (c *lokiCatalog) labelNames(ctx context.Context) ([]string, error) {
+	var names []string
+	err := callToolJSON(ctx, c.mcp, "list_loki_label_names", map[string]any{"datasourceUid": c.datasourceUID}, &names)
+	if err != nil {
+		return nil, err
+	}
+	c.names = make(map[string]bool, len(names))
+	for _, n := range names {
+		c.names[n] = true
+	}
+	return names, nil
+}
+
+// labelExists reports whether a label name exists in the datasource.
+func (c *lokiCatalog) labelExists(ctx context.Context, name string) (bool, error) {
+	if c.names == nil {
+		if _, err := c.labelNames(ctx); err != nil {
+			return false, err
+		}
+	}
+	return c.names[name], nil
+}
+
+// labelValues lists the values of a label.
+func (c *lokiCatalog) labelValues(ctx context.Context, label string) ([]string, error) {
+	var values []string
+	err := callToolJSON(ctx, c.mcp, "list_loki_label_values", map[string]any{
+		"datasourceUid": c.datasourceUID,
+		"labelName":     label,
+	}, &values)
+	return values, err
+}
+
+// logqlSelectorLabels returns the stream selector labels referenced by an expression, in order.
+func logqlSelectorLabels(expr logql.Expr) []string {
+	set := map[string]bool{}
+	logql.Inspect(expr, func(n logql.Node) bool {
+		if m, ok := n.(*logql.Matcher); ok {
+			set[m.Name] = true
+		}
+		return true
+	})
+	return sortedKeys(set)
+}
+
+// validateLogQL parses a query and checks that its stream selectors only use labels that
+// exist in the datasource. Labels extracted by parsers are not indexed and are not checked.
+// Problems with the query are returned as *invalidQueryError.
+func validateLogQL(ctx context.Context, catalog *lokiCatalog, query string) ([]string, error) {
+	if query == "" {
+		return nil, invalidQuery("query is empty")
+	}
+	expr, err := logql.ParseExpr(query)
+	if err != nil {
+		return nil, invalidQuery("%s", err)
+	}
+	selectorLabels := logqlSelectorLabels(expr)
+	for _, l := range selectorLabels {
+		ok, err := catalog.labelExists(ctx, l)
+		if err != nil {
+			return selectorLabels, err
+		}
+		if !ok {
+			names, _ := catalog.labelNames(ctx)
+			return selectorLabels, invalidQuery("stream label %q does not exist (available labels: %s)", l, limitedList(names, 30))
+		}
+	}
+	return selectorLabels, nil
+}
+
+const logqlSystemPrompt = `You are an expert in Grafana Loki and LogQL helping SRE engineers.
+Translate the user's question into a single LogQL query.
+Rules:
+- Stream selectors ({...}) may only use the labels that appear in the provided context.
+- Use line filters (|= "text", |~ "regex") before parsers such as | json or | logfmt, and label filters after them.
+- For counts, rates or trends, wrap the log query in a range aggregation such as count_over_time(...[5m]) or rate(...[5m]) and aggregate with sum by (...).
+- Use | unwrap <label> for sum_over_time, avg_over_time, quantile_over_time and similar.
+- Do not add a time range outside of range selectors; the caller chooses the time range.
+Reply only with a JSON object: {"query": "<LogQL>", "explanation": "<one or two sentences>"}.`
+
+// logqlGenerateRequest is the body of POST /query/logql/generate.
+type logqlGenerateRequest struct {
+	Question      string `json:"question"`
+	DatasourceUID string `json:"datasourceUid"`
+	// Labels optionally lists labels whose values should be offered to the LLM.
+	Labels []string `json:"labels"`
+}
+
+// logqlPrompt builds the user prompt, gathering label and label value context from the datasource.
+func logqlPrompt(ctx context.Context, catalog *lokiCatalog, body logqlGenerateRequest) (string, error) {
+	names, err := catalog.labelNames(ctx)
+	if err != nil {
+		return "", err
+	}
+	labels := body.Labels
+	if len(labels) == 0 {
+		labels = rankByRelevance(body.Question, names, logqlContextLabels)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Question: %s\n\nAvailable stream labels: %s\n", body.Question, strings.Join(names, ", "))
+	for _, l := range labels {
+		values, err := catalog.labelValues(ctx, l)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "Values of label %s: %s\n", l, limitedList(rankByRelevance(body.Question, values, len(values)), logqlContextLabelValues))
+	}
+	return b.String(), nil
+}
+
+// handleLogQLGenerate translates a natural-language question into a validated LogQL query.
+func (a *App) handleLogQLGenerate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body logqlGenerateRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(body.Question) == "" || body.DatasourceUID == "" {
+		http.Error(w, "question and datasourceUid are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	catalog := newLokiCatalog(a.mcp, body.DatasourceUID)
+	prompt, err := logqlPrompt(ctx, catalog, body)
+	if err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	var labels []string
+	q, attempts, err := a.generateQuery(ctx, logqlSystemPrompt, prompt, func(ctx context.Context, query string) error {
+		var err error
+		labels, err = validateLogQL(ctx, catalog, query)
+		return err
+	})
+	var degraded degradation
+	if llmUnavailable(err) {
+		degraded = a.degrade(ctx, featureQuery, err)
+		q, labels, err = logqlFallback(ctx, catalog, body)
+	}
+	var invalid *invalidQueryError
+	if errors.Is(err, errQueryGenerationFailed) || errors.As(err, &invalid) {
+		writeJSON(w, http.StatusUnprocessableEntity, degraded.annotate(map[string]any{"error": err.Error(), "attempts": attempts}))
+		return
+	}
+	if err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, degraded.annotate(map[string]any{
+		"query":       q.Query,
+		"explanation": q.Explanation,
+		"labels":      labels,
+		"attempts":    attempts,
+	}))
+}
+
+// logqlFilterWords are the words of a question that add a case-insensitive line filter
+// to a template query.
+var logqlFilterWords = []string{"error", "exception", "fail", "panic", "timeout", "warn"}
+
+// logqlCountWords are the words of a question asking for a count or rate of log lines.
+var logqlCountWords = []string{"how many", "count", "number of", "rate", "per second", "per minute"}
+
+// logqlFallback builds a template query without the LLM: a stream selector on the label
+// value that best matches the question, a line filter for the problem words it mentions,
+// and a count over time if it asks for one. It fails with an *invalidQueryError if no
+// label value matches.
+func logqlFallback(ctx context.Context, catalog *lokiCatalog, body logqlGenerateRequest) (generatedQuery, []string, error) {
+	names, err := catalog.labelNames(ctx)
+	if err != nil {
+		return generatedQuery{}, nil, err
+	}
+	labels := body.Labels
+	if len(labels) == 0 {
+		labels = rankByRelevance(body.Question, names, logqlContextLabels)
+	}
+	var selector string
+	for _, l := range labels {
+		values, err := catalog.labelValues(ctx, l)
+		if err != nil {
+			return generatedQuery{}, nil, err
+		}
+		if v, ok := mostRelevant(body.Question, values); ok {
+			selector = fmt.Sprintf("{%s=%s}", l, strconv.Quote(v))
+			break
+		}
+	}
+	if selector == "" {
+		return generatedQuery{}, nil, invalidQuery("no label value matches the question")
+	}
+	question := strings.ToLower(body.Question)
+	query := selector
+	var filters []string
+	for _, w := range logqlFilterWords {
+		if strings.Contains(question, w) {
+			filters = append(filters, w)
+		}
+	}
+	if len(filters) > 0 {
+		query += fmt.Sprintf(" |~ %s", strconv.Quote("(?i)"+strings.Join(filters, "|")))
+	}
+	explanation := "Log lines of the streams " + selector
+	for _, w := range logqlCountWords {
+		if strings.Contains(question, w) {
+			query = fmt.Sprintf("sum(count_over_time(%s[5m]))", query)
+			explanation = "The number of log lines per 5 minutes of the streams " + selector
+			break
+		}
+	}
+	if len(filters) > 0 {
+		explanation += " that mention " + strings.Join(filters, " or ")
+	}
+	selectorLabels, err := validateLogQL(ctx, catalog, query)
+	return generatedQuery{Query: query, Explanation: explanation + "."}, selectorLabels, err
+}
@@ -0,0 +1,414 @@
+// Package logql parses and validates LogQL, the query language of Loki.
+//
+// The parser covers log queries (stream selectors with line filters, parsers,
+// label filters and formatting stages) and metric queries (range and vector
+// aggregations, binary operations, label_replace and vector). It is meant for
+// validating and describing queries, not for executing them.
+package logql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Node is any node of a parsed query.
+type Node interface {
+	String() string
+}
+
+// Expr is a complete log or metric expression.
+type Expr interface {
+	Node
+	expr()
+}
+
+// Matcher is a stream selector label matcher, e.g. app="checkout".
+type Matcher struct {
+	Name  string
+	Op    string // one of =, !=, =~, !~
+	Value string
+}
+
+func (m *Matcher) String() string { return m.Name + m.Op + strconv.Quote(m.Value) }
+
+// Stage is a stage of a log pipeline.
+type Stage interface {
+	Node
+	stage()
+}
+
+// LogExpr is a log query: a stream selector followed by a pipeline.
+type LogExpr struct {
+	Matchers []*Matcher
+	Pipeline []Stage
+}
+
+func (e *LogExpr) String() string {
+	ms := make([]string, len(e.Matchers))
+	for i, m := range e.Matchers {
+		ms[i] = m.String()
+	}
+	var b strings.Builder
+	b.WriteString("{" + strings.Join(ms, ", ") + "}")
+	for _, s := range e.Pipeline {
+		b.WriteString(" " + s.String())
+	}
+	return b.String()
+}
+
+// LineFilter filters log lines, e.g. |= "error" or "timeout".
+type LineFilter struct {
+	Op string // one of |=, !=, |~, !~, |>, !>
+	// Values are alternatives chained with "or".
+	Values []string
+	// IP is set for ip("...") filters, in which case Values holds the CIDR or range.
+	IP bool
+}
+
+func (f *LineFilter) String() string {
+	vs := make([]string, len(f.Values))
+	for i, v := range f.Values {
+		vs[i] = strconv.Quote(v)
+		if f.IP {
+			vs[i] = "ip(" + vs[i] + ")"
+		}
+	}
+	return f.Op + " " + strings.Join(vs, " or ")
+}
+
+// LabelParam is a label extracted or formatted by a pipeline stage, e.g. status="response.code".
+type LabelParam struct {
+	Name string
+	// Value is the expression or template; empty when only the label name is given.
+	Value string
+	// Ident is true when Value is a label name rather than a string, as in label_format a=b.
+	Ident bool
+}
+
+func (p LabelParam) String() string {
+	switch {
+	case p.Value == "" && !p.Ident:
+		return p.Name
+	case p.Ident:
+		return p.Name + "=" + p.Value
+	default:
+		return p.Name + "=" + strconv.Quote(p.Value)
+	}
+}
+
+func joinParams(ps []LabelParam) string {
+	out := make([]string, len(ps))
+	for i, p := range ps {
+		out[i] = p.String()
+	}
+	return strings.Join(out, ", ")
+}
+
+// ParserStage extracts labels from log lines: json, logfmt, regexp, pattern or unpack.
+type ParserStage struct {
+	Parser string
+	// Expression is the regexp or pattern expression.
+	Expression string
+	Flags      []string
+	Params     []LabelParam
+}
+
+func (s *ParserStage) String() string {
+	out := "| " + s.Parser
+	for _, f := range s.Flags {
+		out += " " + f
+	}
+	if s.Parser == "regexp" || s.Parser == "pattern" {
+		out += " " + strconv.Quote(s.Expression)
+	}
+	if len(s.Params) > 0 {
+		out += " " + joinParams(s.Params)
+	}
+	return out
+}
+
+// LabelFilter is a label filter expression.
+type LabelFilter interface {
+	Node
+	labelFilter()
+}
+
+// LabelComparison compares a label with a value, e.g. status >= 500.
+type LabelComparison struct {
+	Name string
+	Op   string
+	// Value is the compared value as written, without quotes for strings.
+	Value string
+	// Kind is one of "string", "number", "duration", "bytes" or "ip".
+	Kind string
+}
+
+func (c *LabelComparison) String() string {
+	switch c.Kind {
+	case "string":
+		return c.Name + c.Op + strconv.Quote(c.Value)
+	case "ip":
+		return c.Name + c.Op + "ip(" + strconv.Quote(c.Value) + ")"
+	default:
+		return c.Name + c.Op + c.Value
+	}
+}
+
+// LabelBinary combines two label filters with "and" or "or".
+type LabelBinary struct {
+	Op       string
+	LHS, RHS LabelFilter
+}
+
+func (b *LabelBinary) String() string {
+	return "(" + b.LHS.String() + " " + b.Op + " " + b.RHS.String() + ")"
+}
+
+// LabelFilterStage filters log lines by their labels.
+type LabelFilterStage struct {
+	Filter LabelFilter
+}
+
+func (s *LabelFilterStage) String() string { return "| " + s.Filter.String() }
+
+// FormatStage is one of line_format, label_format, drop, keep or decolorize.
+type FormatStage struct {
+	Op string
+	// Template is the line_format template.
+	Template string
+	Params   []LabelParam
+}
+
+func (s *FormatStage) String() string {
+	switch s.Op {
+	case "line_format":
+		return "| line_format " + strconv.Quote(s.Template)
+	case "decolorize":
+		return "| decolorize"
+	default:
+		return "| " + s.Op + " " + joinParams(s.Params)
+	}
+}
+
+// UnwrapStage selects the label a range aggregation operates on.
+type UnwrapStage struct {
+	Label string
+	// Conversion is "duration", "duration_seconds" or "bytes", if any.
+	Conversion string
+}
+
+func (s *UnwrapStage) String() string {
+	if s.Conversion != "" {
+		return "| unwrap " + s.Conversion + "(" + s.Label + ")"
+	}
+	return "| unwrap " + s.Label
+}
+
+func (*LineFilter) stage()       {}
+func (*ParserStage) stage()      {}
+func (*LabelFilterStage) stage() {}
+func (*FormatStage) stage()      {}
+func (*UnwrapStage) stage()      {}
+
+func (*LabelComparison) labelFilter() {}
+func (*LabelBinary) labelFilter()     {}
+
+// LogRange is a log query over a range window, the argument of a range aggregation.
+type LogRange struct {
+	Log    *LogExpr
+	Range  time.Duration
+	Offset time.Duration
+}
+
+// Unwrap returns the unwrap stage of the range, if any.
+func (r *LogRange) Unwrap() *UnwrapStage {
+	for _, s := range r.Log.Pipeline {
+		if u, ok := s.(*UnwrapStage); ok {
+			return u
+		}
+	}
+	return nil
+}
+
+func (r *LogRange) String() string {
+	out := r.Log.String() + " [" + model.Duration(r.Range).String() + "]"
+	if r.Offset != 0 {
+		out += " offset " + model.Duration(r.Offset).String()
+	}
+	return out
+}
+
+// Grouping is a by or without clause.
+type Grouping struct {
+	Without bool
+	Labels  []string
+}
+
+func (g *Grouping) String() string {
+	kw := "by"
+	if g.Without {
+		kw = "without"
+	}
+	return kw + " (" + strings.Join(g.Labels, ", ") + ")"
+}
+
+// RangeAggregationExpr applies a function such as rate or count_over_time to a log range.
+type RangeAggregationExpr struct {
+	Op       string
+	Param    *float64
+	Range    *LogRange
+	Grouping *Grouping
+}
+
+func (e *RangeAggregationExpr) String() string {
+	out := e.Op + "("
+	if e.Param != nil {
+		out += formatFloat(*e.Param) + ", "
+	}
+	out += e.Range.String() + ")"
+	if e.Grouping != nil {
+		out += " " + e.Grouping.String()
+	}
+	return out
+}
+
+// VectorAggregationExpr aggregates a metric expression, e.g. sum by (app) (...).
+type VectorAggregationExpr struct {
+	Op       string
+	Param    *float64
+	Grouping *Grouping
+	Expr     Expr
+}
+
+func (e *VectorAggregationExpr) String() string {
+	out := e.Op
+	if e.Grouping != nil {
+		out += " " + e.Grouping.String() + " "
+	}
+	out += "("
+	if e.Param != nil {
+		out += formatFloat(*e.Param) + ", "
+	}
+	return out + e.Expr.String() + ")"
+}
+
+// VectorMatching is an on/ignoring clause of a binary operation.
+type VectorMatching struct {
+	On     bool
+	Labels []string
+	// Group is "group_left" or "group_right", if any.
+	Group   string
+	Include []string
+}
+
+func (m *VectorMatching) String() string {
+	kw := "ignoring"
+	if m.On {
+		kw = "on"
+	}
+	out := kw + " (" + strings.Join(m.Labels, ", ") + ")"
+	if m.Group != "" {
+		out += " " + m.Group
+		if len(m.Include) > 0 {
+			out += " (" + strings.Join(m.Include, ", ") + ")"
+		}
+	}
+	return out
+}
+
+// BinaryExpr is a binary operation between two metric expressions.
+type BinaryExpr struct {
+	Op         string
+	LHS, RHS   Expr
+	ReturnBool bool
+	Matching   *VectorMatching
+}
+
+func (e *BinaryExpr) String() string {
+	op := e.Op
+	if e.ReturnBool {
+		op += " bool"
+	}
+	if e.Matching != nil {
+		op += " " + e.Matching.String()
+	}
+	return "(" + e.LHS.String() + " " + op + " " + e.RHS.String() + ")"
+}
+
+// LiteralExpr is a number.
+type LiteralExpr struct {
+	Value float64
+}
+
+func (e *LiteralExpr) String() string { return formatFloat(e.Value) }
+
+// VectorExpr is vector(<number>).
+type VectorExpr struct {
+	Value float64
+}
+
+func (e *VectorExpr) String() string { return "vector(" + formatFloat(e.Value) + ")" }
+
+// LabelReplaceExpr is label_replace(expr, dst, replacement, src, regex).
+type LabelReplaceExpr struct {
+	Expr                          Expr
+	Dst, Replacement, Src, Regexp string
+}
+
+func (e *LabelReplaceExpr) String() string {
+	return fmt.Sprintf("label_replace(%s, %q, %q, %q, %q)", e.Expr, e.Dst, e.Replacement, e.Src, e.Regexp)
+}
+
+func (*LogExpr) expr()               {}
+func (*RangeAggregationExpr) expr()  {}
+func (*VectorAggregationExpr) expr() {}
+func (*BinaryExpr) expr()            {}
+func (*LiteralExpr) expr()           {}
+func (*VectorExpr) expr()            {}
+func (*LabelReplaceExpr) expr()      {}
+
+func formatFloat(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+
+// IsMetric reports whether e is a metric query rather than a log query.
+func IsMetric(e Expr) bool {
+	_, isLog := e.(*LogExpr)
+	return !isLog
+}
+
+// Inspect calls fn for every node of the expression in depth-first order, including
+// log ranges, pipeline stages and label filters. If fn returns false, the children
+// of that node are skipped.
+func Inspect(node Node, fn func(Node) bool) {
+	if node == nil || !fn(node) {
+		return
+	}
+	switch n := node.(type) {
+	case *LogExpr:
+		for _, m := range n.Matchers {
+			Inspect(m, fn)
+		}
+		for _, s := range n.Pipeline {
+			Inspect(s, fn)
+		}
+	case *LabelFilterStage:
+		Inspect(n.Filter, fn)
+	case *LabelBinary:
+		Inspect(n.LHS, fn)
+		Inspect(n.RHS, fn)
+	case *LogRange:
+		Inspect(n.Log, fn)
+	case *RangeAggregationExpr:
+		Inspect(n.Range, fn)
+	case *VectorAggregationExpr:
+		Inspect(n.Expr, fn)
+	case *BinaryExpr:
+		Inspect(n.LHS, fn)
+		Inspect(n.RHS, fn)
+	case *LabelReplaceExpr:
+		Inspect(n.Expr, fn)
+	}
+}
@@ -0,0 +1,140 @@
+package logql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	// tokUnitNumber is a number followed by a unit, such as 5m or 10MB.
+	tokUnitNumber
+	tokFlag
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	// text is the token as written; for strings it is the unquoted value.
+	text string
+	pos  int
+}
+
+func (t token) describe() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// operators ordered so that longer operators are matched first.
+var operators = []string{
+	"|=", "|~", "|>", "!=", "!~", "!>", "=~", "==", ">=", "<=",
+	"{", "}", "(", ")", "[", "]", ",", "|", "=", ">", "<", "+", "-", "*", "/", "%", "^",
+}
+
+// lex splits a query into tokens.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		r, size := utf8.DecodeRuneInString(input[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '#':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case r == '"' || r == '`':
+			end, err := scanString(input, i)
+			if err != nil {
+				return nil, err
+			}
+			s, err := strconv.Unquote(input[i:end])
+			if err != nil {
+				return nil, &Error{Pos: i, Msg: "invalid string literal " + input[i:end]}
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, pos: i})
+			i = end
+		case r >= '0' && r <= '9' || r == '.' && i+1 < len(input) && isDigit(input[i+1]):
+			start := i
+			for i < len(input) && (isDigit(input[i]) || input[i] == '.') {
+				i++
+			}
+			if i < len(input) && (input[i] == 'e' || input[i] == 'E') && i+1 < len(input) && (isDigit(input[i+1]) || input[i+1] == '-' || input[i+1] == '+') {
+				i += 2
+				for i < len(input) && isDigit(input[i]) {
+					i++
+				}
+			}
+			kind := tokNumber
+			// Units may be combined, as in 1h30m.
+			for i < len(input) && (isLetter(input[i]) || isDigit(input[i]) || input[i] == '.') {
+				kind = tokUnitNumber
+				i++
+			}
+			if strings.HasPrefix(input[i:], "µs") {
+				kind = tokUnitNumber
+				i += len("µs")
+			}
+			tokens = append(tokens, token{kind: kind, text: input[start:i], pos: start})
+		case isLetter(input[i]) || input[i] == '_':
+			start := i
+			for i < len(input) && (isLetter(input[i]) || isDigit(input[i]) || input[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: input[start:i], pos: start})
+		case strings.HasPrefix(input[i:], "--"):
+			start := i
+			i += 2
+			for i < len(input) && (isLetter(input[i]) || input[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokFlag, text: input[start:i], pos: start})
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(input[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, &Error{Pos: i, Msg: fmt.Sprintf("unexpected character %q", r)}
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+// scanString returns the end offset of the string literal starting at start.
+func scanString(input string, start int) (int, error) {
+	quote := input[start]
+	for i := start + 1; i < len(input); i++ {
+		switch {
+		case input[i] == '\\' && quote == '"':
+			i++
+		case input[i] == quote:
+			return i + 1, nil
+		}
+	}
+	return 0, &Error{Pos: start, Msg: "unterminated string literal"}
+}
+
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
@@ -0,0 +1,854 @@
+package logql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Error is a parse or validation error. Pos is the byte offset of the query the
+// error refers to, or -1 for errors found after parsing.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	if e.Pos < 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("parse error at char %d: %s", e.Pos+1, e.Msg)
+}
+
+func semanticError(format string, args ...any) *Error {
+	return &Error{Pos: -1, Msg: fmt.Sprintf(format, args...)}
+}
+
+var (
+	// rangeAggregations maps each range aggregation to whether it requires an unwrap stage.
+	rangeAggregations = map[string]bool{
+		"rate":               false,
+		"count_over_time":    false,
+		"bytes_rate":         false,
+		"bytes_over_time":    false,
+		"absent_over_time":   false,
+		"rate_counter":       true,
+		"sum_over_time":      true,
+		"avg_over_time":      true,
+		"max_over_time":      true,
+		"min_over_time":      true,
+		"stdvar_over_time":   true,
+		"stddev_over_time":   true,
+		"quantile_over_time": true,
+		"first_over_time":    true,
+		"last_over_time":     true,
+	}
+	vectorAggregations = map[string]bool{
+		"sum": true, "avg": true, "min": true, "max": true, "count": true,
+		"stddev": true, "stdvar": true, "topk": true, "bottomk": true,
+		"sort": true, "sort_desc": true,
+	}
+	parsers = map[string]bool{"json": true, "logfmt": true, "regexp": true, "pattern": true, "unpack": true}
+	// binaryPrecedence lists binary operators from lowest to highest precedence.
+	binaryPrecedence = map[string]int{
+		"or": 1, "and": 2, "unless": 2,
+		"==": 3, "!=": 3, ">": 3, ">=": 3, "<": 3, "<=": 3,
+		"+": 4, "-": 4,
+		"*": 5, "/": 5, "%": 5,
+		"^": 6,
+	}
+)
+
+// RangeAggregation reports whether op is a range aggregation such as rate.
+func RangeAggregation(op string) bool {
+	_, ok := rangeAggregations[op]
+	return ok
+}
+
+// ParseExpr parses and validates a LogQL query.
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t, "end of query")
+	}
+	if err := validate(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) peekAt(n int) token {
+	if p.pos+n < len(p.tokens) {
+		return p.tokens[p.pos+n]
+	}
+	return p.tokens[len(p.tokens)-1]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) is(kind tokenKind, text string) bool {
+	t := p.peek()
+	return t.kind == kind && t.text == text
+}
+
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if p.is(kind, text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		return p.unexpected(p.peek(), strconv.Quote(text))
+	}
+	return nil
+}
+
+func (p *parser) expectIdent() (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent {
+		return "", p.unexpected(t, "a label name")
+	}
+	p.next()
+	return t.text, nil
+}
+
+func (p *parser) expectString() (string, error) {
+	t := p.peek()
+	if t.kind != tokString {
+		return "", p.unexpected(t, "a string")
+	}
+	p.next()
+	return t.text, nil
+}
+
+func (p *parser) unexpected(t token, expected string) error {
+	return &Error{Pos: t.pos, Msg: fmt.Sprintf("unexpected %s, expected %s", t.describe(), expected)}
+}
+
+// parseExpr parses a binary expression whose operators bind tighter than minPrec.
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec, ok := binaryPrecedence[t.text]
+		if !ok || (t.kind != tokOp && t.kind != tokIdent) || prec <= minPrec {
+			return lhs, nil
+		}
+		p.next()
+		be := &BinaryExpr{Op: t.text, LHS: lhs}
+		if p.accept(tokIdent, "bool") {
+			be.ReturnBool = true
+		}
+		if be.Matching, err = p.parseVectorMatching(); err != nil {
+			return nil, err
+		}
+		// ^ is right-associative, everything else is left-associative.
+		next := prec
+		if t.text == "^" {
+			next = prec - 1
+		}
+		if be.RHS, err = p.parseExpr(next); err != nil {
+			return nil, err
+		}
+		for _, side := range []Expr{be.LHS, be.RHS} {
+			if !IsMetric(side) {
+				return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("binary operator %s needs metric queries on both sides, not log queries", t.text)}
+			}
+		}
+		if be.ReturnBool && prec != 3 {
+			return nil, &Error{Pos: t.pos, Msg: "bool modifier can only be used on comparison operators"}
+		}
+		lhs = be
+	}
+}
+
+func (p *parser) parseVectorMatching() (*VectorMatching, error) {
+	var m VectorMatching
+	switch {
+	case p.accept(tokIdent, "on"):
+		m.On = true
+	case p.accept(tokIdent, "ignoring"):
+	default:
+		return nil, nil
+	}
+	var err error
+	if m.Labels, err = p.parseLabelList(); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokIdent && (t.text == "group_left" || t.text == "group_right") {
+		p.next()
+		m.Group = t.text
+		if p.is(tokOp, "(") {
+			if m.Include, err = p.parseLabelList(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &m, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if t := p.peek(); t.kind == tokOp && (t.text == "-" || t.text == "+") {
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "+" {
+			return e, nil
+		}
+		if lit, ok := e.(*LiteralExpr); ok {
+			return &LiteralExpr{Value: -lit.Value}, nil
+		}
+		return &BinaryExpr{Op: "*", LHS: &LiteralExpr{Value: -1}, RHS: e}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && t.text == "(":
+		p.next()
+		e, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(tokOp, ")")
+	case t.kind == tokOp && t.text == "{":
+		return p.parseLogExpr()
+	case t.kind == tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &Error{Pos: t.pos, Msg: "invalid number " + t.text}
+		}
+		return &LiteralExpr{Value: v}, nil
+	case t.kind == tokIdent && RangeAggregation(t.text):
+		return p.parseRangeAggregation()
+	case t.kind == tokIdent && vectorAggregations[t.text]:
+		return p.parseVectorAggregation()
+	case t.kind == tokIdent && t.text == "label_replace":
+		return p.parseLabelReplace()
+	case t.kind == tokIdent && t.text == "vector":
+		p.next()
+		if err := p.expect(tokOp, "("); err != nil {
+			return nil, err
+		}
+		v, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		return &VectorExpr{Value: v}, p.expect(tokOp, ")")
+	case t.kind == tokIdent:
+		return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("unknown function or keyword %q", t.text)}
+	default:
+		return nil, p.unexpected(t, "a stream selector, an aggregation or a number")
+	}
+}
+
+func (p *parser) parseNumber() (float64, error) {
+	neg := p.accept(tokOp, "-")
+	t := p.peek()
+	if t.kind != tokNumber {
+		return 0, p.unexpected(t, "a number")
+	}
+	p.next()
+	v, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return 0, &Error{Pos: t.pos, Msg: "invalid number " + t.text}
+	}
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+func (p *parser) parseDuration() (time.Duration, error) {
+	t := p.peek()
+	if t.kind != tokUnitNumber {
+		return 0, p.unexpected(t, "a duration")
+	}
+	p.next()
+	d, err := model.ParseDuration(t.text)
+	if err != nil {
+		return 0, &Error{Pos: t.pos, Msg: fmt.Sprintf("invalid duration %q", t.text)}
+	}
+	return time.Duration(d), nil
+}
+
+func (p *parser) parseLogExpr() (*LogExpr, error) {
+	e := &LogExpr{}
+	if err := p.expect(tokOp, "{"); err != nil {
+		return nil, err
+	}
+	for !p.accept(tokOp, "}") {
+		if len(e.Matchers) > 0 {
+			if err := p.expect(tokOp, ","); err != nil {
+				return nil, err
+			}
+		}
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		op := p.peek()
+		if op.kind != tokOp || (op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~") {
+			return nil, p.unexpected(op, "one of =, !=, =~ or !~")
+		}
+		p.next()
+		value, err := p.expectString()
+		if err != nil {
+			return nil, err
+		}
+		e.Matchers = append(e.Matchers, &Matcher{Name: name, Op: op.text, Value: value})
+	}
+	var err error
+	e.Pipeline, err = p.parsePipeline()
+	return e, err
+}
+
+func (p *parser) parsePipeline() ([]Stage, error) {
+	var stages []Stage
+	for {
+		t := p.peek()
+		if t.kind != tokOp {
+			return stages, nil
+		}
+		switch t.text {
+		case "|=", "!=", "|~", "!~", "|>", "!>":
+			f, err := p.parseLineFilter()
+			if err != nil {
+				return nil, err
+			}
+			stages = append(stages, f)
+		case "|":
+			p.next()
+			s, err := p.parseStage()
+			if err != nil {
+				return nil, err
+			}
+			stages = append(stages, s)
+		default:
+			return stages, nil
+		}
+	}
+}
+
+func (p *parser) parseLineFilter() (*LineFilter, error) {
+	f := &LineFilter{Op: p.next().text}
+	for {
+		if p.accept(tokIdent, "ip") {
+			if err := p.expect(tokOp, "("); err != nil {
+				return nil, err
+			}
+			v, err := p.expectString()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokOp, ")"); err != nil {
+				return nil, err
+			}
+			f.IP = true
+			f.Values = append(f.Values, v)
+		} else {
+			v, err := p.expectString()
+			if err != nil {
+				return nil, err
+			}
+			f.Values = append(f.Values, v)
+		}
+		if !p.accept(tokIdent, "or") {
+			return f, nil
+		}
+	}
+}
+
+func (p *parser) parseStage() (Stage, error) {
+	t := p.peek()
+	if t.kind == tokIdent && !isComparison(p.peekAt(1)) {
+		switch {
+		case parsers[t.text]:
+			return p.parseParserStage()
+		case t.text == "line_format":
+			p.next()
+			tmpl, err := p.expectString()
+			return &FormatStage{Op: "line_format", Template: tmpl}, err
+		case t.text == "label_format", t.text == "drop", t.text == "keep":
+			p.next()
+			params, err := p.parseParams(t.text == "label_format")
+			if err == nil && len(params) == 0 {
+				err = p.unexpected(p.peek(), "a label name")
+			}
+			return &FormatStage{Op: t.text, Params: params}, err
+		case t.text == "decolorize":
+			p.next()
+			return &FormatStage{Op: "decolorize"}, nil
+		case t.text == "unwrap":
+			return p.parseUnwrap()
+		}
+	}
+	f, err := p.parseLabelFilter()
+	if err != nil {
+		return nil, err
+	}
+	return &LabelFilterStage{Filter: f}, nil
+}
+
+func isComparison(t token) bool {
+	if t.kind != tokOp {
+		return false
+	}
+	switch t.text {
+	case "=", "==", "!=", "=~", "!~", ">", ">=", "<", "<=":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseParserStage() (*ParserStage, error) {
+	s := &ParserStage{Parser: p.next().text}
+	var err error
+	switch s.Parser {
+	case "regexp", "pattern":
+		if s.Expression, err = p.expectString(); err != nil {
+			return nil, err
+		}
+	case "json", "logfmt":
+		for p.peek().kind == tokFlag {
+			s.Flags = append(s.Flags, p.next().text)
+		}
+		if s.Params, err = p.parseParams(false); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// parseParams parses a comma-separated list of name or name="value" parameters. With
+// allowIdent, values may also be label names, as in label_format dst=src.
+func (p *parser) parseParams(allowIdent bool) ([]LabelParam, error) {
+	var params []LabelParam
+	for p.peek().kind == tokIdent {
+		param := LabelParam{Name: p.next().text}
+		if p.accept(tokOp, "=") {
+			t := p.peek()
+			switch {
+			case t.kind == tokString:
+				param.Value = t.text
+			case t.kind == tokIdent && allowIdent:
+				param.Value, param.Ident = t.text, true
+			default:
+				return nil, p.unexpected(t, "a string")
+			}
+			p.next()
+		}
+		params = append(params, param)
+		if !p.accept(tokOp, ",") {
+			break
+		}
+	}
+	return params, nil
+}
+
+func (p *parser) parseUnwrap() (*UnwrapStage, error) {
+	p.next()
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept(tokOp, "(") {
+		return &UnwrapStage{Label: name}, nil
+	}
+	if name != "duration" && name != "duration_seconds" && name != "bytes" {
+		return nil, &Error{Pos: p.tokens[p.pos-2].pos, Msg: fmt.Sprintf("unknown unwrap conversion %q", name)}
+	}
+	label, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	return &UnwrapStage{Label: label, Conversion: name}, p.expect(tokOp, ")")
+}
+
+// parseLabelFilter parses label filters joined by "or", "and" or ",".
+func (p *parser) parseLabelFilter() (LabelFilter, error) {
+	lhs, err := p.parseLabelAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokIdent, "or") {
+		rhs, err := p.parseLabelAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &LabelBinary{Op: "or", LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseLabelAnd() (LabelFilter, error) {
+	lhs, err := p.parseLabelPrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokIdent, "and") || p.accept(tokOp, ",") {
+		rhs, err := p.parseLabelPrimary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &LabelBinary{Op: "and", LHS: lhs, RHS: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *parser) parseLabelPrimary() (LabelFilter, error) {
+	if p.accept(tokOp, "(") {
+		f, err := p.parseLabelFilter()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(tokOp, ")")
+	}
+	t := p.peek()
+	if t.kind != tokIdent {
+		return nil, p.unexpected(t, "a pipeline stage or label filter")
+	}
+	p.next()
+	op := p.peek()
+	if !isComparison(op) {
+		return nil, p.unexpected(op, "a comparison operator")
+	}
+	p.next()
+	c := &LabelComparison{Name: t.text, Op: op.text}
+	v := p.next()
+	switch {
+	case v.kind == tokString:
+		c.Value, c.Kind = v.text, "string"
+	case v.kind == tokNumber:
+		c.Value, c.Kind = v.text, "number"
+	case v.kind == tokOp && v.text == "-" && p.peek().kind == tokNumber:
+		c.Value, c.Kind = "-"+p.next().text, "number"
+	case v.kind == tokUnitNumber:
+		c.Value = v.text
+		if _, err := time.ParseDuration(v.text); err == nil {
+			c.Kind = "duration"
+		} else if _, err := parseBytes(v.text); err == nil {
+			c.Kind = "bytes"
+		} else {
+			return nil, &Error{Pos: v.pos, Msg: fmt.Sprintf("invalid duration or byte size %q", v.text)}
+		}
+	case v.kind == tokIdent && v.text == "ip":
+		if err := p.expect(tokOp, "("); err != nil {
+			return nil, err
+		}
+		s, err := p.expectString()
+		if err != nil {
+			return nil, err
+		}
+		c.Value, c.Kind = s, "ip"
+		if err := p.expect(tokOp, ")"); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, p.unexpected(v, "a string, number, duration or byte size")
+	}
+	if c.Kind == "string" && (c.Op == ">" || c.Op == ">=" || c.Op == "<" || c.Op == "<=") {
+		return nil, &Error{Pos: op.pos, Msg: fmt.Sprintf("operator %s cannot be used with a string value", c.Op)}
+	}
+	if c.Kind != "string" && c.Kind != "ip" && (c.Op == "=~" || c.Op == "!~") {
+		return nil, &Error{Pos: op.pos, Msg: fmt.Sprintf("operator %s needs a string value", c.Op)}
+	}
+	return c, nil
+}
+
+// parseBytes parses a human readable byte size such as 10MB or 1.5KiB.
+func parseBytes(s string) (float64, error) {
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40}, {"pib", 1 << 50},
+		{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12}, {"pb", 1e15}, {"b", 1},
+	}
+	lower := strings.ToLower(s)
+	for _, u := range units {
+		if num, ok := strings.CutSuffix(lower, u.suffix); ok {
+			v, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, err
+			}
+			return v * u.mult, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid byte size %q", s)
+}
+
+func (p *parser) parseLabelList() ([]string, error) {
+	if err := p.expect(tokOp, "("); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for !p.accept(tokOp, ")") {
+		if len(labels) > 0 {
+			if err := p.expect(tokOp, ","); err != nil {
+				return nil, err
+			}
+		}
+		l, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, l)
+	}
+	return labels, nil
+}
+
+func (p *parser) parseGrouping() (*Grouping, error) {
+	var g Grouping
+	switch {
+	case p.accept(tokIdent, "by"):
+	case p.accept(tokIdent, "without"):
+		g.Without = true
+	default:
+		return nil, nil
+	}
+	var err error
+	g.Labels, err = p.parseLabelList()
+	return &g, err
+}
+
+func (p *parser) parseRangeAggregation() (Expr, error) {
+	opTok := p.next()
+	e := &RangeAggregationExpr{Op: opTok.text}
+	if err := p.expect(tokOp, "("); err != nil {
+		return nil, err
+	}
+	if opTok.text == "quantile_over_time" {
+		v, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		e.Param = &v
+		if err := p.expect(tokOp, ","); err != nil {
+			return nil, err
+		}
+	}
+	log, err := p.parseLogExpr()
+	if err != nil {
+		return nil, err
+	}
+	r := &LogRange{Log: log}
+	if err := p.expect(tokOp, "["); err != nil {
+		return nil, err
+	}
+	if r.Range, err = p.parseDuration(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokOp, "]"); err != nil {
+		return nil, err
+	}
+	// The pipeline may also follow the range, as in rate({app="a"}[5m] |= "error").
+	more, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	log.Pipeline = append(log.Pipeline, more...)
+	if p.accept(tokIdent, "offset") {
+		if r.Offset, err = p.parseDuration(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(tokOp, ")"); err != nil {
+		return nil, err
+	}
+	e.Range = r
+	if e.Grouping, err = p.parseGrouping(); err != nil {
+		return nil, err
+	}
+	if e.Grouping != nil && !rangeAggregations[e.Op] {
+		return nil, &Error{Pos: opTok.pos, Msg: fmt.Sprintf("grouping is only allowed on unwrapped range aggregations, not %s", e.Op)}
+	}
+	return e, nil
+}
+
+func (p *parser) parseVectorAggregation() (Expr, error) {
+	opTok := p.next()
+	e := &VectorAggregationExpr{Op: opTok.text}
+	var err error
+	if e.Grouping, err = p.parseGrouping(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokOp, "("); err != nil {
+		return nil, err
+	}
+	if e.Op == "topk" || e.Op == "bottomk" {
+		v, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		e.Param = &v
+		if err := p.expect(tokOp, ","); err != nil {
+			return nil, err
+		}
+	}
+	if e.Expr, err = p.parseExpr(0); err != nil {
+		return nil, err
+	}
+	if !IsMetric(e.Expr) {
+		return nil, &Error{Pos: opTok.pos, Msg: fmt.Sprintf("%s needs a metric query, not a log query; wrap the selector in a range aggregation such as count_over_time", e.Op)}
+	}
+	if err := p.expect(tokOp, ")"); err != nil {
+		return nil, err
+	}
+	if e.Grouping == nil {
+		if e.Grouping, err = p.parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (p *parser) parseLabelReplace() (Expr, error) {
+	opTok := p.next()
+	if err := p.expect(tokOp, "("); err != nil {
+		return nil, err
+	}
+	inner, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if !IsMetric(inner) {
+		return nil, &Error{Pos: opTok.pos, Msg: "label_replace needs a metric query, not a log query"}
+	}
+	e := &LabelReplaceExpr{Expr: inner}
+	for _, dst := range []*string{&e.Dst, &e.Replacement, &e.Src, &e.Regexp} {
+		if err := p.expect(tokOp, ","); err != nil {
+			return nil, err
+		}
+		if *dst, err = p.expectString(); err != nil {
+			return nil, err
+		}
+	}
+	return e, p.expect(tokOp, ")")
+}
+
+// validate checks the semantic rules Loki applies after parsing.
+func validate(e Expr) error {
+	var err error
+	Inspect(e, func(n Node) bool {
+		if err != nil {
+			return false
+		}
+		switch n := n.(type) {
+		case *LogExpr:
+			err = validateSelector(n)
+		case *LineFilter:
+			if n.Op == "|~" || n.Op == "!~" {
+				for _, v := range n.Values {
+					if err = validateRegexp(v); err != nil {
+						break
+					}
+				}
+			}
+		case *LabelComparison:
+			if n.Op == "=~" || n.Op == "!~" {
+				err = validateRegexp(n.Value)
+			}
+		case *ParserStage:
+			if n.Parser == "regexp" {
+				if err = validateRegexp(n.Expression); err == nil && !strings.Contains(n.Expression, "(?P<") {
+					err = semanticError("regexp parser needs at least one named capture group")
+				}
+			}
+		case *RangeAggregationExpr:
+			unwrap := n.Range.Unwrap()
+			switch required := rangeAggregations[n.Op]; {
+			case required && unwrap == nil:
+				err = semanticError("%s needs an unwrap stage, e.g. | unwrap latency", n.Op)
+			case unwrap != nil && !required && n.Op != "rate":
+				err = semanticError("%s cannot be used with an unwrap stage", n.Op)
+			}
+			if n.Range.Range <= 0 {
+				err = semanticError("range must be greater than zero")
+			}
+			return err == nil
+		}
+		return err == nil
+	})
+	if err == nil {
+		if log, ok := e.(*LogExpr); ok {
+			for _, s := range log.Pipeline {
+				if _, ok := s.(*UnwrapStage); ok {
+					return semanticError("unwrap can only be used inside a range aggregation")
+				}
+			}
+		}
+	}
+	return err
+}
+
+// validateSelector enforces Loki's rule that a selector has at least one matcher
+// that does not match the empty string.
+func validateSelector(e *LogExpr) error {
+	if len(e.Matchers) == 0 {
+		return semanticError("stream selector needs at least one label matcher")
+	}
+	for _, m := range e.Matchers {
+		if m.Op == "=~" || m.Op == "!~" {
+			if err := validateRegexp(m.Value); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range e.Matchers {
+		switch m.Op {
+		case "=":
+			if m.Value != "" {
+				return nil
+			}
+		case "=~":
+			if re, err := regexp.Compile("^(?:" + m.Value + ")$"); err == nil && !re.MatchString("") {
+				return nil
+			}
+		}
+	}
+	return semanticError("stream selector needs at least one = or =~ matcher that does not match the empty string")
+}
+
+func validateRegexp(s string) error {
+	if _, err := regexp.Compile(s); err != nil {
+		return semanticError("invalid regular expression %q: %s", s, err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package logql
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpr(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		exp   string
+	}{
+		{query: `{app="checkout"}`, exp: `{app="checkout"}`},
+		{query: `{app="checkout", env=~"prod|staging"} |= "error" != "timeout"`, exp: `{app="checkout", env=~"prod|staging"} |= "error" != "timeout"`},
+		{query: "{app=`a`} |~ `err(or)?` or \"fatal\"", exp: `{app="a"} |~ "err(or)?" or "fatal"`},
+		{query: `{app="a"} | json | status >= 500 and duration > 1s`, exp: `{app="a"} | json | (status>=500 and duration>1s)`},
+		{query: `{app="a"} | logfmt --strict level, msg="message" | level="error" or level="warn"`, exp: `{app="a"} | logfmt --strict level, msg="message" | (level="error" or level="warn")`},
+		{query: `{app="a"} | regexp "(?P<method>\\w+) (?P<path>\\S+)" | line_format "{{.method}} {{.path}}"`, exp: `{app="a"} | regexp "(?P<method>\\w+) (?P<path>\\S+)" | line_format "{{.method}} {{.path}}"`},
+		{query: `{app="a"} | pattern "<ip> - <_>" | label_format src=ip, note="x" | drop __error__ | keep ip`, exp: `{app="a"} | pattern "<ip> - <_>" | label_format src=ip, note="x" | drop __error__ | keep ip`},
+		{query: `{app="a"} | size > 10KB | addr = ip("10.0.0.0/8")`, exp: `{app="a"} | size>10KB | addr=ip("10.0.0.0/8")`},
+		{query: `rate({app="a"} |= "error" [5m])`, exp: `rate({app="a"} |= "error" [5m])`},
+		{query: `count_over_time({app="a"}[1h] |= "error")`, exp: `count_over_time({app="a"} |= "error" [1h])`},
+		{query: `sum by (status) (count_over_time({app="a"} | json [5m] offset 1h))`, exp: `sum by (status) (count_over_time({app="a"} | json [5m] offset 1h))`},
+		{query: `quantile_over_time(0.99, {app="a"} | logfmt | unwrap duration(latency) [5m]) by (route)`, exp: `quantile_over_time(0.99, {app="a"} | logfmt | unwrap duration(latency) [5m]) by (route)`},
+		{query: `topk(5, sum(rate({app="a"}[1m])) by (pod))`, exp: `topk(5, sum by (pod) (rate({app="a"} [1m])))`},
+		{query: `sum(rate({app="a"} |= "error" [5m])) / sum(rate({app="a"}[5m])) * 100 > bool 5`, exp: `(((sum(rate({app="a"} |= "error" [5m])) / sum(rate({app="a"} [5m]))) * 100) > bool 5)`},
+		{query: `2 ^ 3 ^ 2`, exp: `(2 ^ (3 ^ 2))`},
+		{query: `-1 + vector(0)`, exp: `(-1 + vector(0))`},
+		{query: `rate({app="a"}[5m]) / on (pod) group_left (node) rate({app="b"}[5m])`, exp: `(rate({app="a"} [5m]) / on (pod) group_left (node) rate({app="b"} [5m]))`},
+		{query: `label_replace(rate({app="a"}[5m]), "svc", "$1", "app", "(.*)")`, exp: `label_replace(rate({app="a"} [5m]), "svc", "$1", "app", "(.*)")`},
+		{query: "# errors only\n{app=\"a\"} |= \"error\"", exp: `{app="a"} |= "error"`},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			e, err := ParseExpr(tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := e.String(); got != tc.exp {
+				t.Fatalf("expected %s, got %s", tc.exp, got)
+			}
+			// The printed form must parse back to the same expression.
+			again, err := ParseExpr(e.String())
+			if err != nil {
+				t.Fatalf("round trip: %s", err)
+			}
+			if again.String() != e.String() {
+				t.Fatalf("round trip: expected %s, got %s", e, again)
+			}
+		})
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		expErr string
+	}{
+		{query: ``, expErr: "unexpected end of input"},
+		{query: `{app="a"`, expErr: `expected ","`},
+		{query: `{}`, expErr: "at least one label matcher"},
+		{query: `{app=""}`, expErr: "does not match the empty string"},
+		{query: `{app=~".*"}`, expErr: "does not match the empty string"},
+		{query: `{app=~"("}`, expErr: "invalid regular expression"},
+		{query: `{app="a"} |~ "[a-"`, expErr: "invalid regular expression"},
+		{query: `{app="a"} | regexp "\\w+"`, expErr: "named capture group"},
+		{query: `{app="a"} | status > "500"`, expErr: "cannot be used with a string value"},
+		{query: `{app="a"} | json | unwrap latency`, expErr: "only be used inside a range aggregation"},
+		{query: `rate({app="a"})`, expErr: `expected "["`},
+		{query: `sum_over_time({app="a"}[5m])`, expErr: "needs an unwrap stage"},
+		{query: `count_over_time({app="a"} | unwrap x [5m])`, expErr: "cannot be used with an unwrap stage"},
+		{query: `count_over_time({app="a"}[5m]) by (pod)`, expErr: "grouping is only allowed"},
+		{query: `sum({app="a"})`, expErr: "needs a metric query"},
+		{query: `{app="a"} / 2`, expErr: "metric queries on both sides"},
+		{query: `rate({app="a"}[5m]) + bool 1`, expErr: "bool modifier"},
+		{query: `rate({app="a"}[5x])`, expErr: "invalid duration"},
+		{query: `histogram_quantile(0.9, rate({app="a"}[5m]))`, expErr: `unknown function or keyword "histogram_quantile"`},
+		{query: `{app="a"} | unwrap seconds(x)`, expErr: "unknown unwrap conversion"},
+		{query: `{app="a"} @`, expErr: "unexpected character"},
+		{query: `{app="a} |= "x"`, expErr: "unterminated string literal"},
+		{query: `{app="a"} |= "x" )`, expErr: "expected end of query"},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			_, err := ParseExpr(tc.query)
+			if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestInspect(t *testing.T) {
+	e, err := ParseExpr(`sum by (pod) (rate({app="a", env="prod"} | json | level="error" [5m])) / sum(rate({app="a"}[1h]))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var matchers []string
+	var ranges []time.Duration
+	Inspect(e, func(n Node) bool {
+		switch n := n.(type) {
+		case *Matcher:
+			matchers = append(matchers, n.String())
+		case *LabelComparison:
+			matchers = append(matchers, "filter:"+n.String())
+		case *LogRange:
+			ranges = append(ranges, n.Range)
+		}
+		return true
+	})
+	if got := strings.Join(matchers, " "); got != `app="a" env="prod" filter:level="error" app="a"` {
+		t.Fatalf("unexpected matchers %s", got)
+	}
+	if len(ranges) != 2 || ranges[0] != 5*time.Minute || ranges[1] != time.Hour {
+		t.Fatalf("unexpected ranges %v", ranges)
+	}
+}
@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newFakeLokiMCP returns a fakeMCP exposing the Loki listing tools for a set of labels and their values.
+func newFakeLokiMCP(labels map[string][]string) *fakeMCP {
+	return &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"list_loki_label_names": func(map[string]any) (any, error) {
+			set := map[string]bool{}
+			for l := range labels {
+				set[l] = true
+			}
+			return sortedKeys(set), nil
+		},
+		"list_loki_label_values": func(args map[string]any) (any, error) {
+			return labels[args["labelName"].(string)], nil
+		},
+	}}
+}
+
+func TestValidateLogQL(t *testing.T) {
+	catalog := newLokiCatalog(newFakeLokiMCP(map[string][]string{"app": {"checkout"}, "namespace": {"shop"}}), "loki")
+	for _, tc := range []struct {
+		name   string
+		query  string
+		expErr string
+	}{
+		{name: "log query", query: `{app="checkout"} |= "error" | json | status >= 500`},
+		{name: "metric query", query: `sum by (namespace) (count_over_time({app="checkout"} |= "error" [5m]))`},
+		{name: "syntax error", query: `{app="checkout"`, expErr: "parse error"},
+		{name: "semantic error", query: `sum_over_time({app="checkout"}[5m])`, expErr: "needs an unwrap stage"},
+		{name: "unknown stream label", query: `{service="checkout"}`, expErr: `stream label "service" does not exist (available labels: app, namespace)`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := validateLogQL(t.Context(), catalog, tc.query)
+			if tc.expErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tc.expErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expErr)) {
+				t.Fatalf("expected error containing %q, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestLogQLGenerate(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	llm := &fakeLLM{replies: []string{
+		`{"query": "{service=\"checkout\"} |= \"error\"", "explanation": "x"}`,
+		`{"query": "sum(count_over_time({app=\"checkout\"} |= \"error\" [5m]))", "explanation": "Error lines per 5 minutes."}`,
+	}}
+	app.llm = llm
+	app.mcp = newFakeLokiMCP(map[string][]string{
+		"app":       {"cart", "checkout"},
+		"namespace": {"shop"},
+	})
+
+	resp := callResource(t, app, http.MethodPost, "query/logql/generate", map[string]any{
+		"question":      "How many errors does the checkout app log?",
+		"datasourceUid": "loki",
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", resp.Status, resp.Body)
+	}
+	var out struct {
+		Query       string              `json:"query"`
+		Explanation string              `json:"explanation"`
+		Labels      []string            `json:"labels"`
+		Attempts    []generationAttempt `json:"attempts"`
+	}
+	if err := json.Unmarshal(resp.Body, &out); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if out.Query != `sum(count_over_time({app="checkout"} |= "error" [5m]))` || out.Explanation == "" {
+		t.Errorf("unexpected query %q", out.Query)
+	}
+	if len(out.Attempts) != 2 || strings.Join(out.Labels, ",") != "app" {
+		t.Errorf("unexpected attempts %+v or labels %v", out.Attempts, out.Labels)
+	}
+
+	first := llm.requests[0].Messages[1].Content
+	if !strings.Contains(first, "Available stream labels: app, namespace") || !strings.Contains(first, "Values of label app: checkout, cart") {
+		t.Errorf("prompt is missing context:\n%s", first)
+	}
+	last := llm.requests[1].Messages
+	if feedback := last[len(last)-1].Content; !strings.Contains(feedback, `stream label "service" does not exist`) {
+		t.Errorf("validation error was not fed back, got %q", feedback)
+	}
+
+	resp = callResource(t, app, http.MethodPost, "query/logql/generate", map[string]any{"question": "x"})
+	if resp.Status != http.StatusBadRequest {
+		t.Errorf("missing datasource should be rejected, got %d", resp.Status)
+	}
+}
@@ -0,0 +1,351 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+const (
+	maintenanceWindowsCollection = "maintenance_windows"
+	// maintenanceSchedulerInterval is how often maintenance windows are checked. Silences
+	// are created up to one interval ahead of time so they are in place when a window opens.
+	maintenanceSchedulerInterval = time.Minute
+)
+
+// maintenanceWindow is a recurring silence stored by the plugin. The scheduler
+// creates an Alertmanager silence for every occurrence of the window.
+type maintenanceWindow struct {
+	ID       string           `json:"id"`
+	Name     string           `json:"name"`
+	Matchers []silenceMatcher `json:"matchers"`
+	// Weekdays restricts the days the window opens on, e.g. ["saturday", "sunday"].
+	// An empty list means every day.
+	Weekdays []string `json:"weekdays,omitempty"`
+	// StartTime is the local time of day the window opens, formatted as "15:04".
+	StartTime string `json:"startTime"`
+	Duration  string `json:"duration"`
+	// Timezone is an IANA time zone name. Defaults to UTC.
+	Timezone  string `json:"timezone,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+	Enabled   bool   `json:"enabled"`
+	CreatedBy string `json:"createdBy,omitempty"`
+
+	// The occurrence most recently turned into a silence by the scheduler.
+	LastSilenceID    string    `json:"lastSilenceId,omitempty"`
+	LastAppliedStart time.Time `json:"lastAppliedStart,omitzero"`
+	LastAppliedEnd   time.Time `json:"lastAppliedEnd,omitzero"`
+}
+
+// validate checks the window definition and normalizes its weekdays.
+func (mw *maintenanceWindow) validate() error {
+	if strings.TrimSpace(mw.Name) == "" {
+		return errors.New("name is required")
+	}
+	if err := validateMatchers(mw.Matchers); err != nil {
+		return err
+	}
+	if _, err := time.Parse("15:04", mw.StartTime); err != nil {
+		return fmt.Errorf("invalid startTime %q: expected HH:MM", mw.StartTime)
+	}
+	d, err := time.ParseDuration(mw.Duration)
+	if err != nil {
+		return fmt.Errorf("invalid duration: %w", err)
+	}
+	if d <= 0 || d > maxSilenceDuration {
+		return fmt.Errorf("duration must be between 0 and %s", maxSilenceDuration)
+	}
+	if _, err := time.LoadLocation(mw.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %w", err)
+	}
+	for i, day := range mw.Weekdays {
+		wd, err := parseWeekday(day)
+		if err != nil {
+			return err
+		}
+		mw.Weekdays[i] = strings.ToLower(wd.String())
+	}
+	return nil
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if l := strings.ToLower(s); l == name || l == name[:3] {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+// occurrence returns the earliest occurrence of the window that has not ended by now
+// and starts no later than now+lookahead. ok is false if there is none.
+func (mw maintenanceWindow) occurrence(now time.Time, lookahead time.Duration) (start, end time.Time, ok bool) {
+	loc, err := time.LoadLocation(mw.Timezone)
+	if err != nil {
+		return start, end, false
+	}
+	tod, err := time.Parse("15:04", mw.StartTime)
+	if err != nil {
+		return start, end, false
+	}
+	d, err := time.ParseDuration(mw.Duration)
+	if err != nil {
+		return start, end, false
+	}
+	local := now.In(loc)
+	// Occurrences last at most maxSilenceDuration, so a week back covers every
+	// occurrence that could still be open.
+	for offset := -7; offset <= 1; offset++ {
+		day := local.AddDate(0, 0, offset)
+		s := time.Date(day.Year(), day.Month(), day.Day(), tod.Hour(), tod.Minute(), 0, 0, loc)
+		if !mw.onWeekday(s.Weekday()) {
+			continue
+		}
+		e := s.Add(d)
+		if e.After(now) && !s.After(now.Add(lookahead)) {
+			return s, e, true
+		}
+	}
+	return start, end, false
+}
+
+func (mw maintenanceWindow) onWeekday(wd time.Weekday) bool {
+	if len(mw.Weekdays) == 0 {
+		return true
+	}
+	for _, day := range mw.Weekdays {
+		if d, err := parseWeekday(day); err == nil && d == wd {
+			return true
+		}
+	}
+	return false
+}
+
+// applyMaintenanceWindow creates a silence for the window's current or upcoming occurrence,
+// unless that occurrence has already been applied. It reports whether a silence was created.
+func (a *App) applyMaintenanceWindow(ctx context.Context, mw *maintenanceWindow, now time.Time) (bool, error) {
+	if !mw.Enabled {
+		return false, nil
+	}
+	start, end, ok := mw.occurrence(now, maintenanceSchedulerInterval)
+	if !ok || start.Equal(mw.LastAppliedStart) {
+		return false, nil
+	}
+	comment := mw.Comment
+	if comment == "" {
+		comment = "Maintenance window: " + mw.Name
+	}
+	createdBy := mw.CreatedBy
+	if createdBy == "" {
+		createdBy = "sre-assistant"
+	}
+	id, err := a.createSilence(ctx, postableSilence{
+		Matchers:  mw.Matchers,
+		StartsAt:  start,
+		EndsAt:    end,
+		CreatedBy: createdBy,
+		Comment:   comment,
+	})
+	if err != nil {
+		return false, fmt.Errorf("create silence for maintenance window %s: %w", mw.ID, err)
+	}
+	mw.LastSilenceID = id
+	mw.LastAppliedStart = start
+	mw.LastAppliedEnd = end
+	return true, saveJSON(ctx, a.store, maintenanceWindowsCollection, mw.ID, mw)
+}
+
+// releaseMaintenanceWindow expires the silence of an occurrence that is still pending or
+// active, so that a changed or deleted window does not keep silencing alerts.
+func (a *App) releaseMaintenanceWindow(ctx context.Context, mw *maintenanceWindow, now time.Time) error {
+	if mw.LastSilenceID == "" || !mw.LastAppliedEnd.After(now) {
+		return nil
+	}
+	if err := a.expireSilence(ctx, mw.LastSilenceID); err != nil {
+		return err
+	}
+	mw.LastSilenceID = ""
+	mw.LastAppliedStart = time.Time{}
+	mw.LastAppliedEnd = time.Time{}
+	return nil
+}
+
+// applyMaintenanceWindows runs a single scheduler pass over every stored window. Windows
+// that fail are logged and skipped; their errors are returned together.
+func (a *App) applyMaintenanceWindows(ctx context.Context, now time.Time) error {
+	a.maintenanceMu.Lock()
+	defer a.maintenanceMu.Unlock()
+	windows, err := listJSON[maintenanceWindow](ctx, a.store, maintenanceWindowsCollection)
+	if err != nil {
+		a.logger(ctx).Error("Error loading maintenance windows", "err", err)
+		return err
+	}
+	var errs []error
+	for i := range windows {
+		applied, err := a.applyMaintenanceWindow(ctx, &windows[i], now)
+		if err != nil {
+			a.logger(ctx).Error("Error applying maintenance window", "id", windows[i].ID, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		if applied {
+			a.logger(ctx).Info("Applied maintenance window", "id", windows[i].ID, "silenceId", windows[i].LastSilenceID)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runMaintenanceScheduler applies maintenance windows every interval until ctx is cancelled.
+func (a *App) runMaintenanceScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			recordJobRun(jobMaintenanceScheduler, a.applyMaintenanceWindows(ctx, now))
+		}
+	}
+}
+
+// maintenanceWindowView is a maintenanceWindow together with its next computed occurrence.
+type maintenanceWindowView struct {
+	maintenanceWindow
+	NextStart time.Time `json:"nextStart,omitzero"`
+	NextEnd   time.Time `json:"nextEnd,omitzero"`
+}
+
+func newMaintenanceWindowView(mw maintenanceWindow, now time.Time) maintenanceWindowView {
+	v := maintenanceWindowView{maintenanceWindow: mw}
+	// Look ahead a little over a week so every enabled window reports its next opening.
+	if start, end, ok := mw.occurrence(now, 8*24*time.Hour); ok {
+		v.NextStart, v.NextEnd = start, end
+	}
+	return v
+}
+
+// handleMaintenanceWindows lists maintenance windows on GET and creates one on POST.
+func (a *App) handleMaintenanceWindows(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	now := time.Now()
+	switch req.Method {
+	case http.MethodGet:
+		windows, err := listJSON[maintenanceWindow](ctx, a.store, maintenanceWindowsCollection)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		out := make([]maintenanceWindowView, len(windows))
+		for i, mw := range windows {
+			out[i] = newMaintenanceWindowView(mw, now)
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		if !requireEditor(w, req, "creating maintenance windows") {
+			return
+		}
+		var mw maintenanceWindow
+		if err := json.NewDecoder(req.Body).Decode(&mw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := mw.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mw.ID = uuid.NewString()
+		mw.LastSilenceID, mw.LastAppliedStart, mw.LastAppliedEnd = "", time.Time{}, time.Time{}
+		mw.CreatedBy = ""
+		if u := backend.UserFromContext(ctx); u != nil {
+			mw.CreatedBy = u.Login
+		}
+		a.maintenanceMu.Lock()
+		defer a.maintenanceMu.Unlock()
+		if err := saveJSON(ctx, a.store, maintenanceWindowsCollection, mw.ID, mw); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Windows that are already open are applied right away instead of on the next tick.
+		if _, err := a.applyMaintenanceWindow(ctx, &mw, now); err != nil {
+			a.logger(ctx).Warn("Error applying new maintenance window", "id", mw.ID, "err", err)
+		}
+		writeJSON(w, http.StatusOK, newMaintenanceWindowView(mw, now))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMaintenanceWindow gets, replaces or deletes the maintenance window identified by {id}.
+func (a *App) handleMaintenanceWindow(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	now := time.Now()
+	id := req.PathValue("id")
+	if (req.Method == http.MethodPut || req.Method == http.MethodDelete) && !requireEditor(w, req, "changing maintenance windows") {
+		return
+	}
+
+	a.maintenanceMu.Lock()
+	defer a.maintenanceMu.Unlock()
+	existing, err := loadJSON[maintenanceWindow](ctx, a.store, maintenanceWindowsCollection, id)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "maintenance window not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, newMaintenanceWindowView(existing, now))
+	case http.MethodPut:
+		var mw maintenanceWindow
+		if err := json.NewDecoder(req.Body).Decode(&mw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := mw.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := a.releaseMaintenanceWindow(ctx, &existing, now); err != nil {
+			writeGrafanaError(w, err)
+			return
+		}
+		mw.ID = existing.ID
+		mw.CreatedBy = existing.CreatedBy
+		mw.LastSilenceID, mw.LastAppliedStart, mw.LastAppliedEnd = existing.LastSilenceID, existing.LastAppliedStart, existing.LastAppliedEnd
+		if err := saveJSON(ctx, a.store, maintenanceWindowsCollection, mw.ID, mw); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := a.applyMaintenanceWindow(ctx, &mw, now); err != nil {
+			a.logger(ctx).Warn("Error applying updated maintenance window", "id", mw.ID, "err", err)
+		}
+		writeJSON(w, http.StatusOK, newMaintenanceWindowView(mw, now))
+	case http.MethodDelete:
+		if err := a.releaseMaintenanceWindow(ctx, &existing, now); err != nil {
+			writeGrafanaError(w, err)
+			return
+		}
+		if err := a.store.Delete(ctx, maintenanceWindowsCollection, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "maintenance window deleted"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
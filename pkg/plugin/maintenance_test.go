@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestMaintenanceWindowOccurrence(t *testing.T) {
+	mw := maintenanceWindow{
+		Name:      "weekly patching",
+		Weekdays:  []string{"sat"},
+		StartTime: "22:00",
+		Duration:  "4h",
+		Timezone:  "UTC",
+	}
+	// 2025-10-18 is a Saturday.
+	sat := func(h, m int) time.Time { return time.Date(2025, 10, 18, h, m, 0, 0, time.UTC) }
+	for _, tc := range []struct {
+		name     string
+		now      time.Time
+		expOK    bool
+		expStart time.Time
+	}{
+		{name: "before the window", now: sat(12, 0), expOK: false},
+		{name: "within lookahead", now: sat(21, 59).Add(30 * time.Second), expOK: true, expStart: sat(22, 0)},
+		{name: "open", now: sat(23, 0), expOK: true, expStart: sat(22, 0)},
+		{name: "open across midnight", now: sat(22, 0).Add(3 * time.Hour), expOK: true, expStart: sat(22, 0)},
+		{name: "closed", now: sat(22, 0).Add(5 * time.Hour), expOK: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end, ok := mw.occurrence(tc.now, time.Minute)
+			if ok != tc.expOK {
+				t.Fatalf("occurrence found should be %v, got %v", tc.expOK, ok)
+			}
+			if ok && (!start.Equal(tc.expStart) || end.Sub(start) != 4*time.Hour) {
+				t.Errorf("unexpected occurrence %s - %s", start, end)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindowValidate(t *testing.T) {
+	valid := func() maintenanceWindow {
+		return maintenanceWindow{
+			Name:      "nightly",
+			Matchers:  []silenceMatcher{{Name: "env", Value: "staging", IsEqual: true}},
+			StartTime: "02:00",
+			Duration:  "1h",
+			Weekdays:  []string{"Mon", "tuesday"},
+		}
+	}
+	mw := valid()
+	if err := mw.validate(); err != nil {
+		t.Fatalf("valid window rejected: %s", err)
+	}
+	if mw.Weekdays[0] != "monday" {
+		t.Errorf("weekdays should be normalized, got %v", mw.Weekdays)
+	}
+	for name, mutate := range map[string]func(*maintenanceWindow){
+		"no name":      func(mw *maintenanceWindow) { mw.Name = "" },
+		"bad start":    func(mw *maintenanceWindow) { mw.StartTime = "25:00" },
+		"too long":     func(mw *maintenanceWindow) { mw.Duration = "200h" },
+		"bad timezone": func(mw *maintenanceWindow) { mw.Timezone = "Mars/Olympus" },
+		"bad weekday":  func(mw *maintenanceWindow) { mw.Weekdays = []string{"someday"} },
+		"no matchers":  func(mw *maintenanceWindow) { mw.Matchers = nil },
+	} {
+		mw := valid()
+		mutate(&mw)
+		if err := mw.validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestMaintenanceScheduler(t *testing.T) {
+	am := &fakeAlertmanager{}
+	app := newTestApp(t, am.server(t).URL, nil)
+
+	resp := callResource(t, app, http.MethodPost, "silences/schedules", map[string]any{
+		"name":      "daily deploy",
+		"matchers":  []map[string]any{{"name": "env", "value": "staging"}},
+		"startTime": "03:00",
+		"duration":  "1h",
+		"enabled":   true,
+		"createdBy": "someone-else",
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("create: unexpected response %d %s", resp.Status, resp.Body)
+	}
+	var created maintenanceWindowView
+	if err := json.Unmarshal(resp.Body, &created); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if created.ID == "" || created.CreatedBy != "tester" || created.NextStart.IsZero() {
+		t.Errorf("unexpected window %s", resp.Body)
+	}
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	open := time.Date(now.Year(), now.Month(), now.Day()+1, 3, 10, 0, 0, time.UTC)
+	am.created = nil
+	app.applyMaintenanceWindows(ctx, open)
+	app.applyMaintenanceWindows(ctx, open.Add(time.Minute))
+	if len(am.created) != 1 {
+		t.Fatalf("expected a single silence for the occurrence, got %d", len(am.created))
+	}
+	if s := am.created[0]; s.StartsAt.Hour() != 3 || s.EndsAt.Sub(s.StartsAt) != time.Hour || s.Comment != "Maintenance window: daily deploy" {
+		t.Errorf("unexpected silence %+v", s)
+	}
+
+	// The next day's occurrence gets its own silence.
+	app.applyMaintenanceWindows(ctx, open.AddDate(0, 0, 1))
+	if len(am.created) != 2 {
+		t.Errorf("expected a silence for the next occurrence, got %d", len(am.created))
+	}
+
+	viewer := &backend.User{Login: "viewer", Role: "Viewer"}
+	if resp := callResourceAs(t, app, viewer, http.MethodDelete, "silences/schedules/"+created.ID, nil); resp.Status != http.StatusForbidden {
+		t.Errorf("expected 403 deleting a window as a viewer, got %d", resp.Status)
+	}
+	resp = callResource(t, app, http.MethodDelete, "silences/schedules/"+created.ID, nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("delete: unexpected response %d %s", resp.Status, resp.Body)
+	}
+	resp = callResource(t, app, http.MethodGet, "silences/schedules/"+created.ID, nil)
+	if resp.Status != http.StatusNotFound {
+		t.Errorf("deleted window should be gone, got %d", resp.Status)
+	}
+}
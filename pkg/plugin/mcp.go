@@ -0,0 +1,303 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// mcpServerPath is the Grafana MCP server hosted by the Grafana LLM app, the same
+	// server the frontend talks to through @grafana/llm.
+	mcpServerPath      = "/api/plugins/grafana-llm-app/resources/mcp/grafana"
+	mcpProtocolVersion = "2025-03-26"
+	mcpSessionHeader   = "Mcp-Session-Id"
+)
+
+// errMCPSessionExpired is returned when the server no longer knows our session.
+var errMCPSessionExpired = errors.New("mcp session expired")
+
+// readOnlyMCPTools are the tools of the Grafana MCP server that only read. Investigation
+// and runbook steps run through the plugin's service account for whoever wrote them, so
+// they may only call these.
+var readOnlyMCPTools = map[string]bool{
+	"search_dashboards":               true,
+	"search_folders":                  true,
+	"get_dashboard_by_uid":            true,
+	"get_dashboard_summary":           true,
+	"get_dashboard_property":          true,
+	"get_dashboard_panel_queries":     true,
+	"list_datasources":                true,
+	"get_datasource_by_uid":           true,
+	"get_datasource_by_name":          true,
+	"query_prometheus":                true,
+	"list_prometheus_metric_metadata": true,
+	"list_prometheus_metric_names":    true,
+	"list_prometheus_label_names":     true,
+	"list_prometheus_label_values":    true,
+	"list_prometheus_metrics":         true,
+	"query_loki_logs":                 true,
+	"query_loki_stats":                true,
+	"list_loki_label_names":           true,
+	"list_loki_label_values":          true,
+	"list_alert_rules":                true,
+	"get_alert_rule_by_uid":           true,
+	"list_contact_points":             true,
+	"list_incidents":                  true,
+	"get_incident":                    true,
+	"list_oncall_schedules":           true,
+	"get_oncall_shift":                true,
+	"get_current_oncall_users":        true,
+	"list_oncall_teams":               true,
+	"list_oncall_users":               true,
+	"list_sift_investigations":        true,
+	"get_sift_investigation":          true,
+	"get_sift_analysis":               true,
+	"list_pyroscope_label_names":      true,
+	"list_pyroscope_label_values":     true,
+	"list_pyroscope_profile_types":    true,
+	"fetch_pyroscope_profile":         true,
+	"list_teams":                      true,
+	"list_users_by_org":               true,
+}
+
+// checkReadOnlyTool returns an error unless name is a read-only tool.
+func checkReadOnlyTool(name string) error {
+	if !readOnlyMCPTools[name] {
+		return fmt.Errorf("tool %q is not a read-only tool", name)
+	}
+	return nil
+}
+
+// mcpToolResult is the result of an MCP tools/call request.
+type mcpToolResult struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text,omitempty"`
+	} `json:"content"`
+	IsError bool `json:"isError"`
+}
+
+// text joins the text content of the result.
+func (r *mcpToolResult) text() string {
+	var parts []string
+	for _, c := range r.Content {
+		if c.Type == "text" {
+			parts = append(parts, c.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// mcpToolCaller calls tools on an MCP server.
+type mcpToolCaller interface {
+	CallTool(ctx context.Context, name string, args map[string]any) (*mcpToolResult, error)
+}
+
+// callToolJSON calls an MCP tool whose text result is JSON and decodes it into out.
+func callToolJSON(ctx context.Context, mcp mcpToolCaller, name string, args map[string]any, out any) error {
+	res, err := mcp.CallTool(ctx, name, args)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(res.text()), out); err != nil {
+		return fmt.Errorf("mcp tool %s: decode result: %w", name, err)
+	}
+	return nil
+}
+
+// mcpClient is a minimal MCP client for the streamable HTTP transport. It only
+// implements what the backend needs: initializing a session and calling tools.
+type mcpClient struct {
+	grafana *grafanaClient
+	path    string
+
+	mu        sync.Mutex
+	sessionID string
+	nextID    atomic.Int64
+}
+
+func newMCPClient(grafana *grafanaClient) *mcpClient {
+	return &mcpClient{grafana: grafana, path: mcpServerPath}
+}
+
+// CallTool calls the named tool. Tool errors reported by the server are returned as errors.
+func (c *mcpClient) CallTool(ctx context.Context, name string, args map[string]any) (*mcpToolResult, error) {
+	if readOnlyMCPTools[name] {
+		// Calls of read-only tools are safe to retry.
+		ctx = withIdempotent(ctx)
+	}
+	params := map[string]any{"name": name, "arguments": args}
+	var raw json.RawMessage
+	for attempt := 0; ; attempt++ {
+		sessionID, err := c.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+		raw, _, err = c.rpc(ctx, sessionID, "tools/call", params)
+		if errors.Is(err, errMCPSessionExpired) && attempt == 0 {
+			c.resetSession(sessionID)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mcp tool %s: %w", name, err)
+		}
+		break
+	}
+	var res mcpToolResult
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("mcp tool %s: decode result: %w", name, err)
+	}
+	if res.IsError {
+		return &res, fmt.Errorf("mcp tool %s: %s", name, res.text())
+	}
+	return &res, nil
+}
+
+// session returns the current session ID, initializing a new session if needed.
+func (c *mcpClient) session(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessionID != "" {
+		return c.sessionID, nil
+	}
+	_, header, err := c.rpc(ctx, "", "initialize", map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "sre-assistant-app", "version": "1.0.0"},
+	})
+	if err != nil {
+		return "", fmt.Errorf("mcp initialize: %w", err)
+	}
+	sessionID := header.Get(mcpSessionHeader)
+	if err := c.notify(ctx, sessionID, "notifications/initialized"); err != nil {
+		return "", fmt.Errorf("mcp initialize: %w", err)
+	}
+	c.sessionID = sessionID
+	return sessionID, nil
+}
+
+func (c *mcpClient) resetSession(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessionID == sessionID {
+		c.sessionID = ""
+	}
+}
+
+func (c *mcpClient) post(ctx context.Context, sessionID string, msg any) (*http.Response, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	req, err := c.grafana.newRequest(ctx, http.MethodPost, c.path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	if sessionID != "" {
+		req.Header.Set(mcpSessionHeader, sessionID)
+	}
+	resp, err := c.grafana.httpClient(c.path).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("make request: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound && sessionID != "" {
+		resp.Body.Close()
+		return nil, errMCPSessionExpired
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &grafanaAPIError{StatusCode: resp.StatusCode, Message: apiErrorMessage(body)}
+	}
+	return resp, nil
+}
+
+func (c *mcpClient) notify(ctx context.Context, sessionID, method string) error {
+	resp, err := c.post(ctx, sessionID, map[string]any{"jsonrpc": "2.0", "method": method})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// rpcResponse is a JSON-RPC 2.0 response.
+type rpcResponse struct {
+	ID     *int64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// rpc sends a JSON-RPC request and waits for its response, which the server may
+// send either as a plain JSON body or as an event in a text/event-stream body.
+func (c *mcpClient) rpc(ctx context.Context, sessionID, method string, params any) (json.RawMessage, http.Header, error) {
+	id := c.nextID.Add(1)
+	resp, err := c.post(ctx, sessionID, map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var msg *rpcResponse
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		msg, err = readSSEResponse(resp.Body, id)
+	} else {
+		msg = &rpcResponse{}
+		err = json.NewDecoder(resp.Body).Decode(msg)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("read response: %w", err)
+	}
+	if msg.Error != nil {
+		return nil, nil, fmt.Errorf("rpc error %d: %s", msg.Error.Code, msg.Error.Message)
+	}
+	return msg.Result, resp.Header, nil
+}
+
+// readSSEResponse reads server-sent events until the JSON-RPC response with the given id arrives.
+// Other messages, such as progress notifications, are skipped.
+func readSSEResponse(r io.Reader, id int64) (*rpcResponse, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if d, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(d, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+		var msg rpcResponse
+		if err := json.Unmarshal([]byte(data.String()), &msg); err == nil && msg.ID != nil && *msg.ID == id {
+			return &msg, nil
+		}
+		data.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if data.Len() > 0 {
+		var msg rpcResponse
+		if err := json.Unmarshal([]byte(data.String()), &msg); err == nil && msg.ID != nil && *msg.ID == id {
+			return &msg, nil
+		}
+	}
+	return nil, errors.New("event stream ended without a response")
+}
@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeMCP is an mcpToolCaller whose tools return the JSON encoding of their handler's result.
+type fakeMCP struct {
+	mu    sync.Mutex
+	tools map[string]func(args map[string]any) (any, error)
+	calls []string
+}
+
+func (f *fakeMCP) CallTool(_ context.Context, name string, args map[string]any) (*mcpToolResult, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, name)
+	tool, ok := f.tools[name]
+	f.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("fake mcp: unknown tool %s", name)
+	}
+	v, err := tool(args)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	res := &mcpToolResult{}
+	res.Content = append(res.Content, struct {
+		Type string `json:"type"`
+		Text string `json:"text,omitempty"`
+	}{Type: "text", Text: string(b)})
+	return res, nil
+}
+
+func TestMCPClient(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		sessions int
+		methods  []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct {
+			ID     *int64          `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		methods = append(methods, msg.Method)
+		switch msg.Method {
+		case "initialize":
+			sessions++
+			w.Header().Set(mcpSessionHeader, fmt.Sprintf("session-%d", sessions))
+			_, _ = fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%d,"result":{}}`, *msg.ID)
+		case "notifications/initialized":
+			w.WriteHeader(http.StatusAccepted)
+		case "tools/call":
+			// The first session expires after one call to exercise re-initialization.
+			if r.Header.Get(mcpSessionHeader) == "session-1" && len(methods) > 3 {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = fmt.Fprintf(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\"}\n\n")
+			_, _ = fmt.Fprintf(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"id\":%d,\"result\":{\"content\":[{\"type\":\"text\",\"text\":\"[\\\"up\\\"]\"}]}}\n\n", *msg.ID)
+		}
+	}))
+	defer srv.Close()
+
+	client := newMCPClient(newGrafanaClient(srv.URL, "token", newTestOutbound(t)))
+	client.path = "/"
+	for i := 0; i < 2; i++ {
+		var names []string
+		if err := callToolJSON(context.Background(), client, "list_prometheus_metric_names", map[string]any{}, &names); err != nil {
+			t.Fatalf("call %d: %s", i, err)
+		}
+		if len(names) != 1 || names[0] != "up" {
+			t.Errorf("unexpected result %v", names)
+		}
+	}
+	if sessions != 2 {
+		t.Errorf("expired session should be re-initialized, got %d sessions (%v)", sessions, methods)
+	}
+}
@@ -0,0 +1,272 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	sdkslo "github.com/grafana/grafana-plugin-sdk-go/experimental/slo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/expfmt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// metricsNamespace prefixes the plugin's own metrics.
+const metricsNamespace = "sre_assistant"
+
+// The metrics are registered with the default registry, which is what the SDK serves to
+// Grafana, together with the SDK's own metrics such as the SLO durations.
+var (
+	routeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "resource_request_duration_seconds",
+		Help:      "Duration of resource requests by route pattern, method and status code.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method", "status_code"})
+
+	llmRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "llm_requests_total",
+		Help:      "LLM chat completion requests by model and status.",
+	}, []string{"model", "status"})
+	llmTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "llm_tokens_total",
+		Help:      "LLM tokens used by model and type (prompt or completion).",
+	}, []string{"model", "type"})
+
+	mcpToolCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mcp_tool_calls_total",
+		Help:      "MCP tool calls by tool and outcome.",
+	}, []string{"tool", "status"})
+	mcpToolDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mcp_tool_call_duration_seconds",
+		Help:      "Duration of MCP tool calls by tool.",
+	}, []string{"tool"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache and result (hit or miss).",
+	}, []string{"cache", "result"})
+
+	redactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "llm_redactions_total",
+		Help:      "Values redacted from LLM requests by kind.",
+	}, []string{"kind"})
+
+	promptInjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "prompt_injection_detections_total",
+		Help:      "Agent tool outputs flagged as possible prompt injections by tool and pattern.",
+	}, []string{"tool", "pattern"})
+
+	llmFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "llm_fallbacks_total",
+		Help:      "Responses built without the LLM because it was unavailable, by feature.",
+	}, []string{"feature"})
+
+	rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests rejected with 429 by scope (route rate limit or LLM queue).",
+	}, []string{"scope"})
+	llmQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "llm_queued_calls",
+		Help:      "LLM calls waiting for a free slot under the concurrency cap.",
+	})
+
+	outboundRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "outbound_request_retries_total",
+		Help:      "Retries of outbound HTTP requests by dependency.",
+	}, []string{"dependency"})
+	circuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breakers by org, dependency and host, for dependencies with a breaker per host: 0 closed, 1 half-open, 2 open.",
+	}, []string{"org_id", "dependency", "host"})
+	circuitBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_transitions_total",
+		Help:      "Circuit breaker state changes by org, dependency, host and new state.",
+	}, []string{"org_id", "dependency", "host", "state"})
+	circuitBreakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_rejections_total",
+		Help:      "Outbound requests failed without being sent because the circuit breaker was open, by org, dependency and host.",
+	}, []string{"org_id", "dependency", "host"})
+
+	jobsRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "jobs_running",
+		Help:      "Background jobs currently running by job.",
+	}, []string{"job"})
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_runs_total",
+		Help:      "Runs of periodic background jobs by job and status.",
+	}, []string{"job", "status"})
+	jobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_last_success_timestamp_seconds",
+		Help:      "Time of the last successful run of periodic background jobs.",
+	}, []string{"job"})
+)
+
+// Outcome label values.
+const (
+	statusSuccess = "success"
+	statusError   = "error"
+)
+
+// outcome returns the status label value for err.
+func outcome(err error) string {
+	if err != nil {
+		return statusError
+	}
+	return statusSuccess
+}
+
+// recordCacheLookup counts a cache hit or miss.
+func recordCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// recordInjection counts the patterns flagged in the output of an agent tool.
+func recordInjection(tool string, flags []string) {
+	for _, f := range flags {
+		promptInjections.WithLabelValues(tool, f).Inc()
+	}
+}
+
+// recordJobRun records the outcome of a run of a periodic job.
+func recordJobRun(job string, err error) {
+	jobRuns.WithLabelValues(job, outcome(err)).Inc()
+	if err == nil {
+		jobLastSuccess.WithLabelValues(job).SetToCurrentTime()
+	}
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrumentRoutes traces every request served by mux and observes its duration and
+// status, labelled by the matched route pattern so that path parameters do not add series.
+func instrumentRoutes(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		req, span := traceRoute(req)
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, req)
+		// ServeMux sets the pattern on the request it was given.
+		route := req.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		endRouteSpan(span, req.Method, route, rec.status)
+		routeDuration.WithLabelValues(route, req.Method, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// newSLOResourceHandler wraps a resource handler with the SDK SLO middleware, which
+// observes the plugin's share of each request's duration.
+func newSLOResourceHandler(h backend.CallResourceHandler) backend.CallResourceHandler {
+	return sdkslo.NewMetricsWrapper(h, backend.DataSourceInstanceSettings{Name: metricsNamespace, Type: "sre-assistant-app"})
+}
+
+// instrumentedLLM traces the requests of an llmProvider and counts their tokens.
+type instrumentedLLM struct {
+	llmProvider
+}
+
+func (l instrumentedLLM) ChatCompletions(ctx context.Context, req chatCompletionRequest) (chatCompletionResponse, error) {
+	ctx, span := tracer().Start(ctx, "llm chat "+req.Model,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrLLMModel.String(req.Model), attrLLMTools.Int(len(req.Tools))))
+	resp, err := l.llmProvider.ChatCompletions(ctx, req)
+	llmRequests.WithLabelValues(req.Model, outcome(err)).Inc()
+	if err == nil {
+		span.SetAttributes(
+			attrLLMResponseModel.String(resp.Model),
+			attrLLMInputTokens.Int(resp.Usage.PromptTokens),
+			attrLLMOutputTokens.Int(resp.Usage.CompletionTokens),
+		)
+		llmTokens.WithLabelValues(req.Model, "prompt").Add(float64(resp.Usage.PromptTokens))
+		llmTokens.WithLabelValues(req.Model, "completion").Add(float64(resp.Usage.CompletionTokens))
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// instrumentedMCP traces the calls of an mcpToolCaller and counts them by tool and outcome.
+type instrumentedMCP struct {
+	mcpToolCaller
+}
+
+func (m instrumentedMCP) CallTool(ctx context.Context, name string, args map[string]any) (*mcpToolResult, error) {
+	start := time.Now()
+	ctx, spans := startToolSpans(ctx, name, args)
+	res, err := m.mcpToolCaller.CallTool(ctx, name, args)
+	for i := len(spans) - 1; i >= 0; i-- {
+		endSpan(spans[i], err)
+	}
+	mcpToolDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	mcpToolCalls.WithLabelValues(name, outcome(err)).Inc()
+	return res, err
+}
+
+// CollectMetrics returns the plugin's metrics in the Prometheus text format.
+func (a *App) CollectMetrics(_ context.Context, _ *backend.CollectMetricsRequest) (*backend.CollectMetricsResult, error) {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+	return &backend.CollectMetricsResult{PrometheusMetrics: buf.Bytes()}, nil
+}
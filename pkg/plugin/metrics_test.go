@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRouteMetrics(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	callResource(t, app, http.MethodGet, "ping", nil)
+	callResource(t, app, http.MethodGet, "investigations/missing", nil)
+	callResource(t, app, http.MethodGet, "no/such/route", nil)
+
+	res, err := app.CollectMetrics(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(res.PrometheusMetrics)
+	for _, want := range []string{
+		`sre_assistant_resource_request_duration_seconds_count{method="GET",route="/ping",status_code="200"}`,
+		// Path parameters are reported by pattern, not by value.
+		`sre_assistant_resource_request_duration_seconds_count{method="GET",route="/investigations/{id}",status_code="404"}`,
+		`sre_assistant_resource_request_duration_seconds_count{method="GET",route="unmatched",status_code="404"}`,
+		// The SDK SLO middleware observes the same requests.
+		`plugins_plugin_request_duration_seconds_count{datasource_name="sre_assistant",datasource_type="sre-assistant-app",endpoint="resource"`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
+
+func TestInstrumentedLLMAndMCP(t *testing.T) {
+	prompt := llmTokens.WithLabelValues("metered-test", "prompt")
+	failed := llmRequests.WithLabelValues("metered-test", statusError)
+	before, failedBefore := testutil.ToFloat64(prompt), testutil.ToFloat64(failed)
+
+	llm := instrumentedLLM{&fakeLLM{replies: []string{"hi"}}}
+	for range 2 {
+		llm.ChatCompletions(context.Background(), chatCompletionRequest{Model: "metered-test"})
+	}
+	// The fake has one reply, so the second request fails and uses no tokens.
+	if got := testutil.ToFloat64(prompt) - before; got != 10 {
+		t.Errorf("expected 10 prompt tokens, got %g", got)
+	}
+	if got := testutil.ToFloat64(failed) - failedBefore; got != 1 {
+		t.Errorf("expected 1 failed request, got %g", got)
+	}
+
+	mcp := instrumentedMCP{&fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"metered_ok":   func(map[string]any) (any, error) { return "ok", nil },
+		"metered_fail": func(map[string]any) (any, error) { return nil, errors.New("boom") },
+	}}}
+	mcp.CallTool(context.Background(), "metered_ok", nil)
+	mcp.CallTool(context.Background(), "metered_fail", nil)
+	if testutil.ToFloat64(mcpToolCalls.WithLabelValues("metered_ok", statusSuccess)) != 1 ||
+		testutil.ToFloat64(mcpToolCalls.WithLabelValues("metered_fail", statusError)) != 1 {
+		t.Error("unexpected MCP tool call counts")
+	}
+}
+
+func TestCacheAndJobMetrics(t *testing.T) {
+	app, _ := newKnowledgeApp(t)
+	hits := cacheRequests.WithLabelValues("knowledge", "hit")
+	before := testutil.ToFloat64(hits)
+	for range 3 {
+		if _, err := app.knowledgeDocs(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(hits) - before; got != 2 {
+		t.Errorf("expected 2 cache hits after the first load, got %g", got)
+	}
+
+	recordJobRun("metrics_test", errors.New("failed"))
+	if testutil.ToFloat64(jobLastSuccess.WithLabelValues("metrics_test")) != 0 {
+		t.Error("a failed run should not update the last success")
+	}
+	recordJobRun("metrics_test", nil)
+	if testutil.ToFloat64(jobRuns.WithLabelValues("metrics_test", statusError)) != 1 ||
+		testutil.ToFloat64(jobLastSuccess.WithLabelValues("metrics_test")) == 0 {
+		t.Error("unexpected job run metrics")
+	}
+}
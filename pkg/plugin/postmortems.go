@@ -0,0 +1,844 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+const (
+	postmortemsCollection = "postmortems"
+	// pluginResourcesPath is where the resources of this plugin are served, used to link
+	// evidence stored by the plugin.
+	pluginResourcesPath = "/api/plugins/sre-assistant-app/resources"
+	// postmortemLookback includes alerts that started firing shortly before the incident window.
+	postmortemLookback = 30 * time.Minute
+	// postmortemFollowUp includes investigations and actions started after the incident ended.
+	postmortemFollowUp = 24 * time.Hour
+	// postmortemMaxWindow bounds the time window of a postmortem without an incident.
+	postmortemMaxWindow = 7 * 24 * time.Hour
+	// postmortemMaxSeries is the number of series per metric snapshot included as evidence.
+	postmortemMaxSeries = 5
+	// postmortemSuspectLimit is the number of suspect changes included as evidence.
+	postmortemSuspectLimit = 5
+	// maxPostmortemDraftAttempts is how many times the LLM is asked for a draft whose claims
+	// all cite evidence.
+	maxPostmortemDraftAttempts = 2
+)
+
+// Postmortem statuses.
+const (
+	postmortemDraft = "draft"
+	postmortemFinal = "final"
+)
+
+// postmortemMetric is a PromQL query whose values at the start and end of the incident are
+// included as evidence.
+type postmortemMetric struct {
+	Title         string `json:"title"`
+	DatasourceUID string `json:"datasourceUid"`
+	Query         string `json:"query"`
+}
+
+// postmortemRequest is the body of POST /postmortems/generate. Either IncidentID or a time
+// window is required.
+type postmortemRequest struct {
+	IncidentID string             `json:"incidentId"`
+	From       time.Time          `json:"from"`
+	To         time.Time          `json:"to"`
+	Title      string             `json:"title"`
+	Labels     map[string]string  `json:"labels"`
+	Metrics    []postmortemMetric `json:"metrics"`
+}
+
+// postmortemEvidence is a piece of source material a postmortem claim can cite.
+type postmortemEvidence struct {
+	ID     string    `json:"id"`
+	Kind   string    `json:"kind"`
+	Title  string    `json:"title"`
+	Time   time.Time `json:"time,omitzero"`
+	URL    string    `json:"url,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// postmortemClaim is a generated statement and the evidence it is based on. Claims the
+// LLM could not support with evidence are kept but marked as unsupported.
+type postmortemClaim struct {
+	Text        string   `json:"text"`
+	Owner       string   `json:"owner,omitempty"`
+	Evidence    []string `json:"evidence"`
+	Unsupported bool     `json:"unsupported,omitempty"`
+}
+
+// postmortemEvent is an entry of the postmortem timeline.
+type postmortemEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Text     string    `json:"text"`
+	Evidence string    `json:"evidence"`
+}
+
+// postmortem is a postmortem document. It is generated as a draft and then edited by
+// the responders.
+type postmortem struct {
+	// degradation is set when the draft was written from templates because the LLM was
+	// unavailable.
+	degradation
+	ID          string               `json:"id"`
+	IncidentID  string               `json:"incidentId,omitempty"`
+	Title       string               `json:"title"`
+	Severity    string               `json:"severity,omitempty"`
+	Status      string               `json:"status"`
+	From        time.Time            `json:"from"`
+	To          time.Time            `json:"to"`
+	Labels      map[string]string    `json:"labels,omitempty"`
+	Summary     postmortemClaim      `json:"summary"`
+	Impact      postmortemClaim      `json:"impact"`
+	RootCause   postmortemClaim      `json:"rootCause"`
+	ActionItems []postmortemClaim    `json:"actionItems"`
+	Timeline    []postmortemEvent    `json:"timeline"`
+	Responders  []string             `json:"responders"`
+	Evidence    []postmortemEvidence `json:"evidence"`
+	// Warnings list the sources that could not be read, so gaps in the draft are visible.
+	Warnings  []string  `json:"warnings,omitempty"`
+	Markdown  string    `json:"markdown"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// addEvidence records evidence and returns its ID, e.g. "E3".
+func (pm *postmortem) addEvidence(ev postmortemEvidence) string {
+	ev.ID = "E" + strconv.Itoa(len(pm.Evidence)+1)
+	pm.Evidence = append(pm.Evidence, ev)
+	return ev.ID
+}
+
+// addEvent records evidence and a timeline entry citing it.
+func (pm *postmortem) addEvent(kind, text string, ev postmortemEvidence) {
+	ev.Kind = kind
+	id := pm.addEvidence(ev)
+	pm.Timeline = append(pm.Timeline, postmortemEvent{Time: ev.Time, Kind: kind, Text: text, Evidence: id})
+}
+
+// addResponder records a responder, unless they are already listed, possibly with their role.
+func (pm *postmortem) addResponder(name string) {
+	if name == "" {
+		return
+	}
+	for _, r := range pm.Responders {
+		if r == name || strings.HasPrefix(r, name+" (") {
+			return
+		}
+	}
+	pm.Responders = append(pm.Responders, name)
+}
+
+func (pm *postmortem) warn(format string, args ...any) {
+	pm.Warnings = append(pm.Warnings, fmt.Sprintf(format, args...))
+}
+
+// gatherPostmortem builds a postmortem without the LLM-written sections: the incident,
+// its timeline, responders and evidence. Sources that cannot be read are reported as
+// warnings, except the incident itself.
+func (a *App) gatherPostmortem(ctx context.Context, r postmortemRequest, now time.Time) (postmortem, error) {
+	pm := postmortem{
+		IncidentID: r.IncidentID,
+		Title:      r.Title,
+		Status:     postmortemDraft,
+		From:       r.From,
+		To:         r.To,
+		Labels:     map[string]string{},
+	}
+	for k, v := range r.Labels {
+		pm.Labels[k] = v
+	}
+
+	if r.IncidentID != "" {
+		inc, err := a.getIncident(ctx, r.IncidentID)
+		if err != nil {
+			return pm, err
+		}
+		pm.From, pm.To = inc.window(now)
+		pm.Severity = inc.Severity
+		if pm.Title == "" {
+			pm.Title = inc.Title
+		}
+		for k, v := range inc.labelSet() {
+			if _, ok := pm.Labels[k]; !ok {
+				pm.Labels[k] = v
+			}
+		}
+		pm.addEvent("incident", fmt.Sprintf("Incident declared: %s", inc.Title), postmortemEvidence{
+			Title:  "Incident " + inc.IncidentID + ": " + inc.Title,
+			Time:   pm.From,
+			URL:    inc.OverviewURL,
+			Detail: strings.TrimSpace(fmt.Sprintf("severity %s, status %s. %s", inc.Severity, inc.Status, inc.Summary)),
+		})
+		for _, as := range inc.IncidentMembership.Assignments {
+			if as.Role.Name != "" {
+				pm.addResponder(fmt.Sprintf("%s (%s)", as.User.Name, as.Role.Name))
+			} else {
+				pm.addResponder(as.User.Name)
+			}
+		}
+		activity, err := a.incidentActivity(ctx, r.IncidentID)
+		if err != nil {
+			pm.warn("incident activity: %s", err)
+		}
+		for _, item := range activity {
+			if strings.TrimSpace(item.Body) == "" {
+				continue
+			}
+			text := item.Body
+			if item.User.Name != "" {
+				text = item.User.Name + ": " + text
+			}
+			pm.addResponder(item.User.Name)
+			pm.addEvent("incident", truncate(text, 300), postmortemEvidence{
+				Title:  "Incident activity (" + item.ActivityKind + ")",
+				Time:   item.time(),
+				URL:    inc.OverviewURL,
+				Detail: item.Body,
+			})
+		}
+	}
+	if pm.Title == "" {
+		pm.Title = fmt.Sprintf("Incident of %s", pm.From.Format("2006-01-02 15:04 MST"))
+	}
+
+	a.gatherAnnotationEvidence(ctx, &pm)
+	a.gatherInvestigationEvidence(ctx, &pm)
+	a.gatherActionEvidence(ctx, &pm)
+	a.gatherChangeEvidence(ctx, &pm)
+	a.gatherMetricEvidence(ctx, &pm, r.Metrics, now)
+
+	sort.SliceStable(pm.Timeline, func(i, j int) bool { return pm.Timeline[i].Time.Before(pm.Timeline[j].Time) })
+	if pm.Responders == nil {
+		pm.Responders = []string{}
+	}
+	return pm, nil
+}
+
+// gatherAnnotationEvidence adds alert state changes and annotations around the incident.
+func (a *App) gatherAnnotationEvidence(ctx context.Context, pm *postmortem) {
+	annotations, err := a.listAnnotations(ctx, pm.From.Add(-postmortemLookback), pm.To, "")
+	if err != nil {
+		pm.warn("annotations: %s", err)
+		return
+	}
+	for _, an := range annotations {
+		if !labelScope(pm.Labels).mentionedIn(an.Text, an.Tags) {
+			continue
+		}
+		ev := postmortemEvidence{Time: an.time(), URL: an.url(), Detail: an.Text}
+		if an.AlertID != 0 || an.NewState != "" {
+			name := an.AlertName
+			if name == "" {
+				name = "alert " + strconv.FormatInt(an.AlertID, 10)
+			}
+			ev.Title = fmt.Sprintf("%s: %s → %s", name, an.PrevState, an.NewState)
+			pm.addEvent("alert", ev.Title, ev)
+			continue
+		}
+		ev.Title = truncate(an.Text, 120)
+		if len(an.Tags) > 0 {
+			ev.Title += " [" + strings.Join(an.Tags, ", ") + "]"
+		}
+		pm.addEvent("annotation", truncate(an.Text, 300), ev)
+		pm.addResponder(an.Login)
+	}
+}
+
+// gatherInvestigationEvidence adds the steps and evidence of investigations started during
+// or shortly after the incident.
+func (a *App) gatherInvestigationEvidence(ctx context.Context, pm *postmortem) {
+	invs, err := listJSON[investigation](ctx, a.store, investigationsCollection)
+	if err != nil {
+		pm.warn("investigations: %s", err)
+		return
+	}
+	for _, inv := range invs {
+		if inv.CreatedAt.Before(pm.From.Add(-postmortemLookback)) || inv.CreatedAt.After(pm.To.Add(postmortemFollowUp)) || !labelScope(pm.Labels).matches(inv.Labels) {
+			continue
+		}
+		url := pluginResourcesPath + "/investigations/" + inv.ID
+		pm.addEvent("investigation", "Investigation started: "+inv.Goal, postmortemEvidence{
+			Title: "Investigation: " + inv.Title, Time: inv.CreatedAt, URL: url, Detail: "Goal: " + inv.Goal,
+		})
+		pm.addResponder(inv.CreatedBy)
+		for i, s := range inv.Steps {
+			if s.Status != investigationCompleted {
+				continue
+			}
+			title := s.Title
+			if title == "" {
+				title = s.Kind + " step"
+			}
+			detail := s.Output
+			if q := s.Query; q != "" {
+				detail = q + "\n" + detail
+			}
+			pm.addEvidence(postmortemEvidence{
+				Kind:   "investigation",
+				Title:  fmt.Sprintf("%s, step %d: %s", inv.Title, i+1, title),
+				Time:   s.CompletedAt,
+				URL:    url + "#step-" + s.ID,
+				Detail: truncate(detail, 1000),
+			})
+			pm.addResponder(s.Author)
+		}
+		for _, ev := range inv.Evidence {
+			pm.addEvidence(postmortemEvidence{
+				Kind: "investigation", Title: ev.Title, Time: ev.AddedAt, URL: ev.URL, Detail: truncate(ev.Content, 1000),
+			})
+		}
+	}
+}
+
+// gatherChangeEvidence adds the changes ranked as suspects of the incident, so the root
+// cause can cite them. Changes unrelated to the incident labels are left out.
+func (a *App) gatherChangeEvidence(ctx context.Context, pm *postmortem) {
+	suspects, err := a.findSuspects(ctx, suspectsRequest{
+		Time: pm.From, Labels: pm.Labels, Limit: postmortemSuspectLimit,
+	}, pm.From)
+	if err != nil {
+		pm.warn("changes: %s", err)
+		return
+	}
+	for _, s := range suspects {
+		if s.ServiceScore < 0.5 {
+			continue
+		}
+		c := s.Change
+		pm.addEvent(c.timelineKind(), c.Title, postmortemEvidence{
+			Title:  fmt.Sprintf("%s%s (score %.2f)", suspectChangePrefix, c.Title, s.Score),
+			Time:   c.Time,
+			URL:    c.URL,
+			Detail: strings.TrimSpace(strings.Join(s.Reasons, ", ") + ". " + c.Description),
+		})
+	}
+}
+
+// gatherActionEvidence adds remediation actions proposed during or shortly after the incident.
+func (a *App) gatherActionEvidence(ctx context.Context, pm *postmortem) {
+	actions, err := listJSON[action](ctx, a.store, actionsCollection)
+	if err != nil {
+		pm.warn("actions: %s", err)
+		return
+	}
+	for _, ac := range actions {
+		if ac.CreatedAt.Before(pm.From.Add(-postmortemLookback)) || ac.CreatedAt.After(pm.To.Add(postmortemFollowUp)) {
+			continue
+		}
+		at := ac.UpdatedAt
+		detail := fmt.Sprintf("%s %s, status %s", ac.Kind, ac.URL, ac.Status)
+		if ac.Outcome != nil {
+			at = ac.Outcome.At
+			detail += fmt.Sprintf(", target responded with %d", ac.Outcome.StatusCode)
+		}
+		pm.addEvent("action", fmt.Sprintf("Remediation %q %s", ac.Title, ac.Status), postmortemEvidence{
+			Title: "Action: " + ac.Title, Time: at, URL: pluginResourcesPath + "/actions/" + ac.ID, Detail: detail,
+		})
+		for _, ap := range ac.Approvals {
+			pm.addResponder(ap.User)
+		}
+	}
+}
+
+// gatherMetricEvidence adds the values of the requested metrics at the start and end of the incident.
+func (a *App) gatherMetricEvidence(ctx context.Context, pm *postmortem, metrics []postmortemMetric, now time.Time) {
+	for _, m := range metrics {
+		catalog := &promCatalog{mcp: a.mcp, datasourceUID: m.DatasourceUID}
+		end := pm.To
+		if end.After(now) {
+			end = time.Time{}
+		}
+		before, err := catalog.queryInstantAt(ctx, m.Query, pm.From)
+		if err == nil {
+			var after []promSample
+			after, err = catalog.queryInstantAt(ctx, m.Query, end)
+			if err == nil {
+				pm.addEvidence(postmortemEvidence{
+					Kind: "metric", Title: m.Title, Time: pm.From, Detail: m.Query + "\n" + metricSnapshot(before, after),
+				})
+				continue
+			}
+		}
+		pm.warn("metric %s: %s", m.Title, err)
+	}
+}
+
+// metricSnapshot describes how the series of a query changed between two evaluations.
+func metricSnapshot(before, after []promSample) string {
+	start := map[string]float64{}
+	for _, s := range before {
+		start["{"+formatLabelSet(s.Metric)+"}"] = s.Value
+	}
+	var lines []string
+	for i, s := range after {
+		if i == postmortemMaxSeries {
+			lines = append(lines, fmt.Sprintf("… %d more series", len(after)-i))
+			break
+		}
+		key := "{" + formatLabelSet(s.Metric) + "}"
+		if v, ok := start[key]; ok {
+			lines = append(lines, fmt.Sprintf("%s: %g at start, %g at end", key, v, s.Value))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: absent at start, %g at end", key, s.Value))
+		}
+	}
+	if len(lines) == 0 {
+		return "no data at the end of the incident"
+	}
+	return strings.Join(lines, "\n")
+}
+
+const postmortemSystemPrompt = `You are an SRE writing a blameless postmortem draft.
+You are given numbered evidence, such as alert state changes, annotations, incident activity, investigation steps, metrics and
+suspect changes ranked by how closely they match the incident in service and time.
+Reply only with a JSON object of this form:
+{"summary": {"text": "...", "evidence": ["E1"]},
+ "impact": {"text": "...", "evidence": ["E2"]},
+ "rootCause": {"text": "...", "evidence": ["E3"]},
+ "actionItems": [{"text": "...", "owner": "", "evidence": ["E4"]}]}
+Every claim must cite the IDs of the evidence it is based on. Do not state anything the evidence does not support;
+if the root cause is unclear, say so and cite the evidence that narrows it down.`
+
+// postmortemPrompt lists the incident and its evidence for the LLM.
+func postmortemPrompt(pm postmortem) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Incident: %s\nWindow: %s to %s\n", pm.Title, pm.From.Format(time.RFC3339), pm.To.Format(time.RFC3339))
+	if pm.Severity != "" {
+		fmt.Fprintf(&b, "Severity: %s\n", pm.Severity)
+	}
+	if len(pm.Labels) > 0 {
+		fmt.Fprintf(&b, "Labels: %s\n", formatLabelSet(pm.Labels))
+	}
+	if len(pm.Responders) > 0 {
+		fmt.Fprintf(&b, "Responders: %s\n", strings.Join(pm.Responders, ", "))
+	}
+	b.WriteString("\nEvidence:\n")
+	for _, ev := range pm.Evidence {
+		fmt.Fprintf(&b, "[%s] (%s", ev.ID, ev.Kind)
+		if !ev.Time.IsZero() {
+			fmt.Fprintf(&b, ", %s", ev.Time.Format(time.RFC3339))
+		}
+		fmt.Fprintf(&b, ") %s\n", ev.Title)
+		if ev.Detail != "" {
+			fmt.Fprintf(&b, "    %s\n", strings.ReplaceAll(truncate(ev.Detail, 500), "\n", "\n    "))
+		}
+	}
+	return b.String()
+}
+
+// postmortemDraftReply is the JSON object the LLM is asked to reply with.
+type postmortemDraftReply struct {
+	Summary     postmortemClaim   `json:"summary"`
+	Impact      postmortemClaim   `json:"impact"`
+	RootCause   postmortemClaim   `json:"rootCause"`
+	ActionItems []postmortemClaim `json:"actionItems"`
+}
+
+// claims returns the claims of the draft with the name they are reported under.
+func (d *postmortemDraftReply) claims() map[string]*postmortemClaim {
+	claims := map[string]*postmortemClaim{"summary": &d.Summary, "impact": &d.Impact, "rootCause": &d.RootCause}
+	for i := range d.ActionItems {
+		claims[fmt.Sprintf("action item %d", i+1)] = &d.ActionItems[i]
+	}
+	return claims
+}
+
+// checkEvidence drops citations of unknown evidence and returns the claims left without
+// any citation.
+func (d *postmortemDraftReply) checkEvidence(known map[string]bool) []string {
+	var unsupported []string
+	for name, c := range d.claims() {
+		c.Evidence = slices.DeleteFunc(c.Evidence, func(id string) bool { return !known[id] })
+		if c.Evidence == nil {
+			c.Evidence = []string{}
+		}
+		c.Unsupported = len(c.Evidence) == 0
+		if c.Unsupported {
+			unsupported = append(unsupported, name)
+		}
+	}
+	sort.Strings(unsupported)
+	return unsupported
+}
+
+// draftPostmortem asks the LLM to write the summary, impact, root cause and action items,
+// asking again when claims do not cite evidence. Claims that are still unsupported after
+// maxPostmortemDraftAttempts are kept and marked as such.
+func (a *App) draftPostmortem(ctx context.Context, pm *postmortem) error {
+	ctx = withLLMFeature(ctx, featureReport, "")
+	known := map[string]bool{}
+	for _, ev := range pm.Evidence {
+		known[ev.ID] = true
+	}
+	messages := []chatMessage{
+		{Role: "system", Content: postmortemSystemPrompt},
+		{Role: "user", Content: postmortemPrompt(*pm)},
+	}
+	var draft postmortemDraftReply
+	for attempt := 1; ; attempt++ {
+		content, err := a.chat(ctx, llmModelLarge, messages)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, chatMessage{Role: "assistant", Content: content})
+		var feedback string
+		if err := decodeLLMJSON(content, &draft); err != nil {
+			feedback = fmt.Sprintf("Your reply could not be read: %s. Reply only with the JSON object.", err)
+		} else if unsupported := draft.checkEvidence(known); len(unsupported) > 0 {
+			feedback = fmt.Sprintf("These claims do not cite any of the evidence IDs: %s. "+
+				"Cite the evidence each claim is based on, or remove claims the evidence does not support.", strings.Join(unsupported, ", "))
+		} else {
+			break
+		}
+		if attempt == maxPostmortemDraftAttempts {
+			if draft.Summary.Text == "" {
+				return fmt.Errorf("llm did not produce a postmortem draft: %s", feedback)
+			}
+			break
+		}
+		messages = append(messages, chatMessage{Role: "user", Content: feedback})
+	}
+	pm.Summary, pm.Impact, pm.RootCause = draft.Summary, draft.Impact, draft.RootCause
+	pm.ActionItems = draft.ActionItems
+	if pm.ActionItems == nil {
+		pm.ActionItems = []postmortemClaim{}
+	}
+	return nil
+}
+
+// suspectChangePrefix starts the title of the evidence of suspect changes.
+const suspectChangePrefix = "Suspect change: "
+
+// templatePostmortem drafts the summary, impact, root cause and action items from the
+// evidence without the LLM. Suspect changes are listed as candidate root causes, and the
+// action items follow from the alerts and the failed remediations.
+func templatePostmortem(pm *postmortem) {
+	claim := func(text string, evidence []postmortemEvidence) postmortemClaim {
+		c := postmortemClaim{Text: text, Evidence: []string{}}
+		for _, ev := range evidence {
+			c.Evidence = append(c.Evidence, ev.ID)
+		}
+		c.Unsupported = len(c.Evidence) == 0
+		return c
+	}
+	byKind := map[string][]postmortemEvidence{}
+	var suspects []postmortemEvidence
+	for _, ev := range pm.Evidence {
+		if strings.HasPrefix(ev.Title, suspectChangePrefix) {
+			suspects = append(suspects, ev)
+		} else {
+			byKind[ev.Kind] = append(byKind[ev.Kind], ev)
+		}
+	}
+	// alerts holds the first event of each alert, in the order the alerts fired.
+	var alerts []postmortemEvidence
+	var alertNames []string
+	for _, ev := range byKind["alert"] {
+		name, _, _ := strings.Cut(ev.Title, ": ")
+		if !slices.Contains(alertNames, name) {
+			alerts, alertNames = append(alerts, ev), append(alertNames, name)
+		}
+	}
+
+	summary := fmt.Sprintf("%s lasted %s, from %s to %s.", pm.Title, formatDuration(pm.To.Sub(pm.From)),
+		pm.From.Format("2006-01-02 15:04"), pm.To.Format("2006-01-02 15:04 MST"))
+	if pm.Severity != "" {
+		summary += " Severity: " + pm.Severity + "."
+	}
+	summary += fmt.Sprintf(" %d alerts fired, and %d annotations and %d remediation actions were recorded.",
+		len(alerts), len(byKind["annotation"]), len(byKind["action"]))
+	// The first incident evidence is the incident itself, the others its activity.
+	incident := byKind["incident"][:min(len(byKind["incident"]), 1)]
+	pm.Summary = claim(summary, slices.Concat(incident, alerts))
+
+	var impact []string
+	if len(alerts) > 0 {
+		impact = append(impact, "Alerts fired: "+limitedList(alertNames, 10)+".")
+	}
+	var metricTitles []string
+	for _, ev := range byKind["metric"] {
+		metricTitles = append(metricTitles, ev.Title)
+	}
+	if len(metricTitles) > 0 {
+		impact = append(impact, "See the values of "+strings.Join(metricTitles, ", ")+" at the start and end of the incident.")
+	}
+	if len(impact) == 0 {
+		impact = append(impact, "The impact could not be derived from alerts or metrics.")
+	}
+	pm.Impact = claim(strings.Join(impact, " "), slices.Concat(alerts, byKind["metric"]))
+
+	if len(suspects) > 0 {
+		var titles []string
+		for _, ev := range suspects {
+			titles = append(titles, strings.TrimPrefix(ev.Title, suspectChangePrefix))
+		}
+		pm.RootCause = claim("Not confirmed. Changes ranked as suspects: "+strings.Join(titles, "; ")+".", suspects)
+	} else {
+		pm.RootCause = claim("Not determined. No recent change was ranked as a suspect.", nil)
+	}
+
+	pm.ActionItems = []postmortemClaim{claim("Confirm the root cause and complete this draft, which was written from templates.", nil)}
+	for i, ev := range alerts[:min(len(alerts), 3)] {
+		pm.ActionItems = append(pm.ActionItems, claim(fmt.Sprintf("Review the alert %s and its runbook.", alertNames[i]), []postmortemEvidence{ev}))
+	}
+	for _, ev := range byKind["action"] {
+		if strings.Contains(ev.Detail, "status "+actionFailed) {
+			pm.ActionItems = append(pm.ActionItems, claim(fmt.Sprintf("Follow up on the failed remediation %q.", strings.TrimPrefix(ev.Title, "Action: ")), []postmortemEvidence{ev}))
+		}
+	}
+}
+
+// renderPostmortem renders a postmortem as Markdown. Citations link to the evidence list
+// at the end of the document.
+func renderPostmortem(pm postmortem) string {
+	var b strings.Builder
+	cite := func(ids []string) string {
+		links := make([]string, len(ids))
+		for i, id := range ids {
+			links[i] = fmt.Sprintf("[%s](#%s)", id, strings.ToLower(id))
+		}
+		return strings.Join(links, " ")
+	}
+	claim := func(c postmortemClaim) string {
+		if c.Unsupported {
+			return c.Text + " _(not supported by evidence)_"
+		}
+		return strings.TrimSpace(c.Text + " " + cite(c.Evidence))
+	}
+
+	fmt.Fprintf(&b, "# Postmortem: %s\n\n", pm.Title)
+	var meta []string
+	if pm.IncidentID != "" {
+		meta = append(meta, "**Incident:** "+pm.IncidentID)
+	}
+	if pm.Severity != "" {
+		meta = append(meta, "**Severity:** "+pm.Severity)
+	}
+	meta = append(meta, fmt.Sprintf("**Window:** %s – %s", pm.From.Format("2006-01-02 15:04"), pm.To.Format("2006-01-02 15:04 MST")))
+	meta = append(meta, "**Status:** "+pm.Status)
+	b.WriteString(strings.Join(meta, " · ") + "\n\n")
+
+	fmt.Fprintf(&b, "## Summary\n\n%s\n\n", claim(pm.Summary))
+	fmt.Fprintf(&b, "## Impact\n\n%s\n\n", claim(pm.Impact))
+	fmt.Fprintf(&b, "## Root cause\n\n%s\n\n", claim(pm.RootCause))
+
+	b.WriteString("## Timeline\n\n")
+	if len(pm.Timeline) == 0 {
+		b.WriteString("No events were found for this incident.\n\n")
+	} else {
+		b.WriteString("| Time (UTC) | Event | Evidence |\n| --- | --- | --- |\n")
+		for _, e := range pm.Timeline {
+			text := strings.ReplaceAll(strings.ReplaceAll(e.Text, "\n", " "), "|", "\\|")
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", e.Time.UTC().Format("2006-01-02 15:04:05"), text, cite([]string{e.Evidence}))
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("## Responders\n\n")
+	if len(pm.Responders) == 0 {
+		b.WriteString("No responders were recorded.\n")
+	}
+	for _, r := range pm.Responders {
+		fmt.Fprintf(&b, "- %s\n", r)
+	}
+	b.WriteString("\n## Action items\n\n")
+	if len(pm.ActionItems) == 0 {
+		b.WriteString("No action items were identified.\n")
+	}
+	for _, c := range pm.ActionItems {
+		owner := ""
+		if c.Owner != "" {
+			owner = " (" + c.Owner + ")"
+		}
+		c.Text += owner
+		fmt.Fprintf(&b, "- [ ] %s\n", claim(c))
+	}
+
+	b.WriteString("\n## Evidence\n\n")
+	for _, ev := range pm.Evidence {
+		title := ev.Title
+		if ev.URL != "" {
+			title = fmt.Sprintf("[%s](%s)", ev.Title, ev.URL)
+		}
+		fmt.Fprintf(&b, "- <a id=\"%s\"></a>**%s** (%s", strings.ToLower(ev.ID), ev.ID, ev.Kind)
+		if !ev.Time.IsZero() {
+			fmt.Fprintf(&b, ", %s", ev.Time.UTC().Format("2006-01-02 15:04:05"))
+		}
+		fmt.Fprintf(&b, ") %s\n", title)
+	}
+	if len(pm.Warnings) > 0 {
+		b.WriteString("\n## Data gaps\n\nThe following sources could not be read when this draft was generated:\n\n")
+		for _, w := range pm.Warnings {
+			fmt.Fprintf(&b, "- %s\n", w)
+		}
+	}
+	return b.String()
+}
+
+// handlePostmortemGenerate gathers the evidence of an incident or time window, has the
+// LLM draft the postmortem and stores the draft.
+func (a *App) handlePostmortemGenerate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var r postmortemRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.IncidentID == "" {
+		switch {
+		case r.From.IsZero() || r.To.IsZero():
+			http.Error(w, "either incidentId or from and to are required", http.StatusBadRequest)
+			return
+		case !r.From.Before(r.To):
+			http.Error(w, "from must be before to", http.StatusBadRequest)
+			return
+		case r.To.Sub(r.From) > postmortemMaxWindow:
+			http.Error(w, fmt.Sprintf("the time window must not be longer than %s", formatDuration(postmortemMaxWindow)), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, m := range r.Metrics {
+		if m.Title == "" || m.DatasourceUID == "" || m.Query == "" {
+			http.Error(w, "metrics need a title, datasourceUid and query", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := req.Context()
+	now := time.Now().UTC()
+	pm, err := a.gatherPostmortem(ctx, r, now)
+	if err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	if err := a.draftPostmortem(ctx, &pm); llmUnavailable(err) {
+		pm.degradation = a.degrade(ctx, featureReport, err)
+		templatePostmortem(&pm)
+	} else if err != nil {
+		a.logger(ctx).Error("Error drafting postmortem", "err", err)
+		if !writeLimitError(w, err) {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	pm.ID = uuid.NewString()
+	pm.Markdown = renderPostmortem(pm)
+	pm.CreatedBy = userLogin(ctx)
+	pm.CreatedAt, pm.UpdatedAt = now, now
+	if err := saveJSON(ctx, a.store, postmortemsCollection, pm.ID, pm); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, pm)
+}
+
+// handlePostmortems lists postmortems, newest first.
+func (a *App) handlePostmortems(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pms, err := listJSON[postmortem](req.Context(), a.store, postmortemsCollection)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.SliceStable(pms, func(i, j int) bool { return pms[i].CreatedAt.After(pms[j].CreatedAt) })
+	writeJSON(w, http.StatusOK, pms)
+}
+
+// postmortemEdit is the body of PUT /postmortems/{id}. Fields that are not set are kept.
+// Unless the Markdown is edited directly, it is rendered again from the edited fields.
+type postmortemEdit struct {
+	Title       *string            `json:"title"`
+	Status      *string            `json:"status"`
+	Summary     *postmortemClaim   `json:"summary"`
+	Impact      *postmortemClaim   `json:"impact"`
+	RootCause   *postmortemClaim   `json:"rootCause"`
+	ActionItems *[]postmortemClaim `json:"actionItems"`
+	Markdown    *string            `json:"markdown"`
+}
+
+// handlePostmortem gets, edits or deletes the postmortem identified by {id}.
+func (a *App) handlePostmortem(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := req.PathValue("id")
+	pm, err := loadJSON[postmortem](ctx, a.store, postmortemsCollection, id)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "postmortem not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, pm)
+	case http.MethodPut:
+		var edit postmortemEdit
+		if err := json.NewDecoder(req.Body).Decode(&edit); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if edit.Status != nil && *edit.Status != postmortemDraft && *edit.Status != postmortemFinal {
+			http.Error(w, fmt.Sprintf("status must be %q or %q", postmortemDraft, postmortemFinal), http.StatusBadRequest)
+			return
+		}
+		setIf(&pm.Title, edit.Title)
+		setIf(&pm.Status, edit.Status)
+		setIf(&pm.Summary, edit.Summary)
+		setIf(&pm.Impact, edit.Impact)
+		setIf(&pm.RootCause, edit.RootCause)
+		setIf(&pm.ActionItems, edit.ActionItems)
+		if edit.Markdown != nil {
+			pm.Markdown = *edit.Markdown
+		} else {
+			pm.Markdown = renderPostmortem(pm)
+		}
+		pm.UpdatedBy = userLogin(ctx)
+		pm.UpdatedAt = time.Now().UTC()
+		if err := saveJSON(ctx, a.store, postmortemsCollection, pm.ID, pm); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, pm)
+	case http.MethodDelete:
+		if err := a.store.Delete(ctx, postmortemsCollection, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "postmortem deleted"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// setIf sets *dst to *v if v is not nil.
+func setIf[T any](dst *T, v *T) {
+	if v != nil {
+		*dst = *v
+	}
+}
@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var incidentStart = time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+
+// newFakeIncidentGrafana serves annotations and an IRM incident around incidentStart.
+func newFakeIncidentGrafana(t *testing.T) (*httptest.Server, *[]string) {
+	var calls []string
+	ms := func(d time.Duration) int64 { return incidentStart.Add(d).UnixMilli() }
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/annotations", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		writeJSON(w, http.StatusOK, []map[string]any{
+			{"id": 1, "alertId": 7, "alertName": "HighErrorRate", "prevState": "Pending", "newState": "Alerting", "time": ms(2 * time.Minute), "text": "{service=checkout} - error rate 5%"},
+			{"id": 2, "dashboardUID": "deploys", "panelId": 2, "time": ms(-5 * time.Minute), "text": "Deploy checkout v2.3.0", "tags": []string{"deploy", "checkout"}, "login": "deployer"},
+			{"id": 3, "time": ms(10 * time.Minute), "text": "Cart maintenance", "tags": []string{"cart"}},
+		})
+	})
+	mux.HandleFunc("POST /api/plugins/grafana-irm-app/resources/api/v1/IncidentsService.GetIncident", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body["incidentID"] != "42" {
+			http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"incident": map[string]any{
+			"incidentID":    "42",
+			"title":         "Checkout errors",
+			"severity":      "major",
+			"status":        "resolved",
+			"overviewURL":   "/a/grafana-irm-app/incidents/42",
+			"incidentStart": incidentStart.Format(time.RFC3339),
+			"incidentEnd":   incidentStart.Add(time.Hour).Format(time.RFC3339),
+			"closedTime":    "",
+			"labels":        []map[string]string{{"key": "service", "label": "checkout"}},
+			"incidentMembership": map[string]any{"assignments": []map[string]any{
+				{"role": map[string]string{"name": "commander"}, "user": map[string]string{"name": "alice"}},
+			}},
+		}})
+	})
+	mux.HandleFunc("POST /api/plugins/grafana-irm-app/resources/api/v1/ActivityService.QueryActivity", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		writeJSON(w, http.StatusOK, map[string]any{"activityItems": []map[string]any{
+			{"activityItemID": "a1", "activityKind": "userNote", "body": "Rolling back v2.3.0", "eventTime": incidentStart.Add(20 * time.Minute).Format(time.RFC3339), "user": map[string]string{"name": "bob"}},
+			{"activityItemID": "a2", "activityKind": "userNote", "body": "", "eventTime": incidentStart.Add(21 * time.Minute).Format(time.RFC3339)},
+			{"activityItemID": "a3", "activityKind": "userNote", "body": "Errors are back to normal", "eventTime": incidentStart.Add(40 * time.Minute).Format(time.RFC3339), "user": map[string]string{"name": "alice"}},
+		}})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestPostmortemGenerate(t *testing.T) {
+	srv, _ := newFakeIncidentGrafana(t)
+	app := newTestApp(t, srv.URL, nil)
+	app.mcp = &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"query_prometheus": func(args map[string]any) (any, error) {
+			value := "0.001"
+			if args["startTime"] == incidentStart.Add(time.Hour).Format(time.RFC3339) {
+				value = "0.002"
+			}
+			return []map[string]any{{"metric": map[string]string{"service": "checkout"}, "value": []any{1, value}}}, nil
+		},
+	}}
+	err := saveJSON(context.Background(), app.store, investigationsCollection, "inv-1", investigation{
+		ID: "inv-1", Title: "checkout errors", Goal: "Find the cause of checkout errors", Status: investigationCompleted,
+		Labels: map[string]string{"service": "checkout"}, CreatedBy: "carol", CreatedAt: incidentStart.Add(5 * time.Minute),
+		Steps: []investigationStep{{ID: "s1", Kind: stepQuery, Title: "error logs", Query: `{app="checkout"} |= "error"`,
+			Status: investigationCompleted, Output: "NullPointerException in PriceService", CompletedAt: incidentStart.Add(6 * time.Minute)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &fakeLLM{replies: []string{
+		`{"summary": {"text": "Checkout failed after a deploy.", "evidence": ["E1", "E4"]},
+		  "impact": {"text": "5% of checkouts failed for 40 minutes.", "evidence": ["E3"]},
+		  "rootCause": {"text": "A bug in v2.3.0.", "evidence": ["E99"]},
+		  "actionItems": [{"text": "Add a canary stage.", "evidence": []}]}`,
+		"```json\n" + `{"summary": {"text": "Checkout failed after a deploy.", "evidence": ["E1", "E4"]},
+		  "impact": {"text": "5% of checkouts failed for 40 minutes.", "evidence": ["E3"]},
+		  "rootCause": {"text": "A NullPointerException introduced in v2.3.0.", "evidence": ["E2", "E8"]},
+		  "actionItems": [{"text": "Add a canary stage.", "owner": "bob", "evidence": ["E2"]}]}` + "\n```",
+	}}
+	app.llm = llm
+
+	resp := callResource(t, app, http.MethodPost, "postmortems/generate", map[string]any{
+		"incidentId": "42",
+		"metrics":    []map[string]string{{"title": "Error ratio", "datasourceUid": "prom", "query": "sum(rate(errors[5m]))"}},
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("generate: %d %s", resp.Status, resp.Body)
+	}
+	var pm postmortem
+	if err := json.Unmarshal(resp.Body, &pm); err != nil {
+		t.Fatal(err)
+	}
+
+	if pm.Title != "Checkout errors" || pm.Severity != "major" || pm.Status != postmortemDraft || !pm.To.Equal(incidentStart.Add(time.Hour)) {
+		t.Errorf("unexpected postmortem %+v", pm)
+	}
+	var timeline []string
+	for _, e := range pm.Timeline {
+		timeline = append(timeline, e.Evidence+":"+e.Kind)
+	}
+	// The cart annotation is out of scope and the empty activity item is skipped.
+	if got := strings.Join(timeline, " "); got != "E5:annotation E1:incident E4:alert E6:investigation E2:incident E3:incident" {
+		t.Errorf("unexpected timeline %s", got)
+	}
+	if got := strings.Join(pm.Responders, ", "); got != "alice (commander), bob, deployer, carol" {
+		t.Errorf("unexpected responders %s", got)
+	}
+	if ev := pm.Evidence[7]; ev.Kind != "metric" || !strings.Contains(ev.Detail, `{service="checkout"}: 0.001 at start, 0.002 at end`) {
+		t.Errorf("unexpected metric evidence %+v", ev)
+	}
+	if ev := pm.Evidence[6]; ev.URL != pluginResourcesPath+"/investigations/inv-1#step-s1" {
+		t.Errorf("unexpected investigation evidence %+v", ev)
+	}
+
+	// The first draft cited unknown evidence, so the LLM was asked again.
+	llm.mu.Lock()
+	if len(llm.requests) != 2 || !strings.Contains(llm.requests[1].Messages[3].Content, "action item 1, rootCause") {
+		t.Errorf("expected feedback about unsupported claims, got %d requests", len(llm.requests))
+	}
+	if prompt := llm.requests[0].Messages[1].Content; !strings.Contains(prompt, "[E7] (investigation") || !strings.Contains(prompt, "NullPointerException") {
+		t.Errorf("prompt is missing evidence:\n%s", prompt)
+	}
+	llm.mu.Unlock()
+	if pm.RootCause.Unsupported || strings.Join(pm.RootCause.Evidence, ",") != "E2,E8" || pm.ActionItems[0].Owner != "bob" {
+		t.Errorf("unexpected draft %+v %+v", pm.RootCause, pm.ActionItems)
+	}
+	for _, want := range []string{
+		"# Postmortem: Checkout errors",
+		"A NullPointerException introduced in v2.3.0. [E2](#e2) [E8](#e8)",
+		"| 2026-10-18 09:55:00 | Deploy checkout v2.3.0 | [E5](#e5) |",
+		"- [ ] Add a canary stage. (bob) [E2](#e2)",
+		`<a id="e4"></a>**E4** (alert, 2026-10-18 10:02:00) HighErrorRate: Pending → Alerting`,
+		"[Deploy checkout v2.3.0 [deploy, checkout]](/d/deploys?from=",
+	} {
+		if !strings.Contains(pm.Markdown, want) {
+			t.Errorf("markdown is missing %q:\n%s", want, pm.Markdown)
+		}
+	}
+
+	resp = callResource(t, app, http.MethodPut, "postmortems/"+pm.ID, map[string]any{
+		"status":    "final",
+		"rootCause": map[string]any{"text": "Missing null check in PriceService.", "evidence": []string{"E7"}},
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("edit: %d %s", resp.Status, resp.Body)
+	}
+	if err := json.Unmarshal(resp.Body, &pm); err != nil {
+		t.Fatal(err)
+	}
+	if pm.Status != postmortemFinal || pm.UpdatedBy != "tester" || !strings.Contains(pm.Markdown, "Missing null check in PriceService. [E7](#e7)") {
+		t.Errorf("edit was not applied: %+v", pm)
+	}
+	resp = callResource(t, app, http.MethodPut, "postmortems/"+pm.ID, map[string]any{"markdown": "# edited by hand"})
+	if err := json.Unmarshal(resp.Body, &pm); err != nil || pm.Markdown != "# edited by hand" {
+		t.Errorf("markdown edit was not kept: %v %q", err, pm.Markdown)
+	}
+	resp = callResource(t, app, http.MethodGet, "postmortems", nil)
+	if resp.Status != http.StatusOK || !strings.Contains(string(resp.Body), "# edited by hand") {
+		t.Errorf("list: %d %s", resp.Status, resp.Body)
+	}
+}
+
+func TestPostmortemGenerateForWindow(t *testing.T) {
+	srv, calls := newFakeIncidentGrafana(t)
+	app := newTestApp(t, srv.URL, nil)
+	app.llm = &fakeLLM{replies: []string{
+		`{"summary": {"text": "Cart maintenance.", "evidence": ["E1"]}, "impact": {"text": "None."}, "rootCause": {"text": "Planned work.", "evidence": ["E1"]}}`,
+		`{"summary": {"text": "Cart maintenance.", "evidence": ["E1"]}, "impact": {"text": "None."}, "rootCause": {"text": "Planned work.", "evidence": ["E1"]}}`,
+	}}
+
+	resp := callResource(t, app, http.MethodPost, "postmortems/generate", map[string]any{
+		"from":   incidentStart,
+		"to":     incidentStart.Add(time.Hour),
+		"labels": map[string]string{"team": "cart"},
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("generate: %d %s", resp.Status, resp.Body)
+	}
+	var pm postmortem
+	if err := json.Unmarshal(resp.Body, &pm); err != nil {
+		t.Fatal(err)
+	}
+	if len(*calls) != 1 || (*calls)[0] != "/api/annotations" {
+		t.Errorf("expected only annotations to be read, got %v", *calls)
+	}
+	if len(pm.Evidence) != 1 || pm.Evidence[0].Title != "Cart maintenance [cart]" {
+		t.Errorf("unexpected evidence %+v", pm.Evidence)
+	}
+	// The impact still has no evidence after the retry, so it is kept but marked.
+	if !pm.Impact.Unsupported || !strings.Contains(pm.Markdown, "None. _(not supported by evidence)_") {
+		t.Errorf("expected the impact to be marked as unsupported: %+v", pm.Impact)
+	}
+	if !strings.HasPrefix(pm.Title, "Incident of 2026-10-18 10:00") {
+		t.Errorf("unexpected title %q", pm.Title)
+	}
+
+	for _, tc := range []struct {
+		name string
+		body map[string]any
+		exp  int
+	}{
+		{name: "no incident or window", body: map[string]any{}, exp: http.StatusBadRequest},
+		{name: "inverted window", body: map[string]any{"from": incidentStart, "to": incidentStart.Add(-time.Hour)}, exp: http.StatusBadRequest},
+		{name: "long window", body: map[string]any{"from": incidentStart, "to": incidentStart.Add(30 * 24 * time.Hour)}, exp: http.StatusBadRequest},
+		{name: "unknown incident", body: map[string]any{"incidentId": "7"}, exp: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if resp := callResource(t, app, http.MethodPost, "postmortems/generate", tc.body); resp.Status != tc.exp {
+				t.Errorf("expected %d, got %d: %s", tc.exp, resp.Status, resp.Body)
+			}
+		})
+	}
+}
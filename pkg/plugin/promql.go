@@ -0,0 +1,461 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// promqlContextMetrics is the number of metric names included in a generation prompt.
+	promqlContextMetrics = 50
+	// promqlContextLabels is the number of label names included in a generation prompt.
+	promqlContextLabels = 50
+	// promqlContextLabelValues is the number of values included per label in a generation prompt.
+	promqlContextLabelValues = 50
+	// promqlListLimit is passed to the listing tools, which otherwise default to a handful of results.
+	promqlListLimit = 10000
+)
+
+// promCatalog looks up metric and label names of a Prometheus datasource through the
+// Prometheus MCP tools, caching results for the lifetime of a single request.
+type promCatalog struct {
+	mcp           mcpToolCaller
+	datasourceUID string
+
+	metrics map[string]bool
+	labels  map[string]map[string]bool
+}
+
+func newPromCatalog(mcp mcpToolCaller, datasourceUID string) *promCatalog {
+	return &promCatalog{
+		mcp:           mcp,
+		datasourceUID: datasourceUID,
+		metrics:       map[string]bool{},
+		labels:        map[string]map[string]bool{},
+	}
+}
+
+// metricNames lists metric names, optionally filtered by a regex.
+func (c *promCatalog) metricNames(ctx context.Context, regex string, limit int) ([]string, error) {
+	var names []string
+	err := callToolJSON(ctx, c.mcp, "list_prometheus_metric_names", map[string]any{
+		"datasourceUid": c.datasourceUID,
+		"regex":         regex,
+		"limit":         limit,
+	}, &names)
+	return names, err
+}
+
+// metricExists reports whether a metric with exactly this name exists.
+func (c *promCatalog) metricExists(ctx context.Context, name string) (bool, error) {
+	if ok, cached := c.metrics[name]; cached {
+		return ok, nil
+	}
+	names, err := c.metricNames(ctx, "^"+regexp.QuoteMeta(name)+"$", 1)
+	if err != nil {
+		return false, err
+	}
+	ok := len(names) > 0 && names[0] == name
+	c.metrics[name] = ok
+	return ok, nil
+}
+
+// labelNames lists the label names of the series matching any of the given metrics.
+// With no metrics, all label names of the datasource are listed.
+func (c *promCatalog) labelNames(ctx context.Context, metrics []string, limit int) ([]string, error) {
+	args := map[string]any{"datasourceUid": c.datasourceUID, "limit": limit}
+	if len(metrics) > 0 {
+		matches := make([]map[string]any, len(metrics))
+		for i, m := range metrics {
+			matches[i] = map[string]any{"filters": []map[string]string{{"name": labels.MetricName, "value": m, "type": "="}}}
+		}
+		args["matches"] = matches
+	}
+	var names []string
+	err := callToolJSON(ctx, c.mcp, "list_prometheus_label_names", args, &names)
+	return names, err
+}
+
+// metricLabels returns the set of label names present on a metric.
+func (c *promCatalog) metricLabels(ctx context.Context, metric string) (map[string]bool, error) {
+	if set, ok := c.labels[metric]; ok {
+		return set, nil
+	}
+	names, err := c.labelNames(ctx, []string{metric}, promqlListLimit)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	c.labels[metric] = set
+	return set, nil
+}
+
+// labelValues lists the values of a label.
+func (c *promCatalog) labelValues(ctx context.Context, label string, limit int) ([]string, error) {
+	var values []string
+	err := callToolJSON(ctx, c.mcp, "list_prometheus_label_values", map[string]any{
+		"datasourceUid": c.datasourceUID,
+		"labelName":     label,
+		"limit":         limit,
+	}, &values)
+	return values, err
+}
+
+// promSample is one sample of an instant query result.
+type promSample struct {
+	Metric map[string]string
+	Value  float64
+}
+
+// queryInstant evaluates an instant query at the current time.
+func (c *promCatalog) queryInstant(ctx context.Context, expr string) ([]promSample, error) {
+	return c.queryInstantAt(ctx, expr, time.Time{})
+}
+
+// queryInstantAt evaluates an instant query at t, or at the current time if t is zero.
+func (c *promCatalog) queryInstantAt(ctx context.Context, expr string, t time.Time) ([]promSample, error) {
+	at := "now"
+	if !t.IsZero() {
+		at = t.UTC().Format(time.RFC3339)
+	}
+	var result []struct {
+		Metric map[string]string `json:"metric"`
+		Value  [2]any            `json:"value"`
+	}
+	err := callToolJSON(ctx, c.mcp, "query_prometheus", map[string]any{
+		"datasourceUid": c.datasourceUID,
+		"expr":          expr,
+		"startTime":     at,
+		"queryType":     "instant",
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]promSample, len(result))
+	for i, r := range result {
+		s, _ := r.Value[1].(string)
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("query %s: invalid sample value %v", expr, r.Value[1])
+		}
+		samples[i] = promSample{Metric: r.Metric, Value: v}
+	}
+	return samples, nil
+}
+
+// promqlRefs are the metrics and labels referenced by a PromQL expression.
+type promqlRefs struct {
+	// Metrics maps each metric name to the labels its selectors match on.
+	Metrics map[string][]string
+	// Grouping lists the labels of by (...) clauses.
+	Grouping []string
+	// Derived lists labels created by label_replace and label_join.
+	Derived []string
+}
+
+// metricNames returns the referenced metric names in order.
+func (r promqlRefs) metricNames() []string {
+	names := make([]string, 0, len(r.Metrics))
+	for n := range r.Metrics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// labelNames returns every referenced label name in order.
+func (r promqlRefs) labelNames() []string {
+	set := map[string]bool{}
+	for _, ls := range r.Metrics {
+		for _, l := range ls {
+			set[l] = true
+		}
+	}
+	for _, l := range r.Grouping {
+		set[l] = true
+	}
+	return sortedKeys(set)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// selectorMetricName returns the metric name a vector selector selects, if it selects a single one.
+func selectorMetricName(vs *parser.VectorSelector) string {
+	if vs.Name != "" {
+		return vs.Name
+	}
+	for _, m := range vs.LabelMatchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+// promqlReferences walks a parsed expression and collects the metrics and labels it references.
+func promqlReferences(expr parser.Expr) promqlRefs {
+	refs := promqlRefs{Metrics: map[string][]string{}}
+	grouping, derived := map[string]bool{}, map[string]bool{}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			name := selectorMetricName(n)
+			if name == "" {
+				return nil
+			}
+			set := map[string]bool{}
+			for _, l := range refs.Metrics[name] {
+				set[l] = true
+			}
+			for _, m := range n.LabelMatchers {
+				if m.Name != labels.MetricName {
+					set[m.Name] = true
+				}
+			}
+			refs.Metrics[name] = sortedKeys(set)
+		case *parser.AggregateExpr:
+			if !n.Without {
+				for _, l := range n.Grouping {
+					grouping[l] = true
+				}
+			}
+		case *parser.Call:
+			if (n.Func.Name == "label_replace" || n.Func.Name == "label_join") && len(n.Args) > 1 {
+				if s, ok := n.Args[1].(*parser.StringLiteral); ok {
+					derived[s.Val] = true
+				}
+			}
+		}
+		return nil
+	})
+	refs.Grouping = sortedKeys(grouping)
+	refs.Derived = sortedKeys(derived)
+	return refs
+}
+
+// validatePromQL parses a query and checks that the metrics and labels it references
+// exist in the datasource. Problems with the query are returned as *invalidQueryError.
+func validatePromQL(ctx context.Context, catalog *promCatalog, query string) (promqlRefs, error) {
+	if query == "" {
+		return promqlRefs{}, invalidQuery("query is empty")
+	}
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return promqlRefs{}, invalidQuery("parse error: %s", err)
+	}
+	refs := promqlReferences(expr)
+	known := map[string]bool{labels.MetricName: true}
+	for _, l := range refs.Derived {
+		known[l] = true
+	}
+	for _, metric := range refs.metricNames() {
+		ok, err := catalog.metricExists(ctx, metric)
+		if err != nil {
+			return refs, err
+		}
+		if !ok {
+			return refs, invalidQuery("metric %q does not exist", metric)
+		}
+		available, err := catalog.metricLabels(ctx, metric)
+		if err != nil {
+			return refs, err
+		}
+		for _, l := range refs.Metrics[metric] {
+			if !available[l] {
+				return refs, invalidQuery("label %q does not exist on metric %q (available labels: %s)", l, metric, limitedList(sortedKeys(available), 30))
+			}
+		}
+		for l := range available {
+			known[l] = true
+		}
+	}
+	if len(refs.Metrics) > 0 {
+		for _, l := range refs.Grouping {
+			if !known[l] {
+				return refs, invalidQuery("label %q in by clause does not exist on any of the queried metrics", l)
+			}
+		}
+	}
+	return refs, nil
+}
+
+// limitedList joins at most n items, noting how many were left out.
+func limitedList(items []string, n int) string {
+	if len(items) <= n {
+		return strings.Join(items, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(items[:n], ", "), len(items)-n)
+}
+
+const promqlSystemPrompt = `You are an expert in Prometheus and PromQL helping SRE engineers.
+Translate the user's question into a single PromQL query.
+Rules:
+- Only use metric names and labels that appear in the provided context.
+- Use rate() or increase() with a range such as [5m] for counters (metrics ending in _total, _count or _sum).
+- Use histogram_quantile() over _bucket metrics for latency percentiles.
+- Do not add a time range outside of range selectors; the caller chooses the time range.
+Reply only with a JSON object: {"query": "<PromQL>", "explanation": "<one or two sentences>"}.`
+
+// promqlGenerateRequest is the body of POST /query/promql/generate.
+type promqlGenerateRequest struct {
+	Question      string `json:"question"`
+	DatasourceUID string `json:"datasourceUid"`
+	// Metrics optionally narrows the metrics offered to the LLM.
+	Metrics []string `json:"metrics"`
+	// Labels optionally lists labels whose values should be offered to the LLM.
+	Labels []string `json:"labels"`
+}
+
+// promqlPrompt builds the user prompt, gathering metric, label and label value context from the datasource.
+func promqlPrompt(ctx context.Context, catalog *promCatalog, body promqlGenerateRequest) (string, error) {
+	metrics := body.Metrics
+	if len(metrics) == 0 {
+		all, err := catalog.metricNames(ctx, "", promqlListLimit)
+		if err != nil {
+			return "", err
+		}
+		metrics = rankByRelevance(body.Question, all, promqlContextMetrics)
+	}
+	labelNames, err := catalog.labelNames(ctx, body.Metrics, promqlListLimit)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Question: %s\n\nAvailable metrics:\n", body.Question)
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "- %s\n", m)
+	}
+	fmt.Fprintf(&b, "\nAvailable labels: %s\n", limitedList(rankByRelevance(body.Question, labelNames, len(labelNames)), promqlContextLabels))
+	for _, l := range body.Labels {
+		values, err := catalog.labelValues(ctx, l, promqlContextLabelValues)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "Values of label %s: %s\n", l, strings.Join(values, ", "))
+	}
+	return b.String(), nil
+}
+
+// handlePromQLGenerate translates a natural-language question into a validated PromQL query.
+func (a *App) handlePromQLGenerate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body promqlGenerateRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(body.Question) == "" || body.DatasourceUID == "" {
+		http.Error(w, "question and datasourceUid are required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	catalog := newPromCatalog(a.mcp, body.DatasourceUID)
+	prompt, err := promqlPrompt(ctx, catalog, body)
+	if err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	var refs promqlRefs
+	q, attempts, err := a.generateQuery(ctx, promqlSystemPrompt, prompt, func(ctx context.Context, query string) error {
+		var err error
+		refs, err = validatePromQL(ctx, catalog, query)
+		return err
+	})
+	var degraded degradation
+	if llmUnavailable(err) {
+		degraded = a.degrade(ctx, featureQuery, err)
+		q, refs, err = promqlFallback(ctx, catalog, body)
+	}
+	var invalid *invalidQueryError
+	if errors.Is(err, errQueryGenerationFailed) || errors.As(err, &invalid) {
+		writeJSON(w, http.StatusUnprocessableEntity, degraded.annotate(map[string]any{"error": err.Error(), "attempts": attempts}))
+		return
+	}
+	if err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, degraded.annotate(map[string]any{
+		"query":       q.Query,
+		"explanation": q.Explanation,
+		"metrics":     refs.metricNames(),
+		"labels":      refs.labelNames(),
+		"attempts":    attempts,
+	}))
+}
+
+// promqlQuantiles are the words of a question choosing the quantile of a latency
+// template, checked in order. The default is 0.99.
+var promqlQuantiles = []struct{ word, quantile string }{
+	{"p50", "0.5"}, {"median", "0.5"}, {"p90", "0.9"}, {"p95", "0.95"}, {"p999", "0.999"},
+}
+
+// promqlTemplate returns a query over metric shaped by the metric type its name suggests:
+// a latency quantile for histogram buckets, a rate for counters and the value of gauges.
+func promqlTemplate(question, metric string) string {
+	switch {
+	case strings.HasSuffix(metric, "_bucket"):
+		quantile := "0.99"
+		for _, q := range promqlQuantiles {
+			if strings.Contains(strings.ToLower(question), q.word) {
+				quantile = q.quantile
+				break
+			}
+		}
+		return fmt.Sprintf("histogram_quantile(%s, sum by (le) (rate(%s[5m])))", quantile, metric)
+	case strings.HasSuffix(metric, "_total") || strings.HasSuffix(metric, "_count") || strings.HasSuffix(metric, "_sum"):
+		return fmt.Sprintf("sum(rate(%s[5m]))", metric)
+	}
+	return metric
+}
+
+// promqlFallback builds a template query without the LLM, over the metric whose name
+// best matches the question. It fails with an *invalidQueryError if no metric matches.
+func promqlFallback(ctx context.Context, catalog *promCatalog, body promqlGenerateRequest) (generatedQuery, promqlRefs, error) {
+	metrics := body.Metrics
+	if len(metrics) == 0 {
+		var err error
+		if metrics, err = catalog.metricNames(ctx, "", promqlListLimit); err != nil {
+			return generatedQuery{}, promqlRefs{}, err
+		}
+	}
+	metric, ok := mostRelevant(body.Question, metrics)
+	if !ok && len(body.Metrics) == 1 {
+		metric, ok = body.Metrics[0], true
+	}
+	if !ok {
+		return generatedQuery{}, promqlRefs{}, invalidQuery("no metric name matches the question")
+	}
+	q := generatedQuery{
+		Query:       promqlTemplate(body.Question, metric),
+		Explanation: fmt.Sprintf("A template query over %s, the metric whose name best matches the question.", metric),
+	}
+	refs, err := validatePromQL(ctx, catalog, q.Query)
+	return q, refs, err
+}
@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newFakePrometheusMCP returns a fakeMCP exposing the Prometheus listing tools for a
+// small set of metrics and their labels.
+func newFakePrometheusMCP(metrics map[string][]string) *fakeMCP {
+	return &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"list_prometheus_metric_names": func(args map[string]any) (any, error) {
+			names := []string{}
+			for m := range metrics {
+				if re, _ := args["regex"].(string); re == "" || re == "^"+m+"$" {
+					names = append(names, m)
+				}
+			}
+			return names, nil
+		},
+		"list_prometheus_label_names": func(args map[string]any) (any, error) {
+			names := []string{"__name__"}
+			matches, _ := args["matches"].([]map[string]any)
+			for _, match := range matches {
+				filters := match["filters"].([]map[string]string)
+				names = append(names, metrics[filters[0]["value"]]...)
+			}
+			return names, nil
+		},
+		"list_prometheus_label_values": func(args map[string]any) (any, error) {
+			return []string{"checkout", "cart"}, nil
+		},
+	}}
+}
+
+func TestPromQLReferences(t *testing.T) {
+	catalog := newPromCatalog(newFakePrometheusMCP(map[string][]string{
+		"http_requests_total": {"service", "code"},
+	}), "prom")
+	for _, tc := range []struct {
+		name   string
+		query  string
+		expErr string
+	}{
+		{name: "valid", query: `sum by (code) (rate(http_requests_total{service="checkout"}[5m]))`},
+		{name: "syntax error", query: `sum(rate(http_requests_total[5m])`, expErr: "parse error"},
+		{name: "unknown metric", query: `rate(http_request_total[5m])`, expErr: `metric "http_request_total" does not exist`},
+		{name: "unknown label", query: `http_requests_total{svc="x"}`, expErr: `label "svc" does not exist`},
+		{name: "unknown grouping label", query: `sum by (pod) (http_requests_total)`, expErr: `label "pod" in by clause`},
+		{name: "derived grouping label", query: `sum by (svc) (label_replace(http_requests_total, "svc", "$1", "service", "(.*)"))`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := validatePromQL(t.Context(), catalog, tc.query)
+			if tc.expErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tc.expErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expErr)) {
+				t.Fatalf("expected error containing %q, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestPromQLGenerate(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	llm := &fakeLLM{replies: []string{
+		`{"query": "sum(rate(http_requests_total[5m])", "explanation": "x"}`,
+		`{"query": "sum(rate(http_request_total[5m]))", "explanation": "x"}`,
+		"```json\n{\"query\": \"sum by (code) (rate(http_requests_total{service=\\\"checkout\\\"}[5m]))\", \"explanation\": \"Request rate per status code.\"}\n```",
+	}}
+	app.llm = llm
+	app.mcp = newFakePrometheusMCP(map[string][]string{
+		"http_requests_total":    {"service", "code"},
+		"node_cpu_seconds_total": {"cpu", "mode"},
+	})
+
+	resp := callResource(t, app, http.MethodPost, "query/promql/generate", map[string]any{
+		"question":      "What is the checkout request rate per status code?",
+		"datasourceUid": "prom",
+		"labels":        []string{"service"},
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", resp.Status, resp.Body)
+	}
+	var out struct {
+		Query    string              `json:"query"`
+		Metrics  []string            `json:"metrics"`
+		Labels   []string            `json:"labels"`
+		Attempts []generationAttempt `json:"attempts"`
+	}
+	if err := json.Unmarshal(resp.Body, &out); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if len(out.Attempts) != 3 || out.Attempts[0].Error == "" || out.Attempts[2].Error != "" {
+		t.Errorf("unexpected attempts %+v", out.Attempts)
+	}
+	if out.Metrics[0] != "http_requests_total" || strings.Join(out.Labels, ",") != "code,service" {
+		t.Errorf("unexpected references %v %v", out.Metrics, out.Labels)
+	}
+
+	// The prompt carries the datasource context, and each error is fed back to the LLM.
+	first := llm.requests[0].Messages[1].Content
+	if !strings.Contains(first, "http_requests_total") || !strings.Contains(first, "Values of label service: checkout, cart") {
+		t.Errorf("prompt is missing context:\n%s", first)
+	}
+	last := llm.requests[2].Messages
+	if feedback := last[len(last)-1].Content; !strings.Contains(feedback, `metric "http_request_total" does not exist`) {
+		t.Errorf("validation error was not fed back, got %q", feedback)
+	}
+}
+
+func TestPromQLGenerateGivesUp(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	app.llm = &fakeLLM{replies: []string{`{"query": "("}`, `{"query": "("}`, `{"query": "("}`}}
+	app.mcp = newFakePrometheusMCP(map[string][]string{"up": nil})
+
+	resp := callResource(t, app, http.MethodPost, "query/promql/generate", map[string]any{
+		"question":      "is it up?",
+		"datasourceUid": "prom",
+	})
+	if resp.Status != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422, got %d %s", resp.Status, resp.Body)
+	}
+	resp = callResource(t, app, http.MethodPost, "query/promql/generate", map[string]any{"question": "x"})
+	if resp.Status != http.StatusBadRequest {
+		t.Errorf("missing datasource should be rejected, got %d", resp.Status)
+	}
+}
+
+func TestPromQLPromptBoundsLabels(t *testing.T) {
+	mcp := newFakePrometheusMCP(map[string][]string{"http_requests_total": nil})
+	mcp.tools["list_prometheus_label_names"] = func(map[string]any) (any, error) {
+		names := make([]string, 2000)
+		for i := range names {
+			names[i] = fmt.Sprintf("label_%d", i)
+		}
+		return append(names, "service"), nil
+	}
+	prompt, err := promqlPrompt(t.Context(), newPromCatalog(mcp, "prom"), promqlGenerateRequest{Question: "requests per service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(prompt, "Available labels: service, label_0,") || !strings.Contains(prompt, "and 1951 more") {
+		t.Errorf("expected the most relevant labels first and the rest counted, got:\n%s", prompt)
+	}
+}
@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxQueryGenerationAttempts is how many times the LLM is asked for a query before giving up.
+const maxQueryGenerationAttempts = 3
+
+// generatedQuery is the JSON object the LLM is asked to reply with.
+type generatedQuery struct {
+	Query       string `json:"query"`
+	Explanation string `json:"explanation"`
+}
+
+// generationAttempt records one LLM answer and why it was rejected, if it was.
+type generationAttempt struct {
+	Query string `json:"query"`
+	Error string `json:"error,omitempty"`
+}
+
+// errQueryGenerationFailed is returned when no attempt produced a valid query.
+var errQueryGenerationFailed = errors.New("could not generate a valid query")
+
+// invalidQueryError describes why a generated query was rejected. Unlike other
+// validation errors, such as a failing datasource lookup, it is fed back to the LLM.
+type invalidQueryError struct {
+	msg string
+}
+
+func (e *invalidQueryError) Error() string { return e.msg }
+
+// invalidQuery formats an *invalidQueryError.
+func invalidQuery(format string, args ...any) error {
+	return &invalidQueryError{msg: fmt.Sprintf(format, args...)}
+}
+
+// generateQuery asks the LLM for a query and validates it, feeding validation errors
+// back to the LLM until a valid query is produced or maxQueryGenerationAttempts is reached.
+// validate must return an *invalidQueryError for queries that should be retried; any other
+// error aborts generation.
+func (a *App) generateQuery(ctx context.Context, systemPrompt, userPrompt string, validate func(context.Context, string) error) (generatedQuery, []generationAttempt, error) {
+	ctx = withLLMFeature(ctx, featureQuery, "")
+	messages := []chatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: userPrompt},
+	}
+	var attempts []generationAttempt
+	for len(attempts) < maxQueryGenerationAttempts {
+		content, err := a.chat(ctx, llmModelBase, messages)
+		if err != nil {
+			return generatedQuery{}, attempts, err
+		}
+		messages = append(messages, chatMessage{Role: "assistant", Content: content})
+
+		var q generatedQuery
+		if err := decodeLLMJSON(content, &q); err != nil {
+			attempts = append(attempts, generationAttempt{Query: content, Error: err.Error()})
+			messages = append(messages, chatMessage{Role: "user", Content: fmt.Sprintf(
+				"Your reply could not be read: %s. Reply only with a JSON object with the keys \"query\" and \"explanation\".", err)})
+			continue
+		}
+		q.Query = strings.TrimSpace(q.Query)
+		err = validate(ctx, q.Query)
+		var invalid *invalidQueryError
+		if err != nil && !errors.As(err, &invalid) {
+			return generatedQuery{}, attempts, err
+		}
+		if err != nil {
+			attempts = append(attempts, generationAttempt{Query: q.Query, Error: err.Error()})
+			messages = append(messages, chatMessage{Role: "user", Content: fmt.Sprintf(
+				"The query `%s` is invalid: %s. Fix the query and reply with the same JSON format.", q.Query, err)})
+			continue
+		}
+		attempts = append(attempts, generationAttempt{Query: q.Query})
+		return q, attempts, nil
+	}
+	return generatedQuery{}, attempts, errQueryGenerationFailed
+}
+
+// relevance returns a function scoring candidates by how many words of the question
+// they contain.
+func relevance(question string) func(string) int {
+	words := strings.FieldsFunc(strings.ToLower(question), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+	return func(c string) int {
+		c = strings.ToLower(c)
+		n := 0
+		for _, w := range words {
+			if len(w) > 2 && strings.Contains(c, w) {
+				n++
+			}
+		}
+		return n
+	}
+}
+
+// rankByRelevance orders candidates by how many words of the question they contain and
+// returns at most limit of them. Candidates that share no words keep their original order.
+func rankByRelevance(question string, candidates []string, limit int) []string {
+	score := relevance(question)
+	ranked := append([]string(nil), candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool { return score(ranked[i]) > score(ranked[j]) })
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked
+}
+
+// mostRelevant returns the candidate sharing the most words with the question, or false if
+// none shares any.
+func mostRelevant(question string, candidates []string) (string, bool) {
+	ranked := rankByRelevance(question, candidates, 1)
+	if len(ranked) == 0 || relevance(question)(ranked[0]) == 0 {
+		return "", false
+	}
+	return ranked[0], true
+}
@@ -0,0 +1,247 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRateLimitBuckets bounds the per-user buckets kept in memory before idle ones
+	// are dropped.
+	maxRateLimitBuckets = 10000
+	// llmQueueRetryAfter is suggested to clients rejected because the LLM queue is full.
+	llmQueueRetryAfter = 5 * time.Second
+)
+
+// rateLimit is a token bucket: requests take a token, and tokens are added back at
+// PerMinute up to Burst. A zero PerMinute disables the limit.
+type rateLimit struct {
+	PerMinute float64 `json:"perMinute"`
+	Burst     int     `json:"burst"`
+}
+
+// rateLimitSettings configures the limits of the routes that call the LLM, embeddings or
+// MCP tools.
+type rateLimitSettings struct {
+	// User limits the requests of each user, Org those of everyone in the org.
+	User rateLimit `json:"user"`
+	Org  rateLimit `json:"org"`
+	// LLMConcurrency caps the LLM calls in flight, from requests and background jobs.
+	// Further calls wait in a queue of at most LLMQueueSize calls, for at most
+	// LLMQueueTimeout. A zero LLMConcurrency disables the cap.
+	LLMConcurrency  int    `json:"llmConcurrency"`
+	LLMQueueSize    int    `json:"llmQueueSize"`
+	LLMQueueTimeout string `json:"llmQueueTimeout"`
+}
+
+// defaultRateLimits sizes the limits for about 100 concurrent users per org.
+var defaultRateLimits = rateLimitSettings{
+	User:            rateLimit{PerMinute: 20, Burst: 10},
+	Org:             rateLimit{PerMinute: 300, Burst: 100},
+	LLMConcurrency:  16,
+	LLMQueueSize:    200,
+	LLMQueueTimeout: "30s",
+}
+
+// rateLimitError rejects a request, which may be retried after retryAfter.
+type rateLimitError struct {
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string { return e.msg }
+
+// writeLimitError writes 429 for requests rejected by a rate limit, the LLM queue or a
+// token budget, and reports whether err was one of them.
+func writeLimitError(w http.ResponseWriter, err error) bool {
+	var rl *rateLimitError
+	switch {
+	case errors.As(err, &rl):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rl.retryAfter.Seconds()))))
+		http.Error(w, rl.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, errBudgetExceeded):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		return false
+	}
+	return true
+}
+
+// tokenBucket is the state of a rateLimit for one key. full is when it has refilled, from
+// which on it behaves like a new bucket.
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+	full   time.Time
+}
+
+// rateLimiter keeps a token bucket per key.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// limitedKey is a bucket and the limit that applies to it.
+type limitedKey struct {
+	key   string
+	limit rateLimit
+}
+
+// allow takes a token from the buckets of all keys if each has one, and otherwise returns
+// how long until they all do.
+func (l *rateLimiter) allow(now time.Time, keys ...limitedKey) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	var buckets []*tokenBucket
+	var perSeconds, bursts []float64
+	for _, k := range keys {
+		if k.limit.PerMinute <= 0 {
+			continue
+		}
+		burst := float64(max(k.limit.Burst, 1))
+		b, ok := l.buckets[k.key]
+		if !ok {
+			l.prune(now)
+			b = &tokenBucket{tokens: burst, at: now}
+			l.buckets[k.key] = b
+		}
+		perSecond := k.limit.PerMinute / 60
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.at).Seconds()*perSecond)
+		b.at = now
+		if b.tokens < 1 {
+			wait = max(wait, time.Duration((1-b.tokens)/perSecond*float64(time.Second)))
+		}
+		buckets = append(buckets, b)
+		perSeconds = append(perSeconds, perSecond)
+		bursts = append(bursts, burst)
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for i, b := range buckets {
+		b.tokens--
+		b.full = now.Add(time.Duration((bursts[i] - b.tokens) / perSeconds[i] * float64(time.Second)))
+	}
+	return true, 0
+}
+
+// prune makes room for a new bucket once there are maxRateLimitBuckets. It drops the
+// buckets that refilled, which behave like the new buckets that replace them, and if
+// that is not enough, the least recently used tenth of the buckets.
+func (l *rateLimiter) prune(now time.Time) {
+	if len(l.buckets) < maxRateLimitBuckets {
+		return
+	}
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+	if len(l.buckets) < maxRateLimitBuckets {
+		return
+	}
+	keys := make([]string, 0, len(l.buckets))
+	for key := range l.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return l.buckets[keys[i]].at.Before(l.buckets[keys[j]].at) })
+	for _, key := range keys[:len(keys)-maxRateLimitBuckets*9/10] {
+		delete(l.buckets, key)
+	}
+}
+
+// rateLimited rejects requests to next once the user or the org used up its bucket. It
+// wraps every route calling the LLM, embeddings or MCP tools.
+func (a *App) rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if a.allowRequest(w, req) {
+			next(w, req)
+		}
+	}
+}
+
+// allowRequest takes a token from the buckets of the user and the org, writing 429 and
+// returning false if one is empty. Handlers whose routes only call the LLM, embeddings or
+// MCP tools for some methods call it directly. As these requests may use the LLM, it also
+// reports the soft budgets the caller reached in the X-Token-Budget-Warning header.
+func (a *App) allowRequest(w http.ResponseWriter, req *http.Request) bool {
+	limits := a.settings.RateLimits
+	ok, wait := a.limiter.allow(time.Now(),
+		limitedKey{"user:" + userLogin(req.Context()), limits.User},
+		limitedKey{"org", limits.Org},
+	)
+	if !ok {
+		rateLimitRejections.WithLabelValues("route").Inc()
+		writeLimitError(w, &rateLimitError{msg: "rate limit exceeded, retry later", retryAfter: wait})
+		return false
+	}
+	if warning, err := a.softBudgetWarning(req.Context(), time.Now()); err != nil {
+		a.logger(req.Context()).Error("Error checking token budgets", "err", err)
+	} else if warning != "" {
+		w.Header().Set(budgetWarningHeader, warning)
+	}
+	return true
+}
+
+// llmGate caps the LLM calls in flight and queues the others.
+type llmGate struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+// newLLMGate returns nil, which lets every call through, when concurrency is not positive.
+func newLLMGate(concurrency, queueSize int, timeout time.Duration) *llmGate {
+	if concurrency <= 0 {
+		return nil
+	}
+	return &llmGate{slots: make(chan struct{}, concurrency), queue: make(chan struct{}, max(queueSize, 0)), timeout: timeout}
+}
+
+// acquire waits for a free slot and returns the function releasing it. Calls are
+// rejected when the queue is full or they waited longer than the queue timeout.
+func (g *llmGate) acquire(ctx context.Context) (func(), error) {
+	if g == nil {
+		return func() {}, nil
+	}
+	release := func() { <-g.slots }
+	select {
+	case g.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	select {
+	case g.queue <- struct{}{}:
+	default:
+		rateLimitRejections.WithLabelValues("llm_queue").Inc()
+		return nil, &rateLimitError{msg: "too many LLM calls in progress, retry later", retryAfter: llmQueueRetryAfter}
+	}
+	llmQueued.Inc()
+	defer func() {
+		<-g.queue
+		llmQueued.Dec()
+	}()
+	timer := time.NewTimer(g.timeout)
+	defer timer.Stop()
+	select {
+	case g.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		rateLimitRejections.WithLabelValues("llm_queue").Inc()
+		return nil, &rateLimitError{msg: fmt.Sprintf("no LLM capacity within %s, retry later", g.timeout), retryAfter: llmQueueRetryAfter}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,240 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter()
+	user := rateLimit{PerMinute: 60, Burst: 2}
+	org := rateLimit{PerMinute: 60, Burst: 3}
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	allow := func(at time.Duration, login string) (bool, time.Duration) {
+		return l.allow(t0.Add(at), limitedKey{"user:" + login, user}, limitedKey{"org", org})
+	}
+	for i := range 2 {
+		if ok, _ := allow(0, "alice"); !ok {
+			t.Fatalf("request %d should be allowed by the burst", i)
+		}
+	}
+	if ok, wait := allow(0, "alice"); ok || wait != time.Second {
+		t.Errorf("expected alice to wait 1s, got %v %s", ok, wait)
+	}
+	// bob takes the last token of the org, after which the org bucket limits him too.
+	if ok, _ := allow(0, "bob"); !ok {
+		t.Error("bob should be allowed")
+	}
+	if ok, wait := allow(500*time.Millisecond, "bob"); ok || wait != 500*time.Millisecond {
+		t.Errorf("expected bob to wait for the org bucket, got %v %s", ok, wait)
+	}
+	// A rejected request does not take a token from the buckets that had one.
+	if ok, _ := allow(time.Second, "bob"); !ok {
+		t.Error("bob should be allowed once the org bucket refilled")
+	}
+	if ok, _ := l.allow(t0, limitedKey{"user:carol", rateLimit{}}); !ok {
+		t.Error("a zero limit should not limit")
+	}
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+	app := newTestApp(t, "", map[string]any{"rateLimits": map[string]any{"user": map[string]any{"perMinute": 1, "burst": 3}}})
+	var replies []chatMessage
+	for range 10 {
+		replies = append(replies, chatMessage{Role: "assistant", Content: "ok"})
+	}
+	app.llm = &scriptedLLM{script: replies}
+
+	// Concurrent requests of one user get the burst and then 429s.
+	var ok, limited atomic.Int32
+	var wg sync.WaitGroup
+	alice := &backend.User{Login: "alice"}
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := callResourceAs(t, app, alice, http.MethodPost, "agent", map[string]any{"question": "Why?"})
+			switch resp.Status {
+			case http.StatusOK:
+				ok.Add(1)
+			case http.StatusTooManyRequests:
+				if s, err := strconv.Atoi(resp.Headers["Retry-After"][0]); err != nil || s < 1 || s > 60 {
+					t.Errorf("unexpected Retry-After %v", resp.Headers["Retry-After"])
+				}
+				limited.Add(1)
+			default:
+				t.Errorf("unexpected status %d %s", resp.Status, resp.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if ok.Load() != 3 || limited.Load() != 5 {
+		t.Errorf("expected 3 allowed and 5 limited requests, got %d and %d", ok.Load(), limited.Load())
+	}
+	// Other users have their own bucket, and other routes are not limited.
+	if resp := callResourceAs(t, app, &backend.User{Login: "bob"}, http.MethodPost, "agent", map[string]any{"question": "Why?"}); resp.Status != http.StatusOK {
+		t.Errorf("expected bob to be allowed, got %d", resp.Status)
+	}
+	if resp := callResourceAs(t, app, alice, http.MethodGet, "usage", nil); resp.Status != http.StatusOK {
+		t.Errorf("expected /usage not to be limited, got %d", resp.Status)
+	}
+
+	// Every route calling the LLM, embeddings or MCP tools shares the bucket, while
+	// reading investigations is not limited.
+	for _, r := range []struct{ method, path string }{
+		{http.MethodPost, "investigations"},
+		{http.MethodPost, "investigations/x/steps"},
+		{http.MethodPost, "investigations/x/resume"},
+		{http.MethodGet, "knowledge/search?q=x"},
+		{http.MethodPost, "knowledge/reindex"},
+		{http.MethodPost, "incidents/similar"},
+		{http.MethodPost, "runbooks/x/execute"},
+		{http.MethodGet, "timeline"},
+		{http.MethodGet, "topology"},
+		{http.MethodGet, "topology/blast-radius"},
+		{http.MethodPost, "changes/suspects"},
+		{http.MethodPost, "query/explain"},
+	} {
+		if resp := callResourceAs(t, app, alice, r.method, r.path, nil); resp.Status != http.StatusTooManyRequests {
+			t.Errorf("expected %s /%s to be limited, got %d", r.method, r.path, resp.Status)
+		}
+	}
+	if resp := callResourceAs(t, app, alice, http.MethodGet, "investigations", nil); resp.Status != http.StatusOK {
+		t.Errorf("expected listing investigations not to be limited, got %d", resp.Status)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter()
+	limit := rateLimit{PerMinute: 60, Burst: 5}
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Buckets that refilled are dropped first.
+	for i := range maxRateLimitBuckets {
+		l.allow(t0, limitedKey{"user:" + strconv.Itoa(i), limit})
+	}
+	l.allow(t0.Add(time.Second), limitedKey{"user:busy", limit})
+	l.allow(t0.Add(10*time.Second), limitedKey{"user:new", limit})
+	if len(l.buckets) != 2 {
+		t.Errorf("expected the refilled buckets to be dropped, got %d buckets", len(l.buckets))
+	}
+	// Buckets still refilling are dropped least recently used first, so the map stays
+	// bounded however many users are active.
+	for i := range 3 * maxRateLimitBuckets {
+		l.allow(t0.Add(20*time.Second+time.Duration(i)*time.Microsecond), limitedKey{"user:" + strconv.Itoa(i), limit})
+		if len(l.buckets) > maxRateLimitBuckets {
+			t.Fatalf("%d buckets after %d users", len(l.buckets), i+1)
+		}
+	}
+	if _, ok := l.buckets["user:"+strconv.Itoa(3*maxRateLimitBuckets-1)]; !ok {
+		t.Error("the most recent bucket should be kept")
+	}
+}
+
+// blockingLLM holds every call until release is closed, tracking the calls in flight.
+type blockingLLM struct {
+	release     chan struct{}
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+}
+
+func (b *blockingLLM) ChatCompletions(ctx context.Context, _ chatCompletionRequest) (chatCompletionResponse, error) {
+	n := b.inFlight.Add(1)
+	defer b.inFlight.Add(-1)
+	for {
+		m := b.maxInFlight.Load()
+		if n <= m || b.maxInFlight.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	var resp chatCompletionResponse
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return resp, ctx.Err()
+	}
+	resp.Choices = append(resp.Choices, struct {
+		Message      chatMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
+	}{Message: chatMessage{Role: "assistant", Content: "ok"}})
+	return resp, nil
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLLMConcurrencyCap(t *testing.T) {
+	app := newTestApp(t, "", map[string]any{"rateLimits": map[string]any{"llmConcurrency": 2, "llmQueueSize": 3, "llmQueueTimeout": "10s"}})
+	llm := &blockingLLM{release: make(chan struct{})}
+	app.llm = llm
+	ask := func(ctx context.Context) error {
+		_, err := app.chat(ctx, llmModelBase, []chatMessage{{Role: "user", Content: "hi"}})
+		return err
+	}
+
+	// Two calls run and three wait in the queue; the next one is rejected.
+	errs := make(chan error, 5)
+	for range 4 {
+		go func() { errs <- ask(context.Background()) }()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() { cancelled <- ask(ctx) }()
+	waitFor(t, "the queue to fill", func() bool { return llm.inFlight.Load() == 2 && len(app.llmGate.queue) == 3 })
+	var rl *rateLimitError
+	if err := ask(context.Background()); !errors.As(err, &rl) || rl.retryAfter != llmQueueRetryAfter {
+		t.Fatalf("expected the full queue to reject the call, got %v", err)
+	}
+	// A queued call gives up its place when its request is cancelled.
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancelled call to fail, got %v", err)
+	}
+	go func() { errs <- ask(context.Background()) }()
+	waitFor(t, "the queue to fill again", func() bool { return len(app.llmGate.queue) == 3 })
+
+	close(llm.release)
+	for range 5 {
+		if err := <-errs; err != nil {
+			t.Errorf("queued call failed: %v", err)
+		}
+	}
+	if llm.maxInFlight.Load() != 2 || len(app.llmGate.queue) != 0 {
+		t.Errorf("expected at most 2 calls in flight and an empty queue, got %d and %d", llm.maxInFlight.Load(), len(app.llmGate.queue))
+	}
+}
+
+func TestLLMQueueTimeout(t *testing.T) {
+	app := newTestApp(t, "", map[string]any{"rateLimits": map[string]any{"llmConcurrency": 1, "llmQueueTimeout": "20ms"}})
+	llm := &blockingLLM{release: make(chan struct{})}
+	app.llm = llm
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = app.chat(context.Background(), llmModelBase, nil)
+	}()
+	waitFor(t, "the first call", func() bool { return llm.inFlight.Load() == 1 })
+
+	resp := callResource(t, app, http.MethodPost, "agent", map[string]any{"question": "Why?"})
+	if resp.Status != http.StatusTooManyRequests || resp.Headers["Retry-After"][0] != "5" {
+		t.Errorf("expected 429 with Retry-After, got %d %v", resp.Status, resp.Headers)
+	}
+	close(llm.release)
+	<-done
+}
@@ -0,0 +1,447 @@
+package plugin
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	redactionAuditCollection = "redaction_audit"
+	// redactionAuditRetention is how long redaction audit entries are kept.
+	redactionAuditRetention = 30 * 24 * time.Hour
+	defaultRedactionAudit   = 100
+	// Audit entries are buffered in memory and saved every redactionAuditFlushInterval,
+	// and entries past retention are dropped every redactionAuditPruneInterval.
+	redactionAuditFlushInterval = 10 * time.Second
+	redactionAuditPruneInterval = time.Hour
+)
+
+// Kinds of redacted values, used in placeholders, metrics and the audit trail.
+const (
+	redactEmail  = "email"
+	redactIP     = "ip"
+	redactToken  = "token"
+	redactCard   = "card"
+	redactJWT    = "jwt"
+	redactAWSKey = "aws_key"
+	redactLabel  = "label"
+)
+
+// redactionSettings configures what is removed from payloads sent to the LLM, on top of
+// the built-in detectors.
+type redactionSettings struct {
+	// Patterns are custom regular expressions, each with a name used as the kind of its
+	// placeholders. A pattern with a capturing group only redacts the first group.
+	Patterns []redactionPattern `json:"patterns"`
+	// LabelDenylist names labels whose values are always redacted, wherever they appear
+	// as name="value", name=value or "name": "value".
+	LabelDenylist []string `json:"labelDenylist"`
+}
+
+type redactionPattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// detector finds sensitive values of one kind. Only the first group is redacted when the
+// expression has one, and valid, if set, filters out false positives.
+type detector struct {
+	kind  string
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+// builtinDetectors are always applied, in order: tokens with a recognizable shape go
+// before the generic patterns that could match parts of them.
+var builtinDetectors = []detector{
+	{kind: redactJWT, re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]+`)},
+	{kind: redactAWSKey, re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{kind: redactToken, re: regexp.MustCompile(`\b(?:glsa|glc|sk|ghp|gho|github_pat|xox[abp])[_-][A-Za-z0-9_-]{10,}`)},
+	{kind: redactToken, re: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/-]{8,}=*)`)},
+	{kind: redactEmail, re: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`)},
+	// Card numbers have 13 to 16 digits and start with the IIN prefix of a major network
+	// (Visa, Mastercard, Amex, Diners, Discover, JCB), which keeps nanosecond timestamps
+	// and other long IDs out.
+	{kind: redactCard, re: regexp.MustCompile(`\b(?:4\d{3}|5[1-5]\d{2}|2[2-7]\d{2}|3[47]\d{2}|3[068]\d{2}|6(?:011|5\d{2}|4[4-9]\d)|35\d{2})(?:[ -]?\d){9,12}\b`), valid: luhn},
+	{kind: redactIP, re: regexp.MustCompile(`\b[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{0,4}){2,7}\b|\b(?:\d{1,3}\.){3}\d{1,3}\b`), valid: func(s string) bool { return net.ParseIP(s) != nil }},
+}
+
+// placeholderPattern matches the placeholders that replace redacted values.
+var placeholderPattern = regexp.MustCompile(`\[[A-Z0-9_]+_\d+\]`)
+
+// luhn reports whether the digits of s pass the Luhn checksum of card numbers.
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// redactor removes sensitive values from LLM-bound payloads.
+type redactor struct {
+	detectors []detector
+}
+
+func newRedactor(s redactionSettings) (*redactor, error) {
+	r := &redactor{detectors: append([]detector{}, builtinDetectors...)}
+	for _, p := range s.Patterns {
+		if !model.LabelName(p.Name).IsValidLegacy() {
+			return nil, fmt.Errorf("redaction pattern name %q must be a valid identifier", p.Name)
+		}
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %s: %w", p.Name, err)
+		}
+		r.detectors = append(r.detectors, detector{kind: p.Name, re: re})
+	}
+	if len(s.LabelDenylist) > 0 {
+		names := make([]string, len(s.LabelDenylist))
+		for i, n := range s.LabelDenylist {
+			names[i] = regexp.QuoteMeta(n)
+		}
+		re := regexp.MustCompile(`"?\b(?:` + strings.Join(names, "|") + `)"?\s*(?:=~|!~|!=|=|:)\s*"?([^"',}\s]+)`)
+		r.detectors = append(r.detectors, detector{kind: redactLabel, re: re})
+	}
+	return r, nil
+}
+
+// redaction replaces sensitive values with placeholders for one LLM request and restores
+// them in its reply. The same value always gets the same placeholder, so the model can
+// still tell values apart and refer to them.
+type redaction struct {
+	r            *redactor
+	placeholders map[string]string // value to placeholder
+	values       map[string]string // placeholder to value
+	kinds        map[string]string // value to kind
+	seq          map[string]int
+	counts       map[string]int
+}
+
+// session starts the redaction of one request. A nil redactor applies the built-in
+// detectors only.
+func (r *redactor) session() *redaction {
+	if r == nil {
+		r = &redactor{detectors: builtinDetectors}
+	}
+	return &redaction{r: r, placeholders: map[string]string{}, values: map[string]string{}, kinds: map[string]string{}, seq: map[string]int{}, counts: map[string]int{}}
+}
+
+func (rd *redaction) placeholder(kind, value string) string {
+	if p, ok := rd.placeholders[value]; ok {
+		return p
+	}
+	rd.seq[kind]++
+	p := fmt.Sprintf("[%s_%d]", strings.ToUpper(kind), rd.seq[kind])
+	rd.placeholders[value], rd.values[p], rd.kinds[value] = p, value, kind
+	return p
+}
+
+// text redacts a string. Values redacted earlier in the request are also replaced where
+// no detector would find them, such as a denylisted label value in tool arguments.
+func (rd *redaction) text(s string) string {
+	for _, d := range rd.r.detectors {
+		var b strings.Builder
+		last := 0
+		for _, m := range d.re.FindAllStringSubmatchIndex(s, -1) {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			value := s[start:end]
+			if value == "" || placeholderPattern.MatchString(value) || (d.valid != nil && !d.valid(value)) {
+				continue
+			}
+			b.WriteString(s[last:start])
+			b.WriteString(rd.placeholder(d.kind, value))
+			last = end
+			rd.counts[d.kind]++
+		}
+		if last > 0 {
+			b.WriteString(s[last:])
+			s = b.String()
+		}
+	}
+	for _, value := range rd.knownValues() {
+		var n int
+		s, n = replaceWord(s, value, rd.placeholders[value])
+		rd.counts[rd.kinds[value]] += n
+	}
+	return s
+}
+
+// knownValues returns the values redacted so far, longest first so that values
+// containing others are replaced whole.
+func (rd *redaction) knownValues() []string {
+	values := make([]string, 0, len(rd.placeholders))
+	for v := range rd.placeholders {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	return values
+}
+
+// replaceWord replaces the occurrences of old in s that are not part of a longer word,
+// returning the number of replacements.
+func replaceWord(s, old, repl string) (string, int) {
+	var b strings.Builder
+	n, last := 0, 0
+	for i := 0; ; {
+		j := strings.Index(s[i:], old)
+		if j < 0 {
+			break
+		}
+		start, end := i+j, i+j+len(old)
+		if (start == 0 || !isWordByte(s[start-1])) && (end == len(s) || !isWordByte(s[end])) {
+			b.WriteString(s[last:start])
+			b.WriteString(repl)
+			last = end
+			n++
+		}
+		i = start + 1
+	}
+	if n == 0 {
+		return s, 0
+	}
+	b.WriteString(s[last:])
+	return b.String(), n
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// restore puts the redacted values back in place of their placeholders.
+func (rd *redaction) restore(s string) string {
+	if len(rd.values) == 0 {
+		return s
+	}
+	return placeholderPattern.ReplaceAllStringFunc(s, func(p string) string {
+		if v, ok := rd.values[p]; ok {
+			return v
+		}
+		return p
+	})
+}
+
+// request returns a copy of req with the content and tool call arguments of every
+// message redacted.
+func (rd *redaction) request(req chatCompletionRequest) chatCompletionRequest {
+	messages := make([]chatMessage, len(req.Messages))
+	for i, m := range req.Messages {
+		m.Content = rd.text(m.Content)
+		if len(m.ToolCalls) > 0 {
+			calls := make([]toolCall, len(m.ToolCalls))
+			for j, c := range m.ToolCalls {
+				c.Function.Arguments = rd.text(c.Function.Arguments)
+				calls[j] = c
+			}
+			m.ToolCalls = calls
+		}
+		messages[i] = m
+	}
+	req.Messages = messages
+	return req
+}
+
+// response restores the redacted values in the choices of resp.
+func (rd *redaction) response(resp chatCompletionResponse) chatCompletionResponse {
+	for i := range resp.Choices {
+		m := &resp.Choices[i].Message
+		m.Content = rd.restore(m.Content)
+		for j := range m.ToolCalls {
+			m.ToolCalls[j].Function.Arguments = rd.restore(m.ToolCalls[j].Function.Arguments)
+		}
+	}
+	return resp
+}
+
+// redactionAuditEntry records what was redacted from an LLM request, without the values.
+type redactionAuditEntry struct {
+	ID     string         `json:"id"`
+	Time   time.Time      `json:"time"`
+	User   string         `json:"user,omitempty"`
+	Model  string         `json:"model"`
+	Counts map[string]int `json:"counts"`
+}
+
+// recordRedactions counts the redactions of a request in metrics and the audit trail.
+func (a *App) recordRedactions(ctx context.Context, model string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	for kind, n := range counts {
+		redactions.WithLabelValues(kind).Add(float64(n))
+	}
+	now := time.Now().UTC()
+	e := redactionAuditEntry{ID: now.Format("20060102T150405.000000000Z") + "-" + uuid.NewString()[:8], Time: now, Model: model, Counts: counts}
+	if u := backend.UserFromContext(ctx); u != nil {
+		e.User = u.Login
+	}
+	a.redactionAuditMu.Lock()
+	a.redactionAuditPending = append(a.redactionAuditPending, e)
+	a.redactionAuditMu.Unlock()
+}
+
+// flushRedactionAudit saves the buffered audit entries. Entries that cannot be saved are
+// kept for the next flush.
+func (a *App) flushRedactionAudit(ctx context.Context) error {
+	a.redactionAuditMu.Lock()
+	defer a.redactionAuditMu.Unlock()
+	for len(a.redactionAuditPending) > 0 {
+		e := a.redactionAuditPending[0]
+		if err := saveJSON(ctx, a.store, redactionAuditCollection, e.ID, e); err != nil {
+			return err
+		}
+		a.redactionAuditPending = a.redactionAuditPending[1:]
+	}
+	a.redactionAuditPending = nil
+	return nil
+}
+
+// pruneRedactionAudit drops the audit entries past retention. IDs start with the time,
+// so they sort chronologically.
+func (a *App) pruneRedactionAudit(ctx context.Context, now time.Time) error {
+	items, err := a.store.List(ctx, redactionAuditCollection)
+	if err != nil {
+		return err
+	}
+	cutoff := now.UTC().Add(-redactionAuditRetention).Format("20060102T150405")
+	for _, it := range items {
+		if it.Key >= cutoff {
+			break
+		}
+		if err := a.store.Delete(ctx, redactionAuditCollection, it.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runRedactionAudit saves the buffered audit entries and prunes old ones until ctx is
+// cancelled, saving what is left on the way out.
+func (a *App) runRedactionAudit(ctx context.Context, flushInterval, pruneInterval time.Duration) {
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := a.flushRedactionAudit(context.WithoutCancel(ctx)); err != nil {
+				a.logger(ctx).Error("Error saving redaction audit entries", "err", err)
+			}
+			return
+		case <-flush.C:
+			if err := a.flushRedactionAudit(ctx); err != nil {
+				a.logger(ctx).Error("Error saving redaction audit entries", "err", err)
+			}
+		case now := <-prune.C:
+			recordJobRun(jobRedactionAudit, a.pruneRedactionAudit(ctx, now))
+		}
+	}
+}
+
+// completion sends a chat completion request to the LLM. Calls over a hard token budget
+// are rejected, calls over the concurrency cap wait in the LLM queue, and the tokens of
+// the others are metered to the caller in ctx, their estimate being reserved against the
+// budgets while they are in flight. Sensitive
+// values in the messages are replaced with placeholders on the way out and restored in
+// the reply.
+func (a *App) completion(ctx context.Context, req chatCompletionRequest) (chatCompletionResponse, error) {
+	caller := llmCallerFromContext(ctx)
+	reservation, err := a.checkBudget(ctx, caller, req, time.Now())
+	if err != nil {
+		return chatCompletionResponse{}, err
+	}
+	release, err := a.llmGate.acquire(ctx)
+	if err != nil {
+		a.releaseBudget(reservation)
+		return chatCompletionResponse{}, err
+	}
+	defer release()
+	rd := a.redactor.session()
+	redacted := rd.request(req)
+	a.recordRedactions(ctx, req.Model, rd.counts)
+	resp, err := a.llm.ChatCompletions(ctx, redacted)
+	if err != nil {
+		a.releaseBudget(reservation)
+		return resp, &llmUnavailableError{err: err}
+	}
+	model := resp.Model
+	if model == "" {
+		model = req.Model
+	}
+	if err := a.recordUsage(ctx, caller, model, resp.Usage, reservation, time.Now()); err != nil {
+		a.logger(ctx).Error("Error recording token usage", "err", err)
+	}
+	return rd.response(resp), nil
+}
+
+// embed returns the embeddings of inputs. Like in completion, sensitive values are
+// replaced with placeholders before the inputs leave the plugin.
+func (a *App) embed(ctx context.Context, inputs []string) ([][]float32, error) {
+	rd := a.redactor.session()
+	redacted := make([]string, len(inputs))
+	for i, in := range inputs {
+		redacted[i] = rd.text(in)
+	}
+	a.recordRedactions(ctx, cmp.Or(a.settings.Embeddings.Model, defaultEmbeddingsModel), rd.counts)
+	return a.embeddings.Embed(ctx, redacted)
+}
+
+// handleRedactionAudit lists the most recent redaction audit entries, newest first.
+func (a *App) handleRedactionAudit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultRedactionAudit
+	if v := req.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if err := a.flushRedactionAudit(req.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := listJSON[redactionAuditEntry](req.Context(), a.store, redactionAuditCollection)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID > entries[j].ID })
+	writeJSON(w, http.StatusOK, entries[:min(limit, len(entries))])
+}
@@ -3,6 +3,9 @@ package plugin
 import (
 	"encoding/json"
 	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 )
 
 // handlePing is an example HTTP GET resource that returns a {"message": "ok"} JSON response.
@@ -37,8 +40,93 @@ func (a *App) handleEcho(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.DefaultLogger.Error("Error writing response", "err", err)
+	}
+}
+
+// isEditor reports whether u has the Editor or Admin role, which changes made through the
+// plugin's service account require.
+func isEditor(u *backend.User) bool {
+	return u != nil && (u.Role == "Admin" || u.Role == "Editor")
+}
+
+// requireEditor writes a 403 response and returns false unless the user of req is an
+// editor. what names the change in the message, e.g. "creating silences".
+func requireEditor(w http.ResponseWriter, req *http.Request, what string) bool {
+	if !isEditor(backend.UserFromContext(req.Context())) {
+		http.Error(w, what+" requires the Editor or Admin role", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 // registerRoutes takes a *http.ServeMux and registers some HTTP handlers.
 func (a *App) registerRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/ping", a.handlePing)
 	mux.HandleFunc("/echo", a.handleEcho)
+	mux.HandleFunc("/logging", a.handleLogging)
+	mux.HandleFunc("/redactions", a.handleRedactionAudit)
+	mux.HandleFunc("/usage", a.handleUsage)
+	mux.HandleFunc("/cache/purge", a.handleCachePurge)
+
+	mux.HandleFunc("/silences", a.handleSilences)
+	mux.HandleFunc("/silences/{id}", a.handleSilence)
+	mux.HandleFunc("/silences/preview", a.handleSilencePreview)
+	mux.HandleFunc("/silences/recommend", a.handleSilenceRecommend)
+	mux.HandleFunc("/silences/schedules", a.handleMaintenanceWindows)
+	mux.HandleFunc("/silences/schedules/{id}", a.handleMaintenanceWindow)
+
+	mux.HandleFunc("/query/promql/generate", a.rateLimited(a.handlePromQLGenerate))
+	mux.HandleFunc("/query/logql/generate", a.rateLimited(a.handleLogQLGenerate))
+	mux.HandleFunc("/query/explain", a.rateLimited(a.handleQueryExplain))
+
+	mux.HandleFunc("/slos", a.handleSLOs)
+	mux.HandleFunc("/slos/status", a.handleSLOsStatus)
+	mux.HandleFunc("/slos/{id}", a.handleSLO)
+	mux.HandleFunc("/slos/{id}/status", a.handleSLOStatus)
+	mux.HandleFunc("/slos/{id}/rules", a.handleSLORules(true))
+	mux.HandleFunc("/slos/{id}/rules/preview", a.handleSLORules(false))
+
+	mux.HandleFunc("/investigations", a.handleInvestigations)
+	mux.HandleFunc("/investigations/{id}", a.handleInvestigation)
+	mux.HandleFunc("/investigations/{id}/steps", a.rateLimited(a.handleInvestigationSteps))
+	mux.HandleFunc("/investigations/{id}/evidence", a.handleInvestigationEvidence)
+	mux.HandleFunc("/investigations/{id}/cancel", a.handleInvestigationCancel)
+	mux.HandleFunc("/investigations/{id}/resume", a.rateLimited(a.handleInvestigationResume))
+
+	mux.HandleFunc("/runbooks", a.handleRunbooks)
+	mux.HandleFunc("/runbooks/match", a.handleRunbookMatch)
+	mux.HandleFunc("/runbooks/{id}", a.handleRunbook)
+	mux.HandleFunc("/runbooks/{id}/execute", a.rateLimited(a.handleRunbookExecute))
+
+	mux.HandleFunc("/actions", a.handleActions)
+	mux.HandleFunc("/actions/{id}", a.handleAction)
+	mux.HandleFunc("/actions/{id}/dry-run", a.handleActionDryRun)
+	mux.HandleFunc("/actions/{id}/approve", a.handleActionApprove)
+	mux.HandleFunc("/actions/{id}/reject", a.handleActionReject)
+
+	mux.HandleFunc("/postmortems", a.handlePostmortems)
+	mux.HandleFunc("/postmortems/generate", a.rateLimited(a.handlePostmortemGenerate))
+	mux.HandleFunc("/postmortems/{id}", a.handlePostmortem)
+
+	mux.HandleFunc("/incidents/similar", a.rateLimited(a.handleSimilarIncidents))
+
+	mux.HandleFunc("/timeline", a.rateLimited(a.handleTimeline))
+
+	mux.HandleFunc("/changes", a.handleChanges)
+	mux.HandleFunc("/changes/suspects", a.rateLimited(a.handleChangeSuspects))
+
+	mux.HandleFunc("/topology", a.rateLimited(a.handleTopology))
+	mux.HandleFunc("/topology/blast-radius", a.rateLimited(a.handleBlastRadius))
+
+	mux.HandleFunc("/knowledge", a.handleKnowledge)
+	mux.HandleFunc("/knowledge/search", a.rateLimited(a.handleKnowledgeSearch))
+	mux.HandleFunc("/knowledge/reindex", a.rateLimited(a.handleKnowledgeReindex))
+
+	mux.HandleFunc("/agent", a.rateLimited(a.handleAgent))
 }
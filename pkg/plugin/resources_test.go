@@ -3,6 +3,7 @@ package plugin
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"net/http"
 	"testing"
@@ -20,6 +21,65 @@ func (s *mockCallResourceResponseSender) Send(response *backend.CallResourceResp
 	return nil
 }
 
+// newTestApp creates an *App that talks to the Grafana API at grafanaURL and keeps
+// its state in a temporary directory. jsonData may be nil.
+func newTestApp(t *testing.T, grafanaURL string, jsonData map[string]any) *App {
+	t.Helper()
+	if jsonData == nil {
+		jsonData = map[string]any{}
+	}
+	if _, ok := jsonData["dataPath"]; !ok {
+		jsonData["dataPath"] = t.TempDir()
+	}
+	b, err := json.Marshal(jsonData)
+	if err != nil {
+		t.Fatalf("marshal settings: %s", err)
+	}
+	ctx := backend.WithGrafanaConfig(context.Background(), backend.NewGrafanaCfg(map[string]string{
+		backend.AppURL:          grafanaURL,
+		backend.AppClientSecret: "test-token",
+	}))
+	inst, err := NewApp(ctx, backend.AppInstanceSettings{JSONData: b})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	t.Cleanup(app.Dispose)
+	return app
+}
+
+// callResource sends a resource request to app as the editor "tester" and returns the response.
+func callResource(t *testing.T, app *App, method, path string, body any) *backend.CallResourceResponse {
+	t.Helper()
+	return callResourceAs(t, app, &backend.User{Login: "tester", Role: "Editor"}, method, path, body)
+}
+
+// callResourceAs sends a resource request to app as user and returns the response.
+func callResourceAs(t *testing.T, app *App, user *backend.User, method, path string, body any) *backend.CallResourceResponse {
+	t.Helper()
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			t.Fatalf("marshal body: %s", err)
+		}
+	}
+	var r mockCallResourceResponseSender
+	err := app.CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{User: user},
+		Method:        method,
+		Path:          path,
+		Body:          b,
+	}, &r)
+	if err != nil {
+		t.Fatalf("CallResource error: %s", err)
+	}
+	if r.response == nil {
+		t.Fatal("no response received from CallResource")
+	}
+	return r.response
+}
+
 // TestCallResource tests CallResource calls, using backend.CallResourceRequest and backend.CallResourceResponse.
 // This ensures the httpadapter for CallResource works correctly.
 func TestCallResource(t *testing.T) {
@@ -0,0 +1,670 @@
+package plugin
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+const (
+	runbooksCollection = "runbooks"
+	// runbookHTTPTimeout bounds a single HTTP check.
+	runbookHTTPTimeout = 10 * time.Second
+	// runbookHTTPBodyLimit is how much of an HTTP check response body is searched for the
+	// expected content.
+	runbookHTTPBodyLimit = 64 << 10
+)
+
+// Runbook step kinds, used as the language of the fenced code block that defines the step.
+const (
+	runbookStepPromQL = "promql"
+	runbookStepLogQL  = "logql"
+	runbookStepMCP    = "mcp"
+	runbookStepHTTP   = "http"
+	// Action steps propose a remediation action instead of running anything.
+	runbookStepAction = "action"
+)
+
+// runbookSettings configures the execution of runbook steps.
+type runbookSettings struct {
+	// HTTPAllowlist lists the hosts HTTP checks may reach: host names, "*.example.com" for
+	// the subdomains of a domain, or CIDRs such as "10.0.0.0/8". HTTP checks fail while it
+	// is empty.
+	HTTPAllowlist []string `json:"httpAllowlist"`
+}
+
+// httpChecker sends the requests of runbook HTTP checks, which anyone able to write a
+// runbook or set alert labels controls, to allowlisted hosts only. Checks are diagnostic,
+// so only GET and HEAD are allowed.
+type httpChecker struct {
+	*addressGuard
+	client *http.Client
+}
+
+func newHTTPChecker(allowlist []string) (*httpChecker, error) {
+	guard, err := newAddressGuard("HTTP check", allowlist)
+	if err != nil {
+		return nil, err
+	}
+	c := &httpChecker{addressGuard: guard}
+	c.client = &http.Client{
+		Timeout: runbookHTTPTimeout,
+		Transport: &http.Transport{
+			// No proxy: the checked address must be the one connected to.
+			Proxy:               nil,
+			DialContext:         guard.dialContext(&net.Dialer{Timeout: runbookHTTPTimeout}),
+			TLSHandshakeTimeout: runbookHTTPTimeout,
+		},
+	}
+	return c, nil
+}
+
+// labelTemplate matches references to alert labels in step blocks, e.g. {{ $labels.service }}.
+var labelTemplate = regexp.MustCompile(`\{\{\s*\$labels\.([a-zA-Z_][a-zA-Z0-9_]*)\s*\}\}`)
+
+// runbookStep is a diagnostic step parsed from a fenced code block of a runbook, e.g.
+//
+//	```promql title="Error rate" datasource=prom range=1h
+//	sum(rate(http_requests_total{service="{{ $labels.service }}", code=~"5.."}[5m]))
+//	```
+//
+// The block body is the query for promql and logql steps, the JSON arguments for mcp
+// steps and "METHOD URL" for http steps. Action steps have "METHOD URL" followed by an
+// optional JSON payload, e.g.
+//
+//	```action kind=restart title="Restart checkout" approvals=2
+//	POST https://deploy.example.com/restart
+//	{"deployment": "{{ $labels.service }}"}
+//	```
+//
+// Alert labels are referenced as {{ $labels.name }}. The URL of action steps cannot
+// reference labels, so that the runbook author alone decides where actions are sent.
+type runbookStep struct {
+	Kind  string `json:"kind"`
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body"`
+	// DatasourceUID and Range apply to promql and logql steps.
+	DatasourceUID string `json:"datasourceUid,omitempty"`
+	Range         string `json:"range,omitempty"`
+	// Tool is the MCP tool called by mcp steps.
+	Tool string `json:"tool,omitempty"`
+	// Expect is the status code an http step expects. Any 2xx status is accepted when empty.
+	Expect   int    `json:"expect,omitempty"`
+	Contains string `json:"contains,omitempty"`
+	// Labels are the alert labels the step references.
+	Labels []string `json:"labels,omitempty"`
+	// ActionKind, Approvals, Replicas and SupportsDryRun describe the action proposed by
+	// action steps.
+	ActionKind     string `json:"actionKind,omitempty"`
+	Approvals      int    `json:"approvals,omitempty"`
+	Replicas       *int   `json:"replicas,omitempty"`
+	SupportsDryRun bool   `json:"supportsDryRun,omitempty"`
+}
+
+// runbook is a Markdown document whose fenced step blocks can be executed against the
+// labels of an alert. Alerts are linked to a runbook when their labels satisfy Matchers,
+// or when their runbook_url annotation points at the runbook.
+type runbook struct {
+	ID       string           `json:"id"`
+	Title    string           `json:"title"`
+	Content  string           `json:"content"`
+	Matchers []silenceMatcher `json:"matchers,omitempty"`
+	// URL is the existing location of the runbook, e.g. a wiki page, that alert rules
+	// may already reference in their runbook_url annotation.
+	URL string `json:"url,omitempty"`
+	// Steps are parsed from Content when the runbook is saved.
+	Steps     []runbookStep `json:"steps"`
+	CreatedBy string        `json:"createdBy,omitempty"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+// validate checks the runbook and parses its steps.
+func (rb *runbook) validate() error {
+	if strings.TrimSpace(rb.Title) == "" {
+		return errors.New("title is required")
+	}
+	if strings.TrimSpace(rb.Content) == "" {
+		return errors.New("content is required")
+	}
+	if len(rb.Matchers) > 0 {
+		if err := validateMatchers(rb.Matchers); err != nil {
+			return err
+		}
+	}
+	if rb.URL != "" {
+		if u, err := url.Parse(rb.URL); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid url %q", rb.URL)
+		}
+	}
+	steps, err := parseRunbookSteps(rb.Content)
+	if err != nil {
+		return err
+	}
+	rb.Steps = steps
+	return nil
+}
+
+// parseRunbookSteps extracts the step blocks of a Markdown runbook. Fenced code blocks in
+// other languages, such as shell snippets, are left alone.
+func parseRunbookSteps(content string) ([]runbookStep, error) {
+	steps := []runbookStep{}
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, "```") {
+			continue
+		}
+		start := i + 1
+		end := start
+		for end < len(lines) && strings.TrimSpace(lines[end]) != "```" {
+			end++
+		}
+		if end == len(lines) {
+			return nil, fmt.Errorf("line %d: unterminated code block", i+1)
+		}
+		i = end
+		lang, attrs, err := parseInfoString(strings.TrimPrefix(line, "```"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", start, err)
+		}
+		switch lang {
+		case runbookStepPromQL, runbookStepLogQL, runbookStepMCP, runbookStepHTTP, runbookStepAction:
+		default:
+			continue
+		}
+		step, err := newRunbookStep(lang, attrs, strings.TrimSpace(strings.Join(lines[start:end], "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("step %d (line %d): %w", len(steps)+1, start, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// parseInfoString parses the info string of a fenced code block: a language followed by
+// key=value attributes, where values may be double-quoted.
+func parseInfoString(s string) (string, map[string]string, error) {
+	s = strings.TrimSpace(s)
+	lang, rest, _ := strings.Cut(s, " ")
+	attrs := map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok || key == "" || strings.ContainsFunc(key, unicode.IsSpace) {
+			return "", nil, fmt.Errorf("invalid attribute %q: expected key=value", rest)
+		}
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			quoted, err := strconv.QuotedPrefix(after)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = after[len(quoted):]
+		} else {
+			value, rest, _ = strings.Cut(after, " ")
+		}
+		attrs[key] = value
+	}
+	return strings.ToLower(lang), attrs, nil
+}
+
+func newRunbookStep(kind string, attrs map[string]string, body string) (runbookStep, error) {
+	step := runbookStep{Kind: kind, Title: attrs["title"], Body: body}
+	if body == "" {
+		return step, errors.New("empty step block")
+	}
+	for _, m := range labelTemplate.FindAllStringSubmatch(body, -1) {
+		if !slices.Contains(step.Labels, m[1]) {
+			step.Labels = append(step.Labels, m[1])
+		}
+	}
+	switch kind {
+	case runbookStepPromQL, runbookStepLogQL:
+		step.DatasourceUID, step.Range = attrs["datasource"], attrs["range"]
+		if step.DatasourceUID == "" {
+			return step, errors.New("datasource attribute is required")
+		}
+		if step.Range != "" {
+			if _, err := time.ParseDuration(step.Range); err != nil {
+				return step, fmt.Errorf("invalid range: %w", err)
+			}
+		}
+	case runbookStepMCP:
+		step.Tool = attrs["tool"]
+		if step.Tool == "" {
+			return step, errors.New("tool attribute is required")
+		}
+		if err := checkReadOnlyTool(step.Tool); err != nil {
+			return step, err
+		}
+		// Templates are replaced with JSON-escaped values, so the body must be valid JSON
+		// with any placeholder in it.
+		var args map[string]any
+		if err := json.Unmarshal([]byte(labelTemplate.ReplaceAllString(body, "x")), &args); err != nil {
+			return step, fmt.Errorf("arguments must be a JSON object: %w", err)
+		}
+	case runbookStepHTTP:
+		method, target, _ := strings.Cut(body, " ")
+		if method != http.MethodGet && method != http.MethodHead {
+			return step, errors.New(`http steps must be "GET <url>" or "HEAD <url>"`)
+		}
+		if u, err := url.Parse(labelTemplate.ReplaceAllString(strings.TrimSpace(target), "x")); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return step, fmt.Errorf("invalid url %q", target)
+		}
+		if v := attrs["expect"]; v != "" {
+			code, err := strconv.Atoi(v)
+			if err != nil || code < 100 || code > 599 {
+				return step, fmt.Errorf("invalid expect status %q", v)
+			}
+			step.Expect = code
+		}
+		step.Contains = attrs["contains"]
+	case runbookStepAction:
+		if step.Title == "" {
+			return step, errors.New("title attribute is required")
+		}
+		step.ActionKind, step.SupportsDryRun = attrs["kind"], attrs["dryrun"] == "true"
+		if v := attrs["approvals"]; v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return step, fmt.Errorf("invalid approvals %q", v)
+			}
+			step.Approvals = n
+		}
+		if v := attrs["replicas"]; v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return step, fmt.Errorf("invalid replicas %q", v)
+			}
+			step.Replicas = &n
+		}
+		if first, _, _ := strings.Cut(body, "\n"); labelTemplate.MatchString(first) {
+			return step, errors.New("the url of action steps cannot reference labels")
+		}
+		if _, err := step.action(labelTemplate.ReplaceAllString(body, "x")); err != nil {
+			return step, err
+		}
+	}
+	return step, nil
+}
+
+// action builds the action proposed by an action step from its rendered body.
+func (s runbookStep) action(rendered string) (action, error) {
+	target, payload, _ := strings.Cut(rendered, "\n")
+	method, u, _ := strings.Cut(strings.TrimSpace(target), " ")
+	ac := action{
+		Title:             s.Title,
+		Kind:              s.ActionKind,
+		Method:            method,
+		URL:               strings.TrimSpace(u),
+		Replicas:          s.Replicas,
+		SupportsDryRun:    s.SupportsDryRun,
+		RequiredApprovals: s.Approvals,
+	}
+	if strings.TrimSpace(payload) != "" {
+		if err := json.Unmarshal([]byte(payload), &ac.Payload); err != nil {
+			return ac, fmt.Errorf("payload must be a JSON object: %w", err)
+		}
+	}
+	return ac, ac.validate()
+}
+
+// render replaces the label references of the step body, escaping values for the step kind.
+func (s runbookStep) render(labels map[string]string) (string, error) {
+	var missing []string
+	for _, name := range s.Labels {
+		if _, ok := labels[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("alert has no %s label", strings.Join(missing, ", "))
+	}
+	escape := func(v string) string { return v }
+	switch s.Kind {
+	case runbookStepPromQL, runbookStepLogQL:
+		escape = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+	case runbookStepMCP, runbookStepAction:
+		escape = func(v string) string {
+			b, _ := json.Marshal(v)
+			return string(b[1 : len(b)-1])
+		}
+	case runbookStepHTTP:
+		escape = url.PathEscape
+	}
+	return labelTemplate.ReplaceAllStringFunc(s.Body, func(ref string) string {
+		return escape(labels[labelTemplate.FindStringSubmatch(ref)[1]])
+	}), nil
+}
+
+// runbookStepResult is the outcome of executing one runbook step.
+type runbookStepResult struct {
+	Index    int    `json:"index"`
+	Kind     string `json:"kind"`
+	Title    string `json:"title,omitempty"`
+	Rendered string `json:"rendered,omitempty"`
+	Status   string `json:"status"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	// ActionID is the action proposed by an action step.
+	ActionID string `json:"actionId,omitempty"`
+}
+
+// executeRunbook runs every step of a runbook in order against the alert labels. A failing
+// step does not stop the remaining ones, as each step is a separate diagnostic.
+func (a *App) executeRunbook(ctx context.Context, rb runbook, labels map[string]string) []runbookStepResult {
+	results := make([]runbookStepResult, 0, len(rb.Steps))
+	for i, step := range rb.Steps {
+		res := runbookStepResult{Index: i + 1, Kind: step.Kind, Title: step.Title}
+		start := time.Now()
+		rendered, err := step.render(labels)
+		var output string
+		if err == nil {
+			res.Rendered = rendered
+			if step.Kind == runbookStepAction {
+				// Actions are only proposed; they run once approved like any other action.
+				var ac action
+				if ac, err = a.proposeRunbookAction(ctx, rb, step, rendered, "runbook", ""); err == nil {
+					res.ActionID, output = ac.ID, describeProposal(ac)
+				}
+			} else {
+				output, err = a.executeRunbookStep(ctx, step, rendered)
+			}
+		}
+		res.Duration = time.Since(start).Round(time.Millisecond).String()
+		res.Output = truncate(output, investigationOutputLimit)
+		res.Status = investigationCompleted
+		if err != nil {
+			res.Status, res.Error = investigationFailed, err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// proposeRunbookAction proposes the action of a rendered action step on behalf of source,
+// "runbook" when the runbook is executed or "assistant" when the agent proposes it.
+func (a *App) proposeRunbookAction(ctx context.Context, rb runbook, step runbookStep, rendered, source, reason string) (action, error) {
+	ac, err := step.action(rendered)
+	if err != nil {
+		return ac, err
+	}
+	ac.Source, ac.SourceID, ac.Reason = source, rb.ID, cmp.Or(reason, "Proposed from the runbook "+rb.Title)
+	return a.proposeAction(ctx, ac)
+}
+
+// describeProposal tells what happens next to a proposed action.
+func describeProposal(ac action) string {
+	next := fmt.Sprintf("%d approval(s) by someone other than %s", ac.RequiredApprovals, cmp.Or(ac.ProposedBy, "the proposer"))
+	if ac.SupportsDryRun {
+		next = "a dry-run and " + next
+	}
+	return fmt.Sprintf("Proposed action %s: %s %s. It waits for %s.", ac.ID, ac.Method, ac.URL, next)
+}
+
+// executeRunbookStep runs a step whose body has already been rendered.
+func (a *App) executeRunbookStep(ctx context.Context, step runbookStep, rendered string) (string, error) {
+	switch step.Kind {
+	case runbookStepPromQL, runbookStepLogQL:
+		// Queries run exactly like investigation query steps.
+		return a.executeInvestigationStep(ctx, investigation{}, investigationStep{
+			Kind:          stepQuery,
+			Language:      step.Kind,
+			DatasourceUID: step.DatasourceUID,
+			Query:         rendered,
+			Range:         step.Range,
+		})
+	case runbookStepMCP:
+		var args map[string]any
+		if err := json.Unmarshal([]byte(rendered), &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+		if err := checkReadOnlyTool(step.Tool); err != nil {
+			return "", err
+		}
+		return toolOutput(a.mcp.CallTool(ctx, step.Tool, args))
+	case runbookStepHTTP:
+		return a.httpChecker.check(ctx, step, rendered)
+	default:
+		return "", fmt.Errorf("unknown step kind %q", step.Kind)
+	}
+}
+
+// check sends the request of an http step and checks the response status and body. Only
+// the status is returned: the body may hold whatever the target network serves.
+func (c *httpChecker) check(ctx context.Context, step runbookStep, rendered string) (string, error) {
+	if !c.enabled() {
+		return "", errors.New("HTTP checks are disabled: no host is allowlisted in the runbook settings")
+	}
+	method, target, _ := strings.Cut(rendered, " ")
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSpace(target), nil)
+	if err != nil {
+		return "", err
+	}
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, runbookHTTPBodyLimit))
+	if err != nil {
+		return "", fmt.Errorf("read response: %w", err)
+	}
+	output := fmt.Sprintf("%s %s in %s", resp.Proto, resp.Status, time.Since(start).Round(time.Millisecond))
+	switch {
+	case step.Expect != 0 && resp.StatusCode != step.Expect:
+		return output, fmt.Errorf("expected status %d, got %d", step.Expect, resp.StatusCode)
+	case step.Expect == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299):
+		return output, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	case step.Contains != "" && !strings.Contains(string(body), step.Contains):
+		return output, fmt.Errorf("response does not contain %q", step.Contains)
+	}
+	return output, nil
+}
+
+// runbookMatch explains why a runbook is linked to an alert.
+type runbookMatch struct {
+	Runbook runbook `json:"runbook"`
+	// Reason is "runbook_url" or "labels".
+	Reason string `json:"reason"`
+}
+
+// matchRunbook reports how an alert is linked to a runbook, if it is. The runbook_url
+// annotation links an alert when it is the runbook URL or points at the runbook page.
+func matchRunbook(rb runbook, labels, annotations map[string]string) (string, bool, error) {
+	if u := strings.TrimRight(annotations["runbook_url"], "/"); u != "" {
+		if (rb.URL != "" && u == strings.TrimRight(rb.URL, "/")) || strings.HasSuffix(u, "/runbooks/"+rb.ID) {
+			return "runbook_url", true, nil
+		}
+	}
+	if len(rb.Matchers) == 0 {
+		return "", false, nil
+	}
+	ok, err := matchAll(rb.Matchers, labels)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	return "labels", true, nil
+}
+
+// alertContext is the alert a runbook is matched or executed against.
+type alertContext struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// handleRunbooks lists runbooks on GET and creates one on POST.
+func (a *App) handleRunbooks(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		runbooks, err := listJSON[runbook](ctx, a.store, runbooksCollection)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, runbooks)
+	case http.MethodPost:
+		if !requireEditor(w, req, "creating runbooks") {
+			return
+		}
+		var rb runbook
+		if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rb.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rb.ID = uuid.NewString()
+		rb.CreatedAt = time.Now().UTC()
+		rb.UpdatedAt = rb.CreatedAt
+		if u := backend.UserFromContext(ctx); u != nil {
+			rb.CreatedBy = u.Login
+		}
+		if err := saveJSON(ctx, a.store, runbooksCollection, rb.ID, rb); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, rb)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRunbook gets, replaces or deletes the runbook identified by {id}.
+func (a *App) handleRunbook(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := req.PathValue("id")
+	if (req.Method == http.MethodPut || req.Method == http.MethodDelete) && !requireEditor(w, req, "changing runbooks") {
+		return
+	}
+	existing, ok := a.loadRunbook(w, req, id)
+	if !ok {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, existing)
+	case http.MethodPut:
+		var rb runbook
+		if err := json.NewDecoder(req.Body).Decode(&rb); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rb.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rb.ID, rb.CreatedBy, rb.CreatedAt = existing.ID, existing.CreatedBy, existing.CreatedAt
+		rb.UpdatedAt = time.Now().UTC()
+		if err := saveJSON(ctx, a.store, runbooksCollection, rb.ID, rb); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, rb)
+	case http.MethodDelete:
+		if err := a.store.Delete(ctx, runbooksCollection, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "runbook deleted"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadRunbook loads the runbook with the given ID, writing an error response if it cannot.
+func (a *App) loadRunbook(w http.ResponseWriter, req *http.Request, id string) (runbook, bool) {
+	rb, err := loadJSON[runbook](req.Context(), a.store, runbooksCollection, id)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "runbook not found", http.StatusNotFound)
+		return rb, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return rb, false
+	}
+	return rb, true
+}
+
+// handleRunbookMatch returns the runbooks linked to an alert.
+func (a *App) handleRunbookMatch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var alert alertContext
+	if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	runbooks, err := listJSON[runbook](req.Context(), a.store, runbooksCollection)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	matches := []runbookMatch{}
+	for _, rb := range runbooks {
+		reason, ok, err := matchRunbook(rb, alert.Labels, alert.Annotations)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("runbook %s: %s", rb.ID, err), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			matches = append(matches, runbookMatch{Runbook: rb, Reason: reason})
+		}
+	}
+	writeJSON(w, http.StatusOK, matches)
+}
+
+// handleRunbookExecute runs the steps of the runbook identified by {id} with the labels
+// of an alert and returns the output of every step.
+func (a *App) handleRunbookExecute(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rb, ok := a.loadRunbook(w, req, req.PathValue("id"))
+	if !ok {
+		return
+	}
+	// The body is optional: runbooks without label references run without an alert.
+	var alert alertContext
+	if req.Body != nil {
+		if err := json.NewDecoder(req.Body).Decode(&alert); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if alert.Labels == nil {
+		alert.Labels = map[string]string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"runbookId": rb.ID,
+		"labels":    alert.Labels,
+		"steps":     a.executeRunbook(req.Context(), rb, alert.Labels),
+	})
+}
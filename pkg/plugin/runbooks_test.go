@@ -0,0 +1,279 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+const testRunbook = "# Checkout errors\n\n" +
+	"Check the error rate first.\n\n" +
+	"```promql title=\"Error rate\" datasource=prom range=30m\n" +
+	"sum(rate(http_requests_total{service=\"{{ $labels.service }}\", code=~\"5..\"}[5m]))\n" +
+	"```\n\n" +
+	"```logql datasource=loki\n" +
+	"{app=\"{{$labels.service}}\"} |= \"error\"\n" +
+	"```\n\n" +
+	"Restart the pods if nothing else helps:\n\n" +
+	"```bash\n" +
+	"kubectl rollout restart deploy/checkout\n" +
+	"```\n\n" +
+	"```mcp tool=list_loki_label_values title=\"Pods\"\n" +
+	"{\"datasourceUid\": \"loki\", \"labelName\": \"pod\", \"service\": \"{{ $labels.service }}\"}\n" +
+	"```\n\n" +
+	"```http title=\"Health\" expect=200 contains=ok\n" +
+	"GET %s/healthz/{{ $labels.service }}\n" +
+	"```\n"
+
+func TestParseRunbookSteps(t *testing.T) {
+	steps, err := parseRunbookSteps(strings.ReplaceAll(testRunbook, "%s", "http://checkout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, s := range steps {
+		kinds = append(kinds, s.Kind)
+	}
+	if got := strings.Join(kinds, ","); got != "promql,logql,mcp,http" {
+		t.Fatalf("unexpected steps %s", got)
+	}
+	if s := steps[0]; s.Title != "Error rate" || s.DatasourceUID != "prom" || s.Range != "30m" || len(s.Labels) != 1 || s.Labels[0] != "service" {
+		t.Errorf("unexpected promql step %+v", s)
+	}
+	if s := steps[3]; s.Expect != 200 || s.Contains != "ok" {
+		t.Errorf("unexpected http step %+v", s)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		expErr  string
+	}{
+		{name: "unterminated", content: "```promql datasource=prom\nup\n", expErr: "unterminated code block"},
+		{name: "missing datasource", content: "```promql\nup\n```", expErr: "datasource attribute is required"},
+		{name: "bad attribute", content: "```promql datasource\nup\n```", expErr: "expected key=value"},
+		{name: "mutating http", content: "```http\nPOST http://checkout/restart\n```", expErr: `must be "GET <url>"`},
+		{name: "invalid json", content: "```mcp tool=list_datasources\n{datasourceUid: loki}\n```", expErr: "must be a JSON object"},
+		{name: "mutating mcp", content: "```mcp tool=create_incident\n{}\n```", expErr: `tool "create_incident" is not a read-only tool`},
+		{name: "empty", content: "```logql datasource=loki\n```", expErr: "empty step block"},
+		{name: "untitled action", content: "```action kind=restart\nPOST http://deploy/restart\n```", expErr: "title attribute is required"},
+		{name: "action url label", content: "```action kind=restart title=x\nPOST http://{{ $labels.host }}/restart\n```", expErr: "cannot reference labels"},
+		{name: "invalid action", content: "```action kind=reboot title=x\nPOST http://deploy/restart\n```", expErr: "kind must be"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseRunbookSteps(tc.content)
+			if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+				t.Errorf("expected error containing %q, got %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestRunbookStepRender(t *testing.T) {
+	steps, err := parseRunbookSteps(strings.ReplaceAll(testRunbook, "%s", "http://checkout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"service": `check"out`}
+	for i, exp := range []string{
+		`sum(rate(http_requests_total{service="check\"out", code=~"5.."}[5m]))`,
+		`{app="check\"out"} |= "error"`,
+		`{"datasourceUid": "loki", "labelName": "pod", "service": "check\"out"}`,
+		`GET http://checkout/healthz/check%22out`,
+	} {
+		got, err := steps[i].render(labels)
+		if err != nil || got != exp {
+			t.Errorf("step %d: expected %s, got %s (%v)", i+1, exp, got, err)
+		}
+	}
+	if _, err := steps[0].render(map[string]string{}); err == nil || err.Error() != "alert has no service label" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRunbookResources(t *testing.T) {
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz/checkout" {
+			http.NotFound(w, req)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer health.Close()
+
+	app := newTestApp(t, "http://localhost:0", map[string]any{"runbooks": map[string]any{"httpAllowlist": []string{"127.0.0.1/32"}}})
+	// httptest servers listen on loopback, which HTTP checks never reach otherwise.
+	app.httpChecker.blocked = nil
+	var queries []string
+	app.mcp = &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"query_prometheus": func(args map[string]any) (any, error) {
+			queries = append(queries, args["expr"].(string))
+			return []map[string]any{{"metric": map[string]string{}, "values": [][]any{{1700000000, "0.5"}}}}, nil
+		},
+		"query_loki_logs": func(args map[string]any) (any, error) {
+			queries = append(queries, args["logql"].(string))
+			return []map[string]any{{"line": "error: payment declined"}}, nil
+		},
+		"list_loki_label_values": func(args map[string]any) (any, error) {
+			return []string{"checkout-1", "checkout-2"}, nil
+		},
+	}}
+
+	resp := callResource(t, app, http.MethodPost, "runbooks", map[string]any{
+		"title":    "Checkout errors",
+		"content":  strings.ReplaceAll(testRunbook, "%s", health.URL),
+		"matchers": []map[string]any{{"name": "service", "value": "checkout"}},
+		"url":      "https://wiki.example.com/runbooks/checkout",
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("create: %d %s", resp.Status, resp.Body)
+	}
+	var rb runbook
+	if err := json.Unmarshal(resp.Body, &rb); err != nil {
+		t.Fatal(err)
+	}
+	if len(rb.Steps) != 4 || rb.CreatedBy != "tester" {
+		t.Fatalf("unexpected runbook %+v", rb)
+	}
+
+	// Viewers can read runbooks but not write them.
+	if resp := callResourceAs(t, app, viewer, http.MethodPost, "runbooks", map[string]any{"title": "t", "content": "text"}); resp.Status != http.StatusForbidden {
+		t.Errorf("expected viewers to be unable to create runbooks, got %d", resp.Status)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		if resp := callResourceAs(t, app, viewer, method, "runbooks/"+rb.ID, map[string]any{"title": "t", "content": "text"}); resp.Status != http.StatusForbidden {
+			t.Errorf("expected viewers to be unable to %s runbooks, got %d", method, resp.Status)
+		}
+	}
+	if resp := callResourceAs(t, app, viewer, http.MethodGet, "runbooks/"+rb.ID, nil); resp.Status != http.StatusOK {
+		t.Errorf("expected viewers to be able to read runbooks, got %d", resp.Status)
+	}
+
+	resp = callResource(t, app, http.MethodPost, "runbooks", map[string]any{"title": "broken", "content": "```promql\nup\n```"})
+	if resp.Status != http.StatusBadRequest {
+		t.Errorf("expected invalid runbook to be rejected, got %d", resp.Status)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		alert  alertContext
+		reason string
+	}{
+		{name: "labels", alert: alertContext{Labels: map[string]string{"service": "checkout"}}, reason: "labels"},
+		{name: "external url", alert: alertContext{Annotations: map[string]string{"runbook_url": "https://wiki.example.com/runbooks/checkout/"}}, reason: "runbook_url"},
+		{name: "plugin url", alert: alertContext{Annotations: map[string]string{"runbook_url": "https://grafana.example.com/a/sre-assistant-app/runbooks/" + rb.ID}}, reason: "runbook_url"},
+		{name: "no match", alert: alertContext{Labels: map[string]string{"service": "cart"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := callResource(t, app, http.MethodPost, "runbooks/match", tc.alert)
+			if resp.Status != http.StatusOK {
+				t.Fatalf("match: %d %s", resp.Status, resp.Body)
+			}
+			var matches []runbookMatch
+			if err := json.Unmarshal(resp.Body, &matches); err != nil {
+				t.Fatal(err)
+			}
+			if tc.reason == "" && len(matches) != 0 {
+				t.Errorf("expected no match, got %+v", matches)
+			}
+			if tc.reason != "" && (len(matches) != 1 || matches[0].Reason != tc.reason) {
+				t.Errorf("expected a match by %s, got %+v", tc.reason, matches)
+			}
+		})
+	}
+
+	resp = callResource(t, app, http.MethodPost, "runbooks/"+rb.ID+"/execute", alertContext{Labels: map[string]string{"service": "checkout"}})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("execute: %d %s", resp.Status, resp.Body)
+	}
+	var out struct {
+		Steps []runbookStepResult `json:"steps"`
+	}
+	if err := json.Unmarshal(resp.Body, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Steps) != 4 {
+		t.Fatalf("unexpected results %+v", out.Steps)
+	}
+	for _, s := range out.Steps {
+		if s.Status != investigationCompleted || s.Output == "" {
+			t.Errorf("step %d (%s): status %s output %q error %q", s.Index, s.Kind, s.Status, s.Output, s.Error)
+		}
+	}
+	if len(queries) != 2 || !strings.Contains(queries[0], `service="checkout"`) || !strings.Contains(queries[1], `{app="checkout"}`) {
+		t.Errorf("unexpected queries %q", queries)
+	}
+	// Only the status of HTTP checks is returned, not the body.
+	if !strings.HasPrefix(out.Steps[3].Output, "HTTP/1.1 200 OK in ") || strings.Contains(out.Steps[3].Output, "\n") {
+		t.Errorf("unexpected http output %q", out.Steps[3].Output)
+	}
+
+	// Steps fail on their own: missing labels and failing checks do not stop the others.
+	resp = callResource(t, app, http.MethodPost, "runbooks/"+rb.ID+"/execute", alertContext{Labels: map[string]string{"service": "cart"}})
+	if err := json.Unmarshal(resp.Body, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Steps[0].Status != investigationCompleted || out.Steps[3].Status != investigationFailed || !strings.Contains(out.Steps[3].Error, "expected status 200, got 404") {
+		t.Errorf("unexpected results %+v", out.Steps)
+	}
+	resp = callResource(t, app, http.MethodPost, "runbooks/"+rb.ID+"/execute", nil)
+	if err := json.Unmarshal(resp.Body, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range out.Steps {
+		if s.Status != investigationFailed || s.Error != "alert has no service label" {
+			t.Errorf("step %d: expected missing label error, got %s %q", s.Index, s.Status, s.Error)
+		}
+	}
+
+	resp = callResource(t, app, http.MethodPost, "runbooks/missing/execute", nil)
+	if resp.Status != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.Status)
+	}
+}
+
+func TestHTTPChecker(t *testing.T) {
+	c, err := newHTTPChecker([]string{"*.example.com", "status.internal", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		host, addr string
+		expErr     string
+	}{
+		{host: "api.example.com", addr: "203.0.113.7"},
+		{host: "status.internal", addr: "192.168.1.10"},
+		{host: "10.1.2.3", addr: "10.1.2.3"},
+		{host: "evil.com", addr: "10.1.2.3"},
+		{host: "example.com", addr: "203.0.113.7", expErr: "not in the HTTP check allowlist"},
+		{host: "evil.com", addr: "192.168.1.10", expErr: "not in the HTTP check allowlist"},
+		{host: "api.example.com", addr: "169.254.169.254", expErr: "is blocked"},
+		{host: "api.example.com", addr: "127.0.0.1", expErr: "is blocked"},
+		{host: "api.example.com", addr: "::ffff:127.0.0.1", expErr: "is blocked"},
+		{host: "api.example.com", addr: "fe80::1", expErr: "is blocked"},
+	} {
+		err := c.checkAddr(tc.host, netip.MustParseAddr(tc.addr))
+		if (tc.expErr == "" && err != nil) || (tc.expErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expErr))) {
+			t.Errorf("%s at %s: expected error %q, got %v", tc.host, tc.addr, tc.expErr, err)
+		}
+	}
+	if _, err := newHTTPChecker([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an invalid CIDR to be rejected")
+	}
+
+	// Names are checked after resolution, and HTTP checks are disabled without an allowlist.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+	step := runbookStep{Kind: runbookStepHTTP}
+	c, _ = newHTTPChecker([]string{"localhost"})
+	if _, err := c.check(t.Context(), step, "GET "+strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)); err == nil || !strings.Contains(err.Error(), "is blocked") {
+		t.Errorf("expected localhost to be blocked, got %v", err)
+	}
+	c, _ = newHTTPChecker(nil)
+	if _, err := c.check(t.Context(), step, "GET "+srv.URL); err == nil || !strings.Contains(err.Error(), "HTTP checks are disabled") {
+		t.Errorf("expected HTTP checks to be disabled, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Settings contains the app settings configured through the plugin's
+// jsonData and secureJsonData.
+type Settings struct {
+	// DataPath is the directory where the plugin persists its own state,
+	// such as maintenance windows. Defaults to a directory below os.TempDir().
+	DataPath string `json:"dataPath"`
+	// IRMPluginID is the ID of the Grafana IRM app incidents are read from.
+	// Defaults to grafana-irm-app.
+	IRMPluginID string `json:"irmPluginId"`
+	// ChangesToken authenticates CI systems reporting changes to /changes. It is set
+	// through secureJsonData; change ingestion is disabled without it.
+	ChangesToken string `json:"-"`
+	// Topology maps caller/callee metrics to the service graph. Defaults to the
+	// Tempo service graph metrics.
+	Topology topologyMapping `json:"topology"`
+	// Embeddings configures the embeddings endpoint of the knowledge base, which is
+	// disabled until a URL is set.
+	Embeddings embeddingsSettings `json:"embeddings"`
+	// Logging configures debug logs and the redaction of PII from logs.
+	Logging loggingSettings `json:"logging"`
+	// Redaction configures what is removed from payloads sent to the LLM, in addition to
+	// the built-in detectors of emails, IPs, tokens, card numbers, JWTs and AWS keys.
+	Redaction redactionSettings `json:"redaction"`
+	// Budgets limit the LLM tokens used by the org and by each user.
+	Budgets budgetSettings `json:"budgets"`
+	// RateLimits limit the requests to the routes calling the LLM and the LLM calls in
+	// flight. Unset fields keep the defaults.
+	RateLimits rateLimitSettings `json:"rateLimits"`
+	// Cache configures the cache of datasource queries and other read-only MCP tools.
+	Cache cacheSettings `json:"cache"`
+	// Runbooks restricts what runbook steps may reach.
+	Runbooks runbookSettings `json:"runbooks"`
+	// Actions restricts what remediation actions may reach.
+	Actions actionSettings `json:"actions"`
+	// HTTP configures the timeouts, retries and circuit breakers of the outbound HTTP
+	// clients by dependency. Unset fields keep the defaults.
+	HTTP httpSettings `json:"http"`
+}
+
+// loadSettings parses the app instance settings into a *Settings, applying
+// defaults for any values that were not configured.
+func loadSettings(appSettings backend.AppInstanceSettings) (*Settings, error) {
+	settings := &Settings{RateLimits: defaultRateLimits, HTTP: defaultHTTPSettings}
+	if len(appSettings.JSONData) > 0 {
+		if err := json.Unmarshal(appSettings.JSONData, settings); err != nil {
+			return nil, fmt.Errorf("unmarshal settings: %w", err)
+		}
+	}
+	if settings.DataPath == "" {
+		settings.DataPath = filepath.Join(os.TempDir(), "sre-assistant-app")
+	}
+	settings.ChangesToken = appSettings.DecryptedSecureJSONData["changesToken"]
+	settings.Embeddings.APIKey = appSettings.DecryptedSecureJSONData["embeddingsApiKey"]
+	if settings.IRMPluginID == "" {
+		settings.IRMPluginID = "grafana-irm-app"
+	}
+	switch settings.Budgets.Period {
+	case "":
+		settings.Budgets.Period = budgetMonth
+	case budgetDay, budgetMonth:
+	default:
+		return nil, fmt.Errorf("invalid budget period %q: expected %s or %s", settings.Budgets.Period, budgetDay, budgetMonth)
+	}
+	return settings, nil
+}
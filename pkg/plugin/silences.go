@@ -0,0 +1,425 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// alertmanagerAPIPrefix is the path of the Grafana-managed Alertmanager API.
+const alertmanagerAPIPrefix = "/api/alertmanager/grafana/api/v2"
+
+const (
+	// defaultSilenceDuration is used when a silence request has neither an end time nor a duration.
+	defaultSilenceDuration = 2 * time.Hour
+	// maxSilenceDuration guards against silences that are accidentally left in place for weeks.
+	maxSilenceDuration = 7 * 24 * time.Hour
+)
+
+// silenceMatcher is an Alertmanager label matcher.
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+// UnmarshalJSON decodes a matcher, treating a missing isEqual as true like Alertmanager does.
+func (m *silenceMatcher) UnmarshalJSON(b []byte) error {
+	type plain silenceMatcher
+	p := plain{IsEqual: true}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*m = silenceMatcher(p)
+	return nil
+}
+
+// String formats the matcher the way Alertmanager displays it, e.g. `alertname=~"High.*"`.
+func (m silenceMatcher) String() string {
+	op := "="
+	switch {
+	case m.IsRegex && m.IsEqual:
+		op = "=~"
+	case m.IsRegex:
+		op = "!~"
+	case !m.IsEqual:
+		op = "!="
+	}
+	return fmt.Sprintf("%s%s%q", m.Name, op, m.Value)
+}
+
+// matches reports whether the label set satisfies the matcher. Missing labels
+// are treated as empty values, and regular expressions are fully anchored.
+func (m silenceMatcher) matches(labels map[string]string) (bool, error) {
+	v := labels[m.Name]
+	matched := v == m.Value
+	if m.IsRegex {
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return false, fmt.Errorf("invalid regex for matcher %s: %w", m.Name, err)
+		}
+		matched = re.MatchString(v)
+	}
+	return matched == m.IsEqual, nil
+}
+
+// validateMatchers checks a matcher set the same way Alertmanager does before accepting a silence.
+func validateMatchers(matchers []silenceMatcher) error {
+	if len(matchers) == 0 {
+		return errors.New("at least one matcher is required")
+	}
+	matchesEmpty := true
+	for _, m := range matchers {
+		if m.Name == "" {
+			return errors.New("matcher name must not be empty")
+		}
+		ok, err := m.matches(map[string]string{})
+		if err != nil {
+			return err
+		}
+		matchesEmpty = matchesEmpty && ok
+	}
+	if matchesEmpty {
+		return errors.New("at least one matcher must not match the empty string")
+	}
+	return nil
+}
+
+// matchAll reports whether labels satisfy every matcher.
+func matchAll(matchers []silenceMatcher, labels map[string]string) (bool, error) {
+	for _, m := range matchers {
+		ok, err := m.matches(labels)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// alertGroup is an Alertmanager alert group, as returned by the alert groups API or
+// as sent by the frontend for a group the user is looking at.
+type alertGroup struct {
+	Labels map[string]string `json:"labels"`
+	Alerts []struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"alerts"`
+}
+
+// matchersFromGroup builds equality matchers for an alert group. The group labels
+// are used when present; otherwise the labels common to every alert in the group.
+// Internal labels (prefixed with "__") are never matched on.
+func matchersFromGroup(g alertGroup) ([]silenceMatcher, error) {
+	labels := g.Labels
+	if len(labels) == 0 && len(g.Alerts) > 0 {
+		labels = map[string]string{}
+		for k, v := range g.Alerts[0].Labels {
+			labels[k] = v
+		}
+		for _, a := range g.Alerts[1:] {
+			for k, v := range labels {
+				if a.Labels[k] != v {
+					delete(labels, k)
+				}
+			}
+		}
+	}
+	matchers := make([]silenceMatcher, 0, len(labels))
+	for k, v := range labels {
+		if strings.HasPrefix(k, "__") || v == "" {
+			continue
+		}
+		matchers = append(matchers, silenceMatcher{Name: k, Value: v, IsEqual: true})
+	}
+	if len(matchers) == 0 {
+		return nil, errors.New("alert group has no labels to build matchers from")
+	}
+	sort.Slice(matchers, func(i, j int) bool { return matchers[i].Name < matchers[j].Name })
+	return matchers, nil
+}
+
+// silence is a silence as returned by the Alertmanager API.
+type silence struct {
+	ID     string `json:"id"`
+	Status struct {
+		State string `json:"state"`
+	} `json:"status"`
+	Matchers  []silenceMatcher `json:"matchers"`
+	StartsAt  time.Time        `json:"startsAt"`
+	EndsAt    time.Time        `json:"endsAt"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+	CreatedBy string           `json:"createdBy"`
+	Comment   string           `json:"comment"`
+}
+
+// postableSilence is the body sent to the Alertmanager API to create a silence.
+type postableSilence struct {
+	Matchers  []silenceMatcher `json:"matchers"`
+	StartsAt  time.Time        `json:"startsAt"`
+	EndsAt    time.Time        `json:"endsAt"`
+	CreatedBy string           `json:"createdBy"`
+	Comment   string           `json:"comment"`
+}
+
+// amAlert is an alert as returned by the Alertmanager API.
+type amAlert struct {
+	Fingerprint string            `json:"fingerprint"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	Status      struct {
+		State      string   `json:"state"`
+		SilencedBy []string `json:"silencedBy"`
+	} `json:"status"`
+}
+
+func (a *App) listSilences(ctx context.Context) ([]silence, error) {
+	var silences []silence
+	if err := a.grafana.do(ctx, http.MethodGet, alertmanagerAPIPrefix+"/silences", nil, &silences); err != nil {
+		return nil, err
+	}
+	return silences, nil
+}
+
+func (a *App) createSilence(ctx context.Context, s postableSilence) (string, error) {
+	var resp struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err := a.grafana.do(ctx, http.MethodPost, alertmanagerAPIPrefix+"/silences", s, &resp); err != nil {
+		return "", err
+	}
+	return resp.SilenceID, nil
+}
+
+func (a *App) expireSilence(ctx context.Context, id string) error {
+	return a.grafana.do(ctx, http.MethodDelete, alertmanagerAPIPrefix+"/silence/"+url.PathEscape(id), nil, nil)
+}
+
+func (a *App) listAlerts(ctx context.Context) ([]amAlert, error) {
+	var alerts []amAlert
+	if err := a.grafana.do(ctx, http.MethodGet, alertmanagerAPIPrefix+"/alerts", nil, &alerts); err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+// silencePreview lists the current alerts a matcher set would silence.
+type silencePreview struct {
+	Matchers []silenceMatcher `json:"matchers"`
+	Alerts   []amAlert        `json:"alerts"`
+	Total    int              `json:"total"`
+}
+
+func (a *App) previewSilence(ctx context.Context, matchers []silenceMatcher) (silencePreview, error) {
+	preview := silencePreview{Matchers: matchers, Alerts: []amAlert{}}
+	alerts, err := a.listAlerts(ctx)
+	if err != nil {
+		return preview, err
+	}
+	for _, alert := range alerts {
+		ok, err := matchAll(matchers, alert.Labels)
+		if err != nil {
+			return preview, err
+		}
+		if ok {
+			preview.Alerts = append(preview.Alerts, alert)
+		}
+	}
+	preview.Total = len(preview.Alerts)
+	return preview, nil
+}
+
+// silenceRequest is the body accepted by POST /silences and POST /silences/recommend.
+// Matchers may be given explicitly or derived from an alert group. The silence is always
+// created by the user of the request.
+type silenceRequest struct {
+	Matchers   []silenceMatcher `json:"matchers"`
+	AlertGroup *alertGroup      `json:"alertGroup"`
+	StartsAt   time.Time        `json:"startsAt"`
+	EndsAt     time.Time        `json:"endsAt"`
+	Duration   string           `json:"duration"`
+	Comment    string           `json:"comment"`
+}
+
+// toPostable resolves the matchers and time range of a request into a silence.
+func (r silenceRequest) toPostable(ctx context.Context, now time.Time) (postableSilence, error) {
+	s := postableSilence{Matchers: r.Matchers, StartsAt: r.StartsAt, EndsAt: r.EndsAt, Comment: r.Comment, CreatedBy: "sre-assistant"}
+	if len(s.Matchers) == 0 && r.AlertGroup != nil {
+		m, err := matchersFromGroup(*r.AlertGroup)
+		if err != nil {
+			return s, err
+		}
+		s.Matchers = m
+	}
+	if err := validateMatchers(s.Matchers); err != nil {
+		return s, err
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if s.EndsAt.IsZero() {
+		d := defaultSilenceDuration
+		if r.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(r.Duration); err != nil {
+				return s, fmt.Errorf("invalid duration: %w", err)
+			}
+		}
+		s.EndsAt = s.StartsAt.Add(d)
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return s, errors.New("silence must end after it starts")
+	}
+	if s.EndsAt.Sub(s.StartsAt) > maxSilenceDuration {
+		return s, fmt.Errorf("silence must not last longer than %s", maxSilenceDuration)
+	}
+	if u := backend.UserFromContext(ctx); u != nil && u.Login != "" {
+		s.CreatedBy = u.Login
+	}
+	if s.Comment == "" {
+		s.Comment = "Silenced by SRE Assistant: " + formatMatchers(s.Matchers)
+	}
+	return s, nil
+}
+
+func formatMatchers(matchers []silenceMatcher) string {
+	parts := make([]string, len(matchers))
+	for i, m := range matchers {
+		parts[i] = m.String()
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// writeGrafanaError writes err as an HTTP error, keeping the status code of Grafana API errors.
+func writeGrafanaError(w http.ResponseWriter, err error) {
+	if writeLimitError(w, err) {
+		return
+	}
+	var apiErr *grafanaAPIError
+	if errors.As(err, &apiErr) {
+		http.Error(w, apiErr.Error(), apiErr.StatusCode)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// handleSilences lists silences on GET (optionally filtered by ?state=) and creates one on POST.
+func (a *App) handleSilences(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		silences, err := a.listSilences(req.Context())
+		if err != nil {
+			writeGrafanaError(w, err)
+			return
+		}
+		out := make([]silence, 0, len(silences))
+		state := req.URL.Query().Get("state")
+		for _, s := range silences {
+			if state == "" || s.Status.State == state {
+				out = append(out, s)
+			}
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		if !requireEditor(w, req, "creating silences") {
+			return
+		}
+		var body silenceRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, err := body.toPostable(req.Context(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := a.createSilence(req.Context(), s)
+		if err != nil {
+			writeGrafanaError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"silenceID": id, "silence": s})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSilence expires the silence identified by the {id} path value.
+func (a *App) handleSilence(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireEditor(w, req, "expiring silences") {
+		return
+	}
+	if err := a.expireSilence(req.Context(), req.PathValue("id")); err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "silence expired"})
+}
+
+// handleSilencePreview returns the currently firing alerts a matcher set would silence.
+func (a *App) handleSilencePreview(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Matchers []silenceMatcher `json:"matchers"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateMatchers(body.Matchers); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	preview, err := a.previewSilence(req.Context(), body.Matchers)
+	if err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
+
+// handleSilenceRecommend proposes a silence for an alert group without creating it,
+// including the alerts it would catch.
+func (a *App) handleSilenceRecommend(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body silenceRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.AlertGroup == nil && len(body.Matchers) == 0 {
+		http.Error(w, "alertGroup or matchers is required", http.StatusBadRequest)
+		return
+	}
+	s, err := body.toPostable(req.Context(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	preview, err := a.previewSilence(req.Context(), s.Matchers)
+	if err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"silence": s, "preview": preview})
+}
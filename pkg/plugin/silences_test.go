@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// fakeAlertmanager is a minimal stand-in for the Grafana Alertmanager API.
+type fakeAlertmanager struct {
+	mu       sync.Mutex
+	alerts   []amAlert
+	created  []postableSilence
+	expired  []string
+	nextID   int
+	lastAuth string
+}
+
+func (f *fakeAlertmanager) server(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+alertmanagerAPIPrefix+"/alerts", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(f.alerts)
+	})
+	mux.HandleFunc("GET "+alertmanagerAPIPrefix+"/silences", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"id":"a","status":{"state":"active"}},{"id":"b","status":{"state":"expired"}}]`))
+	})
+	mux.HandleFunc("POST "+alertmanagerAPIPrefix+"/silences", func(w http.ResponseWriter, r *http.Request) {
+		var s postableSilence
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.lastAuth = r.Header.Get("Authorization")
+		f.created = append(f.created, s)
+		f.nextID++
+		_ = json.NewEncoder(w).Encode(map[string]any{"silenceID": "silence-" + string(rune('0'+f.nextID))})
+	})
+	mux.HandleFunc("DELETE "+alertmanagerAPIPrefix+"/silence/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.expired = append(f.expired, r.PathValue("id"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSilenceMatcher(t *testing.T) {
+	labels := map[string]string{"alertname": "HighLatency", "service": "checkout"}
+	for _, tc := range []struct {
+		name    string
+		matcher string
+		exp     bool
+	}{
+		{name: "equal", matcher: `{"name":"service","value":"checkout"}`, exp: true},
+		{name: "not equal", matcher: `{"name":"service","value":"checkout","isEqual":false}`, exp: false},
+		{name: "regex is anchored", matcher: `{"name":"alertname","value":"High","isRegex":true}`, exp: false},
+		{name: "regex", matcher: `{"name":"alertname","value":"High.*","isRegex":true}`, exp: true},
+		{name: "negative regex", matcher: `{"name":"alertname","value":"Low.*","isRegex":true,"isEqual":false}`, exp: true},
+		{name: "missing label is empty", matcher: `{"name":"team","value":""}`, exp: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var m silenceMatcher
+			if err := json.Unmarshal([]byte(tc.matcher), &m); err != nil {
+				t.Fatalf("unmarshal: %s", err)
+			}
+			got, err := m.matches(labels)
+			if err != nil {
+				t.Fatalf("matches: %s", err)
+			}
+			if got != tc.exp {
+				t.Errorf("%s should match %v, got %v", m, tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestValidateMatchers(t *testing.T) {
+	if err := validateMatchers(nil); err == nil {
+		t.Error("empty matcher set should be rejected")
+	}
+	if err := validateMatchers([]silenceMatcher{{Name: "a", Value: ".*", IsRegex: true, IsEqual: true}}); err == nil {
+		t.Error("matcher set matching everything should be rejected")
+	}
+	if err := validateMatchers([]silenceMatcher{{Name: "a", Value: "(", IsRegex: true, IsEqual: true}}); err == nil {
+		t.Error("invalid regex should be rejected")
+	}
+	if err := validateMatchers([]silenceMatcher{{Name: "a", Value: "b", IsEqual: true}}); err != nil {
+		t.Errorf("valid matcher set rejected: %s", err)
+	}
+}
+
+func TestMatchersFromGroup(t *testing.T) {
+	var g alertGroup
+	if err := json.Unmarshal([]byte(`{"alerts":[
+		{"labels":{"alertname":"HighLatency","service":"checkout","pod":"a","__alert_rule_uid__":"x"}},
+		{"labels":{"alertname":"HighLatency","service":"checkout","pod":"b","__alert_rule_uid__":"x"}}
+	]}`), &g); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	matchers, err := matchersFromGroup(g)
+	if err != nil {
+		t.Fatalf("matchersFromGroup: %s", err)
+	}
+	if got := formatMatchers(matchers); got != `{alertname="HighLatency", service="checkout"}` {
+		t.Errorf("unexpected matchers %s", got)
+	}
+
+	g = alertGroup{Labels: map[string]string{"alertname": "DiskFull"}}
+	if matchers, err = matchersFromGroup(g); err != nil || formatMatchers(matchers) != `{alertname="DiskFull"}` {
+		t.Errorf("group labels should be used, got %v (%v)", matchers, err)
+	}
+
+	if _, err := matchersFromGroup(alertGroup{}); err == nil {
+		t.Error("empty group should be rejected")
+	}
+}
+
+func TestSilencesResource(t *testing.T) {
+	am := &fakeAlertmanager{alerts: []amAlert{
+		{Fingerprint: "1", Labels: map[string]string{"alertname": "HighLatency", "service": "checkout"}},
+		{Fingerprint: "2", Labels: map[string]string{"alertname": "HighLatency", "service": "cart"}},
+	}}
+	app := newTestApp(t, am.server(t).URL, nil)
+
+	t.Run("list filters by state", func(t *testing.T) {
+		resp := callResource(t, app, http.MethodGet, "silences?state=active", nil)
+		var out []silence
+		if err := json.Unmarshal(resp.Body, &out); err != nil {
+			t.Fatalf("unmarshal: %s", err)
+		}
+		if resp.Status != http.StatusOK || len(out) != 1 || out[0].ID != "a" {
+			t.Errorf("unexpected response %d %s", resp.Status, resp.Body)
+		}
+	})
+
+	t.Run("preview", func(t *testing.T) {
+		resp := callResource(t, app, http.MethodPost, "silences/preview", map[string]any{
+			"matchers": []map[string]any{{"name": "service", "value": "checkout"}},
+		})
+		var out silencePreview
+		if err := json.Unmarshal(resp.Body, &out); err != nil {
+			t.Fatalf("unmarshal: %s", err)
+		}
+		if out.Total != 1 || out.Alerts[0].Fingerprint != "1" {
+			t.Errorf("unexpected preview %s", resp.Body)
+		}
+	})
+
+	t.Run("recommend does not create", func(t *testing.T) {
+		resp := callResource(t, app, http.MethodPost, "silences/recommend", map[string]any{
+			"alertGroup": map[string]any{"labels": map[string]string{"alertname": "HighLatency"}},
+		})
+		var out struct {
+			Silence postableSilence `json:"silence"`
+			Preview silencePreview  `json:"preview"`
+		}
+		if err := json.Unmarshal(resp.Body, &out); err != nil {
+			t.Fatalf("unmarshal: %s", err)
+		}
+		if out.Preview.Total != 2 || out.Silence.EndsAt.Sub(out.Silence.StartsAt) != defaultSilenceDuration {
+			t.Errorf("unexpected recommendation %s", resp.Body)
+		}
+		if len(am.created) != 0 {
+			t.Error("recommend must not create silences")
+		}
+	})
+
+	t.Run("create from alert group", func(t *testing.T) {
+		resp := callResource(t, app, http.MethodPost, "silences", map[string]any{
+			"alertGroup": map[string]any{"labels": map[string]string{"alertname": "HighLatency", "service": "cart"}},
+			"duration":   "30m",
+			"createdBy":  "someone-else",
+		})
+		if resp.Status != http.StatusOK {
+			t.Fatalf("unexpected response %d %s", resp.Status, resp.Body)
+		}
+		if len(am.created) != 1 {
+			t.Fatalf("expected one silence, got %d", len(am.created))
+		}
+		s := am.created[0]
+		if s.CreatedBy != "tester" || len(s.Matchers) != 2 || s.EndsAt.Sub(s.StartsAt) != 30*time.Minute {
+			t.Errorf("unexpected silence %+v", s)
+		}
+		if am.lastAuth != "Bearer test-token" {
+			t.Errorf("service account token not sent, got %q", am.lastAuth)
+		}
+	})
+
+	t.Run("create rejects empty matchers", func(t *testing.T) {
+		resp := callResource(t, app, http.MethodPost, "silences", map[string]any{"comment": "x"})
+		if resp.Status != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", resp.Status)
+		}
+	})
+
+	t.Run("viewers cannot change silences", func(t *testing.T) {
+		viewer := &backend.User{Login: "viewer", Role: "Viewer"}
+		resp := callResourceAs(t, app, viewer, http.MethodPost, "silences", map[string]any{"matchers": []map[string]any{{"name": "env", "value": "prod"}}})
+		if resp.Status != http.StatusForbidden {
+			t.Errorf("expected 403 creating a silence, got %d", resp.Status)
+		}
+		if resp := callResourceAs(t, app, viewer, http.MethodDelete, "silences/abc", nil); resp.Status != http.StatusForbidden {
+			t.Errorf("expected 403 expiring a silence, got %d", resp.Status)
+		}
+		if resp := callResourceAs(t, app, viewer, http.MethodPost, "silences/preview", map[string]any{"matchers": []map[string]any{{"name": "env", "value": "prod"}}}); resp.Status != http.StatusOK {
+			t.Errorf("expected viewers to preview silences, got %d %s", resp.Status, resp.Body)
+		}
+		if len(am.created) != 1 || len(am.expired) != 0 {
+			t.Errorf("unexpected changes %v %v", am.created, am.expired)
+		}
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		resp := callResource(t, app, http.MethodDelete, "silences/abc", nil)
+		if resp.Status != http.StatusOK || len(am.expired) != 1 || am.expired[0] != "abc" {
+			t.Errorf("unexpected response %d %s, expired %v", resp.Status, resp.Body, am.expired)
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSimilarIncidents = 5
+	maxSimilarIncidents     = 20
+)
+
+// volatileLabels differ between occurrences of the same problem, so they are left out of
+// label similarity.
+var volatileLabels = []string{"pod", "instance", "container_id", "pod_template_hash", "alertstate"}
+
+// similarRequest is the alert group to find similar past investigations for.
+type similarRequest struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	// LogPatterns are log lines or patterns seen with the alert, e.g. from a pattern query.
+	LogPatterns []string `json:"logPatterns"`
+	Limit       int      `json:"limit"`
+}
+
+// text describes the alert for embedding.
+func (r similarRequest) text() string {
+	var b strings.Builder
+	if name := r.Labels["alertname"]; name != "" {
+		fmt.Fprintf(&b, "Alert %s\n", name)
+	}
+	keys := make([]string, 0, len(r.Annotations))
+	for k := range r.Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s: %s\n", k, r.Annotations[k])
+	}
+	for _, p := range r.LogPatterns {
+		fmt.Fprintf(&b, "%s\n", p)
+	}
+	return b.String()
+}
+
+// similarMatch is a past investigation similar to the alert.
+type similarMatch struct {
+	InvestigationID string            `json:"investigationId"`
+	Title           string            `json:"title"`
+	URL             string            `json:"url"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	SharedLabels    []string          `json:"sharedLabels"`
+	CompletedAt     time.Time         `json:"completedAt,omitzero"`
+	// Score combines LabelScore, the Jaccard similarity of the labels, and TextScore, the
+	// embedding similarity of the annotations and log patterns.
+	Score      float64 `json:"score"`
+	LabelScore float64 `json:"labelScore"`
+	TextScore  float64 `json:"textScore"`
+	// Resolution says how the problem was resolved.
+	Resolution string `json:"resolution"`
+}
+
+// labelJaccard returns the Jaccard similarity of two label sets, comparing name=value
+// pairs and ignoring volatile labels, and the pairs they share.
+func labelJaccard(a, b map[string]string) (float64, []string) {
+	union := map[string]bool{}
+	var shared []string
+	for k, v := range a {
+		if !slices.Contains(volatileLabels, k) {
+			union[k+"="+v] = true
+			if bv, ok := b[k]; ok && bv == v {
+				shared = append(shared, k+"="+v)
+			}
+		}
+	}
+	for k, v := range b {
+		if !slices.Contains(volatileLabels, k) {
+			union[k+"="+v] = true
+		}
+	}
+	sort.Strings(shared)
+	if len(union) == 0 {
+		return 0, shared
+	}
+	return float64(len(shared)) / float64(len(union)), shared
+}
+
+// resolutionNotes summarizes how an investigation ended: the root cause and action items of
+// a postmortem citing it, or else its last conclusion and the remediations that succeeded.
+func resolutionNotes(inv investigation, pms []postmortem, actions []action) string {
+	url := pluginResourcesPath + "/investigations/" + inv.ID
+	for _, pm := range pms {
+		cites := slices.ContainsFunc(pm.Evidence, func(ev postmortemEvidence) bool {
+			return ev.URL == url || strings.HasPrefix(ev.URL, url+"#")
+		})
+		if !cites || pm.RootCause.Text == "" {
+			continue
+		}
+		notes := "Root cause (postmortem " + pm.Title + "): " + pm.RootCause.Text
+		for _, item := range pm.ActionItems {
+			notes += "\n- " + item.Text
+		}
+		return notes
+	}
+	var notes []string
+	for i := len(inv.Steps) - 1; i >= 0; i-- {
+		s := inv.Steps[i]
+		if s.Status == investigationCompleted && (s.Kind == stepNote || s.Kind == stepLLM) {
+			notes = append(notes, truncate(s.Output, 1000))
+			break
+		}
+	}
+	for _, ac := range actions {
+		if ac.SourceID == inv.ID && ac.Status == actionSucceeded {
+			notes = append(notes, fmt.Sprintf("Remediation %q succeeded.", ac.Title))
+		}
+	}
+	return strings.Join(notes, "\n")
+}
+
+// findSimilarIncidents ranks completed investigations by similarity to the alert. Without
+// embeddings, only labels are compared; warnings say so.
+func (a *App) findSimilarIncidents(ctx context.Context, r similarRequest) ([]similarMatch, []string, error) {
+	var warnings []string
+	invs, err := listJSON[investigation](ctx, a.store, investigationsCollection)
+	if err != nil {
+		return nil, nil, err
+	}
+	pms, err := listJSON[postmortem](ctx, a.store, postmortemsCollection)
+	if err != nil {
+		return nil, nil, err
+	}
+	actions, err := listJSON[action](ctx, a.store, actionsCollection)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Text similarity uses the investigations indexed by the knowledge base.
+	textScores := map[string]float64{}
+	text := r.text()
+	switch {
+	case a.embeddings == nil:
+		warnings = append(warnings, "embeddings are not configured: only labels were compared")
+	case strings.TrimSpace(text) == "":
+	default:
+		results, err := a.searchKnowledge(ctx, text, maxKnowledgeResults, []string{knowledgeInvestigation})
+		if err != nil {
+			a.logger(ctx).Warn("Similar incidents text search failed", "err", err)
+			warnings = append(warnings, "text similarity: "+err.Error())
+		}
+		for _, res := range results {
+			textScores[res.SourceID] = res.Score
+		}
+	}
+	weight := 1.0
+	if a.embeddings != nil && strings.TrimSpace(text) != "" {
+		weight = 0.5
+	}
+
+	matches := []similarMatch{}
+	for _, inv := range invs {
+		if inv.Status != investigationCompleted {
+			continue
+		}
+		labelScore, shared := labelJaccard(r.Labels, inv.Labels)
+		textScore := max(0, textScores[inv.ID])
+		score := weight*labelScore + (1-weight)*textScore
+		if score <= 0 {
+			continue
+		}
+		matches = append(matches, similarMatch{
+			InvestigationID: inv.ID, Title: inv.Title, URL: pluginResourcesPath + "/investigations/" + inv.ID,
+			Labels: inv.Labels, SharedLabels: append([]string{}, shared...), CompletedAt: inv.CompletedAt,
+			Score: score, LabelScore: labelScore, TextScore: textScore,
+			Resolution: resolutionNotes(inv, pms, actions),
+		})
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].CompletedAt.After(matches[j].CompletedAt)
+	})
+	limit := r.Limit
+	if limit <= 0 {
+		limit = defaultSimilarIncidents
+	}
+	return matches[:min(limit, maxSimilarIncidents, len(matches))], warnings, nil
+}
+
+// handleSimilarIncidents answers "have we seen this before?" for an alert group.
+func (a *App) handleSimilarIncidents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var r similarRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(r.Labels) == 0 {
+		http.Error(w, "labels are required", http.StatusBadRequest)
+		return
+	}
+	matches, warnings, err := a.findSimilarIncidents(req.Context(), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"matches": matches, "warnings": warnings})
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLabelJaccard(t *testing.T) {
+	score, shared := labelJaccard(
+		map[string]string{"alertname": "HighLatency", "service": "orders", "pod": "orders-1"},
+		map[string]string{"alertname": "HighLatency", "service": "search", "pod": "orders-1"},
+	)
+	// The pod is volatile; of alertname and the two services only alertname is shared.
+	if score != 1.0/3 || strings.Join(shared, ",") != "alertname=HighLatency" {
+		t.Errorf("unexpected similarity %g %v", score, shared)
+	}
+	if score, _ := labelJaccard(nil, map[string]string{"pod": "x"}); score != 0 {
+		t.Errorf("expected 0 without comparable labels, got %g", score)
+	}
+}
+
+// saveSimilarHistory stores completed investigations of past incidents, one of them
+// covered by a postmortem and one fixed by a remediation action.
+func saveSimilarHistory(t *testing.T, app *App) {
+	t.Helper()
+	ctx := context.Background()
+	done := time.Date(2025, 2, 1, 12, 0, 0, 0, time.UTC)
+	for _, inv := range []investigation{
+		{ID: "inv-orders", Title: "orders latency", Goal: "Find why orders are slow", Status: investigationCompleted, CompletedAt: done,
+			Labels: map[string]string{"alertname": "HighLatency", "service": "orders", "pod": "orders-7"},
+			Steps:  []investigationStep{{Kind: stepNote, Status: investigationCompleted, Output: "Slow queries exhausted the connection pool; timeouts acquiring connections."}}},
+		{ID: "inv-search", Title: "search latency", Goal: "Find why search is slow", Status: investigationCompleted, CompletedAt: done,
+			Labels: map[string]string{"alertname": "HighLatency", "service": "search"},
+			Steps: []investigationStep{
+				{Kind: stepLLM, Status: investigationCompleted, Output: "Elasticsearch garbage collection pauses."},
+				{Kind: stepQuery, Status: investigationCompleted, Output: "[]"},
+			}},
+		{ID: "inv-open", Title: "orders latency again", Status: investigationRunning,
+			Labels: map[string]string{"alertname": "HighLatency", "service": "orders"}},
+	} {
+		if err := saveJSON(ctx, app.store, investigationsCollection, inv.ID, inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pm := postmortem{
+		ID: "pm-1", Title: "Orders outage", RootCause: postmortemClaim{Text: "A missing index made order queries slow."},
+		ActionItems: []postmortemClaim{{Text: "Add the index."}},
+		Evidence:    []postmortemEvidence{{ID: "E1", URL: pluginResourcesPath + "/investigations/inv-orders#step-s1"}},
+	}
+	if err := saveJSON(ctx, app.store, postmortemsCollection, pm.ID, pm); err != nil {
+		t.Fatal(err)
+	}
+	ac := action{ID: "act-1", Title: "Restart search", Status: actionSucceeded, SourceID: "inv-search"}
+	if err := saveJSON(ctx, app.store, actionsCollection, ac.ID, ac); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimilarIncidents(t *testing.T) {
+	app, _ := newKnowledgeApp(t)
+	saveSimilarHistory(t, app)
+	if _, err := app.reindexKnowledge(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := callResource(t, app, http.MethodPost, "incidents/similar", map[string]any{
+		"labels":      map[string]string{"alertname": "HighLatency", "service": "checkout", "pod": "checkout-1"},
+		"annotations": map[string]string{"summary": "p99 latency is high, the connection pool is exhausted"},
+		"logPatterns": []string{"timeout acquiring connection from pool"},
+	})
+	if resp.Status != http.StatusOK {
+		t.Fatalf("similar: %d %s", resp.Status, resp.Body)
+	}
+	var body struct {
+		Matches  []similarMatch `json:"matches"`
+		Warnings []string       `json:"warnings"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	// Both match on alertname alone, but the orders investigation saw the same symptoms.
+	if len(body.Matches) != 2 || body.Matches[0].InvestigationID != "inv-orders" || len(body.Warnings) != 0 {
+		t.Fatalf("unexpected matches %+v, warnings %v", body.Matches, body.Warnings)
+	}
+	m := body.Matches[0]
+	if m.LabelScore != 1.0/3 || m.TextScore <= body.Matches[1].TextScore || m.Score != 0.5*m.LabelScore+0.5*m.TextScore {
+		t.Errorf("unexpected scores %+v", m)
+	}
+	if m.Resolution != "Root cause (postmortem Orders outage): A missing index made order queries slow.\n- Add the index." {
+		t.Errorf("unexpected resolution %q", m.Resolution)
+	}
+	if r := body.Matches[1].Resolution; r != "Elasticsearch garbage collection pauses.\nRemediation \"Restart search\" succeeded." {
+		t.Errorf("unexpected resolution %q", r)
+	}
+}
+
+func TestSimilarIncidentsWithoutEmbeddings(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	saveSimilarHistory(t, app)
+	resp := callResource(t, app, http.MethodPost, "incidents/similar", map[string]any{
+		"labels": map[string]string{"alertname": "HighLatency", "service": "orders", "pod": "orders-1"},
+		"limit":  1,
+	})
+	var body struct {
+		Matches  []similarMatch `json:"matches"`
+		Warnings []string       `json:"warnings"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Matches) != 1 || body.Matches[0].InvestigationID != "inv-orders" || body.Matches[0].Score != 1 || len(body.Warnings) != 1 {
+		t.Errorf("unexpected result %s", resp.Body)
+	}
+	if resp := callResource(t, app, http.MethodPost, "incidents/similar", map[string]any{}); resp.Status != http.StatusBadRequest {
+		t.Errorf("expected 400 without labels, got %d", resp.Status)
+	}
+}
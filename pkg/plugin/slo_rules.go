@@ -0,0 +1,331 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	provisioningRulesPath = "/api/v1/provisioning/alert-rules"
+	// sloRuleLabel tags every generated rule with the ID of its SLO, and sloRuleAlertLabel
+	// with the burn rate alert it implements, so rules can be regenerated without duplicates.
+	sloRuleLabel      = "sre_assistant_slo"
+	sloRuleAlertLabel = "sre_assistant_slo_alert"
+)
+
+// burnRateAlert is one alert of the multiwindow, multi-burn-rate pattern: it fires when
+// the burn rate over both the long and the short window would spend BudgetConsumed of
+// the error budget within the long window.
+type burnRateAlert struct {
+	Name           string
+	Long, Short    time.Duration
+	BudgetConsumed float64
+	Severity       string
+	For            string
+}
+
+// burnRateAlerts are the alerts recommended by the Google SRE workbook. For a 30d SLO
+// window their burn rate thresholds are 14.4, 6, 3 and 1.
+var burnRateAlerts = []burnRateAlert{
+	{Name: "page-1h", Long: time.Hour, Short: 5 * time.Minute, BudgetConsumed: 0.02, Severity: "critical", For: "2m"},
+	{Name: "page-6h", Long: 6 * time.Hour, Short: 30 * time.Minute, BudgetConsumed: 0.05, Severity: "critical", For: "2m"},
+	{Name: "ticket-1d", Long: 24 * time.Hour, Short: 2 * time.Hour, BudgetConsumed: 0.10, Severity: "warning", For: "15m"},
+	{Name: "ticket-3d", Long: 72 * time.Hour, Short: 6 * time.Hour, BudgetConsumed: 0.10, Severity: "warning", For: "15m"},
+}
+
+// threshold returns the burn rate at which the alert fires for an SLO window.
+func (b burnRateAlert) threshold(sloWindow time.Duration) float64 {
+	return b.BudgetConsumed * float64(sloWindow) / float64(b.Long)
+}
+
+// alertRuleQuery is a query or expression of a Grafana alert rule.
+type alertRuleQuery struct {
+	RefID             string `json:"refId"`
+	QueryType         string `json:"queryType"`
+	RelativeTimeRange struct {
+		From int64 `json:"from"`
+		To   int64 `json:"to"`
+	} `json:"relativeTimeRange"`
+	DatasourceUID string         `json:"datasourceUid"`
+	Model         map[string]any `json:"model"`
+}
+
+// provisionedAlertRule is an alert rule as returned and accepted by the provisioning API.
+type provisionedAlertRule struct {
+	UID          string            `json:"uid,omitempty"`
+	OrgID        int64             `json:"orgID"`
+	FolderUID    string            `json:"folderUID"`
+	RuleGroup    string            `json:"ruleGroup"`
+	Title        string            `json:"title"`
+	Condition    string            `json:"condition"`
+	Data         []alertRuleQuery  `json:"data"`
+	NoDataState  string            `json:"noDataState"`
+	ExecErrState string            `json:"execErrState"`
+	For          string            `json:"for"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	IsPaused     bool              `json:"isPaused"`
+}
+
+// expr returns the PromQL expression of the rule's first query.
+func (r provisionedAlertRule) expr() string {
+	if len(r.Data) == 0 {
+		return ""
+	}
+	s, _ := r.Data[0].Model["expr"].(string)
+	return s
+}
+
+// sloRuleUID derives a stable rule UID from the SLO and the burn rate alert.
+func sloRuleUID(sloID, alert string) string {
+	sum := sha256.Sum256([]byte(sloID + "/" + alert))
+	return "slo-" + hex.EncodeToString(sum[:])[:32]
+}
+
+// burnRateExpr returns a PromQL expression that is the long window burn rate when both
+// windows burn faster than threshold, and empty otherwise.
+func burnRateExpr(s slo, alert burnRateAlert, threshold float64) string {
+	budget := strconv.FormatFloat(s.errorBudget(), 'g', 10, 64)
+	thr := strconv.FormatFloat(threshold, 'g', 4, 64)
+	burnRate := func(w time.Duration) string {
+		return fmt.Sprintf("(1 - (%s)) / %s", s.sliQuery(w), budget)
+	}
+	return fmt.Sprintf("%s > %s and %s > %s", burnRate(alert.Long), thr, burnRate(alert.Short), thr)
+}
+
+// sloAlertRules builds the burn rate alert rules of an SLO.
+func sloAlertRules(s slo, folderUID, ruleGroup string) []provisionedAlertRule {
+	window := s.window()
+	rules := make([]provisionedAlertRule, 0, len(burnRateAlerts))
+	for _, alert := range burnRateAlerts {
+		threshold := alert.threshold(window)
+		labels := map[string]string{}
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		labels["severity"] = alert.Severity
+		labels["slo"] = s.Name
+		labels[sloRuleLabel] = s.ID
+		labels[sloRuleAlertLabel] = alert.Name
+
+		annotations := map[string]string{
+			"summary": fmt.Sprintf("%s is burning its error budget %.3gx faster than sustainable", s.Name, threshold),
+			"description": fmt.Sprintf("The error rate over the last %s and %s is more than %.3g times the error budget of %s "+
+				"(target %g%% over %s). At this rate %g%% of the error budget is spent within %s.",
+				formatDuration(alert.Long), formatDuration(alert.Short), threshold, s.Name,
+				s.Target*100, s.Window, alert.BudgetConsumed*100, formatDuration(alert.Long)),
+		}
+		if s.RunbookURL != "" {
+			annotations["runbook_url"] = s.RunbookURL
+		}
+
+		query := alertRuleQuery{RefID: "A", DatasourceUID: s.DatasourceUID, Model: map[string]any{
+			"refId":   "A",
+			"expr":    burnRateExpr(s, alert, threshold),
+			"instant": true,
+			"range":   false,
+		}}
+		query.RelativeTimeRange.From = int64(alert.Long / time.Second)
+		condition := alertRuleQuery{RefID: "C", DatasourceUID: "__expr__", Model: map[string]any{
+			"refId":      "C",
+			"type":       "threshold",
+			"expression": "A",
+			"conditions": []map[string]any{{"evaluator": map[string]any{"type": "gt", "params": []float64{0}}}},
+		}}
+		rules = append(rules, provisionedAlertRule{
+			UID:          sloRuleUID(s.ID, alert.Name),
+			FolderUID:    folderUID,
+			RuleGroup:    ruleGroup,
+			Title:        fmt.Sprintf("%s error budget burn (%s)", s.Name, alert.Name),
+			Condition:    "C",
+			Data:         []alertRuleQuery{query, condition},
+			NoDataState:  "OK",
+			ExecErrState: "Error",
+			For:          alert.For,
+			Annotations:  annotations,
+			Labels:       labels,
+		})
+	}
+	return rules
+}
+
+// Actions of a ruleChange.
+const (
+	ruleCreate    = "create"
+	ruleUpdate    = "update"
+	ruleDelete    = "delete"
+	ruleUnchanged = "unchanged"
+)
+
+// ruleFieldChange is a difference between an existing and a generated rule.
+type ruleFieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// ruleChange is what regenerating the rules of an SLO does to one rule.
+type ruleChange struct {
+	Action  string            `json:"action"`
+	UID     string            `json:"uid"`
+	Title   string            `json:"title"`
+	Changes []ruleFieldChange `json:"changes,omitempty"`
+	Error   string            `json:"error,omitempty"`
+
+	rule provisionedAlertRule
+}
+
+func formatLabelSet(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// diffRule lists the fields of existing that differ from the generated rule.
+func diffRule(existing, generated provisionedAlertRule) []ruleFieldChange {
+	var changes []ruleFieldChange
+	for _, f := range []struct{ field, old, new string }{
+		{"title", existing.Title, generated.Title},
+		{"folderUID", existing.FolderUID, generated.FolderUID},
+		{"ruleGroup", existing.RuleGroup, generated.RuleGroup},
+		{"expr", existing.expr(), generated.expr()},
+		{"for", existing.For, generated.For},
+		{"noDataState", existing.NoDataState, generated.NoDataState},
+		{"labels", formatLabelSet(existing.Labels), formatLabelSet(generated.Labels)},
+		{"annotations", formatLabelSet(existing.Annotations), formatLabelSet(generated.Annotations)},
+	} {
+		if f.old != f.new {
+			changes = append(changes, ruleFieldChange{Field: f.field, Old: f.old, New: f.new})
+		}
+	}
+	return changes
+}
+
+// planSLOAlertRules compares the generated rules of an SLO with the rules previously
+// generated for it, which are found by their sloRuleLabel wherever they live.
+func (a *App) planSLOAlertRules(ctx context.Context, s slo, folderUID, ruleGroup string) ([]ruleChange, error) {
+	var all []provisionedAlertRule
+	if err := a.grafana.do(ctx, http.MethodGet, provisioningRulesPath, nil, &all); err != nil {
+		return nil, err
+	}
+	existing := map[string]provisionedAlertRule{}
+	for _, r := range all {
+		if r.Labels[sloRuleLabel] == s.ID {
+			existing[r.Labels[sloRuleAlertLabel]] = r
+		}
+	}
+
+	var plan []ruleChange
+	for i, rule := range sloAlertRules(s, folderUID, ruleGroup) {
+		name := burnRateAlerts[i].Name
+		old, ok := existing[name]
+		delete(existing, name)
+		if !ok {
+			plan = append(plan, ruleChange{Action: ruleCreate, UID: rule.UID, Title: rule.Title, rule: rule})
+			continue
+		}
+		rule.UID = old.UID
+		change := ruleChange{Action: ruleUnchanged, UID: rule.UID, Title: rule.Title, rule: rule}
+		if change.Changes = diffRule(old, rule); len(change.Changes) > 0 {
+			change.Action = ruleUpdate
+		}
+		plan = append(plan, change)
+	}
+	// Rules for alerts that are no longer generated are removed.
+	stale := make([]provisionedAlertRule, 0, len(existing))
+	for _, old := range existing {
+		stale = append(stale, old)
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].UID < stale[j].UID })
+	for _, old := range stale {
+		plan = append(plan, ruleChange{Action: ruleDelete, UID: old.UID, Title: old.Title, rule: old})
+	}
+	return plan, nil
+}
+
+// applySLOAlertRules carries out a plan through the provisioning API. Rules are created
+// without provenance so they stay editable in the Grafana UI. Errors are recorded on
+// the change they occurred on, and the number of failed changes is returned.
+func (a *App) applySLOAlertRules(ctx context.Context, plan []ruleChange) int {
+	header := http.Header{}
+	header.Set("X-Disable-Provenance", "true")
+	failed := 0
+	for i := range plan {
+		c := &plan[i]
+		var err error
+		switch c.Action {
+		case ruleCreate:
+			err = a.grafana.doWithHeader(ctx, http.MethodPost, provisioningRulesPath, header, c.rule, nil)
+		case ruleUpdate:
+			err = a.grafana.doWithHeader(ctx, http.MethodPut, provisioningRulesPath+"/"+c.UID, header, c.rule, nil)
+		case ruleDelete:
+			err = a.grafana.doWithHeader(ctx, http.MethodDelete, provisioningRulesPath+"/"+c.UID, header, nil, nil)
+		}
+		if err != nil {
+			c.Error = err.Error()
+			failed++
+		}
+	}
+	return failed
+}
+
+// sloRulesRequest is the body of POST /slos/{id}/rules and /slos/{id}/rules/preview.
+type sloRulesRequest struct {
+	FolderUID string `json:"folderUid"`
+	// RuleGroup defaults to the SLO name.
+	RuleGroup string `json:"ruleGroup"`
+}
+
+// handleSLORules generates the burn rate alert rules of the SLO identified by {id}. The
+// preview route only returns the changes; the other route also applies them, which
+// requires the Editor role.
+func (a *App) handleSLORules(apply bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if apply && !requireEditor(w, req, "applying SLO alert rules") {
+			return
+		}
+		var body sloRulesRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.FolderUID == "" {
+			http.Error(w, "folderUid is required", http.StatusBadRequest)
+			return
+		}
+		s, ok := a.loadSLO(w, req, req.PathValue("id"))
+		if !ok {
+			return
+		}
+		if body.RuleGroup == "" {
+			body.RuleGroup = s.Name
+		}
+
+		ctx := req.Context()
+		plan, err := a.planSLOAlertRules(ctx, s, body.FolderUID, body.RuleGroup)
+		if err != nil {
+			writeGrafanaError(w, err)
+			return
+		}
+		status := http.StatusOK
+		if apply && a.applySLOAlertRules(ctx, plan) > 0 {
+			status = http.StatusBadGateway
+		}
+		writeJSON(w, status, map[string]any{"changes": plan, "applied": apply})
+	}
+}
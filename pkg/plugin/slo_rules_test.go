@@ -0,0 +1,165 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRuleProvisioning is a minimal stand-in for the Grafana alert rule provisioning API.
+type fakeRuleProvisioning struct {
+	mu         sync.Mutex
+	rules      map[string]provisionedAlertRule
+	provenance []string
+}
+
+func (f *fakeRuleProvisioning) server(t *testing.T) *httptest.Server {
+	f.rules = map[string]provisionedAlertRule{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+provisioningRulesPath, func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		out := []provisionedAlertRule{}
+		for _, rule := range f.rules {
+			out = append(out, rule)
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	})
+	save := func(w http.ResponseWriter, r *http.Request) {
+		var rule provisionedAlertRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if uid := r.PathValue("uid"); uid != "" {
+			rule.UID = uid
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.provenance = append(f.provenance, r.Header.Get("X-Disable-Provenance"))
+		f.rules[rule.UID] = rule
+		_ = json.NewEncoder(w).Encode(rule)
+	}
+	mux.HandleFunc("POST "+provisioningRulesPath, save)
+	mux.HandleFunc("PUT "+provisioningRulesPath+"/{uid}", save)
+	mux.HandleFunc("DELETE "+provisioningRulesPath+"/{uid}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.rules, r.PathValue("uid"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSLOAlertRules(t *testing.T) {
+	s := slo{
+		ID:            "slo-1",
+		Name:          "checkout availability",
+		DatasourceUID: "prom",
+		GoodQuery:     `sum(rate(http_requests_total{code!~"5.."}[$window]))`,
+		TotalQuery:    `sum(rate(http_requests_total[$window]))`,
+		Target:        0.999,
+		Window:        "30d",
+		Labels:        map[string]string{"team": "payments"},
+		RunbookURL:    "https://runbooks.example.com/checkout",
+	}
+	rules := sloAlertRules(s, "folder", "group")
+	if len(rules) != len(burnRateAlerts) {
+		t.Fatalf("expected %d rules, got %d", len(burnRateAlerts), len(rules))
+	}
+	fast := rules[0]
+	exp := `(1 - ((sum(rate(http_requests_total{code!~"5.."}[1h]))) / (sum(rate(http_requests_total[1h]))))) / 0.001 > 14.4 and ` +
+		`(1 - ((sum(rate(http_requests_total{code!~"5.."}[5m]))) / (sum(rate(http_requests_total[5m]))))) / 0.001 > 14.4`
+	if fast.expr() != exp {
+		t.Errorf("unexpected expression:\n%s\nexpected:\n%s", fast.expr(), exp)
+	}
+	if fast.Labels["severity"] != "critical" || fast.Labels["team"] != "payments" || fast.Labels[sloRuleLabel] != "slo-1" {
+		t.Errorf("unexpected labels %v", fast.Labels)
+	}
+	if fast.Annotations["runbook_url"] != s.RunbookURL || len(fast.UID) > 40 {
+		t.Errorf("unexpected rule %+v", fast)
+	}
+	var thresholds []float64
+	for _, a := range burnRateAlerts {
+		thresholds = append(thresholds, a.threshold(30*24*time.Hour))
+	}
+	if thresholds[0] != 14.4 || thresholds[1] != 6 || thresholds[2] != 3 || thresholds[3] != 1 {
+		t.Errorf("unexpected thresholds %v", thresholds)
+	}
+}
+
+func TestSLORulesResources(t *testing.T) {
+	fake := &fakeRuleProvisioning{}
+	srv := fake.server(t)
+	app := newTestApp(t, srv.URL, nil)
+
+	resp := callResource(t, app, http.MethodPost, "slos", validSLO())
+	var s slo
+	if err := json.Unmarshal(resp.Body, &s); err != nil {
+		t.Fatalf("create slo: %d %s", resp.Status, resp.Body)
+	}
+	actions := func(body []byte) string {
+		var out struct {
+			Changes []ruleChange `json:"changes"`
+		}
+		if err := json.Unmarshal(body, &out); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range out.Changes {
+			got = append(got, c.Action)
+		}
+		return strings.Join(got, ",")
+	}
+	rulesBody := map[string]any{"folderUid": "slo-folder"}
+
+	resp = callResource(t, app, http.MethodPost, "slos/"+s.ID+"/rules/preview", rulesBody)
+	if resp.Status != http.StatusOK || actions(resp.Body) != "create,create,create,create" || len(fake.rules) != 0 {
+		t.Fatalf("preview: %d %s", resp.Status, resp.Body)
+	}
+	// Viewers may preview the rules but not apply them.
+	if resp := callResourceAs(t, app, viewer, http.MethodPost, "slos/"+s.ID+"/rules/preview", rulesBody); resp.Status != http.StatusOK {
+		t.Errorf("expected viewers to be able to preview, got %d", resp.Status)
+	}
+	if resp := callResourceAs(t, app, viewer, http.MethodPost, "slos/"+s.ID+"/rules", rulesBody); resp.Status != http.StatusForbidden || len(fake.rules) != 0 {
+		t.Fatalf("expected viewers to be unable to apply rules, got %d with %d rules", resp.Status, len(fake.rules))
+	}
+	resp = callResource(t, app, http.MethodPost, "slos/"+s.ID+"/rules", rulesBody)
+	if resp.Status != http.StatusOK || len(fake.rules) != 4 || fake.provenance[0] != "true" {
+		t.Fatalf("apply: %d %s", resp.Status, resp.Body)
+	}
+
+	// Regenerating without changes is a no-op.
+	resp = callResource(t, app, http.MethodPost, "slos/"+s.ID+"/rules", rulesBody)
+	if got := actions(resp.Body); got != "unchanged,unchanged,unchanged,unchanged" || len(fake.rules) != 4 {
+		t.Fatalf("regenerate: %s %s", got, resp.Body)
+	}
+
+	// Changing the target updates the rules in place, and stale rules are removed.
+	update := validSLO()
+	update["target"] = 0.99
+	callResource(t, app, http.MethodPut, "slos/"+s.ID, update)
+	stale := provisionedAlertRule{UID: "old", Title: "old", Labels: map[string]string{sloRuleLabel: s.ID, sloRuleAlertLabel: "page-5m"}}
+	fake.rules[stale.UID] = stale
+	resp = callResource(t, app, http.MethodPost, "slos/"+s.ID+"/rules/preview", rulesBody)
+	if got := actions(resp.Body); got != "update,update,update,update,delete" {
+		t.Fatalf("preview after update: %s", got)
+	}
+	if !strings.Contains(string(resp.Body), `"field":"expr"`) {
+		t.Errorf("diff should include the changed expression: %s", resp.Body)
+	}
+	callResource(t, app, http.MethodPost, "slos/"+s.ID+"/rules", rulesBody)
+	if _, ok := fake.rules["old"]; ok || len(fake.rules) != 4 {
+		t.Errorf("unexpected rules after update: %d", len(fake.rules))
+	}
+
+	if resp := callResource(t, app, http.MethodPost, "slos/"+s.ID+"/rules", map[string]any{}); resp.Status != http.StatusBadRequest {
+		t.Errorf("missing folder should be rejected, got %d", resp.Status)
+	}
+}
@@ -0,0 +1,367 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+const (
+	slosCollection = "slos"
+	// sloWindowPlaceholder is replaced by the evaluation window in the good and total queries.
+	sloWindowPlaceholder = "$window"
+	defaultSLOWindow     = "30d"
+)
+
+// sloBurnRateWindows are the windows the SLI and burn rate are reported for.
+var sloBurnRateWindows = []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour, 30 * 24 * time.Hour}
+
+// SLO kinds.
+const (
+	sloKindAvailability = "availability"
+	sloKindLatency      = "latency"
+)
+
+// slo is a service level objective defined as the ratio of good to total events.
+type slo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Kind is "availability" or "latency". It does not change how the SLI is computed.
+	Kind          string `json:"kind"`
+	DatasourceUID string `json:"datasourceUid"`
+	// GoodQuery and TotalQuery are PromQL expressions counting good and total events over
+	// $window, e.g. sum(rate(http_requests_total{code!~"5.."}[$window])).
+	GoodQuery  string `json:"goodQuery"`
+	TotalQuery string `json:"totalQuery"`
+	// Target is the objective as a ratio, e.g. 0.999.
+	Target float64 `json:"target"`
+	// Window is the compliance window the error budget is computed over. Defaults to 30d.
+	Window string `json:"window"`
+	// Labels identify the service and owner, e.g. {"service": "checkout", "team": "payments"}.
+	Labels map[string]string `json:"labels,omitempty"`
+	// RunbookURL is added to the generated alert rules.
+	RunbookURL string    `json:"runbookUrl,omitempty"`
+	CreatedBy  string    `json:"createdBy,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// validate checks the SLO definition and fills in defaults.
+func (s *slo) validate() error {
+	if strings.TrimSpace(s.Name) == "" {
+		return errors.New("name is required")
+	}
+	if s.DatasourceUID == "" {
+		return errors.New("datasourceUid is required")
+	}
+	switch s.Kind {
+	case "":
+		s.Kind = sloKindAvailability
+	case sloKindAvailability, sloKindLatency:
+	default:
+		return fmt.Errorf("kind must be %q or %q", sloKindAvailability, sloKindLatency)
+	}
+	if !(s.Target > 0 && s.Target < 1) {
+		return errors.New("target must be a ratio between 0 and 1, e.g. 0.999")
+	}
+	if s.Window == "" {
+		s.Window = defaultSLOWindow
+	}
+	if d, err := model.ParseDuration(s.Window); err != nil || d <= 0 {
+		return fmt.Errorf("invalid window %q", s.Window)
+	}
+	for name, q := range map[string]string{"goodQuery": s.GoodQuery, "totalQuery": s.TotalQuery} {
+		if !strings.Contains(q, sloWindowPlaceholder) {
+			return fmt.Errorf("%s must use %s as its range, e.g. rate(metric[%s])", name, sloWindowPlaceholder, sloWindowPlaceholder)
+		}
+		if _, err := parser.ParseExpr(sloQuery(q, 5*time.Minute)); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *slo) window() time.Duration {
+	d, _ := model.ParseDuration(s.Window)
+	return time.Duration(d)
+}
+
+// errorBudget is the fraction of events allowed to be bad.
+func (s *slo) errorBudget() float64 { return 1 - s.Target }
+
+// sliQuery returns the PromQL expression for the SLI over a window.
+func (s *slo) sliQuery(window time.Duration) string {
+	return fmt.Sprintf("(%s) / (%s)", sloQuery(s.GoodQuery, window), sloQuery(s.TotalQuery, window))
+}
+
+func sloQuery(q string, window time.Duration) string {
+	return strings.ReplaceAll(q, sloWindowPlaceholder, formatDuration(window))
+}
+
+// sloWindowStatus is the SLI and burn rate over one window. Values are nil when there
+// were no events in the window.
+type sloWindowStatus struct {
+	Window    string   `json:"window"`
+	SLI       *float64 `json:"sli"`
+	ErrorRate *float64 `json:"errorRate"`
+	// BurnRate is how fast the error budget is spent; 1 spends it exactly over the SLO window.
+	BurnRate *float64 `json:"burnRate"`
+}
+
+// sloStatus is the computed state of an SLO.
+type sloStatus struct {
+	SLO string `json:"slo"`
+	// SLI is the SLI over the SLO window.
+	SLI *float64 `json:"sli"`
+	// ErrorBudgetRemaining is the fraction of the error budget left over the SLO window.
+	// It is negative once the budget is exhausted.
+	ErrorBudgetRemaining *float64          `json:"errorBudgetRemaining"`
+	Windows              []sloWindowStatus `json:"windows"`
+	EvaluatedAt          time.Time         `json:"evaluatedAt"`
+}
+
+// computeSLOStatus evaluates the SLI of an SLO over its window and the standard burn rate windows.
+func (a *App) computeSLOStatus(ctx context.Context, s slo, now time.Time) (sloStatus, error) {
+	catalog := newPromCatalog(a.mcp, s.DatasourceUID)
+	sli := func(window time.Duration) (*float64, error) {
+		samples, err := catalog.queryInstant(ctx, s.sliQuery(window))
+		if err != nil || len(samples) == 0 {
+			return nil, err
+		}
+		v := samples[0].Value
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, nil
+		}
+		return &v, nil
+	}
+
+	status := sloStatus{SLO: s.ID, EvaluatedAt: now}
+	sliByWindow := map[time.Duration]*float64{}
+	for _, w := range append([]time.Duration{s.window()}, sloBurnRateWindows...) {
+		if _, ok := sliByWindow[w]; ok {
+			continue
+		}
+		v, err := sli(w)
+		if err != nil {
+			return status, err
+		}
+		sliByWindow[w] = v
+	}
+	for _, w := range sloBurnRateWindows {
+		ws := sloWindowStatus{Window: formatDuration(w), SLI: sliByWindow[w]}
+		if ws.SLI != nil {
+			errorRate := 1 - *ws.SLI
+			burnRate := errorRate / s.errorBudget()
+			ws.ErrorRate, ws.BurnRate = &errorRate, &burnRate
+		}
+		status.Windows = append(status.Windows, ws)
+	}
+	if status.SLI = sliByWindow[s.window()]; status.SLI != nil {
+		remaining := 1 - (1-*status.SLI)/s.errorBudget()
+		status.ErrorBudgetRemaining = &remaining
+	}
+	return status, nil
+}
+
+// sloStatusFrame returns the per-window SLI and burn rates of an SLO.
+func sloStatusFrame(s slo, status sloStatus) *data.Frame {
+	windows := make([]string, len(status.Windows))
+	slis := make([]*float64, len(status.Windows))
+	errorRates := make([]*float64, len(status.Windows))
+	burnRates := make([]*float64, len(status.Windows))
+	for i, ws := range status.Windows {
+		windows[i], slis[i], errorRates[i], burnRates[i] = ws.Window, ws.SLI, ws.ErrorRate, ws.BurnRate
+	}
+	return data.NewFrame(s.Name,
+		data.NewField("window", nil, windows),
+		data.NewField("sli", nil, slis).SetConfig(&data.FieldConfig{Unit: "percentunit"}),
+		data.NewField("error_rate", nil, errorRates).SetConfig(&data.FieldConfig{Unit: "percentunit"}),
+		data.NewField("burn_rate", nil, burnRates),
+	)
+}
+
+// sloOverviewFrame returns one row per SLO with its current SLI, error budget and burn rates.
+func sloOverviewFrame(slos []slo, statuses []sloStatus) *data.Frame {
+	frame := data.NewFrame("slos",
+		data.NewField("id", nil, []string{}),
+		data.NewField("name", nil, []string{}),
+		data.NewField("target", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "percentunit"}),
+		data.NewField("sli", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percentunit"}),
+		data.NewField("error_budget_remaining", nil, []*float64{}).SetConfig(&data.FieldConfig{Unit: "percentunit"}),
+	)
+	for _, w := range sloBurnRateWindows {
+		frame.Fields = append(frame.Fields, data.NewField("burn_rate_"+formatDuration(w), nil, []*float64{}))
+	}
+	for i, s := range slos {
+		row := []any{s.ID, s.Name, s.Target, statuses[i].SLI, statuses[i].ErrorBudgetRemaining}
+		for j := range sloBurnRateWindows {
+			var burnRate *float64
+			if j < len(statuses[i].Windows) {
+				burnRate = statuses[i].Windows[j].BurnRate
+			}
+			row = append(row, burnRate)
+		}
+		frame.AppendRow(row...)
+	}
+	return frame
+}
+
+// handleSLOs lists SLOs on GET and creates one on POST.
+func (a *App) handleSLOs(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	switch req.Method {
+	case http.MethodGet:
+		slos, err := listJSON[slo](ctx, a.store, slosCollection)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, slos)
+	case http.MethodPost:
+		if !requireEditor(w, req, "creating SLOs") {
+			return
+		}
+		var s slo
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ID = uuid.NewString()
+		s.CreatedAt = time.Now().UTC()
+		s.UpdatedAt = s.CreatedAt
+		if u := backend.UserFromContext(ctx); u != nil {
+			s.CreatedBy = u.Login
+		}
+		if err := saveJSON(ctx, a.store, slosCollection, s.ID, s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSLO gets, replaces or deletes the SLO identified by {id}.
+func (a *App) handleSLO(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := req.PathValue("id")
+	if (req.Method == http.MethodPut || req.Method == http.MethodDelete) && !requireEditor(w, req, "changing SLOs") {
+		return
+	}
+	existing, ok := a.loadSLO(w, req, id)
+	if !ok {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, existing)
+	case http.MethodPut:
+		var s slo
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ID, s.CreatedBy, s.CreatedAt = existing.ID, existing.CreatedBy, existing.CreatedAt
+		s.UpdatedAt = time.Now().UTC()
+		if err := saveJSON(ctx, a.store, slosCollection, s.ID, s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case http.MethodDelete:
+		if err := a.store.Delete(ctx, slosCollection, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "SLO deleted"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadSLO loads the SLO with the given ID, writing an error response if it cannot.
+func (a *App) loadSLO(w http.ResponseWriter, req *http.Request, id string) (slo, bool) {
+	s, err := loadJSON[slo](req.Context(), a.store, slosCollection, id)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "SLO not found", http.StatusNotFound)
+		return s, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return s, false
+	}
+	return s, true
+}
+
+// handleSLOStatus computes the SLI, error budget and burn rates of the SLO identified by {id}.
+func (a *App) handleSLOStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s, ok := a.loadSLO(w, req, req.PathValue("id"))
+	if !ok {
+		return
+	}
+	status, err := a.computeSLOStatus(req.Context(), s, time.Now())
+	if err != nil {
+		writeGrafanaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": status,
+		"frames": data.Frames{sloStatusFrame(s, status)},
+	})
+}
+
+// handleSLOsStatus computes the status of every SLO for the overview page. SLOs whose
+// status cannot be computed are reported without values rather than failing the request.
+func (a *App) handleSLOsStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := req.Context()
+	slos, err := listJSON[slo](ctx, a.store, slosCollection)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	statuses := make([]sloStatus, len(slos))
+	for i, s := range slos {
+		statuses[i], err = a.computeSLOStatus(ctx, s, now)
+		if err != nil {
+			a.logger(ctx).Warn("Error computing SLO status", "id", s.ID, "err", err)
+			statuses[i] = sloStatus{SLO: s.ID, EvaluatedAt: now}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"statuses": statuses,
+		"frames":   data.Frames{sloOverviewFrame(slos, statuses)},
+	})
+}
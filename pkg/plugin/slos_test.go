@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeSLOMCP returns a fakeMCP answering SLI queries with a fixed SLI per window.
+func newFakeSLOMCP(sliByWindow map[string]string) *fakeMCP {
+	return &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"query_prometheus": func(args map[string]any) (any, error) {
+			expr := args["expr"].(string)
+			for window, sli := range sliByWindow {
+				if strings.Contains(expr, "["+window+"]") {
+					return []map[string]any{{"metric": map[string]string{}, "value": []any{1700000000, sli}}}, nil
+				}
+			}
+			return []map[string]any{}, nil
+		},
+	}}
+}
+
+func validSLO() map[string]any {
+	return map[string]any{
+		"name":          "checkout availability",
+		"datasourceUid": "prom",
+		"goodQuery":     `sum(rate(http_requests_total{service="checkout", code!~"5.."}[$window]))`,
+		"totalQuery":    `sum(rate(http_requests_total{service="checkout"}[$window]))`,
+		"target":        0.999,
+		"labels":        map[string]string{"service": "checkout"},
+	}
+}
+
+func TestSLOValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(map[string]any)
+		expErr string
+	}{
+		{name: "valid", modify: func(map[string]any) {}},
+		{name: "target as percentage", modify: func(s map[string]any) { s["target"] = 99.9 }, expErr: "target must be a ratio"},
+		{name: "missing window placeholder", modify: func(s map[string]any) { s["goodQuery"] = "sum(rate(x[5m]))" }, expErr: "must use $window"},
+		{name: "invalid query", modify: func(s map[string]any) { s["totalQuery"] = "sum(rate(x[$window])" }, expErr: "invalid totalQuery"},
+		{name: "invalid window", modify: func(s map[string]any) { s["window"] = "a month" }, expErr: "invalid window"},
+		{name: "invalid kind", modify: func(s map[string]any) { s["kind"] = "durability" }, expErr: "kind must be"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := validSLO()
+			tc.modify(body)
+			b, _ := json.Marshal(body)
+			var s slo
+			if err := json.Unmarshal(b, &s); err != nil {
+				t.Fatal(err)
+			}
+			err := s.validate()
+			if tc.expErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tc.expErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expErr)) {
+				t.Fatalf("expected error containing %q, got %v", tc.expErr, err)
+			}
+			if tc.expErr == "" && (s.Window != "30d" || s.Kind != sloKindAvailability) {
+				t.Errorf("defaults not applied: %+v", s)
+			}
+		})
+	}
+}
+
+func TestSLOResources(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	app.mcp = newFakeSLOMCP(map[string]string{"1h": "0.99", "6h": "0.999", "1d": "0.9995", "30d": "0.9998"})
+
+	resp := callResource(t, app, http.MethodPost, "slos", validSLO())
+	if resp.Status != http.StatusOK {
+		t.Fatalf("create: %d %s", resp.Status, resp.Body)
+	}
+	var created slo
+	if err := json.Unmarshal(resp.Body, &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.CreatedBy != "tester" {
+		t.Errorf("unexpected SLO %+v", created)
+	}
+
+	resp = callResource(t, app, http.MethodGet, "slos/"+created.ID+"/status", nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("status: %d %s", resp.Status, resp.Body)
+	}
+	var out struct {
+		Status sloStatus         `json:"status"`
+		Frames []json.RawMessage `json:"frames"`
+	}
+	if err := json.Unmarshal(resp.Body, &out); err != nil {
+		t.Fatal(err)
+	}
+	approx := func(v *float64, exp float64) bool { return v != nil && math.Abs(*v-exp) < 1e-6 }
+	if !approx(out.Status.SLI, 0.9998) || !approx(out.Status.ErrorBudgetRemaining, 0.8) {
+		t.Errorf("unexpected SLI %v or error budget %v", out.Status.SLI, out.Status.ErrorBudgetRemaining)
+	}
+	var burnRates []string
+	for _, w := range out.Status.Windows {
+		burnRates = append(burnRates, fmt.Sprintf("%s=%.1f", w.Window, *w.BurnRate))
+	}
+	if got := strings.Join(burnRates, " "); got != "1h=10.0 6h=1.0 1d=0.5 30d=0.2" {
+		t.Errorf("unexpected burn rates %s", got)
+	}
+	if len(out.Frames) != 1 || !strings.Contains(string(out.Frames[0]), `"burn_rate"`) {
+		t.Errorf("unexpected frames %s", out.Frames)
+	}
+
+	resp = callResource(t, app, http.MethodGet, "slos/status", nil)
+	if resp.Status != http.StatusOK || !strings.Contains(string(resp.Body), `"burn_rate_1h"`) {
+		t.Errorf("overview: %d %s", resp.Status, resp.Body)
+	}
+
+	// Viewers can read SLOs but not write them.
+	if resp := callResourceAs(t, app, viewer, http.MethodPost, "slos", validSLO()); resp.Status != http.StatusForbidden {
+		t.Errorf("expected viewers to be unable to create SLOs, got %d", resp.Status)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		if resp := callResourceAs(t, app, viewer, method, "slos/"+created.ID, validSLO()); resp.Status != http.StatusForbidden {
+			t.Errorf("expected viewers to be unable to %s SLOs, got %d", method, resp.Status)
+		}
+	}
+	if resp := callResourceAs(t, app, viewer, http.MethodGet, "slos/"+created.ID, nil); resp.Status != http.StatusOK {
+		t.Errorf("expected viewers to be able to read SLOs, got %d", resp.Status)
+	}
+
+	update := validSLO()
+	update["target"] = 0.99
+	resp = callResource(t, app, http.MethodPut, "slos/"+created.ID, update)
+	if resp.Status != http.StatusOK || !strings.Contains(string(resp.Body), `"target":0.99`) {
+		t.Errorf("update: %d %s", resp.Status, resp.Body)
+	}
+	if resp := callResource(t, app, http.MethodDelete, "slos/"+created.ID, nil); resp.Status != http.StatusOK {
+		t.Errorf("delete: %d %s", resp.Status, resp.Body)
+	}
+	if resp := callResource(t, app, http.MethodGet, "slos/"+created.ID, nil); resp.Status != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", resp.Status)
+	}
+}
+
+func TestSLOStatusWithoutTraffic(t *testing.T) {
+	app := newTestApp(t, "http://localhost:0", nil)
+	app.mcp = newFakeSLOMCP(map[string]string{"30d": "NaN"})
+	s := slo{ID: "a", DatasourceUID: "prom", GoodQuery: "good[$window]", TotalQuery: "total[$window]", Target: 0.99, Window: "30d"}
+	status, err := app.computeSLOStatus(t.Context(), s, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.SLI != nil || status.ErrorBudgetRemaining != nil || status.Windows[0].BurnRate != nil {
+		t.Errorf("windows without events should have no values: %+v", status)
+	}
+}
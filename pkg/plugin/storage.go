@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+// loadJSON reads the value stored under collection/key and decodes it into a T.
+func loadJSON[T any](ctx context.Context, s store.Store, collection, key string) (T, error) {
+	var v T
+	b, err := s.Get(ctx, collection, key)
+	if err != nil {
+		return v, err
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return v, fmt.Errorf("decode %s/%s: %w", collection, key, err)
+	}
+	return v, nil
+}
+
+// saveJSON encodes v as JSON and stores it under collection/key.
+func saveJSON(ctx context.Context, s store.Store, collection, key string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode %s/%s: %w", collection, key, err)
+	}
+	return s.Put(ctx, collection, key, b)
+}
+
+// listJSON decodes every value in collection into a T, ordered by key.
+func listJSON[T any](ctx context.Context, s store.Store, collection string) ([]T, error) {
+	items, err := s.List(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]T, 0, len(items))
+	for _, item := range items {
+		var v T
+		if err := json.Unmarshal(item.Value, &v); err != nil {
+			return nil, fmt.Errorf("decode %s/%s: %w", collection, item.Key, err)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
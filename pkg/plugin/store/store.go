@@ -0,0 +1,186 @@
+// Package store provides the small key/value store the plugin uses to persist
+// its own state between restarts.
+//
+// Values are grouped into collections. Each collection is kept in memory and,
+// for the file-backed store, written to a single JSON file whenever it changes.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned by Get when a key does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Item is a single key/value pair in a collection.
+type Item struct {
+	Key   string
+	Value []byte
+}
+
+// Store is a collection-scoped key/value store.
+type Store interface {
+	// Get returns the value stored under key, or ErrNotFound.
+	Get(ctx context.Context, collection, key string) ([]byte, error)
+	// Put stores value under key, replacing any existing value.
+	Put(ctx context.Context, collection, key string, value []byte) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, collection, key string) error
+	// List returns all items in a collection ordered by key.
+	List(ctx context.Context, collection string) ([]Item, error)
+}
+
+// memoryStore keeps every collection in memory. If dir is not empty,
+// collections are also persisted to dir as JSON files.
+type memoryStore struct {
+	mu          sync.RWMutex
+	dir         string
+	collections map[string]map[string]json.RawMessage
+}
+
+// NewMemoryStore creates a Store that only lives in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{collections: map[string]map[string]json.RawMessage{}}
+}
+
+// NewFileStore creates a Store that persists each collection as a JSON file in dir.
+// The directory is created if it does not exist.
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create store directory: %w", err)
+	}
+	return &memoryStore{dir: dir, collections: map[string]map[string]json.RawMessage{}}, nil
+}
+
+func (s *memoryStore) Get(_ context.Context, collection, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.load(collection)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := c[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (s *memoryStore) Put(_ context.Context, collection, key string, value []byte) error {
+	if !json.Valid(value) {
+		return fmt.Errorf("value for %s/%s is not valid JSON", collection, key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.load(collection)
+	if err != nil {
+		return err
+	}
+	prev, existed := c[key]
+	c[key] = append(json.RawMessage(nil), value...)
+	if err := s.flush(collection, c); err != nil {
+		if existed {
+			c[key] = prev
+		} else {
+			delete(c, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) Delete(_ context.Context, collection, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.load(collection)
+	if err != nil {
+		return err
+	}
+	prev, ok := c[key]
+	if !ok {
+		return nil
+	}
+	delete(c, key)
+	if err := s.flush(collection, c); err != nil {
+		c[key] = prev
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) List(_ context.Context, collection string) ([]Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.load(collection)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, len(c))
+	for k, v := range c {
+		items = append(items, Item{Key: k, Value: append([]byte(nil), v...)})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items, nil
+}
+
+// load returns the in-memory map for a collection, reading it from disk the
+// first time it is accessed. s.mu must be held.
+func (s *memoryStore) load(collection string) (map[string]json.RawMessage, error) {
+	if c, ok := s.collections[collection]; ok {
+		return c, nil
+	}
+	c := map[string]json.RawMessage{}
+	if s.dir != "" {
+		b, err := os.ReadFile(s.path(collection))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("read collection %s: %w", collection, err)
+		default:
+			if err := json.Unmarshal(b, &c); err != nil {
+				return nil, fmt.Errorf("decode collection %s: %w", collection, err)
+			}
+		}
+	}
+	s.collections[collection] = c
+	return c, nil
+}
+
+// flush writes a collection to disk. The file is replaced atomically so that a
+// crash while writing never leaves a truncated collection behind. s.mu must be held.
+func (s *memoryStore) flush(collection string, c map[string]json.RawMessage) error {
+	if s.dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("encode collection %s: %w", collection, err)
+	}
+	tmp, err := os.CreateTemp(s.dir, collection+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("write collection %s: %w", collection, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write collection %s: %w", collection, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write collection %s: %w", collection, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(collection)); err != nil {
+		return fmt.Errorf("write collection %s: %w", collection, err)
+	}
+	return nil
+}
+
+func (s *memoryStore) path(collection string) string {
+	return filepath.Join(s.dir, collection+".json")
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("new file store: %s", err)
+	}
+	if _, err := s.Get(ctx, "things", "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing key should return ErrNotFound, got %v", err)
+	}
+	if err := s.Put(ctx, "things", "b", []byte(`{"n":2}`)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if err := s.Put(ctx, "things", "a", []byte(`{"n":1}`)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if err := s.Put(ctx, "things", "c", []byte(`not json`)); err == nil {
+		t.Error("invalid JSON should be rejected")
+	}
+
+	// A new store on the same directory sees the persisted values.
+	s, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopen file store: %s", err)
+	}
+	items, err := s.List(ctx, "things")
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(items) != 2 || items[0].Key != "a" || string(items[1].Value) != `{"n":2}` {
+		t.Errorf("unexpected items %+v", items)
+	}
+	if err := s.Delete(ctx, "things", "a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if err := s.Delete(ctx, "things", "missing"); err != nil {
+		t.Errorf("deleting a missing key should not fail: %s", err)
+	}
+	if _, err := s.Get(ctx, "things", "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted key should return ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	if err := s.Put(ctx, "c", "k", []byte(`1`)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	v, err := s.Get(ctx, "c", "k")
+	if err != nil || string(v) != "1" {
+		t.Errorf("unexpected value %s (%v)", v, err)
+	}
+	if items, _ := s.List(ctx, "other"); len(items) != 0 {
+		t.Errorf("unknown collection should be empty, got %v", items)
+	}
+}
@@ -0,0 +1,365 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// defaultTimelineWindow is the window of a timeline request without a from parameter.
+	defaultTimelineWindow = 6 * time.Hour
+	maxTimelineWindow     = 7 * 24 * time.Hour
+)
+
+// Timeline event sources.
+const (
+	sourceGrafana   = "grafana"
+	sourceIRM       = "irm"
+	sourceAssistant = "assistant"
+	sourceChanges   = "changes"
+)
+
+// deployTags and changeTags classify annotations as deploy or change events.
+var (
+	deployTags = []string{"deploy", "deployment", "release", "rollout"}
+	changeTags = []string{"change", "config", "feature-flag", "flag", "migration"}
+)
+
+// timelineEvent is a normalized event of the incident timeline.
+type timelineEvent struct {
+	Time time.Time `json:"time"`
+	End  time.Time `json:"end,omitzero"`
+	// Kind is alert, annotation, deploy, change, incident, investigation, action or postmortem.
+	Kind   string            `json:"kind"`
+	Source string            `json:"source"`
+	Title  string            `json:"title"`
+	Text   string            `json:"text,omitempty"`
+	User   string            `json:"user,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	URL    string            `json:"url,omitempty"`
+}
+
+// labelScope restricts events to the ones related to a set of labels. An empty scope
+// matches everything.
+type labelScope map[string]string
+
+// matches reports whether labels share at least one label with the scope.
+func (s labelScope) matches(labels map[string]string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for k, v := range s {
+		if labels[k] == v {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionedIn reports whether free text or tags, such as those of an annotation, mention
+// a label of the scope as name=value, as a name:value tag or as a value tag.
+func (s labelScope) mentionedIn(text string, tags []string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for k, v := range s {
+		if strings.Contains(text, k+"="+v) || slices.Contains(tags, v) || slices.Contains(tags, k+":"+v) {
+			return true
+		}
+	}
+	return false
+}
+
+// annotationKind classifies an annotation by its tags.
+func annotationKind(an grafanaAnnotation) string {
+	switch {
+	case an.AlertID != 0 || an.NewState != "":
+		return "alert"
+	case slices.ContainsFunc(an.Tags, func(t string) bool { return slices.Contains(deployTags, strings.ToLower(t)) }):
+		return "deploy"
+	case slices.ContainsFunc(an.Tags, func(t string) bool { return slices.Contains(changeTags, strings.ToLower(t)) }):
+		return "change"
+	default:
+		return "annotation"
+	}
+}
+
+// annotationEvents returns the alert state changes and annotations in the window.
+func (a *App) annotationEvents(ctx context.Context, from, to time.Time, scope labelScope) ([]timelineEvent, error) {
+	annotations, err := a.listAnnotations(ctx, from, to, "")
+	if err != nil {
+		return nil, err
+	}
+	var events []timelineEvent
+	for _, an := range annotations {
+		if !scope.mentionedIn(an.Text, an.Tags) {
+			continue
+		}
+		ev := timelineEvent{Time: an.time(), Kind: annotationKind(an), Source: sourceGrafana, Text: an.Text, User: an.Login, URL: an.url()}
+		if an.TimeEnd > an.Time {
+			ev.End = time.UnixMilli(an.TimeEnd).UTC()
+		}
+		if ev.Kind == "alert" {
+			name := an.AlertName
+			if name == "" {
+				name = "alert " + strconv.FormatInt(an.AlertID, 10)
+			}
+			ev.Title = fmt.Sprintf("%s: %s → %s", name, an.PrevState, an.NewState)
+		} else {
+			ev.Title = truncate(strings.SplitN(an.Text, "\n", 2)[0], 120)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// incidentEvents returns the declaration and activity of an IRM incident.
+func (a *App) incidentEvents(ctx context.Context, id string) ([]timelineEvent, error) {
+	inc, err := a.getIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	start, _ := inc.window(time.Now())
+	events := []timelineEvent{{
+		Time: start, Kind: "incident", Source: sourceIRM, Title: "Incident declared: " + inc.Title,
+		Text: inc.Summary, Labels: inc.labelSet(), URL: inc.OverviewURL,
+	}}
+	if end := parseIRMTime(inc.IncidentEnd); !end.IsZero() {
+		events = append(events, timelineEvent{Time: end, Kind: "incident", Source: sourceIRM, Title: "Incident resolved: " + inc.Title, URL: inc.OverviewURL})
+	}
+	activity, err := a.incidentActivity(ctx, id)
+	if err != nil {
+		return events, err
+	}
+	for _, item := range activity {
+		if strings.TrimSpace(item.Body) == "" {
+			continue
+		}
+		events = append(events, timelineEvent{
+			Time: item.time(), Kind: "incident", Source: sourceIRM, Title: truncate(item.Body, 120),
+			Text: item.Body, User: item.User.Name, URL: inc.OverviewURL,
+		})
+	}
+	return events, nil
+}
+
+// assistantEvents returns what the assistant and its users did: investigation steps,
+// remediation action transitions and postmortems.
+func (a *App) assistantEvents(ctx context.Context, from, to time.Time, scope labelScope) ([]timelineEvent, error) {
+	inWindow := func(t time.Time) bool { return !t.Before(from) && !t.After(to) }
+	var events []timelineEvent
+
+	invs, err := listJSON[investigation](ctx, a.store, investigationsCollection)
+	if err != nil {
+		return nil, err
+	}
+	// Actions carry no labels; they are in scope when the investigation they came from is.
+	investigationsInScope := map[string]bool{}
+	for _, inv := range invs {
+		if !scope.matches(inv.Labels) {
+			continue
+		}
+		investigationsInScope[inv.ID] = true
+		url := pluginResourcesPath + "/investigations/" + inv.ID
+		if inWindow(inv.CreatedAt) {
+			events = append(events, timelineEvent{
+				Time: inv.CreatedAt, Kind: "investigation", Source: sourceAssistant, Title: "Investigation started: " + inv.Title,
+				Text: inv.Goal, User: inv.CreatedBy, Labels: inv.Labels, URL: url,
+			})
+		}
+		for i, s := range inv.Steps {
+			if s.CompletedAt.IsZero() || !inWindow(s.CompletedAt) {
+				continue
+			}
+			title := s.Title
+			if title == "" {
+				title = s.Kind
+			}
+			text := s.Output
+			if s.Error != "" {
+				text = s.Error
+			}
+			events = append(events, timelineEvent{
+				Time: s.CompletedAt, Kind: "investigation", Source: sourceAssistant,
+				Title: fmt.Sprintf("%s, step %d %s: %s", inv.Title, i+1, s.Status, title),
+				Text:  truncate(text, 500), User: s.Author, Labels: inv.Labels, URL: url + "#step-" + s.ID,
+			})
+		}
+	}
+
+	actions, err := listJSON[action](ctx, a.store, actionsCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, ac := range actions {
+		if len(scope) > 0 && !investigationsInScope[ac.SourceID] {
+			continue
+		}
+		for _, e := range ac.Audit {
+			if !inWindow(e.At) {
+				continue
+			}
+			title := fmt.Sprintf("Action %q: %s", ac.Title, e.Event)
+			if e.To != "" {
+				title = fmt.Sprintf("Action %q %s", ac.Title, e.To)
+			}
+			events = append(events, timelineEvent{
+				Time: e.At, Kind: "action", Source: sourceAssistant, Title: title, Text: e.Message,
+				User: e.User, URL: pluginResourcesPath + "/actions/" + ac.ID,
+			})
+		}
+	}
+
+	pms, err := listJSON[postmortem](ctx, a.store, postmortemsCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, pm := range pms {
+		if inWindow(pm.CreatedAt) && scope.matches(pm.Labels) {
+			events = append(events, timelineEvent{
+				Time: pm.CreatedAt, Kind: "postmortem", Source: sourceAssistant, Title: "Postmortem drafted: " + pm.Title,
+				User: pm.CreatedBy, Labels: pm.Labels, URL: pluginResourcesPath + "/postmortems/" + pm.ID,
+			})
+		}
+	}
+	return events, nil
+}
+
+// changeEvents returns the changes reported to /changes in the window.
+func (a *App) changeEvents(ctx context.Context, from, to time.Time, scope labelScope) ([]timelineEvent, error) {
+	changes, err := a.listChanges(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	var events []timelineEvent
+	for _, c := range changes {
+		if labels := c.labelSet(); scope.matches(labels) {
+			events = append(events, timelineEvent{
+				Time: c.Time, Kind: c.timelineKind(), Source: sourceChanges, Title: c.Title,
+				Text: c.Description, User: c.Author, Labels: labels, URL: c.URL,
+			})
+		}
+	}
+	return events, nil
+}
+
+// collectTimeline merges the events of every source, oldest first. Sources that cannot be
+// read are reported as warnings rather than failing the whole timeline.
+func (a *App) collectTimeline(ctx context.Context, from, to time.Time, scope labelScope, incidentIDs []string) ([]timelineEvent, []string) {
+	events := []timelineEvent{}
+	var warnings []string
+	add := func(source string, evs []timelineEvent, err error) {
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", source, err))
+		}
+		events = append(events, evs...)
+	}
+	evs, err := a.annotationEvents(ctx, from, to, scope)
+	add("annotations", evs, err)
+	for _, id := range incidentIDs {
+		evs, err := a.incidentEvents(ctx, id)
+		add("incident "+id, evs, err)
+	}
+	evs, err = a.changeEvents(ctx, from, to, scope)
+	add("changes", evs, err)
+	evs, err = a.assistantEvents(ctx, from, to, scope)
+	add("assistant", evs, err)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, warnings
+}
+
+// timelineFrame returns the events as a frame. The title links to the source of the event.
+func timelineFrame(events []timelineEvent) *data.Frame {
+	times := make([]time.Time, len(events))
+	ends := make([]*time.Time, len(events))
+	kinds := make([]string, len(events))
+	sources := make([]string, len(events))
+	titles := make([]string, len(events))
+	texts := make([]string, len(events))
+	users := make([]string, len(events))
+	urls := make([]string, len(events))
+	for i, e := range events {
+		times[i], kinds[i], sources[i], titles[i], texts[i], users[i], urls[i] = e.Time, e.Kind, e.Source, e.Title, e.Text, e.User, e.URL
+		if !e.End.IsZero() {
+			end := e.End
+			ends[i] = &end
+		}
+	}
+	return data.NewFrame("timeline",
+		data.NewField("time", nil, times),
+		data.NewField("timeEnd", nil, ends),
+		data.NewField("kind", nil, kinds),
+		data.NewField("source", nil, sources),
+		data.NewField("title", nil, titles).SetConfig(&data.FieldConfig{
+			Links: []data.DataLink{{Title: "Open", URL: "${__data.fields.url}"}},
+		}),
+		data.NewField("text", nil, texts),
+		data.NewField("user", nil, users),
+		data.NewField("url", nil, urls),
+	)
+}
+
+// parseTimeParam parses a time given as Unix milliseconds, like Grafana time ranges, or
+// as RFC 3339. An empty value returns def.
+func parseTimeParam(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected Unix milliseconds or RFC 3339", v)
+	}
+	return t.UTC(), nil
+}
+
+// handleTimeline returns the merged timeline of a time window. The query parameters are
+// from and to, label=name=value to restrict the timeline to related events, and incidentId
+// to include the activity of IRM incidents.
+func (a *App) handleTimeline(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	to, err := parseTimeParam(q.Get("to"), time.Now().UTC())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(q.Get("from"), to.Add(-defaultTimelineWindow))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !from.Before(to) || to.Sub(from) > maxTimelineWindow {
+		http.Error(w, fmt.Sprintf("from must be before to, and the window must not be longer than %s", formatDuration(maxTimelineWindow)), http.StatusBadRequest)
+		return
+	}
+	scope := labelScope{}
+	for _, l := range q["label"] {
+		name, value, ok := strings.Cut(l, "=")
+		if !ok || name == "" {
+			http.Error(w, fmt.Sprintf("invalid label %q: expected name=value", l), http.StatusBadRequest)
+			return
+		}
+		scope[name] = value
+	}
+
+	events, warnings := a.collectTimeline(req.Context(), from, to, scope, q["incidentId"])
+	writeJSON(w, http.StatusOK, map[string]any{
+		"events":   events,
+		"warnings": warnings,
+		"frames":   data.Frames{timelineFrame(events)},
+	})
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLabelScope(t *testing.T) {
+	scope := labelScope{"service": "checkout"}
+	if !scope.matches(map[string]string{"service": "checkout", "env": "prod"}) || scope.matches(map[string]string{"service": "cart"}) {
+		t.Error("unexpected label match")
+	}
+	if !scope.mentionedIn("{service=checkout} - firing", nil) || !scope.mentionedIn("", []string{"service:checkout"}) || scope.mentionedIn("cart", []string{"cart"}) {
+		t.Error("unexpected mention match")
+	}
+	if !(labelScope{}).matches(nil) || !(labelScope{}).mentionedIn("", nil) {
+		t.Error("an empty scope should match everything")
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	srv, _ := newFakeIncidentGrafana(t)
+	app := newTestApp(t, srv.URL, nil)
+	ctx := context.Background()
+	err := saveJSON(ctx, app.store, investigationsCollection, "inv-1", investigation{
+		ID: "inv-1", Title: "checkout errors", Goal: "Find the cause", Status: investigationCompleted,
+		Labels: map[string]string{"service": "checkout"}, CreatedBy: "carol", CreatedAt: incidentStart.Add(5 * time.Minute),
+		Steps: []investigationStep{{ID: "s1", Kind: stepNote, Title: "check deploys", Status: investigationCompleted,
+			Output: "v2.3.0 was deployed", CompletedAt: incidentStart.Add(6 * time.Minute)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ac := range []action{
+		{ID: "act-1", Title: "Roll back checkout", Source: "assistant", SourceID: "inv-1",
+			Audit: []actionAuditEntry{{At: incidentStart.Add(8 * time.Minute), User: "carol", Event: "transition", To: actionProposed}}},
+		{ID: "act-2", Title: "Restart cart", Source: "user",
+			Audit: []actionAuditEntry{{At: incidentStart.Add(9 * time.Minute), User: "dave", Event: "transition", To: actionProposed}}},
+	} {
+		if err := saveJSON(ctx, app.store, actionsCollection, ac.ID, ac); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := url.Values{}
+	q.Set("from", strconv.FormatInt(incidentStart.Add(-30*time.Minute).UnixMilli(), 10))
+	q.Set("to", incidentStart.Add(2*time.Hour).Format(time.RFC3339))
+	q.Set("label", "service=checkout")
+	q.Set("incidentId", "42")
+	resp := callResource(t, app, http.MethodGet, "timeline?"+q.Encode(), nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("timeline: %d %s", resp.Status, resp.Body)
+	}
+	var body struct {
+		Events   []timelineEvent `json:"events"`
+		Warnings []string        `json:"warnings"`
+		Frames   []json.RawMessage
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range body.Events {
+		got = append(got, e.Kind+"/"+e.Source)
+	}
+	// The cart annotation and the cart action are out of scope.
+	exp := "deploy/grafana incident/irm alert/grafana investigation/assistant investigation/assistant action/assistant incident/irm incident/irm incident/irm"
+	if strings.Join(got, " ") != exp {
+		t.Errorf("unexpected events:\n got %s\nwant %s", strings.Join(got, " "), exp)
+	}
+	if len(body.Warnings) != 0 || len(body.Frames) != 1 {
+		t.Errorf("unexpected warnings %v or %d frames", body.Warnings, len(body.Frames))
+	}
+	if e := body.Events[2]; e.Title != "HighErrorRate: Pending → Alerting" {
+		t.Errorf("unexpected alert event %+v", e)
+	}
+	if e := body.Events[0]; e.User != "deployer" || !strings.HasPrefix(e.URL, "/d/deploys?") {
+		t.Errorf("unexpected deploy event %+v", e)
+	}
+	if e := body.Events[5]; e.Title != `Action "Roll back checkout" proposed` || e.URL != pluginResourcesPath+"/actions/act-1" {
+		t.Errorf("unexpected action event %+v", e)
+	}
+
+	frame := timelineFrame(body.Events)
+	if frame.Rows() != len(body.Events) || frame.Fields[4].Config.Links[0].URL != "${__data.fields.url}" {
+		t.Errorf("unexpected frame %v", frame)
+	}
+}
+
+func TestTimelineValidation(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	for _, path := range []string{
+		"timeline?from=yesterday",
+		"timeline?from=2000&to=1000",
+		"timeline?from=0&to=" + strconv.FormatInt(int64(30*24*time.Hour/time.Millisecond), 10),
+		"timeline?label=service",
+	} {
+		if resp := callResource(t, app, http.MethodGet, path, nil); resp.Status != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", path, resp.Status)
+		}
+	}
+}
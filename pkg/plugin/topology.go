@@ -0,0 +1,438 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	defaultTopologyWindow = 5 * time.Minute
+	maxTopologyWindow     = 24 * time.Hour
+	// topologyLatencyQuantile is the latency quantile reported for edges.
+	topologyLatencyQuantile = 0.95
+)
+
+// topologyMapping describes how caller/callee metrics encode a service graph. Preset
+// names a built-in mapping whose fields are used for every field left empty.
+type topologyMapping struct {
+	Preset string `json:"preset,omitempty"`
+	// RequestsMetric counts requests from SourceLabel to TargetLabel.
+	RequestsMetric string `json:"requestsMetric,omitempty"`
+	// FailedMetric counts failed requests. Without it, failed requests are the ones of
+	// RequestsMetric matching ErrorMatcher, e.g. response_code=~"5..".
+	FailedMetric string `json:"failedMetric,omitempty"`
+	ErrorMatcher string `json:"errorMatcher,omitempty"`
+	// LatencyMetric is a histogram of request durations, without the _bucket suffix,
+	// measured in LatencyUnit ("s" or "ms").
+	LatencyMetric string `json:"latencyMetric,omitempty"`
+	LatencyUnit   string `json:"latencyUnit,omitempty"`
+	SourceLabel   string `json:"sourceLabel,omitempty"`
+	TargetLabel   string `json:"targetLabel,omitempty"`
+	// Selector restricts all series, e.g. reporter="destination" so Istio requests are not
+	// counted twice.
+	Selector string `json:"selector,omitempty"`
+}
+
+// topologyPresets are the mappings of the Tempo service graph and Istio request metrics.
+var topologyPresets = map[string]topologyMapping{
+	"tempo": {
+		RequestsMetric: "traces_service_graph_request_total",
+		FailedMetric:   "traces_service_graph_request_failed_total",
+		LatencyMetric:  "traces_service_graph_request_server_seconds",
+		LatencyUnit:    "s",
+		SourceLabel:    "client",
+		TargetLabel:    "server",
+	},
+	"istio": {
+		RequestsMetric: "istio_requests_total",
+		ErrorMatcher:   `response_code=~"5.."`,
+		LatencyMetric:  "istio_request_duration_milliseconds",
+		LatencyUnit:    "ms",
+		SourceLabel:    "source_workload",
+		TargetLabel:    "destination_workload",
+		Selector:       `reporter="destination"`,
+	},
+}
+
+var errInvalidTopologyMapping = errors.New("invalid topology mapping")
+
+// resolve fills the empty fields from the preset, defaulting to the Tempo service graph,
+// and validates the mapping.
+func (m topologyMapping) resolve() (topologyMapping, error) {
+	if m.Preset == "" && m.RequestsMetric == "" {
+		m.Preset = "tempo"
+	}
+	if m.Preset != "" {
+		p, ok := topologyPresets[m.Preset]
+		if !ok {
+			return m, fmt.Errorf("%w: unknown preset %q", errInvalidTopologyMapping, m.Preset)
+		}
+		for _, f := range []struct {
+			field  *string
+			preset string
+		}{
+			{&m.RequestsMetric, p.RequestsMetric}, {&m.FailedMetric, p.FailedMetric}, {&m.ErrorMatcher, p.ErrorMatcher},
+			{&m.LatencyMetric, p.LatencyMetric}, {&m.LatencyUnit, p.LatencyUnit}, {&m.SourceLabel, p.SourceLabel},
+			{&m.TargetLabel, p.TargetLabel}, {&m.Selector, p.Selector},
+		} {
+			if *f.field == "" {
+				*f.field = f.preset
+			}
+		}
+	}
+	for _, name := range []string{m.RequestsMetric, m.FailedMetric, m.LatencyMetric} {
+		if name != "" && !model.IsValidLegacyMetricName(name) {
+			return m, fmt.Errorf("%w: invalid metric name %q", errInvalidTopologyMapping, name)
+		}
+	}
+	if m.RequestsMetric == "" {
+		return m, fmt.Errorf("%w: requestsMetric is required", errInvalidTopologyMapping)
+	}
+	for _, l := range []string{m.SourceLabel, m.TargetLabel} {
+		if !model.LabelName(l).IsValidLegacy() {
+			return m, fmt.Errorf("%w: invalid label name %q", errInvalidTopologyMapping, l)
+		}
+	}
+	if m.LatencyUnit != "" && m.LatencyUnit != "s" && m.LatencyUnit != "ms" {
+		return m, fmt.Errorf(`%w: latencyUnit must be "s" or "ms"`, errInvalidTopologyMapping)
+	}
+	for _, sel := range []string{m.Selector, m.ErrorMatcher} {
+		if sel == "" {
+			continue
+		}
+		if _, err := parser.ParseMetricSelector("{" + sel + "}"); err != nil {
+			return m, fmt.Errorf("%w: invalid matchers %q: %s", errInvalidTopologyMapping, sel, err)
+		}
+	}
+	return m, nil
+}
+
+// selector returns the series selector of metric restricted by the mapping selector and
+// the extra matchers.
+func (m topologyMapping) selector(metric string, extra ...string) string {
+	var matchers []string
+	for _, s := range append([]string{m.Selector}, extra...) {
+		if s != "" {
+			matchers = append(matchers, s)
+		}
+	}
+	return metric + "{" + strings.Join(matchers, ",") + "}"
+}
+
+// queries returns the rate, error rate and latency queries of the edges over window.
+func (m topologyMapping) queries(window time.Duration) (requests, failed, latency string) {
+	by := m.SourceLabel + ", " + m.TargetLabel
+	w := formatDuration(window)
+	requests = fmt.Sprintf("sum by (%s) (rate(%s[%s]))", by, m.selector(m.RequestsMetric), w)
+	switch {
+	case m.FailedMetric != "":
+		failed = fmt.Sprintf("sum by (%s) (rate(%s[%s]))", by, m.selector(m.FailedMetric), w)
+	case m.ErrorMatcher != "":
+		failed = fmt.Sprintf("sum by (%s) (rate(%s[%s]))", by, m.selector(m.RequestsMetric, m.ErrorMatcher), w)
+	}
+	if m.LatencyMetric != "" {
+		latency = fmt.Sprintf("histogram_quantile(%g, sum by (%s, le) (rate(%s[%s])))", topologyLatencyQuantile, by, m.selector(m.LatencyMetric+"_bucket"), w)
+	}
+	return requests, failed, latency
+}
+
+// topologyEdge is a caller/callee pair with its traffic. Rates are per second, ErrorRate
+// is the fraction of failed requests and LatencyMs the 95th percentile.
+type topologyEdge struct {
+	ID        string  `json:"id"`
+	Source    string  `json:"source"`
+	Target    string  `json:"target"`
+	Rate      float64 `json:"rate"`
+	ErrorRate float64 `json:"errorRate"`
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+// topologyNode is a service. Its rates are of the requests it receives.
+type topologyNode struct {
+	ID        string  `json:"id"`
+	Rate      float64 `json:"rate"`
+	ErrorRate float64 `json:"errorRate"`
+}
+
+// topology is a service graph.
+type topology struct {
+	Nodes []topologyNode `json:"nodes"`
+	Edges []topologyEdge `json:"edges"`
+}
+
+// finite replaces NaN and infinities, which histogram_quantile returns for idle edges and
+// JSON cannot encode, with 0.
+func finite(v float64) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0
+	}
+	return v
+}
+
+// buildTopology queries the service graph at t over window.
+func (a *App) buildTopology(ctx context.Context, datasourceUID string, m topologyMapping, t time.Time, window time.Duration) (topology, error) {
+	catalog := newPromCatalog(a.mcp, datasourceUID)
+	requestsQuery, failedQuery, latencyQuery := m.queries(window)
+	edges := map[string]*topologyEdge{}
+	edge := func(s promSample) *topologyEdge {
+		src, dst := s.Metric[m.SourceLabel], s.Metric[m.TargetLabel]
+		if src == "" || dst == "" {
+			return nil
+		}
+		id := src + "->" + dst
+		if edges[id] == nil {
+			edges[id] = &topologyEdge{ID: id, Source: src, Target: dst}
+		}
+		return edges[id]
+	}
+
+	samples, err := catalog.queryInstantAt(ctx, requestsQuery, t)
+	if err != nil {
+		return topology{}, fmt.Errorf("query request rates: %w", err)
+	}
+	for _, s := range samples {
+		if e := edge(s); e != nil {
+			e.Rate = finite(s.Value)
+		}
+	}
+	failed := map[string]float64{}
+	if failedQuery != "" {
+		samples, err := catalog.queryInstantAt(ctx, failedQuery, t)
+		if err != nil {
+			return topology{}, fmt.Errorf("query error rates: %w", err)
+		}
+		for _, s := range samples {
+			if e := edge(s); e != nil {
+				failed[e.ID] = finite(s.Value)
+				if e.Rate > 0 {
+					e.ErrorRate = min(1, failed[e.ID]/e.Rate)
+				}
+			}
+		}
+	}
+	if latencyQuery != "" {
+		samples, err := catalog.queryInstantAt(ctx, latencyQuery, t)
+		if err != nil {
+			return topology{}, fmt.Errorf("query latencies: %w", err)
+		}
+		for _, s := range samples {
+			if e := edge(s); e != nil {
+				e.LatencyMs = finite(s.Value)
+				if m.LatencyUnit != "ms" {
+					e.LatencyMs *= 1000
+				}
+			}
+		}
+	}
+
+	g := topology{Edges: make([]topologyEdge, 0, len(edges))}
+	nodes := map[string]*topologyNode{}
+	node := func(id string) *topologyNode {
+		if nodes[id] == nil {
+			nodes[id] = &topologyNode{ID: id}
+		}
+		return nodes[id]
+	}
+	nodeFailed := map[string]float64{}
+	for _, e := range edges {
+		g.Edges = append(g.Edges, *e)
+		node(e.Source)
+		n := node(e.Target)
+		n.Rate += e.Rate
+		nodeFailed[n.ID] += failed[e.ID]
+	}
+	for _, n := range nodes {
+		if n.Rate > 0 {
+			n.ErrorRate = min(1, nodeFailed[n.ID]/n.Rate)
+		}
+		g.Nodes = append(g.Nodes, *n)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].ID < g.Nodes[j].ID })
+	sort.Slice(g.Edges, func(i, j int) bool { return g.Edges[i].ID < g.Edges[j].ID })
+	return g, nil
+}
+
+// blastRadiusEntry is a service affected when another one degrades. Via is the service it
+// calls on its way to the degraded one, and Depth how many calls away it is.
+type blastRadiusEntry struct {
+	Service string  `json:"service"`
+	Depth   int     `json:"depth"`
+	Via     string  `json:"via"`
+	Rate    float64 `json:"rate"`
+}
+
+// blastRadius returns the services that directly or transitively call service, nearest
+// first, and the subgraph connecting them.
+func (g topology) blastRadius(service string) ([]blastRadiusEntry, topology) {
+	callers := map[string][]topologyEdge{}
+	for _, e := range g.Edges {
+		if e.Source != e.Target {
+			callers[e.Target] = append(callers[e.Target], e)
+		}
+	}
+	affected := []blastRadiusEntry{}
+	seen := map[string]bool{service: true}
+	var sub topology
+	queue := []string{service}
+	for depth := 1; len(queue) > 0; depth++ {
+		var next []string
+		for _, target := range queue {
+			for _, e := range callers[target] {
+				sub.Edges = append(sub.Edges, e)
+				if seen[e.Source] {
+					continue
+				}
+				seen[e.Source] = true
+				affected = append(affected, blastRadiusEntry{Service: e.Source, Depth: depth, Via: target, Rate: e.Rate})
+				next = append(next, e.Source)
+			}
+		}
+		queue = next
+	}
+	for _, n := range g.Nodes {
+		if seen[n.ID] {
+			sub.Nodes = append(sub.Nodes, n)
+		}
+	}
+	sort.SliceStable(affected, func(i, j int) bool {
+		if affected[i].Depth != affected[j].Depth {
+			return affected[i].Depth < affected[j].Depth
+		}
+		return affected[i].Service < affected[j].Service
+	})
+	return affected, sub
+}
+
+// frames returns the graph as the nodes and edges frames of the node graph panel. The node
+// arcs show the share of failed requests, and highlighted nodes are marked.
+func (g topology) frames(highlight string) data.Frames {
+	nodes := data.NewFrame("nodes",
+		data.NewField("id", nil, []string{}),
+		data.NewField("title", nil, []string{}),
+		data.NewField("mainstat", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Requests", Unit: "reqps"}),
+		data.NewField("secondarystat", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Errors", Unit: "percentunit"}),
+		data.NewField("arc__success", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Success", Color: map[string]any{"mode": "fixed", "fixedColor": "green"}}),
+		data.NewField("arc__errors", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Errors", Color: map[string]any{"mode": "fixed", "fixedColor": "red"}}),
+		data.NewField("highlighted", nil, []bool{}),
+	)
+	for _, n := range g.Nodes {
+		success := 1 - n.ErrorRate
+		if n.Rate == 0 {
+			// Nodes without incoming requests, such as clients, get a neutral arc.
+			success = 1
+		}
+		nodes.AppendRow(n.ID, n.ID, n.Rate, n.ErrorRate, success, 1-success, n.ID == highlight)
+	}
+	edges := data.NewFrame("edges",
+		data.NewField("id", nil, []string{}),
+		data.NewField("source", nil, []string{}),
+		data.NewField("target", nil, []string{}),
+		data.NewField("mainstat", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Requests", Unit: "reqps"}),
+		data.NewField("secondarystat", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "p95 latency", Unit: "ms"}),
+		data.NewField("detail__errorRate", nil, []float64{}).SetConfig(&data.FieldConfig{DisplayName: "Errors", Unit: "percentunit"}),
+	)
+	for _, e := range g.Edges {
+		edges.AppendRow(e.ID, e.Source, e.Target, e.Rate, e.LatencyMs, e.ErrorRate)
+	}
+	for _, f := range []*data.Frame{nodes, edges} {
+		f.SetMeta(&data.FrameMeta{PreferredVisualization: data.VisTypeNodeGraph})
+	}
+	return data.Frames{nodes, edges}
+}
+
+// topologyRequest parses the parameters shared by the topology resources: datasourceUid,
+// the preset overriding the configured mapping, the rate window and the evaluation time.
+func (a *App) topologyRequest(req *http.Request) (datasourceUID string, m topologyMapping, t time.Time, window time.Duration, err error) {
+	q := req.URL.Query()
+	datasourceUID = q.Get("datasourceUid")
+	if datasourceUID == "" {
+		return "", m, t, 0, errors.New("datasourceUid is required")
+	}
+	m = a.settings.Topology
+	if preset := q.Get("preset"); preset != "" {
+		m = topologyMapping{Preset: preset}
+	}
+	if m, err = m.resolve(); err != nil {
+		return "", m, t, 0, err
+	}
+	if t, err = parseTimeParam(q.Get("time"), time.Time{}); err != nil {
+		return "", m, t, 0, err
+	}
+	window = defaultTopologyWindow
+	if w := q.Get("window"); w != "" {
+		d, err := model.ParseDuration(w)
+		if err != nil || time.Duration(d) <= 0 || time.Duration(d) > maxTopologyWindow {
+			return "", m, t, 0, fmt.Errorf("window must be a duration up to %s", formatDuration(maxTopologyWindow))
+		}
+		window = time.Duration(d)
+	}
+	return datasourceUID, m, t, window, nil
+}
+
+// handleTopology returns the service graph.
+func (a *App) handleTopology(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	datasourceUID, m, t, window, err := a.topologyRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g, err := a.buildTopology(req.Context(), datasourceUID, m, t, window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"nodes":  g.Nodes,
+		"edges":  g.Edges,
+		"frames": g.frames(""),
+	})
+}
+
+// handleBlastRadius returns the upstream services affected when the service given by the
+// service query parameter degrades.
+func (a *App) handleBlastRadius(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	service := req.URL.Query().Get("service")
+	if service == "" {
+		http.Error(w, "service is required", http.StatusBadRequest)
+		return
+	}
+	datasourceUID, m, t, window, err := a.topologyRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g, err := a.buildTopology(req.Context(), datasourceUID, m, t, window)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if !slices.ContainsFunc(g.Nodes, func(n topologyNode) bool { return n.ID == service }) {
+		http.Error(w, fmt.Sprintf("service %q is not in the topology", service), http.StatusNotFound)
+		return
+	}
+	affected, sub := g.blastRadius(service)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"service":  service,
+		"affected": affected,
+		"frames":   sub.frames(service),
+	})
+}
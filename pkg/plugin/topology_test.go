@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// istioMCP serves Istio request metrics for a small service graph.
+func istioMCP(queries *[]string) *fakeMCP {
+	sample := func(src, dst, value string) map[string]any {
+		return map[string]any{"metric": map[string]string{"source_workload": src, "destination_workload": dst}, "value": []any{0, value}}
+	}
+	return &fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"query_prometheus": func(args map[string]any) (any, error) {
+			expr := args["expr"].(string)
+			*queries = append(*queries, expr)
+			switch {
+			case strings.HasPrefix(expr, "histogram_quantile"):
+				return []map[string]any{sample("checkout", "payments", "250"), sample("admin", "payments", "NaN")}, nil
+			case strings.Contains(expr, "response_code"):
+				return []map[string]any{sample("checkout", "payments", "0.4"), sample("admin", "payments", "0.1")}, nil
+			default:
+				return []map[string]any{
+					sample("gateway", "frontend", "10"), sample("frontend", "checkout", "10"), sample("checkout", "payments", "4"),
+					sample("checkout", "cart", "6"), sample("payments", "db", "4"), sample("cart", "db", "6"),
+					sample("admin", "payments", "1"), {"metric": map[string]string{"source_workload": "unknown"}, "value": []any{0, "3"}},
+				}, nil
+			}
+		},
+	}}
+}
+
+func TestTopology(t *testing.T) {
+	app := newTestApp(t, "", map[string]any{"topology": map[string]any{"preset": "istio"}})
+	var queries []string
+	app.mcp = istioMCP(&queries)
+
+	resp := callResource(t, app, http.MethodGet, "topology?datasourceUid=prom&window=10m", nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("topology: %d %s", resp.Status, resp.Body)
+	}
+	var body struct {
+		Nodes  []topologyNode `json:"nodes"`
+		Edges  []topologyEdge `json:"edges"`
+		Frames data.Frames    `json:"frames"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if exp := `sum by (source_workload, destination_workload) (rate(istio_requests_total{reporter="destination"}[10m]))`; queries[0] != exp {
+		t.Errorf("unexpected requests query %s", queries[0])
+	}
+	if exp := `sum by (source_workload, destination_workload) (rate(istio_requests_total{reporter="destination",response_code=~"5.."}[10m]))`; queries[1] != exp {
+		t.Errorf("unexpected errors query %s", queries[1])
+	}
+	if len(body.Nodes) != 7 || len(body.Edges) != 7 {
+		t.Fatalf("unexpected graph: %d nodes, %d edges", len(body.Nodes), len(body.Edges))
+	}
+	for _, e := range body.Edges {
+		if e.ID == "checkout->payments" && (e.Rate != 4 || e.ErrorRate != 0.1 || e.LatencyMs != 250) {
+			t.Errorf("unexpected edge %+v", e)
+		}
+		if e.ID == "admin->payments" && e.LatencyMs != 0 {
+			t.Errorf("NaN latency should be reported as 0: %+v", e)
+		}
+	}
+	for _, n := range body.Nodes {
+		if n.ID == "payments" && (n.Rate != 5 || n.ErrorRate != 0.1) {
+			t.Errorf("unexpected node %+v", n)
+		}
+	}
+	if len(body.Frames) != 2 || body.Frames[0].Name != "nodes" || body.Frames[1].Name != "edges" ||
+		body.Frames[0].Meta.PreferredVisualization != data.VisTypeNodeGraph || body.Frames[1].Rows() != 7 {
+		t.Errorf("unexpected frames %v", body.Frames)
+	}
+
+	// The preset parameter overrides the configured mapping.
+	queries = nil
+	callResource(t, app, http.MethodGet, "topology?datasourceUid=prom&preset=tempo", nil)
+	if !strings.Contains(queries[0], "traces_service_graph_request_total{}[5m]") || !strings.Contains(queries[1], "traces_service_graph_request_failed_total") {
+		t.Errorf("unexpected tempo queries %v", queries)
+	}
+}
+
+func TestTopologyValidation(t *testing.T) {
+	app := newTestApp(t, "", nil)
+	for _, path := range []string{
+		"topology",
+		"topology?datasourceUid=prom&preset=linkerd",
+		"topology?datasourceUid=prom&window=2d",
+		"topology/blast-radius?datasourceUid=prom",
+	} {
+		if resp := callResource(t, app, http.MethodGet, path, nil); resp.Status != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", path, resp.Status)
+		}
+	}
+	for _, m := range []topologyMapping{
+		{RequestsMetric: "requests-total", SourceLabel: "a", TargetLabel: "b"},
+		{RequestsMetric: "requests", SourceLabel: "", TargetLabel: "b"},
+		{Preset: "istio", Selector: `reporter=`},
+		{Preset: "tempo", LatencyUnit: "us"},
+	} {
+		if _, err := m.resolve(); err == nil {
+			t.Errorf("%+v: expected an error", m)
+		}
+	}
+}
+
+func TestBlastRadius(t *testing.T) {
+	app := newTestApp(t, "", map[string]any{"topology": map[string]any{"preset": "istio"}})
+	var queries []string
+	app.mcp = istioMCP(&queries)
+
+	resp := callResource(t, app, http.MethodGet, "topology/blast-radius?datasourceUid=prom&service=payments", nil)
+	if resp.Status != http.StatusOK {
+		t.Fatalf("blast radius: %d %s", resp.Status, resp.Body)
+	}
+	var body struct {
+		Affected []blastRadiusEntry `json:"affected"`
+		Frames   data.Frames        `json:"frames"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range body.Affected {
+		got = append(got, e.Service+"@"+e.Via)
+	}
+	// db is downstream of payments and cart is a sibling, so neither is affected.
+	if strings.Join(got, " ") != "admin@payments checkout@payments frontend@checkout gateway@frontend" {
+		t.Errorf("unexpected blast radius %v", got)
+	}
+	if body.Affected[3].Depth != 3 || body.Frames[0].Rows() != 5 || body.Frames[1].Rows() != 4 {
+		t.Errorf("unexpected depth or subgraph: %+v", body)
+	}
+
+	if resp := callResource(t, app, http.MethodGet, "topology/blast-radius?datasourceUid=prom&service=search", nil); resp.Status != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown service, got %d", resp.Status)
+	}
+}
@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span attribute keys. The LLM ones follow the OpenTelemetry GenAI conventions.
+const (
+	attrHTTPMethod       = attribute.Key("http.request.method")
+	attrHTTPRoute        = attribute.Key("http.route")
+	attrHTTPStatusCode   = attribute.Key("http.response.status_code")
+	attrLLMModel         = attribute.Key("gen_ai.request.model")
+	attrLLMResponseModel = attribute.Key("gen_ai.response.model")
+	attrLLMInputTokens   = attribute.Key("gen_ai.usage.input_tokens")
+	attrLLMOutputTokens  = attribute.Key("gen_ai.usage.output_tokens")
+	attrLLMTools         = attribute.Key("gen_ai.request.tools")
+	attrMCPTool          = attribute.Key("mcp.tool.name")
+	attrDatasourceUID    = attribute.Key("datasource.uid")
+	attrQueryType        = attribute.Key("datasource.query.type")
+	attrQuery            = attribute.Key("db.query.text")
+)
+
+// tracer returns the tracer set up by the SDK, which exports to the collector configured
+// in Grafana. It is looked up on every use because the SDK replaces it on startup.
+func tracer() trace.Tracer {
+	return tracing.DefaultTracer()
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		tracing.Error(span, err)
+	}
+	span.End()
+}
+
+// traceRoute starts the span of a resource request. The span is named after the route
+// once the mux has matched it, see instrumentRoutes.
+func traceRoute(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracer().Start(req.Context(), "resource "+req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrHTTPMethod.String(req.Method)))
+	return req.WithContext(ctx), span
+}
+
+// endRouteSpan names the span of a resource request after its route and records its status.
+func endRouteSpan(span trace.Span, method, route string, status int) {
+	span.SetName(method + " " + route)
+	span.SetAttributes(attrHTTPRoute.String(route), attrHTTPStatusCode.Int(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// datasourceQueryTools are the MCP tools that query a datasource, with the argument
+// holding the query.
+var datasourceQueryTools = map[string]string{
+	"query_prometheus": "expr",
+	"query_loki_logs":  "logql",
+	"query_loki_stats": "logql",
+}
+
+// startToolSpans starts the span of an MCP tool call and, for tools querying a
+// datasource, a child span for the query.
+func startToolSpans(ctx context.Context, name string, args map[string]any) (context.Context, []trace.Span) {
+	ctx, span := tracer().Start(ctx, "mcp "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrMCPTool.String(name)))
+	spans := []trace.Span{span}
+	if arg, ok := datasourceQueryTools[name]; ok {
+		attrs := []attribute.KeyValue{attrQueryType.String(strings.TrimPrefix(name, "query_"))}
+		if uid, ok := args["datasourceUid"].(string); ok {
+			attrs = append(attrs, attrDatasourceUID.String(uid))
+		}
+		if q, ok := args[arg].(string); ok {
+			attrs = append(attrs, attrQuery.String(q))
+		}
+		var query trace.Span
+		ctx, query = tracer().Start(ctx, "datasource query", trace.WithAttributes(attrs...))
+		spans = append(spans, query)
+	}
+	return ctx, spans
+}
@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanExporter receives the spans of all tests. Tests start a root span and only look at
+// the spans of its trace.
+var spanExporter = tracetest.NewInMemoryExporter()
+
+func init() {
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter))
+	tracing.InitDefaultTracer(tp.Tracer("test"))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// traceSpans returns the ended spans of the trace of root.
+func traceSpans(root trace.Span) tracetest.SpanStubs {
+	var spans tracetest.SpanStubs
+	for _, s := range spanExporter.GetSpans() {
+		if s.SpanContext.TraceID() == root.SpanContext().TraceID() {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// childSpan returns the child of parent whose name starts with prefix.
+func childSpan(t *testing.T, spans tracetest.SpanStubs, parent trace.SpanContext, prefix string) tracetest.SpanStub {
+	t.Helper()
+	for _, s := range spans {
+		if s.Parent.SpanID() == parent.SpanID() && strings.HasPrefix(s.Name, prefix) {
+			return s
+		}
+	}
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+	}
+	t.Fatalf("no span %q under %s in %v", prefix, parent.SpanID(), names)
+	return tracetest.SpanStub{}
+}
+
+// spanAttr returns the value of a span attribute.
+func spanAttr(s tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingResourceAndLLM(t *testing.T) {
+	var mu sync.Mutex
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != llmAppChatCompletionsPath {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		traceparent = r.Header.Get("traceparent")
+		mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"model":   "gpt-4o",
+			"choices": []map[string]any{{"message": map[string]any{"role": "assistant", "content": "All good."}}},
+			"usage":   map[string]any{"prompt_tokens": 12, "completion_tokens": 3, "total_tokens": 15},
+		})
+	}))
+	defer srv.Close()
+	app := newTestApp(t, srv.URL, nil)
+
+	// The root span stands in for the span the SDK starts for the request from Grafana.
+	ctx, root := tracer().Start(context.Background(), "sdk.callResource")
+	var r mockCallResourceResponseSender
+	err := app.CallResource(ctx, &backend.CallResourceRequest{
+		Method: http.MethodPost, Path: "agent", Body: []byte(`{"question": "Is checkout healthy?"}`),
+	}, &r)
+	root.End()
+	if err != nil || r.response.Status != http.StatusOK {
+		t.Fatalf("agent: %v %+v", err, r.response)
+	}
+
+	spans := traceSpans(root)
+	route := childSpan(t, spans, root.SpanContext(), "POST /agent")
+	if spanAttr(route, attrHTTPStatusCode).AsInt64() != http.StatusOK || spanAttr(route, attrHTTPRoute).AsString() != "/agent" {
+		t.Errorf("unexpected route span attributes %v", route.Attributes)
+	}
+	llm := childSpan(t, spans, route.SpanContext, "llm chat")
+	if spanAttr(llm, attrLLMModel).AsString() != llmModelLarge || spanAttr(llm, attrLLMResponseModel).AsString() != "gpt-4o" ||
+		spanAttr(llm, attrLLMInputTokens).AsInt64() != 12 || spanAttr(llm, attrLLMOutputTokens).AsInt64() != 3 {
+		t.Errorf("unexpected llm span attributes %v", llm.Attributes)
+	}
+	outgoing := childSpan(t, spans, llm.SpanContext, "HTTP Outgoing Request")
+
+	// The trace context is propagated to Grafana.
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(traceparent, root.SpanContext().TraceID().String()+"-"+outgoing.SpanContext.SpanID().String()) {
+		t.Errorf("unexpected traceparent %q", traceparent)
+	}
+}
+
+func TestTracingToolCalls(t *testing.T) {
+	mcp := instrumentedMCP{&fakeMCP{tools: map[string]func(map[string]any) (any, error){
+		"query_prometheus":        func(map[string]any) (any, error) { return []any{}, nil },
+		"list_prometheus_metrics": func(map[string]any) (any, error) { return nil, errors.New("unavailable") },
+	}}}
+	ctx, root := tracer().Start(context.Background(), "test")
+	mcp.CallTool(ctx, "query_prometheus", map[string]any{"datasourceUid": "prom", "expr": "up"})
+	mcp.CallTool(ctx, "list_prometheus_metrics", nil)
+	root.End()
+
+	spans := traceSpans(root)
+	call := childSpan(t, spans, root.SpanContext(), "mcp query_prometheus")
+	query := childSpan(t, spans, call.SpanContext, "datasource query")
+	if spanAttr(query, attrDatasourceUID).AsString() != "prom" || spanAttr(query, attrQuery).AsString() != "up" ||
+		spanAttr(query, attrQueryType).AsString() != "prometheus" {
+		t.Errorf("unexpected query span attributes %v", query.Attributes)
+	}
+	failed := childSpan(t, spans, root.SpanContext(), "mcp list_prometheus_metrics")
+	if failed.Status.Code != codes.Error || failed.ChildSpanCount != 0 {
+		t.Errorf("unexpected failed span %+v", failed.Status)
+	}
+}
@@ -0,0 +1,509 @@
+package plugin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/sre/assistant/pkg/plugin/store"
+)
+
+const (
+	usageCollection = "usage"
+	// usageDayLayout formats the UTC day usage is aggregated by.
+	usageDayLayout = "2006-01-02"
+	// defaultUsageDays is the range /usage reports when no from date is given.
+	defaultUsageDays = 30
+	// budgetWarningHeader names the soft budgets the caller reached, on the responses of
+	// the routes using the LLM.
+	budgetWarningHeader = "X-Token-Budget-Warning"
+	// bytesPerToken and reservedCompletionTokens estimate the tokens of an LLM call, which
+	// are reserved against the hard budgets while the call is in flight.
+	bytesPerToken            = 4
+	reservedCompletionTokens = 1024
+)
+
+// Features LLM calls are metered by.
+const (
+	featureAgent         = "agent"
+	featureInvestigation = "investigation"
+	featureReport        = "report"
+	featureQuery         = "query"
+	featureOther         = "other"
+)
+
+// Budget periods.
+const (
+	budgetDay   = "day"
+	budgetMonth = "month"
+)
+
+// Budget statuses reported by /usage.
+const (
+	budgetOK       = "ok"
+	budgetWarning  = "warning"
+	budgetExceeded = "exceeded"
+)
+
+// errBudgetExceeded is returned for LLM calls rejected by a hard budget.
+var errBudgetExceeded = errors.New("token budget exceeded")
+
+// tokenBudget limits the tokens used in a budget period. Zero disables a limit.
+type tokenBudget struct {
+	// Soft logs a warning and reports the budget as "warning" once reached.
+	Soft int64 `json:"soft"`
+	// Hard rejects LLM calls once reached.
+	Hard int64 `json:"hard"`
+}
+
+// budgetSettings configures the token budgets of the org and its users.
+type budgetSettings struct {
+	// Period is "day" or "month" (the default). Periods start at midnight UTC.
+	Period string `json:"period"`
+	// Org limits the tokens used by everyone in the org.
+	Org tokenBudget `json:"org"`
+	// User limits the tokens used by each user, unless Users has an entry for the login.
+	User  tokenBudget            `json:"user"`
+	Users map[string]tokenBudget `json:"users"`
+}
+
+// userBudget returns the budget of a user.
+func (s budgetSettings) userBudget(user string) tokenBudget {
+	if b, ok := s.Users[user]; ok {
+		return b
+	}
+	return s.User
+}
+
+// periodStart returns the first day of the budget period containing now.
+func (s budgetSettings) periodStart(now time.Time) string {
+	now = now.UTC()
+	if s.Period == budgetDay {
+		return now.Format(usageDayLayout)
+	}
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Format(usageDayLayout)
+}
+
+// llmCaller is who an LLM call is metered to.
+type llmCaller struct {
+	feature string
+	user    string
+}
+
+type llmCallerKey struct{}
+
+// withLLMFeature returns a context whose LLM calls are metered to feature. An empty user
+// means the user of the request in ctx.
+func withLLMFeature(ctx context.Context, feature, user string) context.Context {
+	if user == "" {
+		user = userLogin(ctx)
+	}
+	return context.WithValue(ctx, llmCallerKey{}, llmCaller{feature: feature, user: user})
+}
+
+func llmCallerFromContext(ctx context.Context) llmCaller {
+	if c, ok := ctx.Value(llmCallerKey{}).(llmCaller); ok {
+		return c
+	}
+	return llmCaller{feature: featureOther, user: userLogin(ctx)}
+}
+
+// usageRecord aggregates the LLM calls of a user, feature and model on one day.
+type usageRecord struct {
+	Day              string `json:"day"`
+	User             string `json:"user"`
+	Feature          string `json:"feature"`
+	Model            string `json:"model"`
+	Requests         int64  `json:"requests"`
+	PromptTokens     int64  `json:"promptTokens"`
+	CompletionTokens int64  `json:"completionTokens"`
+	TotalTokens      int64  `json:"totalTokens"`
+}
+
+// key sorts records by day first, so that periods are contiguous ranges of the collection.
+func (r usageRecord) key() string {
+	return r.Day + "/" + r.Feature + "/" + r.Model + "/" + r.User
+}
+
+// periodUsage is the token usage of the current budget period, kept in memory so that
+// budget checks do not read the usage records. The reserved totals are the estimated
+// tokens of the calls in flight.
+type periodUsage struct {
+	since          string
+	org            int64
+	byUser         map[string]int64
+	reservedOrg    int64
+	reservedByUser map[string]int64
+}
+
+// budgetReservation is the estimated tokens of an LLM call, reserved in the budget period
+// starting on since until the call's usage is recorded or the call fails.
+type budgetReservation struct {
+	since  string
+	user   string
+	tokens int64
+}
+
+// estimateTokens estimates the tokens an LLM call uses from the size of its request.
+func estimateTokens(req chatCompletionRequest) int64 {
+	var size int
+	for _, m := range req.Messages {
+		size += len(m.Content)
+		for _, c := range m.ToolCalls {
+			size += len(c.Function.Name) + len(c.Function.Arguments)
+		}
+	}
+	for _, t := range req.Tools {
+		b, _ := json.Marshal(t)
+		size += len(b)
+	}
+	return int64(size/bytesPerToken) + reservedCompletionTokens
+}
+
+// periodTotals returns the usage of the budget period starting on since, loading it from
+// the usage records when the period changed. usageMu must be held.
+func (a *App) periodTotals(ctx context.Context, since string) (*periodUsage, error) {
+	if a.usagePeriod != nil && a.usagePeriod.since == since {
+		return a.usagePeriod, nil
+	}
+	records, err := a.listUsage(ctx, since, "9999-12-31")
+	if err != nil {
+		return nil, err
+	}
+	p := &periodUsage{since: since, byUser: map[string]int64{}, reservedByUser: map[string]int64{}}
+	for _, r := range records {
+		p.org += r.TotalTokens
+		p.byUser[r.User] += r.TotalTokens
+	}
+	a.usagePeriod = p
+	return p, nil
+}
+
+// recordUsage adds the tokens of an LLM call to the day's usage, replacing the tokens
+// reserved for the call, if any.
+func (a *App) recordUsage(ctx context.Context, caller llmCaller, model string, usage llmUsage, res *budgetReservation, now time.Time) error {
+	a.usageMu.Lock()
+	defer a.usageMu.Unlock()
+	a.releaseLocked(res)
+	r := usageRecord{Day: now.UTC().Format(usageDayLayout), User: caller.user, Feature: caller.feature, Model: model}
+	existing, err := loadJSON[usageRecord](ctx, a.store, usageCollection, r.key())
+	if err == nil {
+		r = existing
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	total := int64(usage.TotalTokens)
+	if total == 0 {
+		total = int64(usage.PromptTokens + usage.CompletionTokens)
+	}
+	r.Requests++
+	r.PromptTokens += int64(usage.PromptTokens)
+	r.CompletionTokens += int64(usage.CompletionTokens)
+	r.TotalTokens += total
+	if err := saveJSON(ctx, a.store, usageCollection, r.key(), r); err != nil {
+		return err
+	}
+	if p := a.usagePeriod; p != nil && r.Day >= p.since {
+		p.org += total
+		p.byUser[r.User] += total
+	}
+	return nil
+}
+
+// releaseBudget releases the tokens reserved for an LLM call that failed.
+func (a *App) releaseBudget(res *budgetReservation) {
+	a.usageMu.Lock()
+	defer a.usageMu.Unlock()
+	a.releaseLocked(res)
+}
+
+// releaseLocked releases the tokens of res unless its period is over. usageMu must be held.
+func (a *App) releaseLocked(res *budgetReservation) {
+	p := a.usagePeriod
+	if res == nil || p == nil || p.since != res.since {
+		return
+	}
+	p.reservedOrg -= res.tokens
+	p.reservedByUser[res.user] -= res.tokens
+	if p.reservedByUser[res.user] <= 0 {
+		delete(p.reservedByUser, res.user)
+	}
+}
+
+// listUsage returns the usage records of the days from from to to, inclusive. Keys start
+// with the day, so only the records in range are decoded.
+func (a *App) listUsage(ctx context.Context, from, to string) ([]usageRecord, error) {
+	items, err := a.store.List(ctx, usageCollection)
+	if err != nil {
+		return nil, err
+	}
+	var out []usageRecord
+	for _, it := range items {
+		day, _, _ := strings.Cut(it.Key, "/")
+		if day < from {
+			continue
+		}
+		if day > to {
+			break
+		}
+		var r usageRecord
+		if err := json.Unmarshal(it.Value, &r); err != nil {
+			return nil, fmt.Errorf("decode %s/%s: %w", usageCollection, it.Key, err)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// budgetStatus is the state of a budget in the current period.
+type budgetStatus struct {
+	// Scope is "org" or "user:<login>".
+	Scope  string `json:"scope"`
+	Period string `json:"period"`
+	Since  string `json:"since"`
+	Used   int64  `json:"used"`
+	Soft   int64  `json:"soft,omitempty"`
+	Hard   int64  `json:"hard,omitempty"`
+	Status string `json:"status"`
+}
+
+func newBudgetStatus(scope string, b tokenBudget, used int64) budgetStatus {
+	s := budgetStatus{Scope: scope, Used: used, Soft: b.Soft, Hard: b.Hard, Status: budgetOK}
+	switch {
+	case b.Hard > 0 && used >= b.Hard:
+		s.Status = budgetExceeded
+	case b.Soft > 0 && used >= b.Soft:
+		s.Status = budgetWarning
+	}
+	return s
+}
+
+// budgetStatuses returns the status of the org budget and of the budgets of users, for
+// the given users or, if users is nil, every user with usage in the period.
+func (a *App) budgetStatuses(ctx context.Context, now time.Time, users []string) ([]budgetStatus, error) {
+	budgets := a.settings.Budgets
+	since := budgets.periodStart(now)
+	a.usageMu.Lock()
+	defer a.usageMu.Unlock()
+	p, err := a.periodTotals(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	return budgets.statuses(p, users), nil
+}
+
+// statuses returns the status of the org budget and of the budgets of users in the period
+// of p, as budgetStatuses does.
+func (s budgetSettings) statuses(p *periodUsage, users []string) []budgetStatus {
+	if users == nil {
+		for u := range p.byUser {
+			users = append(users, u)
+		}
+		sort.Strings(users)
+	}
+	statuses := []budgetStatus{newBudgetStatus("org", s.Org, p.org)}
+	for _, u := range users {
+		statuses = append(statuses, newBudgetStatus("user:"+u, s.userBudget(u), p.byUser[u]))
+	}
+	for i := range statuses {
+		statuses[i].Period, statuses[i].Since = s.Period, p.since
+	}
+	return statuses
+}
+
+// checkBudget rejects LLM calls of caller once the org or the user reached a hard budget,
+// counting the tokens reserved for the calls in flight, and logs a warning the first time
+// a soft budget is reached in a period. Otherwise it reserves the estimated tokens of req,
+// which recordUsage or releaseBudget give back; the reservation is nil without budgets.
+func (a *App) checkBudget(ctx context.Context, caller llmCaller, req chatCompletionRequest, now time.Time) (*budgetReservation, error) {
+	b := a.settings.Budgets
+	if b.Org == (tokenBudget{}) && b.userBudget(caller.user) == (tokenBudget{}) {
+		return nil, nil
+	}
+	a.usageMu.Lock()
+	p, err := a.periodTotals(ctx, b.periodStart(now))
+	if err != nil {
+		a.usageMu.Unlock()
+		return nil, err
+	}
+	var warnings []budgetStatus
+	for _, s := range b.statuses(p, []string{caller.user}) {
+		reserved := p.reservedOrg
+		if s.Scope != "org" {
+			reserved = p.reservedByUser[caller.user]
+		}
+		if s.Hard > 0 && s.Used+reserved >= s.Hard {
+			a.usageMu.Unlock()
+			err := fmt.Errorf("%w: %s used %d of %d tokens since %s", errBudgetExceeded, s.Scope, s.Used, s.Hard, s.Since)
+			if reserved > 0 {
+				err = fmt.Errorf("%w, %d reserved by calls in flight", err, reserved)
+			}
+			return nil, err
+		}
+		key := s.Scope + "/" + s.Since
+		if s.Status == budgetWarning && !a.budgetWarnings[key] {
+			a.budgetWarnings[key] = true
+			warnings = append(warnings, s)
+		}
+	}
+	res := &budgetReservation{since: p.since, user: caller.user, tokens: estimateTokens(req)}
+	p.reservedOrg += res.tokens
+	p.reservedByUser[res.user] += res.tokens
+	a.usageMu.Unlock()
+	for _, s := range warnings {
+		a.logger(ctx).Warn("Soft token budget reached", "scope", s.Scope, "used", s.Used, "soft", s.Soft, "since", s.Since)
+	}
+	return res, nil
+}
+
+// softBudgetWarning describes the soft budgets the user in ctx or the org reached, or is
+// empty if there are none.
+func (a *App) softBudgetWarning(ctx context.Context, now time.Time) (string, error) {
+	user := userLogin(ctx)
+	b := a.settings.Budgets
+	if b.Org.Soft == 0 && b.userBudget(user).Soft == 0 {
+		return "", nil
+	}
+	statuses, err := a.budgetStatuses(ctx, now, []string{user})
+	if err != nil {
+		return "", err
+	}
+	var warnings []string
+	for _, s := range statuses {
+		if s.Soft > 0 && s.Used >= s.Soft {
+			warnings = append(warnings, fmt.Sprintf("%s used %d of %d tokens since %s", s.Scope, s.Used, s.Soft, s.Since))
+		}
+	}
+	return strings.Join(warnings, "; "), nil
+}
+
+// usageDay is the usage of one day, broken down by user, feature and model.
+type usageDay struct {
+	Day              string           `json:"day"`
+	Requests         int64            `json:"requests"`
+	PromptTokens     int64            `json:"promptTokens"`
+	CompletionTokens int64            `json:"completionTokens"`
+	TotalTokens      int64            `json:"totalTokens"`
+	ByUser           map[string]int64 `json:"byUser"`
+	ByFeature        map[string]int64 `json:"byFeature"`
+	ByModel          map[string]int64 `json:"byModel"`
+}
+
+// usageReport is the response of GET /usage.
+type usageReport struct {
+	OrgID   int64          `json:"orgId"`
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Days    []usageDay     `json:"days"`
+	Total   int64          `json:"totalTokens"`
+	Budgets []budgetStatus `json:"budgets"`
+}
+
+// parseUsageRange reads the from and to days of a usage request, defaulting to the last
+// defaultUsageDays days.
+func parseUsageRange(q map[string][]string, now time.Time) (string, string, error) {
+	now = now.UTC()
+	from, to := now.AddDate(0, 0, 1-defaultUsageDays).Format(usageDayLayout), now.Format(usageDayLayout)
+	for name, v := range map[string]*string{"from": &from, "to": &to} {
+		if s := firstValue(q[name]); s != "" {
+			if _, err := time.Parse(usageDayLayout, s); err != nil {
+				return "", "", fmt.Errorf("invalid %s: expected YYYY-MM-DD", name)
+			}
+			*v = s
+		}
+	}
+	if from > to {
+		return "", "", errors.New("from must not be after to")
+	}
+	return from, to, nil
+}
+
+func firstValue(v []string) string {
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+// handleUsage reports token usage by day on GET, as JSON or, with ?format=csv, as one
+// CSV row per day, user, feature and model. ?from and ?to select days (YYYY-MM-DD), and
+// ?user, ?feature and ?model filter the records. Only admins see the usage of other users.
+func (a *App) handleUsage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := req.Context()
+	now := time.Now()
+	q := req.URL.Query()
+	from, to, err := parseUsageRange(q, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user := q.Get("user")
+	var budgetUsers []string
+	if u := backend.UserFromContext(ctx); u == nil || u.Role != "Admin" {
+		if user != "" && user != userLogin(ctx) {
+			http.Error(w, "viewing the usage of other users requires the Admin role", http.StatusForbidden)
+			return
+		}
+		user = userLogin(ctx)
+		budgetUsers = []string{user}
+	}
+	records, err := a.listUsage(ctx, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filtered := records[:0]
+	for _, r := range records {
+		if (user == "" || r.User == user) && (q.Get("feature") == "" || r.Feature == q.Get("feature")) && (q.Get("model") == "" || r.Model == q.Get("model")) {
+			filtered = append(filtered, r)
+		}
+	}
+
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "usage-"+from+"-"+to+".csv"))
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"day", "org_id", "user", "feature", "model", "requests", "prompt_tokens", "completion_tokens", "total_tokens"})
+		org := strconv.FormatInt(a.orgID, 10)
+		for _, r := range filtered {
+			_ = cw.Write([]string{r.Day, org, r.User, r.Feature, r.Model, strconv.FormatInt(r.Requests, 10),
+				strconv.FormatInt(r.PromptTokens, 10), strconv.FormatInt(r.CompletionTokens, 10), strconv.FormatInt(r.TotalTokens, 10)})
+		}
+		cw.Flush()
+		return
+	}
+
+	report := usageReport{OrgID: a.orgID, From: from, To: to, Days: []usageDay{}}
+	for _, r := range filtered {
+		if n := len(report.Days); n == 0 || report.Days[n-1].Day != r.Day {
+			report.Days = append(report.Days, usageDay{Day: r.Day, ByUser: map[string]int64{}, ByFeature: map[string]int64{}, ByModel: map[string]int64{}})
+		}
+		d := &report.Days[len(report.Days)-1]
+		d.Requests += r.Requests
+		d.PromptTokens += r.PromptTokens
+		d.CompletionTokens += r.CompletionTokens
+		d.TotalTokens += r.TotalTokens
+		d.ByUser[r.User] += r.TotalTokens
+		d.ByFeature[r.Feature] += r.TotalTokens
+		d.ByModel[r.Model] += r.TotalTokens
+		report.Total += r.TotalTokens
+	}
+	if report.Budgets, err = a.budgetStatuses(ctx, now, budgetUsers); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
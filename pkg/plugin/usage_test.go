@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestUsageBudgets(t *testing.T) {
+	app := newTestApp(t, "", map[string]any{"budgets": map[string]any{
+		"org":   map[string]any{"soft": 40},
+		"user":  map[string]any{"hard": 30},
+		"users": map[string]any{"carol": map[string]any{"hard": 100}},
+	}})
+	rec := newRecordingLogger()
+	app.baseLogger = rec
+	app.llm = &fakeLLM{replies: []string{"a", "b", "c", "d", "e"}}
+	ctx := context.Background()
+	ask := func(feature, user string) error {
+		_, err := app.chat(withLLMFeature(ctx, feature, user), llmModelLarge, []chatMessage{{Role: "user", Content: "hi"}})
+		return err
+	}
+
+	// Each call of the fake uses 15 tokens: alice reaches her hard budget after two.
+	for range 2 {
+		if err := ask(featureReport, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ask(featureReport, "alice"); !errors.Is(err, errBudgetExceeded) || !strings.Contains(err.Error(), "user:alice used 30 of 30 tokens") {
+		t.Fatalf("expected the hard budget to reject the call, got %v", err)
+	}
+	// carol's own budget applies. The org's soft budget is only reported once.
+	for range 2 {
+		if err := ask(featureQuery, "carol"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var warnings int
+	for _, l := range rec.recorded() {
+		if l.level == "warn" && l.msg == "Soft token budget reached" {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("expected one soft budget warning, got %d", warnings)
+	}
+
+	// The period totals are kept in memory and start over with the next period.
+	statuses, err := app.budgetStatuses(ctx, time.Now().AddDate(0, 1, 0), nil)
+	if err != nil || len(statuses) != 1 || statuses[0].Used != 0 {
+		t.Errorf("expected an empty next period, got %+v (%v)", statuses, err)
+	}
+
+	// The agent endpoint rejects alice with 429, and reports the org's soft budget as
+	// every route using the LLM does.
+	resp := callResourceAs(t, app, &backend.User{Login: "alice"}, http.MethodPost, "agent", map[string]any{"question": "Why?"})
+	if resp.Status != http.StatusTooManyRequests {
+		t.Errorf("expected 429 over budget, got %d %s", resp.Status, resp.Body)
+	}
+	if got := resp.Headers[budgetWarningHeader]; len(got) != 1 || !strings.HasPrefix(got[0], "org used 60 of 40 tokens since ") {
+		t.Errorf("expected a soft budget warning header, got %v", resp.Headers)
+	}
+
+	admin := &backend.User{Login: "admin", Role: "Admin"}
+	resp = callResourceAs(t, app, admin, http.MethodGet, "usage", nil)
+	var report usageReport
+	if err := json.Unmarshal(resp.Body, &report); err != nil {
+		t.Fatal(err)
+	}
+	today := time.Now().UTC().Format(usageDayLayout)
+	if len(report.Days) != 1 || report.Total != 60 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	day := report.Days[0]
+	if day.Day != today || day.Requests != 4 || day.PromptTokens != 40 || day.ByUser["alice"] != 30 || day.ByFeature[featureQuery] != 30 || day.ByModel[llmModelLarge] != 60 {
+		t.Errorf("unexpected day %+v", day)
+	}
+	if len(report.Budgets) != 3 || report.Budgets[0].Status != budgetWarning || report.Budgets[1].Scope != "user:alice" || report.Budgets[1].Status != budgetExceeded ||
+		report.Budgets[2].Status != budgetOK || report.Budgets[0].Period != budgetMonth {
+		t.Errorf("unexpected budgets %+v", report.Budgets)
+	}
+
+	resp = callResourceAs(t, app, admin, http.MethodGet, "usage?format=csv&feature=report", nil)
+	rows, err := csv.NewReader(strings.NewReader(string(resp.Body))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0][0] != "day" || strings.Join(rows[1], ",") != today+",0,alice,report,large,2,20,10,30" {
+		t.Errorf("unexpected csv %q", rows)
+	}
+
+	// Other users only see their own usage.
+	resp = callResourceAs(t, app, &backend.User{Login: "carol"}, http.MethodGet, "usage", nil)
+	report = usageReport{}
+	if err := json.Unmarshal(resp.Body, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 30 || len(report.Days[0].ByUser) != 1 || len(report.Budgets) != 2 || report.Budgets[1].Scope != "user:carol" {
+		t.Errorf("unexpected report for carol %+v", report)
+	}
+	if resp := callResourceAs(t, app, &backend.User{Login: "carol"}, http.MethodGet, "usage?user=alice", nil); resp.Status != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.Status)
+	}
+	if resp := callResourceAs(t, app, admin, http.MethodGet, "usage?from=2026-13-01", nil); resp.Status != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid day, got %d", resp.Status)
+	}
+	if _, err := loadSettings(backend.AppInstanceSettings{JSONData: []byte(`{"budgets": {"period": "week"}}`)}); err == nil {
+		t.Error("expected an error for an invalid budget period")
+	}
+}
+
+func TestBudgetReservations(t *testing.T) {
+	app := newTestApp(t, "", map[string]any{"budgets": map[string]any{"user": map[string]any{"hard": 100}}})
+	llm := &blockingLLM{release: make(chan struct{})}
+	app.llm = llm
+	ctx := withLLMFeature(context.Background(), featureQuery, "alice")
+	ask := func() error {
+		_, err := app.chat(ctx, llmModelLarge, []chatMessage{{Role: "user", Content: "hi"}})
+		return err
+	}
+
+	// The call in flight reserves its estimated tokens, so a concurrent call is rejected
+	// before either recorded any usage.
+	done := make(chan error, 1)
+	go func() { done <- ask() }()
+	waitFor(t, "the first call to reach the LLM", func() bool { return llm.inFlight.Load() == 1 })
+	if err := ask(); !errors.Is(err, errBudgetExceeded) || !strings.Contains(err.Error(), "reserved by calls in flight") {
+		t.Fatalf("expected the reservation to reject the call, got %v", err)
+	}
+	close(llm.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Recording the usage gives the reservation back.
+	if err := ask(); err != nil {
+		t.Fatalf("expected the reservation to be released, got %v", err)
+	}
+	app.llm = &fakeLLM{}
+	if err := ask(); err == nil {
+		t.Fatal("expected the LLM error")
+	}
+	app.usageMu.Lock()
+	reserved := app.usagePeriod.reservedOrg
+	app.usageMu.Unlock()
+	if reserved != 0 {
+		t.Errorf("expected failed calls to release their reservation, got %d reserved", reserved)
+	}
+}
@@ -2,6 +2,9 @@ import pluginJson from './plugin.json';
 
 export const PLUGIN_BASE_URL = `/a/${pluginJson.id}`;
 
+// 後端 resource 路由的基底路徑。
+export const PLUGIN_RESOURCES_URL = `/api/plugins/${pluginJson.id}/resources`;
+
 export enum ROUTES {
   Home = 'home',
   WithTabs = 'page-with-tabs',
@@ -0,0 +1,221 @@
+import React from 'react';
+import { css } from '@emotion/css';
+import { lastValueFrom } from 'rxjs';
+import type { DataSourceRef } from '@grafana/schema';
+import { SceneObjectBase, type SceneComponentProps, type SceneObjectState } from '@grafana/scenes';
+import { getBackendSrv } from '@grafana/runtime';
+import { Alert, Button, Field, HorizontalGroup, Input, Spinner, Stack, TextArea, useStyles2 } from '@grafana/ui';
+import { PLUGIN_RESOURCES_URL } from '../../constants';
+
+/** 尚未產生查詢時使用的預設 LogQL。 */
+export const DEFAULT_LOGQL = '{job="grafana"} |= "error"';
+
+interface LogQLQueryPanelState extends SceneObjectState {
+  /** 使用者以自然語言描述的問題。 */
+  question: string;
+  /** 目前要執行的 LogQL 查詢。 */
+  expr: string;
+  /** 產生查詢時要使用的 Loki 資料來源，尚未選擇時為 null。 */
+  datasource: DataSourceRef | null;
+  /** 後端對產生查詢的說明。 */
+  explanation?: string;
+  /** LLM 無法使用時，後端改以規則產生查詢的原因。 */
+  degradedReason?: string;
+  /** 是否正在產生查詢。 */
+  loading: boolean;
+  /** 使用者可見的錯誤訊息。 */
+  error?: string;
+}
+
+/** /query/logql/generate 的回應內容。 */
+interface LogQLGenerateResponse {
+  query?: string;
+  explanation?: string;
+  error?: string;
+  degraded?: boolean;
+  degradedReason?: string;
+}
+
+/**
+ * 日誌分析的查詢面板：以自然語言問題透過後端產生並驗證 LogQL，或直接編輯查詢後執行。
+ */
+export class LogQLQueryPanel extends SceneObjectBase<LogQLQueryPanelState> {
+  static Component = LogQLQueryPanelRenderer;
+
+  private readonly onRun: (expr: string) => void;
+
+  constructor(onRun: (expr: string) => void) {
+    super({
+      question: '',
+      expr: DEFAULT_LOGQL,
+      datasource: null,
+      loading: false,
+    });
+
+    this.onRun = onRun;
+  }
+
+  /**
+   * 由資料來源選擇器呼叫，記錄產生查詢時要使用的 Loki 資料來源。
+   */
+  setDatasource(ref: DataSourceRef | null) {
+    this.setState({ datasource: ref });
+  }
+
+  hasDatasource() {
+    return this.state.datasource !== null;
+  }
+
+  updateQuestion(question: string) {
+    this.setState({ question });
+  }
+
+  updateExpr(expr: string) {
+    this.setState({ expr });
+  }
+
+  /**
+   * 執行目前的查詢。
+   */
+  run() {
+    this.onRun(this.state.expr);
+  }
+
+  /**
+   * 將問題送至後端產生 LogQL，成功後直接執行產生的查詢。
+   */
+  async generate() {
+    const question = this.state.question.trim();
+    const { datasource } = this.state;
+
+    if (!datasource?.uid) {
+      this.setState({ error: '請先選擇 Loki 資料來源。' });
+      return;
+    }
+    if (question === '') {
+      this.setState({ error: '請輸入要查詢的問題。' });
+      return;
+    }
+
+    this.setState({ loading: true, error: undefined, explanation: undefined, degradedReason: undefined });
+
+    try {
+      const response = await lastValueFrom(
+        getBackendSrv().fetch<LogQLGenerateResponse>({
+          url: `${PLUGIN_RESOURCES_URL}/query/logql/generate`,
+          method: 'POST',
+          data: { question, datasourceUid: datasource.uid },
+          showErrorAlert: false,
+        })
+      );
+      const { query, explanation, degradedReason } = response.data;
+
+      if (!query) {
+        this.setState({ loading: false, error: '後端沒有回傳查詢。' });
+        return;
+      }
+
+      this.setState({ loading: false, expr: query, explanation, degradedReason });
+      this.onRun(query);
+    } catch (err) {
+      this.setState({ loading: false, error: extractErrorMessage(err) });
+    }
+  }
+}
+
+function LogQLQueryPanelRenderer({ model }: SceneComponentProps<LogQLQueryPanel>) {
+  const state = model.useState();
+  const styles = useStyles2(getStyles);
+
+  return (
+    <div className={styles.container}>
+      <Stack gap={1} direction="column">
+        <Field
+          label="以自然語言查詢"
+          description="例如：過去一小時 checkout 的 5xx 錯誤。後端會產生 LogQL 並以 Loki 標籤驗證。"
+        >
+          <Input
+            value={state.question}
+            placeholder="想查詢哪些日誌？"
+            onChange={(event) => model.updateQuestion(event.currentTarget.value)}
+            onKeyDown={(event) => {
+              if (event.key === 'Enter') {
+                model.generate();
+              }
+            }}
+          />
+        </Field>
+
+        <HorizontalGroup spacing="sm">
+          <Button icon="bolt" onClick={() => model.generate()} disabled={state.loading || state.datasource === null}>
+            產生查詢
+          </Button>
+          {state.loading && <Spinner inline={true} size={16} />}
+        </HorizontalGroup>
+
+        {state.error && (
+          <Alert title="無法產生查詢" severity="error">
+            {state.error}
+          </Alert>
+        )}
+
+        {state.degradedReason && (
+          <Alert title="AI 服務暫時無法使用" severity="warning">
+            查詢依規則產生，請確認後再使用：{state.degradedReason}
+          </Alert>
+        )}
+
+        <Field label="LogQL 查詢" description={state.explanation ?? '可直接修改查詢後執行。'}>
+          <TextArea
+            className={styles.expr}
+            value={state.expr}
+            rows={2}
+            spellCheck={false}
+            onChange={(event) => model.updateExpr(event.currentTarget.value)}
+          />
+        </Field>
+
+        <HorizontalGroup spacing="sm">
+          <Button variant="secondary" icon="play" onClick={() => model.run()} disabled={state.datasource === null}>
+            執行查詢
+          </Button>
+        </HorizontalGroup>
+      </Stack>
+    </div>
+  );
+}
+
+function extractErrorMessage(error: unknown): string {
+  if (error && typeof error === 'object' && 'data' in error) {
+    const data = (error as { data?: unknown }).data;
+
+    if (typeof data === 'string' && data.trim() !== '') {
+      return data.trim();
+    }
+    if (data && typeof data === 'object') {
+      const { error: message, message: fallback } = data as { error?: string; message?: string };
+      if (message || fallback) {
+        return (message ?? fallback) as string;
+      }
+    }
+  }
+
+  if (error instanceof Error) {
+    return error.message;
+  }
+
+  return '產生查詢時發生錯誤，請稍後再試。';
+}
+
+function getStyles() {
+  return {
+    container: css`
+      display: flex;
+      flex-direction: column;
+      gap: 8px;
+    `,
+    expr: css`
+      font-family: var(--grafana-font-family-monospace);
+    `,
+  };
+}
@@ -12,6 +12,7 @@ import {
   SceneTimeRange,
 } from '@grafana/scenes';
 import { DataSourceSelectControl } from '../../components/DataSourceControls/DataSourceSelectControl';
+import { LogQLQueryPanel } from './LogQLQueryPanel';
 
 interface LokiRangeQuery extends DataQuery {
   expr: string;
@@ -29,26 +30,41 @@ export const logAnalysisScene = () => {
     queries: [],
   });
 
+  let datasource: DataSourceRef | null = null;
+
+  const runQuery = (expr: string) => {
+    if (!datasource) {
+      return;
+    }
+
+    const query: LokiRangeQuery = {
+      refId: 'A',
+      datasource,
+      expr,
+      queryType: 'range',
+      maxLines: 1000,
+    };
+
+    queryRunner.setState({ datasource, queries: [query] });
+    queryRunner.runQueries();
+  };
+
+  const queryPanel = new LogQLQueryPanel(runQuery);
+
   const datasourceSelector = new DataSourceSelectControl({
     pluginId: 'loki',
     label: 'Loki',
     onChange: (ref: DataSourceRef | null) => {
+      datasource = ref;
+      queryPanel.setDatasource(ref);
+
       if (!ref) {
         queryRunner.cancelQuery();
         queryRunner.setState({ datasource: undefined, queries: [] });
         return;
       }
 
-      const query: LokiRangeQuery = {
-        refId: 'A',
-        datasource: ref,
-        expr: '{job="grafana"} |= "error"',
-        queryType: 'range',
-        maxLines: 1000,
-      };
-
-      queryRunner.setState({ datasource: ref, queries: [query] });
-      queryRunner.runQueries();
+      runQuery(queryPanel.state.expr);
     },
   });
 
@@ -56,13 +72,17 @@ export const logAnalysisScene = () => {
     $timeRange: timeRange,
     $data: queryRunner,
     body: new SceneFlexLayout({
+      direction: 'column',
       children: [
+        new SceneFlexItem({
+          body: queryPanel,
+        }),
         new SceneFlexItem({
           minHeight: 420,
           body: PanelBuilders.logs()
-            .setTitle('Grafana 錯誤日誌')
+            .setTitle('日誌查詢結果')
             .setDisplayMode('transparent')
-            .setDescription('請於上方選擇 Loki 資料來源後執行 LogQL 查詢。')
+            .setDescription('請於上方選擇 Loki 資料來源，輸入問題產生 LogQL 或直接編輯查詢後執行。')
             .setOption('showLabels', true)
             .setOption('showTime', true)
             .build(),